@@ -1,7 +1,10 @@
 package senpai
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"html"
@@ -20,6 +23,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -27,6 +31,7 @@ import (
 	"git.sr.ht/~rockorager/vaxis"
 	"golang.org/x/net/context"
 	"golang.org/x/net/proxy"
+	"golang.org/x/time/rate"
 
 	"git.sr.ht/~delthas/senpai/events"
 	"git.sr.ht/~delthas/senpai/irc"
@@ -35,6 +40,35 @@ import (
 
 const eventChanSize = 1024
 
+// quitTimeout is how long to wait for servers to close the connections when
+// quitting.
+const quitTimeout = 2 * time.Second
+
+// smartJoinDelay is how long after their last message the joins, parts and
+// quits of a user are shown, with the smart joins verbosity.
+const smartJoinDelay = 5 * time.Minute
+
+// maxTalkers is how many users who spoke last are remembered per channel, for
+// the smart joins verbosity and nick completions.
+const maxTalkers = 64
+
+// compactJoinWindow is the period of time summarized by a single line, with
+// the compact joins verbosity.
+const compactJoinWindow = 10 * time.Minute
+
+// scriptTimeout is how long the on-highlight and on-event commands may run
+// before they are killed.
+const scriptTimeout = 10 * time.Second
+
+// scriptMaxRunning is how many on-highlight and on-event commands may run at
+// once. Events received while that many commands are running do not run the
+// command.
+const scriptMaxRunning = 4
+
+// maxSeenChannels is how many channel names seen in LIST replies are kept
+// per network for completions.
+const maxSeenChannels = 4096
+
 func isCommand(input []rune) bool {
 	// Command can't start with two slashes because that's an escape for
 	// a literal slash in the message
@@ -99,6 +133,22 @@ type boundKey struct {
 	target string
 }
 
+// messageBoundKey returns the key of the message bounds of the given buffer.
+// Buffer names are casemapped, since the server might refer to the same
+// buffer with a different case.
+func (app *App) messageBoundKey(netID, buffer string) boundKey {
+	return boundKey{netID, app.casemap(netID, buffer)}
+}
+
+// casemap returns the canonical form of a name on a network, with the
+// casemapping of its session if connected.
+func (app *App) casemap(netID, name string) string {
+	if s := app.sessions[netID]; s != nil {
+		return s.Casemap(name)
+	}
+	return irc.CasemapRFC1459(name)
+}
+
 type pendingCompletion struct {
 	id       int
 	f        completionAsync
@@ -108,9 +158,16 @@ type pendingCompletion struct {
 type App struct {
 	win              *ui.UI
 	sessions         map[string]*irc.Session // map of network IDs to their current session
+	conns            sync.WaitGroup          // open connections, waited for when quitting
+	connsLock        sync.Mutex              // held while adding to conns, and when starting to wait for it
+	connsClosed      bool                    // whether no connection may be added to conns anymore
 	pasting          bool
-	pastingInputOnly bool // true is pasting started when the editor input was empty
+	pastingInputOnly bool   // true is pasting started when the editor input was empty
+	rawPaste         bool   // true if the next paste should keep its formatting codes
+	pasteBefore      string // content of the editor input before the current paste
+	pasteConfirm     bool   // true while asking whether to send a large paste
 	events           chan event
+	netEvents        *netEvents // events of the networks, taken in turn
 
 	cfg        Config
 	highlights []string
@@ -118,6 +175,7 @@ type App struct {
 	lastQuery     string
 	lastQueryNet  string
 	messageBounds map[boundKey]bound
+	talkers       map[boundKey]map[string]time.Time // last message time of users per channel, for smart joins and completions
 	lastNetID     string
 	lastBuffer    string
 
@@ -125,8 +183,14 @@ type App struct {
 
 	monitor map[string]map[string]struct{} // set of targets we want to monitor per netID, best-effort. netID->target->{}
 
-	networkLock sync.RWMutex        // locks networks
-	networks    map[string]struct{} // set of network IDs we want to connect to; to be locked with networkLock
+	seenChannels map[string]map[string]string // names of channels seen in LIST and NAMES replies per netID, for completions. netID->lowercased->name
+
+	overlayLines []ui.Line // lines of the overlay, shown one page at a time
+	overlayPage  int
+
+	networkLock sync.RWMutex             // locks networks and reconnects
+	networks    map[string]struct{}      // set of network IDs we want to connect to; to be locked with networkLock
+	reconnects  map[string]chan struct{} // per network ID, signals ircLoop to reconnect now; to be locked with networkLock
 
 	pendingCompletions    map[string][]pendingCompletion
 	pendingCompletionsOff int
@@ -140,6 +204,14 @@ type App struct {
 	imageOverlay bool
 
 	uploadingProgress *float64
+
+	lastActivity time.Time           // time of the last key press, for auto-away
+	autoAway     bool                // true if we are away because of auto-away
+	autoAways    map[string]struct{} // set of network IDs we marked away because of auto-away
+
+	scriptsRunning    chan struct{} // semaphore of running on-highlight and on-event commands
+	eventsLimiter     *rate.Limiter // rate limit of on-event commands
+	highlightsPending highlightCoalescer
 }
 
 func NewApp(cfg Config) (app *App, err error) {
@@ -149,6 +221,9 @@ func NewApp(cfg Config) (app *App, err error) {
 	if cfg.Nick == "" {
 		return nil, errors.New("nick is required")
 	}
+	if cfg.Password != nil && !cfg.TLS && !cfg.AllowPlaintextPassword && !isLoopback(cfg.Addr) {
+		return nil, errors.New("refusing to send the password in cleartext without TLS: enable TLS, or set allow-plaintext-password")
+	}
 	if cfg.User == "" {
 		cfg.User = cfg.Nick
 	}
@@ -160,12 +235,20 @@ func NewApp(cfg Config) (app *App, err error) {
 		networks: map[string]struct{}{
 			"": {}, // add the master network by default
 		},
+		reconnects:         make(map[string]chan struct{}),
 		pendingCompletions: make(map[string][]pendingCompletion),
 		sessions:           map[string]*irc.Session{},
 		events:             make(chan event, eventChanSize),
+		netEvents:          newNetEvents(),
 		cfg:                cfg,
 		messageBounds:      map[boundKey]bound{},
+		talkers:            map[boundKey]map[string]time.Time{},
 		monitor:            make(map[string]map[string]struct{}),
+		seenChannels:       make(map[string]map[string]string),
+		autoAways:          make(map[string]struct{}),
+		scriptsRunning:     make(chan struct{}, scriptMaxRunning),
+		eventsLimiter:      rate.NewLimiter(rate.Every(time.Second), 5),
+		highlightsPending:  newHighlightCoalescer(cfg.HighlightWindow),
 
 		bufferBeforeCyclingUnread: -1,
 	}
@@ -177,8 +260,28 @@ func NewApp(cfg Config) (app *App, err error) {
 		}
 	}
 
+	var dictionary map[string]struct{}
+	if cfg.DictionaryPath != "" {
+		dictionary, err = loadDictionary(cfg.DictionaryPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load dictionary: %v", err)
+		}
+	}
+
+	var preview func(link string)
+	if cfg.ImagePreviews {
+		preview = func(link string) {
+			go app.fetchPreview(link)
+		}
+	}
+
 	mouse := cfg.Mouse
 
+	var mergeWindow time.Duration
+	if cfg.Joins == JoinVerbosityCompact {
+		mergeWindow = compactJoinWindow
+	}
+
 	app.win, err = ui.New(ui.Config{
 		ChanColWidth:     cfg.ChanColWidth,
 		ChanColEnabled:   cfg.ChanColEnabled,
@@ -192,8 +295,19 @@ func NewApp(cfg Config) (app *App, err error) {
 		MergeLine: func(former *ui.Line, addition ui.Line) {
 			app.mergeLine(former, addition)
 		},
+		MergeWindow:       mergeWindow,
 		Colors:            cfg.Colors,
 		LocalIntegrations: cfg.LocalIntegrations,
+		Dictionary:        dictionary,
+		MessageText:       messageTextStart,
+		Preview:           preview,
+		CycleStatus:       cfg.CycleStatus,
+		HideServerBuffers: cfg.HideServerBuffers,
+		CompletionPopup:   cfg.CompletionPopup,
+		CJKLineBreak:      cfg.CJKLineBreak,
+		EscapeBidi:        cfg.EscapeBidi,
+		GroupAuthors:      cfg.GroupAuthors,
+		UnreadRuler:       cfg.UnreadRuler,
 	})
 	if err != nil {
 		return
@@ -214,17 +328,64 @@ func NewApp(cfg Config) (app *App, err error) {
 	return
 }
 
+// loadDictionary reads a word list with one word per line.
+func loadDictionary(path string) (map[string]struct{}, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dictionary := make(map[string]struct{})
+	for _, word := range strings.Fields(string(b)) {
+		dictionary[strings.ToLower(word)] = struct{}{}
+	}
+	return dictionary, nil
+}
+
+// Close stops the application. Connections are closed cleanly when Run
+// returns.
 func (app *App) Close() {
 	app.win.Exit()       // tell all instances of app.ircLoop to stop when possible
 	app.events <- event{ // tell app.eventLoop to stop
 		src:     "*",
 		content: nil,
 	}
+}
+
+// quit sends QUIT to all servers, then waits briefly for them to close the
+// connections.
+func (app *App) quit() {
+	app.connsLock.Lock()
+	app.connsClosed = true
+	app.connsLock.Unlock()
+	for _, session := range app.sessions {
+		session.Quit(app.cfg.QuitMessage)
+	}
+	done := make(chan struct{})
+	go func() {
+		app.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(quitTimeout):
+	}
 	for _, session := range app.sessions {
 		session.Close()
 	}
 }
 
+// addConn registers a new connection in app.conns, and returns false if the
+// application is quitting, in which case the connection must not be used.
+func (app *App) addConn() bool {
+	app.connsLock.Lock()
+	defer app.connsLock.Unlock()
+	if app.connsClosed || app.win.ShouldExit() {
+		return false
+	}
+	app.conns.Add(1)
+	return true
+}
+
 func (app *App) SwitchToBuffer(netID, buffer string) {
 	app.lastNetID = netID
 	app.lastBuffer = buffer
@@ -233,10 +394,22 @@ func (app *App) SwitchToBuffer(netID, buffer string) {
 func (app *App) Run() {
 	if app.lastCloseTime.IsZero() {
 		app.lastCloseTime = time.Now()
+	} else {
+		// Lines received while senpai was closed are missed lines too.
+		app.win.SetAway(app.lastCloseTime)
+		app.win.SetBack(time.Now())
 	}
+	app.lastActivity = time.Now()
 	go app.uiLoop()
 	go app.ircLoop("")
+	if app.cfg.AutoAway > 0 {
+		go app.autoAwayLoop()
+	}
+	if app.cfg.ResumeJump > 0 {
+		go app.resumeLoop()
+	}
 	app.eventLoop()
+	app.quit()
 }
 
 func (app *App) CurrentSession() *irc.Session {
@@ -256,27 +429,221 @@ func (app *App) SetLastClose(t time.Time) {
 	app.lastCloseTime = t
 }
 
+func (app *App) BufferOrder() []ui.BufferKey {
+	return app.win.BufferOrder()
+}
+
+func (app *App) SetBufferOrder(order []ui.BufferKey) {
+	app.win.SetBufferOrder(order)
+}
+
+// Layout returns whether the buffer and member lists are shown.
+func (app *App) Layout() (channelShown, memberShown bool) {
+	return app.win.Layout()
+}
+
+func (app *App) SetLayout(channelShown, memberShown bool) {
+	app.win.SetLayout(channelShown, memberShown)
+}
+
+func (app *App) ScrollAnchors() map[ui.BufferKey]time.Time {
+	return app.win.ScrollAnchors()
+}
+
+func (app *App) SetScrollAnchors(anchors map[ui.BufferKey]time.Time) {
+	app.win.SetScrollAnchors(anchors)
+}
+
+// autoAwayCheck is sent to app.events periodically when auto-away is enabled.
+type autoAwayCheck struct{}
+
+// autoAwayLoop periodically asks app.eventLoop to check whether the user is
+// idle.
+func (app *App) autoAwayLoop() {
+	interval := app.cfg.AutoAway / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for !app.win.ShouldExit() {
+		<-t.C
+		app.events <- event{
+			src:     "*",
+			content: autoAwayCheck{},
+		}
+	}
+}
+
+// resumed is sent to app.events when the wall clock jumped forward, which
+// likely means the system was asleep for gap.
+type resumed struct {
+	gap time.Duration
+}
+
+// resumeLoop watches the wall clock for jumps forward longer than the
+// reconnect-on-resume duration.
+func (app *App) resumeLoop() {
+	const interval = 5 * time.Second
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	last := time.Now()
+	for !app.win.ShouldExit() {
+		<-t.C
+		now := time.Now()
+		if gap := wallClockGap(last, now, interval); gap > app.cfg.ResumeJump {
+			app.events <- event{
+				src:     "*",
+				content: resumed{gap: gap},
+			}
+		}
+		last = now
+	}
+}
+
+// wallClockGap returns how much more than interval elapsed between last and
+// now, according to the wall clock. The monotonic clock is ignored, since it
+// may not advance while the system is asleep.
+func wallClockGap(last, now time.Time, interval time.Duration) time.Duration {
+	return now.Round(0).Sub(last.Round(0)) - interval
+}
+
+// resumePingTimeout is how long the servers have to answer after the system
+// resumed from sleep, before their connections are considered dead.
+const resumePingTimeout = 10 * time.Second
+
+// resumeCheck is sent to app.events resumePingTimeout after the system resumed
+// from sleep, with the sessions that were pinged then.
+type resumeCheck struct {
+	gap      time.Duration
+	sessions map[string]*irc.Session
+}
+
+// handleResumed pings all connected networks after the system resumed from
+// sleep, since their connections may be dead. The clock may also jump for
+// other reasons, so the connections are only dropped if the servers do not
+// answer in time.
+func (app *App) handleResumed(gap time.Duration) {
+	if len(app.sessions) == 0 {
+		return
+	}
+	sessions := make(map[string]*irc.Session, len(app.sessions))
+	for netID, s := range app.sessions {
+		s.Ping()
+		sessions[netID] = s
+	}
+	time.AfterFunc(resumePingTimeout, func() {
+		app.events <- event{
+			src: "*",
+			content: resumeCheck{
+				gap:      gap,
+				sessions: sessions,
+			},
+		}
+	})
+}
+
+// handleResumeCheck reconnects to the networks which did not answer the PING
+// sent after the system resumed from sleep.
+func (app *App) handleResumeCheck(ev resumeCheck) {
+	for netID, s := range ev.sessions {
+		if app.sessions[netID] != s || !s.PingPending() {
+			continue
+		}
+		s.Quit("Reconnecting")
+		app.reconnect(netID)
+		app.addStatusLine(netID, ui.Line{
+			At:        time.Now(),
+			Head:      "--",
+			HeadColor: app.cfg.Colors.Status,
+			Body: ui.Styled(fmt.Sprintf("Resumed after %v asleep, and the server does not answer: reconnecting...", ev.gap.Round(time.Second)), vaxis.Style{
+				Foreground: app.cfg.Colors.Status,
+			}),
+		})
+	}
+}
+
+// checkAutoAway marks the user away on all networks where they are not away
+// already, if they have been idle for longer than the auto-away duration.
+func (app *App) checkAutoAway() {
+	if app.autoAway || time.Since(app.lastActivity) < app.cfg.AutoAway {
+		return
+	}
+	app.autoAway = true
+	for netID, s := range app.sessions {
+		if s.IsAway() {
+			// Do not clobber a manually set away message.
+			continue
+		}
+		s.Away(app.cfg.AutoAwayReason)
+		app.autoAways[netID] = struct{}{}
+	}
+	if len(app.autoAways) > 0 {
+		app.win.SetAway(app.lastActivity)
+	}
+}
+
+// markActive records user activity, and ends auto-away if needed.
+func (app *App) markActive() {
+	app.lastActivity = time.Now()
+	if !app.autoAway {
+		return
+	}
+	app.autoAway = false
+	if len(app.autoAways) == 0 {
+		return
+	}
+	for netID := range app.autoAways {
+		if s, ok := app.sessions[netID]; ok {
+			s.Away("")
+		}
+		delete(app.autoAways, netID)
+	}
+	app.win.SetBack(app.lastActivity)
+}
+
 // eventLoop retrieves events (in batches) from the event channel and handle
 // them, then draws the interface after each batch is handled.
 func (app *App) eventLoop() {
 	defer app.win.Close()
 
 	for !app.win.ShouldExit() {
-		ev := <-app.events
-		if !app.handleEvent(ev) {
-			return
+		select {
+		case ev := <-app.events:
+			if !app.handleEvent(ev) {
+				return
+			}
+		case <-app.netEvents.ready:
 		}
 		deadline := time.NewTimer(200 * time.Millisecond)
 	outer:
 		for {
 			select {
 			case <-deadline.C:
+				// Draw now, and take the remaining events of the
+				// networks on the next iteration.
+				app.netEvents.rearm()
 				break outer
+			default:
+			}
+			// Alternate between UI events and the events of each
+			// network in turn.
+			handled := false
+			select {
 			case ev := <-app.events:
 				if !app.handleEvent(ev) {
 					return
 				}
+				handled = true
 			default:
+			}
+			if ev, ok := app.netEvents.pop(); ok {
+				if !app.handleEvent(ev) {
+					return
+				}
+				handled = true
+			}
+			if !handled {
 				if !deadline.Stop() {
 					<-deadline.C
 				}
@@ -286,7 +653,7 @@ func (app *App) eventLoop() {
 
 		if !app.pasting {
 			if app.win.Focused() {
-				if netID, buffer, timestamp := app.win.UpdateRead(); buffer != "" {
+				if netID, buffer, timestamp := app.win.UpdateRead(); buffer != "" && buffer != servicesBuffer {
 					s := app.sessions[netID]
 					if s != nil {
 						s.ReadSet(buffer, timestamp)
@@ -294,6 +661,7 @@ func (app *App) eventLoop() {
 				}
 			}
 			app.maybeRequestHistory()
+			app.updateLoadingHistory()
 			app.setStatus()
 			app.updatePrompt()
 			app.setBufferNumbers()
@@ -320,6 +688,15 @@ func (app *App) eventLoop() {
 		for range app.events {
 		}
 	}()
+	go func() {
+		for range app.netEvents.ready {
+			for {
+				if _, ok := app.netEvents.pop(); !ok {
+					break
+				}
+			}
+		}
+	}()
 }
 
 func (app *App) handleEvent(ev event) bool {
@@ -346,28 +723,71 @@ func (app *App) wantsNetwork(netID string) bool {
 	return ok
 }
 
+// reconnectChan returns the channel signaling ircLoop to reconnect a network
+// immediately.
+func (app *App) reconnectChan(netID string) chan struct{} {
+	app.networkLock.Lock()
+	defer app.networkLock.Unlock()
+	wake, ok := app.reconnects[netID]
+	if !ok {
+		wake = make(chan struct{}, 1)
+		app.reconnects[netID] = wake
+	}
+	return wake
+}
+
+// reconnect drops the connection to a network, if any, and connects again
+// without waiting.
+func (app *App) reconnect(netID string) {
+	select {
+	case app.reconnectChan(netID) <- struct{}{}:
+	default:
+	}
+}
+
 // ircLoop maintains a connection to the IRC server by connecting and then
 // forwarding IRC events to app.events repeatedly.
 func (app *App) ircLoop(netID string) {
-	var auth irc.SASLClient
+	var auths []irc.SASLClient
+	if app.cfg.TLSCertificate != nil {
+		auths = append(auths, &irc.SASLExternal{})
+	}
 	if app.cfg.Password != nil {
-		auth = &irc.SASLPlain{
+		auths = append(auths, &irc.SASLPlain{
 			Username: app.cfg.User,
 			Password: *app.cfg.Password,
-		}
+		})
 	}
 	params := irc.SessionParams{
 		Nickname: app.cfg.Nick,
 		Username: app.cfg.User,
 		RealName: app.cfg.Real,
 		NetID:    netID,
-		Auth:     auth,
+		Auths:    auths,
 	}
 	const throttleInterval = 6 * time.Second
 	const throttleMax = 1 * time.Minute
+	// Reconnecting right away after being killed would likely get us
+	// killed again.
+	const killedDelay = 5 * time.Minute
 	var delay time.Duration = 0
+	banned := false
+	wake := app.reconnectChan(netID)
 	for app.wantsNetwork(netID) {
-		time.Sleep(delay)
+		if banned {
+			// Only reconnect on /reconnect.
+			select {
+			case <-time.After(throttleMax):
+				continue
+			case <-wake:
+				banned = false
+			}
+		} else {
+			select {
+			case <-time.After(delay):
+			case <-wake:
+			}
+		}
 		if delay < throttleMax {
 			delay += throttleInterval
 		}
@@ -377,58 +797,160 @@ func (app *App) ircLoop(netID string) {
 		}
 		delay = throttleInterval
 
-		in, out := irc.ChanInOut(conn)
+		if !app.addConn() {
+			conn.Close()
+			return
+		}
+		in, out := irc.ChanInOut(conn, app.cfg.FloodLimit)
+		done := make(chan struct{})
 		if app.cfg.Debug {
-			out = app.debugOutputMessages(netID, out)
+			out = app.debugOutputMessages(netID, out, done)
 		}
 		session := irc.NewSession(out, params)
-		app.events <- event{
+		app.netEvents.push(netID, event{
 			src:     netID,
 			content: session,
-		}
+		})
 		go func() {
 			for stop := range session.TypingStops() {
-				app.events <- event{
+				app.netEvents.push(netID, event{
 					src:     netID,
 					content: stop,
-				}
+				})
+			}
+		}()
+		woken := make(chan bool, 1)
+		var quitting int32 // set once we sent QUIT, before reconnecting
+		go func() {
+			select {
+			case <-wake:
+				atomic.StoreInt32(&quitting, 1)
+			case <-done:
+				woken <- false
+				return
 			}
+			// Give the server some time to close the connection after QUIT.
+			select {
+			case <-done:
+			case <-time.After(quitTimeout):
+				conn.Close()
+			}
+			woken <- true
 		}()
+		killed := false
 		for msg := range in {
+			if msg.Command == "KILL" {
+				killed = true
+			}
+			quit := atomic.LoadInt32(&quitting) != 0 || app.win.ShouldExit()
+			if isBan(msg, app.cfg.BanPatterns, quit) {
+				banned = true
+			}
 			if app.cfg.Debug {
-				app.queueStatusLine(netID, ui.Line{
+				app.queueNetworkStatusLine(netID, ui.Line{
 					At:   time.Now(),
 					Head: "IN --",
 					Body: ui.PlainString(msg.String()),
 				})
 			}
-			app.events <- event{
+			app.netEvents.push(netID, event{
 				src:     netID,
 				content: msg,
-			}
+			})
 		}
-		app.events <- event{
+		app.conns.Done()
+		close(done)
+		if <-woken {
+			delay = 0
+			banned = false
+		} else if killed {
+			delay = killedDelay
+		}
+		app.netEvents.push(netID, event{
 			src:     netID,
 			content: nil,
+		})
+		body := "Connection lost"
+		if banned {
+			body = "Connection lost: banned from the server, use /reconnect to try again"
+		} else if delay > 0 && app.wantsNetwork(netID) {
+			body = fmt.Sprintf("Connection lost, reconnecting in %v", delay)
 		}
-		app.queueStatusLine(netID, ui.Line{
+		app.queueNetworkStatusLine(netID, ui.Line{
 			Head:      "!!",
 			HeadColor: ui.ColorRed,
-			Body:      ui.PlainString("Connection lost"),
+			Body:      ui.PlainString(body),
 		})
 	}
 }
 
+// isBan reports whether msg tells that we are banned from the server, either
+// with ERR_YOUREBANNEDCREEP or with a reason for closing the connection
+// matching one of patterns, case-insensitively. ERROR is ignored if quit is
+// true, since the server then only answers our own QUIT.
+func isBan(msg irc.Message, patterns []string, quit bool) bool {
+	switch msg.Command {
+	case "465": // ERR_YOUREBANNEDCREEP
+		return true
+	case "ERROR", "KILL":
+		if msg.Command == "ERROR" && quit {
+			return false
+		}
+		if len(msg.Params) == 0 {
+			return false
+		}
+		reason := strings.ToLower(msg.Params[len(msg.Params)-1])
+		for _, pattern := range patterns {
+			if strings.Contains(reason, strings.ToLower(pattern)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyFingerprint returns a function checking that the certificate of the
+// server has the given SHA-256 fingerprint.
+func verifyFingerprint(fingerprint []byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no server certificate")
+		}
+		sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		if !bytes.Equal(sum[:], fingerprint) {
+			return fmt.Errorf("server certificate fingerprint %s does not match the pinned fingerprint", hex.EncodeToString(sum[:]))
+		}
+		return nil
+	}
+}
+
 func (app *App) connect(netID string) net.Conn {
-	app.queueStatusLine(netID, ui.Line{
+	app.queueNetworkStatusLine(netID, ui.Line{
 		Head: "--",
 		Body: ui.PlainSprintf("Connecting to %s...", app.cfg.Addr),
 	})
+	if app.cfg.TLS && app.cfg.TLSSkipVerify && app.cfg.TLSFingerprint == nil {
+		app.queueNetworkStatusLine(netID, ui.Line{
+			Head:      "!!",
+			HeadColor: ui.ColorRed,
+			Body:      ui.PlainString("Warning: TLS certificate verification is disabled, the connection is vulnerable to man-in-the-middle attacks"),
+		})
+	}
 	conn, err := app.tryConnect()
 	if err == nil {
+		if app.cfg.ConnectProgress {
+			body := "Connection established"
+			if app.cfg.TLS {
+				body = "Connection established, TLS handshake done"
+			}
+			app.queueNetworkStatusLine(netID, ui.Line{
+				Head: "--",
+				Body: ui.PlainString(body),
+			})
+		}
 		return conn
 	}
-	app.queueStatusLine(netID, ui.Line{
+	app.queueNetworkStatusLine(netID, ui.Line{
 		Head:      "!!",
 		HeadColor: ui.ColorRed,
 		Body:      ui.PlainSprintf("Connection failed: %v", err),
@@ -437,17 +959,9 @@ func (app *App) connect(netID string) net.Conn {
 }
 
 func (app *App) tryConnect() (conn net.Conn, err error) {
-	addr := app.cfg.Addr
-	colonIdx := strings.LastIndexByte(addr, ':')
-	bracketIdx := strings.LastIndexByte(addr, ']')
-	if colonIdx <= bracketIdx {
-		// either colonIdx < 0, or the last colon is before a ']' (end
-		// of IPv6 address). -> missing port
-		if app.cfg.TLS {
-			addr += ":6697"
-		} else {
-			addr += ":6667"
-		}
+	addr, err := addrWithPort(app.cfg.Addr, app.cfg.TLS)
+	if err != nil {
+		return nil, err
 	}
 
 	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
@@ -455,18 +969,41 @@ func (app *App) tryConnect() (conn net.Conn, err error) {
 	dialer := &net.Dialer{
 		Timeout: 10 * time.Second,
 	}
-	conn, err = proxy.FromEnvironmentUsing(dialer).(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	if app.cfg.LocalAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{
+			IP: app.cfg.LocalAddr,
+		}
+	}
+	var cd proxy.ContextDialer
+	if app.cfg.Proxy != nil {
+		cd, err = proxyDialer(app.cfg.Proxy, dialer)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %v", err)
+		}
+	} else {
+		cd = proxy.FromEnvironmentUsing(dialer).(proxy.ContextDialer)
+	}
+	conn, err = cd.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("connect: %v", err)
 	}
 
 	if app.cfg.TLS {
 		host, _, _ := net.SplitHostPort(addr) // should succeed since net.Dial did.
-		conn = tls.Client(conn, &tls.Config{
+		tlsConfig := &tls.Config{
 			ServerName:         host,
 			InsecureSkipVerify: app.cfg.TLSSkipVerify,
 			NextProtos:         []string{"irc"},
-		})
+		}
+		if app.cfg.TLSFingerprint != nil {
+			// The pinned certificate replaces the usual verification.
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyConnection = verifyFingerprint(app.cfg.TLSFingerprint)
+		}
+		if app.cfg.TLSCertificate != nil {
+			tlsConfig.Certificates = []tls.Certificate{*app.cfg.TLSCertificate}
+		}
+		conn = tls.Client(conn, tlsConfig)
 		err = conn.(*tls.Conn).HandshakeContext(ctx)
 		if err != nil {
 			conn.Close()
@@ -477,20 +1014,48 @@ func (app *App) tryConnect() (conn net.Conn, err error) {
 	return
 }
 
-func (app *App) debugOutputMessages(netID string, out chan<- irc.Message) chan<- irc.Message {
+// debugOutputMessages returns a channel that logs outgoing messages to the
+// status buffer before forwarding them to out.
+//
+// out is closed when either the returned channel is closed (by
+// irc.Session.Close) or done is closed (the connection is lost). In the latter
+// case, messages sent by the session until it is closed are dropped, so that
+// the session never blocks on a dead connection.
+func (app *App) debugOutputMessages(netID string, out chan<- irc.Message, done <-chan struct{}) chan<- irc.Message {
 	debugOut := make(chan irc.Message, cap(out))
-	go func() {
-		for msg := range debugOut {
+	go app.debugOutput(netID, debugOut, out, done)
+	return debugOut
+}
+
+// debugOutput forwards messages from debugOut to out for debugOutputMessages,
+// and returns once out is closed.
+func (app *App) debugOutput(netID string, debugOut <-chan irc.Message, out chan<- irc.Message, done <-chan struct{}) {
+	defer func() {
+		// Drain until the session is closed.
+		for range debugOut {
+		}
+	}()
+	defer close(out)
+	for {
+		select {
+		case msg, ok := <-debugOut:
+			if !ok {
+				return
+			}
 			app.queueStatusLine(netID, ui.Line{
 				At:   time.Now(),
 				Head: "OUT --",
 				Body: ui.PlainString(msg.String()),
 			})
-			out <- msg
+			select {
+			case out <- msg:
+			case <-done:
+				return
+			}
+		case <-done:
+			return
 		}
-		close(out)
-	}()
-	return debugOut
+	}
 }
 
 // uiLoop retrieves events from the UI and forwards them to app.events for
@@ -513,8 +1078,10 @@ func (app *App) handleUIEvent(ev interface{}) bool {
 	case vaxis.PasteStartEvent:
 		app.pasting = true
 		app.pastingInputOnly = len(app.win.InputContent()) == 0
+		app.pasteBefore = string(app.win.InputContent())
 	case vaxis.PasteEndEvent:
 		app.pasting = false
+		app.rawPaste = false
 		if app.pastingInputOnly {
 			app.pastingInputOnly = false
 
@@ -523,6 +1090,11 @@ func (app *App) handleUIEvent(ev interface{}) bool {
 				app.win.InputSet(fmt.Sprintf("/upload %v", path))
 			}
 		}
+		input := string(app.win.InputContent())
+		if n := strings.Count(input, "\n") + 1; app.cfg.PasteConfirm > 0 && n > app.cfg.PasteConfirm {
+			app.openOverlay("", pastePreview(input, time.Now()))
+			app.pasteConfirm = true
+		}
 	case vaxis.Mouse:
 		app.handleMouseEvent(ev)
 	case vaxis.Key:
@@ -535,15 +1107,27 @@ func (app *App) handleUIEvent(ev interface{}) bool {
 		app.win.JumpBufferNetwork(ev.NetID, ev.Buffer)
 	case statusLine:
 		app.addStatusLine(ev.netID, ev.line)
+	case highlightFlush:
+		app.flushHighlight(boundKey(ev))
+	case autoAwayCheck:
+		app.checkAutoAway()
+	case resumed:
+		app.handleResumed(ev.gap)
+	case resumeCheck:
+		app.handleResumeCheck(ev)
 	case *events.EventClickNick:
 		app.handleNickEvent(ev)
 	case *events.EventClickLink:
 		app.handleLinkEvent(ev)
+	case *events.EventClickLine:
+		app.handleLineEvent(ev)
 	case *events.EventImageLoaded:
 		app.win.ShowImage(ev.Image)
 		if ev.Image == nil {
 			app.imageLoading = false
 		}
+	case *events.EventPreviewLoaded:
+		app.win.SetPreview(ev.Link, ev.Image)
 	case *events.EventFileUpload:
 		if ev.Location != "" {
 			app.uploadingProgress = nil
@@ -640,7 +1224,7 @@ func (app *App) handleMouseEvent(ev vaxis.Mouse) {
 			if ok && channel != "" {
 				s := app.sessions[netID]
 				if s != nil && s.IsChannel(channel) {
-					s.Part(channel, "")
+					s.Part(channel, app.cfg.PartMessage)
 				} else {
 					app.win.RemoveBuffer(netID, channel)
 				}
@@ -707,14 +1291,7 @@ func (app *App) handleMouseEvent(ev vaxis.Mouse) {
 					if s != nil && target != "" {
 						members := s.Names(target)
 						if i < len(members) {
-							buffer := members[i].Name.Name
-							i, added := app.win.AddBuffer(netID, "", buffer)
-							app.win.JumpBufferIndex(i)
-							if added {
-								s.MonitorAdd(buffer)
-								s.ReadGet(buffer)
-								s.NewHistoryRequest(buffer).WithLimit(500).Latest()
-							}
+							app.openQuery(s, members[i].Name.Name)
 						}
 					}
 				}
@@ -740,6 +1317,13 @@ func (app *App) handleKeyEvent(ev vaxis.Key) {
 	default:
 		return
 	}
+	app.markActive()
+	if ev.EventType != vaxis.EventPaste && app.handlePasteConfirmKey(ev) {
+		return
+	}
+	if ev.EventType != vaxis.EventPaste && app.handleSelectionKey(ev) {
+		return
+	}
 	if ev.Text != "" {
 		for _, r := range ev.Text {
 			app.win.InputRune(r)
@@ -747,6 +1331,10 @@ func (app *App) handleKeyEvent(ev vaxis.Key) {
 		app.typing()
 		return
 	}
+	if ev.EventType == vaxis.EventPaste {
+		app.handlePasteKey(ev)
+		return
+	}
 
 	if keyMatches(ev, 'c', vaxis.ModCtrl) {
 		if app.win.InputClear() {
@@ -768,6 +1356,10 @@ func (app *App) handleKeyEvent(ev vaxis.Key) {
 		app.win.InputEnd()
 	} else if keyMatches(ev, 'l', vaxis.ModCtrl) {
 		app.win.Resize()
+	} else if keyMatches(ev, vaxis.KeyPgUp, vaxis.ModAlt) {
+		app.showOverlayPage(app.overlayPage - 1)
+	} else if keyMatches(ev, vaxis.KeyPgDown, vaxis.ModAlt) {
+		app.showOverlayPage(app.overlayPage + 1)
 	} else if keyMatches(ev, 'u', vaxis.ModCtrl) || keyMatches(ev, vaxis.KeyPgUp, 0) {
 		app.win.ScrollUp()
 	} else if keyMatches(ev, 'd', vaxis.ModCtrl) || keyMatches(ev, vaxis.KeyPgDown, 0) {
@@ -800,6 +1392,8 @@ func (app *App) handleKeyEvent(ev vaxis.Key) {
 		app.win.InputLeft()
 	} else if keyMatches(ev, vaxis.KeyUp, vaxis.ModAlt) {
 		app.win.PreviousBuffer()
+	} else if keyMatches(ev, vaxis.KeyUp, vaxis.ModCtrl) {
+		app.win.SelectUp()
 	} else if keyMatches(ev, vaxis.KeyUp, 0) {
 		app.win.InputUp()
 	} else if keyMatches(ev, vaxis.KeyDown, vaxis.ModAlt) {
@@ -807,12 +1401,12 @@ func (app *App) handleKeyEvent(ev vaxis.Key) {
 	} else if keyMatches(ev, vaxis.KeyDown, 0) {
 		app.win.InputDown()
 	} else if keyMatches(ev, vaxis.KeyHome, vaxis.ModAlt) {
-		app.win.GoToBufferNo(0)
+		app.win.GoToBufferPosition(0)
 	} else if keyMatches(ev, vaxis.KeyHome, 0) {
 		app.win.InputHome()
 	} else if keyMatches(ev, vaxis.KeyEnd, vaxis.ModAlt) {
 		maxInt := int(^uint(0) >> 1)
-		app.win.GoToBufferNo(maxInt)
+		app.win.GoToBufferPosition(maxInt)
 	} else if keyMatches(ev, vaxis.KeyEnd, 0) {
 		app.win.InputEnd()
 	} else if keyMatches(ev, vaxis.KeyBackspace, vaxis.ModAlt) {
@@ -838,56 +1432,66 @@ func (app *App) handleKeyEvent(ev vaxis.Key) {
 			app.typing()
 		}
 	} else if keyMatches(ev, vaxis.KeyEsc, 0) {
-		app.win.CloseOverlay()
+		if !app.win.HasOverlay() && strings.ContainsRune(string(app.win.InputContent()), '\n') {
+			// Cancel the multi-line message being composed.
+			if app.win.InputClear() {
+				app.typing()
+			}
+		} else {
+			app.win.CloseOverlay()
+			app.overlayLines = nil
+		}
+	} else if keyMatches(ev, '\n', vaxis.ModAlt) || keyMatches(ev, '\r', vaxis.ModAlt) {
+		app.win.InputRune('\n')
+		app.typing()
 	} else if keyMatches(ev, vaxis.KeyF07, 0) {
 		app.win.ToggleChannelList()
 	} else if keyMatches(ev, vaxis.KeyF08, 0) {
 		app.win.ToggleMemberList()
 	} else if keyMatches(ev, '\n', 0) || keyMatches(ev, '\r', 0) || keyMatches(ev, 'j', vaxis.ModCtrl) || keyMatches(ev, vaxis.KeyKeyPadEnter, 0) {
-		if ev.EventType == vaxis.EventPaste {
-			app.win.InputRune('\n')
-		} else if !app.win.InputEnter() {
-			netID, buffer := app.win.CurrentBuffer()
-			input := string(app.win.InputContent())
-			var err error
-			for _, part := range strings.Split(input, "\n") {
-				if err = app.handleInput(buffer, part); err != nil {
-					app.win.AddLine(netID, buffer, ui.Line{
-						At:        time.Now(),
-						Head:      "!!",
-						HeadColor: ui.ColorRed,
-						Notify:    ui.NotifyUnread,
-						Body:      ui.PlainSprintf("%q: %s", input, err),
-					})
-					break
-				}
-			}
-			if err == nil {
-				app.win.InputFlush()
-			}
-		}
+		if !app.win.InputEnter() {
+			app.sendComposed()
+		}
+	} else if keyMatches(ev, 'b', vaxis.ModAlt) {
+		app.win.InputRune(0x02)
+	} else if keyMatches(ev, 'i', vaxis.ModAlt) {
+		app.win.InputRune(0x1D)
+	} else if keyMatches(ev, 'u', vaxis.ModAlt) {
+		app.win.InputRune(0x1F)
+	} else if keyMatches(ev, 's', vaxis.ModAlt) {
+		app.win.InputRune(0x1E)
+	} else if keyMatches(ev, 'o', vaxis.ModAlt) {
+		app.win.InputRune(0x0F)
+	} else if keyMatches(ev, 'c', vaxis.ModAlt) {
+		app.win.InputRune(0x03)
+		// Open the color picker right away.
+		app.win.InputAutoComplete()
 	} else if keyMatches(ev, 'n', vaxis.ModAlt) {
 		app.win.ScrollDownHighlight()
 	} else if keyMatches(ev, 'p', vaxis.ModAlt) {
 		app.win.ScrollUpHighlight()
+	} else if keyMatches(ev, 'g', vaxis.ModAlt) {
+		if len(app.win.InputContent()) == 0 {
+			app.win.InputSet("/buffer ")
+		}
 	} else if keyMatches(ev, '1', vaxis.ModAlt) || keyMatches(ev, vaxis.KeyKeyPad1, vaxis.ModAlt) {
-		app.win.GoToBufferNo(0)
+		app.win.GoToBufferPosition(0)
 	} else if keyMatches(ev, '2', vaxis.ModAlt) || keyMatches(ev, vaxis.KeyKeyPad2, vaxis.ModAlt) {
-		app.win.GoToBufferNo(1)
+		app.win.GoToBufferPosition(1)
 	} else if keyMatches(ev, '3', vaxis.ModAlt) || keyMatches(ev, vaxis.KeyKeyPad3, vaxis.ModAlt) {
-		app.win.GoToBufferNo(2)
+		app.win.GoToBufferPosition(2)
 	} else if keyMatches(ev, '4', vaxis.ModAlt) || keyMatches(ev, vaxis.KeyKeyPad4, vaxis.ModAlt) {
-		app.win.GoToBufferNo(3)
+		app.win.GoToBufferPosition(3)
 	} else if keyMatches(ev, '5', vaxis.ModAlt) || keyMatches(ev, vaxis.KeyKeyPad5, vaxis.ModAlt) {
-		app.win.GoToBufferNo(4)
+		app.win.GoToBufferPosition(4)
 	} else if keyMatches(ev, '6', vaxis.ModAlt) || keyMatches(ev, vaxis.KeyKeyPad6, vaxis.ModAlt) {
-		app.win.GoToBufferNo(5)
+		app.win.GoToBufferPosition(5)
 	} else if keyMatches(ev, '7', vaxis.ModAlt) || keyMatches(ev, vaxis.KeyKeyPad7, vaxis.ModAlt) {
-		app.win.GoToBufferNo(6)
+		app.win.GoToBufferPosition(6)
 	} else if keyMatches(ev, '8', vaxis.ModAlt) || keyMatches(ev, vaxis.KeyKeyPad8, vaxis.ModAlt) {
-		app.win.GoToBufferNo(7)
+		app.win.GoToBufferPosition(7)
 	} else if keyMatches(ev, '9', vaxis.ModAlt) || keyMatches(ev, vaxis.KeyKeyPad9, vaxis.ModAlt) {
-		app.win.GoToBufferNo(8)
+		app.win.GoToBufferPosition(8)
 	} else if keyMatches(ev, 'a', vaxis.ModAlt) {
 		cur := app.win.CurrentBufferID()
 		if app.win.GoToNextUnread() {
@@ -901,17 +1505,279 @@ func (app *App) handleKeyEvent(ev vaxis.Key) {
 	}
 }
 
+// sendInput sends each line of the editor input, and clears it unless one
+// of them failed.
+func (app *App) sendInput() {
+	netID, buffer := app.win.CurrentBuffer()
+	input := string(app.win.InputContent())
+	var err error
+	for _, part := range strings.Split(input, "\n") {
+		if err = app.handleInput(buffer, part); err != nil {
+			app.win.AddLine(netID, buffer, ui.Line{
+				At:        time.Now(),
+				Head:      "!!",
+				HeadColor: ui.ColorRed,
+				Notify:    ui.NotifyUnread,
+				Body:      ui.PlainSprintf("%q: %s", input, err),
+			})
+			break
+		}
+	}
+	if err == nil {
+		app.win.InputFlush()
+	}
+}
+
+// sendComposed sends the editor input. Lines composed with Alt+Enter are sent
+// as a single multiline message when the server accepts them as such, and
+// otherwise one message per line, like commands.
+func (app *App) sendComposed() {
+	netID, buffer := app.win.CurrentBuffer()
+	lines := strings.Split(string(app.win.InputContent()), "\n")
+	if len(lines) < 2 || buffer == "" || buffer == servicesBuffer {
+		app.sendInput()
+		return
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, "/") {
+			app.sendInput()
+			return
+		}
+	}
+	if s := app.sessions[netID]; s == nil || !s.CanMultiline(buffer, lines) {
+		app.sendInput()
+		return
+	}
+	app.sendInputMultiline()
+}
+
+// sendInputMultiline sends the editor input as a single multiline message to
+// the current buffer, and clears it unless this failed.
+func (app *App) sendInputMultiline() {
+	netID, buffer := app.win.CurrentBuffer()
+	input := string(app.win.InputContent())
+	if err := sendMultiline(app, strings.Split(input, "\n")); err != nil {
+		app.win.AddLine(netID, buffer, ui.Line{
+			At:        time.Now(),
+			Head:      "!!",
+			HeadColor: ui.ColorRed,
+			Notify:    ui.NotifyUnread,
+			Body:      ui.PlainSprintf("%q: %s", input, err),
+		})
+		return
+	}
+	app.win.InputFlush()
+}
+
+// pastePreview returns the lines of the overlay asking whether to send the
+// multi-line text, which was just pasted.
+func pastePreview(text string, now time.Time) []ui.Line {
+	parts := strings.Split(text, "\n")
+	lines := make([]ui.Line, 0, len(parts)+1)
+	body := fmt.Sprintf("Send these %d lines? Press Alt+Enter to send them as a single message, Enter to send them one message per line, or Escape to cancel the paste.", len(parts))
+	lines = append(lines, ui.Line{
+		At:        now,
+		Head:      "--",
+		HeadColor: ui.ColorRed,
+		Body: ui.Styled(body, vaxis.Style{
+			Foreground: ui.ColorRed,
+			Attribute:  vaxis.AttrBold,
+		}),
+	})
+	for _, part := range parts {
+		lines = append(lines, ui.Line{
+			At:   now,
+			Body: ui.IRCString(part),
+		})
+	}
+	return lines
+}
+
+// handlePasteConfirmKey handles the keys while asking whether to send a
+// large paste, and returns true if the key was eaten: Alt+Enter sends the
+// input as a single multiline message, Enter sends the input line by line,
+// Escape restores the input from before the paste.
+func (app *App) handlePasteConfirmKey(ev vaxis.Key) bool {
+	if !app.pasteConfirm {
+		return false
+	}
+	if !app.win.HasOverlay() {
+		// The overlay was closed some other way: keep the paste in the
+		// input, to be edited or sent as usual.
+		app.pasteConfirm = false
+		return false
+	}
+	if keyMatches(ev, '\n', vaxis.ModAlt) || keyMatches(ev, '\r', vaxis.ModAlt) || keyMatches(ev, vaxis.KeyKeyPadEnter, vaxis.ModAlt) {
+		app.pasteConfirm = false
+		app.win.CloseOverlay()
+		app.overlayLines = nil
+		app.sendInputMultiline()
+	} else if keyMatches(ev, '\n', 0) || keyMatches(ev, '\r', 0) || keyMatches(ev, 'j', vaxis.ModCtrl) || keyMatches(ev, vaxis.KeyKeyPadEnter, 0) {
+		app.pasteConfirm = false
+		app.win.CloseOverlay()
+		app.overlayLines = nil
+		app.sendInput()
+	} else if keyMatches(ev, vaxis.KeyEsc, 0) {
+		app.pasteConfirm = false
+		app.win.CloseOverlay()
+		app.overlayLines = nil
+		app.win.InputSet(app.pasteBefore)
+		app.typing()
+	} else if keyMatches(ev, vaxis.KeyPgUp, vaxis.ModAlt) || keyMatches(ev, vaxis.KeyPgDown, vaxis.ModAlt) {
+		return false
+	}
+	return true
+}
+
+// handleSelectionKey handles a key while a line of the current buffer is
+// selected. It returns false if the key should be handled as usual.
+func (app *App) handleSelectionKey(ev vaxis.Key) bool {
+	line, ok := app.win.Selection()
+	if !ok {
+		return false
+	}
+	if keyMatches(ev, vaxis.KeyUp, 0) || keyMatches(ev, vaxis.KeyUp, vaxis.ModCtrl) {
+		app.win.SelectUp()
+	} else if keyMatches(ev, vaxis.KeyDown, 0) || keyMatches(ev, vaxis.KeyDown, vaxis.ModCtrl) {
+		app.win.SelectDown()
+	} else if keyMatches(ev, vaxis.KeyEsc, 0) {
+		app.win.ClearSelection()
+	} else if keyMatches(ev, 'r', 0) {
+		if line.ID != "" {
+			app.win.ClearSelection()
+			app.win.InputSet(fmt.Sprintf("/replyto %s ", line.ID))
+		}
+	} else {
+		return false
+	}
+	return true
+}
+
+// pasteFormatKeys maps the keys sent by the terminal for IRC formatting codes
+// to these codes.
+var pasteFormatKeys = map[rune]rune{
+	'b': 0x02,
+	'c': 0x03,
+	'd': 0x04,
+	'o': 0x0F,
+	'v': 0x16,
+	']': 0x1D,
+	'^': 0x1E,
+	'_': 0x1F,
+}
+
+// handlePasteKey handles a non-text key that is part of a paste.
+func (app *App) handlePasteKey(ev vaxis.Key) {
+	if r, ok := pasteKeyRune(ev, app.cfg.StripPaste && !app.rawPaste); ok {
+		app.win.InputRune(r)
+	}
+}
+
+// pasteKeyRune returns the rune to insert for a non-text key that is part of
+// a paste. Line breaks and tabs are kept; formatting codes are kept unless
+// strip is true; any other control character or escape sequence is dropped.
+func pasteKeyRune(ev vaxis.Key, strip bool) (r rune, ok bool) {
+	if keyMatches(ev, '\n', 0) || keyMatches(ev, '\r', 0) || keyMatches(ev, 'j', vaxis.ModCtrl) || keyMatches(ev, vaxis.KeyKeyPadEnter, 0) {
+		return '\n', true
+	} else if keyMatches(ev, vaxis.KeyTab, 0) {
+		return ' ', true
+	} else if ev.Modifiers == vaxis.ModCtrl && !strip {
+		r, ok = pasteFormatKeys[ev.Keycode]
+		return r, ok
+	}
+	return 0, false
+}
+
 func (app *App) handleNickEvent(ev *events.EventClickNick) {
 	s := app.sessions[ev.NetID]
 	if s == nil {
 		return
 	}
-	i, added := app.win.AddBuffer(ev.NetID, "", ev.Nick)
+	app.openQuery(s, ev.Nick)
+}
+
+// seeChannel adds channel to the channels seen on a network, for completions.
+func (app *App) seeChannel(netID, channel string) {
+	seen, ok := app.seenChannels[netID]
+	if !ok {
+		seen = make(map[string]string)
+		app.seenChannels[netID] = seen
+	}
+	addSeenChannel(seen, channel)
+}
+
+// addSeenChannel adds channel to the channels seen in LIST and NAMES replies,
+// dropping another one if there are already maxSeenChannels of them.
+func addSeenChannel(seen map[string]string, channel string) {
+	channelCf := strings.ToLower(channel)
+	if _, ok := seen[channelCf]; !ok && len(seen) >= maxSeenChannels {
+		for k := range seen {
+			delete(seen, k)
+			break
+		}
+	}
+	seen[channelCf] = channel
+}
+
+// restoreQueries monitors the users of the open queries of the network of s
+// after connecting, and fetches the read markers of the queries, which were
+// possibly read elsewhere in the meantime. With chathistory, the read markers
+// are fetched along with the history targets instead.
+func (app *App) restoreQueries(s *irc.Session) {
+	history := s.HasCapability("draft/chathistory")
+	for target := range app.monitor[s.NetID()] {
+		// TODO: batch MONITOR +
+		s.MonitorAdd(target)
+		if !history {
+			s.ReadGet(target)
+		}
+	}
+}
+
+// openQuery opens and focuses the query buffer of nick, even if they are
+// offline, and fetches its history if it was not open yet.
+func (app *App) openQuery(s *irc.Session, nick string) {
+	netID := s.NetID()
+	i, added := app.win.AddBuffer(netID, "", nick)
 	app.win.JumpBufferIndex(i)
 	if added {
-		s.MonitorAdd(ev.Nick)
-		s.ReadGet(ev.Nick)
-		s.NewHistoryRequest(ev.Nick).WithLimit(500).Latest()
+		app.monitor[netID][nick] = struct{}{}
+		s.MonitorAdd(nick)
+		s.ReadGet(nick)
+		app.requestInitialHistory(s, nick, time.Time{})
+	}
+}
+
+// searchResult is the data of the lines of search results, shown in the
+// overlay.
+type searchResult struct {
+	netID  string
+	buffer string
+	ev     irc.MessageEvent
+}
+
+// handleLineEvent jumps to the message of a search result.
+func (app *App) handleLineEvent(ev *events.EventClickLine) {
+	if ev.Event.Button != vaxis.MouseLeftButton {
+		return
+	}
+	r, ok := ev.Data.(searchResult)
+	if !ok {
+		return
+	}
+	if !app.win.JumpToLine(r.netID, r.buffer, r.ev.MsgID, r.ev.Time) {
+		netID, buffer := app.win.CurrentBuffer()
+		if netID != r.netID || buffer != r.buffer {
+			return
+		}
+		app.win.AddLine(netID, buffer, ui.Line{
+			At:        time.Now(),
+			Head:      "--",
+			HeadColor: app.cfg.Colors.Status,
+			Body: ui.Styled("This message is older than the loaded history: scroll up to load it", vaxis.Style{
+				Foreground: app.cfg.Colors.Status,
+			}),
+		})
 	}
 }
 
@@ -985,6 +1851,73 @@ func (app *App) fetchImage(link string) (image.Image, error) {
 	return img, nil
 }
 
+// fetchPreview downloads the image at link for an inline preview, and sends
+// the result to the event loop. Only links to images no larger than the
+// configured size are previewed.
+func (app *App) fetchPreview(link string) {
+	img, _ := fetchPreviewImage(link, app.cfg.ImagePreviewsMaxSize)
+	app.events <- event{
+		src: "*",
+		content: &events.EventPreviewLoaded{
+			Link:  link,
+			Image: img,
+		},
+	}
+}
+
+func fetchPreviewImage(link string, maxSize int64) (image.Image, error) {
+	c := http.Client{
+		Timeout: 6 * time.Second,
+	}
+	res, err := c.Get(link)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+	contentType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected content type: %v", res.Header.Get("Content-Type"))
+	}
+	switch contentType {
+	case "image/gif", "image/jpeg", "image/png":
+	default:
+		return nil, fmt.Errorf("unexpected content type: %v", contentType)
+	}
+	if res.ContentLength > maxSize {
+		return nil, fmt.Errorf("image too large: %d bytes", res.ContentLength)
+	}
+	b, err := io.ReadAll(io.LimitReader(res.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > maxSize {
+		return nil, fmt.Errorf("image too large")
+	}
+	return decodePreviewImage(b, maxPreviewPixels)
+}
+
+// maxPreviewPixels is the maximum number of pixels of previewed images, so
+// that small but highly compressed images cannot take gigabytes of memory
+// once decoded.
+const maxPreviewPixels = 4096 * 4096
+
+// decodePreviewImage decodes an image for a preview, unless it has more than
+// maxPixels pixels.
+func decodePreviewImage(b []byte, maxPixels int) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > maxPixels/cfg.Height {
+		return nil, fmt.Errorf("image too large: %dx%d pixels", cfg.Width, cfg.Height)
+	}
+	img, _, err := ui.DecodeImage(bytes.NewReader(b))
+	return img, err
+}
+
 func (app *App) handleLinkEvent(ev *events.EventClickLink) {
 	open := func() {
 		if strings.HasPrefix(ev.Link, "-") {
@@ -1099,6 +2032,48 @@ func (app *App) handleUpload(url string, f *os.File, size int64) {
 	}()
 }
 
+// openOverlay shows lines in an overlay, at most "overlay-page-size" lines at a
+// time, so that large results do not slow down the UI.
+func (app *App) openOverlay(hint string, lines []ui.Line) {
+	app.win.OpenOverlay(hint)
+	app.overlayLines = lines
+	app.overlayPage = 0
+	app.showOverlayPage(0)
+}
+
+// showOverlayPage shows the given page of the lines of the overlay, if any.
+func (app *App) showOverlayPage(page int) {
+	if !app.win.HasOverlay() {
+		return
+	}
+	size := app.cfg.OverlayPage
+	pages := (len(app.overlayLines) + size - 1) / size
+	if page < 0 || page >= pages {
+		return
+	}
+	app.overlayPage = page
+	start := page * size
+	end := start + size
+	if end > len(app.overlayLines) {
+		end = len(app.overlayLines)
+	}
+	lines := make([]ui.Line, end-start, end-start+1)
+	copy(lines, app.overlayLines[start:end])
+	if pages > 1 {
+		body := fmt.Sprintf("Results %d-%d of %d, %d not shown: press Alt+PgUp and Alt+PgDown to change pages", start+1, end, len(app.overlayLines), len(app.overlayLines)-(end-start))
+		lines = append(lines, ui.Line{
+			At:        lines[len(lines)-1].At,
+			Head:      "--",
+			HeadColor: app.cfg.Colors.Status,
+			Body: ui.Styled(body, vaxis.Style{
+				Foreground: app.cfg.Colors.Status,
+			}),
+		})
+	}
+	app.win.ClearBuffer("", ui.Overlay)
+	app.win.AddLines("", ui.Overlay, lines, nil)
+}
+
 // maybeRequestHistory is a wrapper around irc.Session.RequestHistory to only request
 // history when needed.
 func (app *App) maybeRequestHistory() {
@@ -1106,7 +2081,11 @@ func (app *App) maybeRequestHistory() {
 		return
 	}
 	netID, buffer := app.win.CurrentBuffer()
-	if app.messageBounds[boundKey{netID, buffer}].complete {
+	if app.messageBounds[app.messageBoundKey(netID, buffer)].complete {
+		return
+	}
+	if app.win.CurrentBufferCleared() {
+		// Only fetch the history again when scrolling up.
 		return
 	}
 	s := app.sessions[netID]
@@ -1114,24 +2093,61 @@ func (app *App) maybeRequestHistory() {
 		return
 	}
 	_, h := app.win.Size()
-	if l := app.win.LinesAboveOffset(); l < h*2 && buffer != "" {
-		if bound, ok := app.messageBounds[boundKey{netID, buffer}]; ok {
+	if l := app.win.LinesAboveOffset(); l < h*2 && buffer != "" && buffer != servicesBuffer {
+		if bound, ok := app.messageBounds[app.messageBoundKey(netID, buffer)]; ok {
 			s.NewHistoryRequest(buffer).
-				WithLimit(200).
+				WithLimit(app.cfg.HistoryPage).
 				Before(bound.first)
 		} else {
 			s.NewHistoryRequest(buffer).
-				WithLimit(200).
+				WithLimit(app.cfg.HistoryPage).
 				Latest()
 		}
 	}
 }
 
+// requestInitialHistory fetches the messages of a buffer that was just added,
+// before t if it is set. If initial history is disabled, the history is
+// instead fetched by maybeRequestHistory once the buffer is opened.
+func (app *App) requestInitialHistory(s *irc.Session, target string, t time.Time) {
+	if app.cfg.HistoryInitial == 0 {
+		return
+	}
+	r := s.NewHistoryRequest(target).WithLimit(app.cfg.HistoryInitial)
+	if t.IsZero() {
+		r.Latest()
+	} else {
+		r.Before(t)
+	}
+}
+
+// setNetworkName names the buffers of a directly connected network after the
+// name advertised by the server. The names of bouncer networks are set from
+// the bouncer instead, and the configured home name takes precedence.
+func (app *App) setNetworkName(netID, name string) {
+	if netID != "" || name == "" || app.cfg.HomeName != "" {
+		return
+	}
+	app.win.SetNetworkName(netID, name)
+}
+
+// updateLoadingHistory shows whether history is being fetched for the current
+// buffer.
+func (app *App) updateLoadingHistory() {
+	netID, buffer := app.win.CurrentBuffer()
+	if buffer == "" {
+		return
+	}
+	s := app.sessions[netID]
+	app.win.SetLoadingHistory(netID, buffer, s != nil && s.HistoryPending(buffer))
+}
+
 func (app *App) handleIRCEvent(netID string, ev interface{}) {
 	if ev == nil {
 		if s, ok := app.sessions[netID]; ok {
 			s.Close()
 			delete(app.sessions, netID)
+			app.notifyEvent(s, "disconnect", "", "", "")
 		}
 		return
 	}
@@ -1180,6 +2196,10 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 	if t.After(app.lastMessageTime) {
 		app.lastMessageTime = t
 	}
+	if msg.Command == "353" && len(msg.Params) >= 3 {
+		// RPL_NAMREPLY, also for channels we are not in.
+		app.seeChannel(netID, msg.Params[2])
+	}
 
 	if cs, ok := app.pendingCompletions[netID]; ok {
 		now := time.Now()
@@ -1224,10 +2244,15 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 			Head: "--",
 			Body: ui.PlainString(body),
 		})
-		for target := range app.monitor[s.NetID()] {
-			// TODO: batch MONITOR +
-			s.MonitorAdd(target)
-		}
+		app.restoreQueries(s)
+		if app.autoAway {
+			s.Away(app.cfg.AutoAwayReason)
+			app.autoAways[netID] = struct{}{}
+		}
+		app.setNetworkName(netID, s.NetworkName())
+		app.notifyEvent(s, "connect", "", "", body)
+	case irc.NetworkNameEvent:
+		app.setNetworkName(netID, ev.Name)
 	case irc.SelfNickEvent:
 		if !app.cfg.StatusEnabled {
 			break
@@ -1262,17 +2287,10 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 		if !ev.Read.IsZero() {
 			app.win.SetRead(netID, ev.Channel, ev.Read)
 		}
-		bounds, ok := app.messageBounds[boundKey{netID, ev.Channel}]
+		bounds, ok := app.messageBounds[app.messageBoundKey(netID, ev.Channel)]
 		if added || !ok {
-			if t, ok := msg.Time(); ok {
-				s.NewHistoryRequest(ev.Channel).
-					WithLimit(500).
-					Before(t)
-			} else {
-				s.NewHistoryRequest(ev.Channel).
-					WithLimit(500).
-					Latest()
-			}
+			t, _ := msg.Time()
+			app.requestInitialHistory(s, ev.Channel, t)
 		} else {
 			s.NewHistoryRequest(ev.Channel).
 				WithLimit(1000).
@@ -1294,16 +2312,17 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 			app.lastBuffer = ""
 		}
 	case irc.UserJoinEvent:
-		if !app.cfg.StatusEnabled {
+		if !app.cfg.StatusEnabled || !app.showJoin(netID, ev.Channel, ev.User, ev.Time) {
 			break
 		}
 		line := app.formatEvent(ev)
 		app.win.AddLine(netID, ev.Channel, line)
 	case irc.SelfPartEvent:
 		app.win.RemoveBuffer(netID, ev.Channel)
-		delete(app.messageBounds, boundKey{netID, ev.Channel})
+		delete(app.messageBounds, app.messageBoundKey(netID, ev.Channel))
+		delete(app.talkers, app.messageBoundKey(netID, ev.Channel))
 	case irc.UserPartEvent:
-		if !app.cfg.StatusEnabled {
+		if !app.cfg.StatusEnabled || !app.showJoin(netID, ev.Channel, ev.User, ev.Time) {
 			break
 		}
 		line := app.formatEvent(ev)
@@ -1314,6 +2333,9 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 		}
 		line := app.formatEvent(ev)
 		for _, c := range ev.Channels {
+			if !app.showJoin(netID, c, ev.User, ev.Time) {
+				continue
+			}
 			app.win.AddLine(netID, c, line)
 		}
 	case irc.TopicChangeEvent:
@@ -1327,6 +2349,43 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 		}
 		line := app.formatEvent(ev)
 		app.win.AddLine(netID, ev.Channel, line)
+	case irc.UserAwayEvent:
+		var body ui.StyledStringBuilder
+		body.SetStyle(vaxis.Style{
+			Foreground: app.cfg.Colors.Status,
+		})
+		body.WriteString(fmt.Sprintf("%s is away: ", ev.User))
+		body.SetStyle(vaxis.Style{})
+		body.WriteStyledString(ui.IRCString(ev.Message))
+		line := ui.Line{
+			At:        ev.Time,
+			Head:      "--",
+			HeadColor: app.cfg.Colors.Status,
+			Body:      body.StyledString(),
+		}
+		if app.win.HasBuffer(netID, ev.User) {
+			app.win.AddLine(netID, ev.User, line)
+		} else {
+			// No query with them, such as for a WHOIS reply.
+			app.addStatusLine(netID, line)
+		}
+	case irc.WallopsEvent:
+		var body ui.StyledStringBuilder
+		body.SetStyle(vaxis.Style{
+			Foreground: ui.IdentColor(app.cfg.Colors.Nicks, ev.Sender, false),
+		})
+		body.WriteString(ev.Sender)
+		body.SetStyle(vaxis.Style{})
+		body.WriteString(": ")
+		body.WriteStyledString(ui.IRCString(ev.Message))
+		app.addStatusLine(netID, ui.Line{
+			At:        ev.Time,
+			Head:      "WALLOPS",
+			HeadColor: ui.ColorRed,
+			Notify:    ui.NotifyUnread,
+			Body:      body.StyledString(),
+			Readable:  true,
+		})
 	case irc.InviteEvent:
 		var buffer string
 		var notify ui.NotifyType
@@ -1355,40 +2414,69 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 			Highlight: notify == ui.NotifyHighlight,
 			Readable:  true,
 		})
+		if notify == ui.NotifyHighlight {
+			app.win.NotifyHighlight(netID, buffer, "--", body)
+			app.notifyEvent(s, "invite", ev.Channel, ev.Inviter, body)
+		}
 	case irc.MessageEvent:
+		if ev.FromServer && !ev.TargetIsChannel {
+			head := "--"
+			if ev.User != "" {
+				head = ev.User + " --"
+			}
+			app.win.AddLine(netID, "", ui.Line{
+				At:        ev.Time,
+				Head:      head,
+				HeadColor: app.cfg.Colors.Status,
+				Notify:    app.statusNotify(),
+				Body:      ui.IRCString(ev.Content).ParseURLs(),
+				Readable:  true,
+			})
+			break
+		}
+		if ev.TargetIsChannel {
+			app.addTalker(netID, ev.Target, ev.User, ev.Time)
+		}
 		buffer, line := app.formatMessage(s, ev)
 		if line.IsZero() {
 			break
 		}
-		if buffer != "" && !s.IsChannel(buffer) {
+		if buffer == servicesBuffer {
+			app.win.AddBuffer(netID, "", buffer)
+		} else if buffer != "" && !s.IsChannel(buffer) {
 			if _, added := app.win.AddBuffer(netID, "", buffer); added {
 				app.monitor[netID][buffer] = struct{}{}
 				s.MonitorAdd(buffer)
 				s.ReadGet(buffer)
-				if t, ok := msg.Time(); ok {
-					s.NewHistoryRequest(buffer).
-						WithLimit(500).
-						Before(t)
-				} else {
-					s.NewHistoryRequest(buffer).
-						WithLimit(500).
-						Latest()
-				}
+				t, _ := msg.Time()
+				app.requestInitialHistory(s, buffer, t)
 			}
 		}
-		app.win.AddLine(netID, buffer, line)
-		if line.Notify == ui.NotifyHighlight {
-			curNetID, curBuffer := app.win.CurrentBuffer()
-			current := app.win.Focused() && curNetID == netID && curBuffer == buffer
-			app.notifyHighlight(buffer, ev.User, line.Body.String(), current)
+		// Edits are not notified again.
+		edited := ev.Edits != "" && app.editLine(s, buffer, ev.Edits, line)
+		if !edited {
+			app.win.AddLine(netID, buffer, line)
+		}
+		if line.Notify == ui.NotifyHighlight && !edited {
+			app.queueHighlight(s, buffer, highlight{
+				nick:  ev.User,
+				head:  line.Head,
+				body:  line.Body.String(),
+				msgID: ev.MsgID,
+				count: 1,
+			})
+		}
+		if buffer != "" && !s.IsChannel(buffer) && !s.IsMe(ev.User) && !edited {
+			app.notifyEvent(s, "query", buffer, ev.User, line.Body.String())
 		}
 		if !s.IsChannel(msg.Params[0]) && !s.IsMe(ev.User) {
 			app.lastQuery = msg.Prefix.Name
 			app.lastQueryNet = netID
 		}
-		bounds := app.messageBounds[boundKey{netID, ev.Target}]
+		key := app.messageBoundKey(netID, buffer)
+		bounds := app.messageBounds[key]
 		bounds.Update(&line)
-		app.messageBounds[boundKey{netID, buffer}] = bounds
+		app.messageBounds[key] = bounds
 	case irc.HistoryTargetsEvent:
 		type target struct {
 			name string
@@ -1411,24 +2499,36 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 			}
 			s.MonitorAdd(target.name)
 			s.ReadGet(target.name)
-			app.win.AddBuffer(netID, "", target.name)
+			_, added := app.win.AddBuffer(netID, "", target.name)
+			if bounds, ok := app.messageBounds[app.messageBoundKey(netID, target.name)]; ok && !added {
+				// Only fetch the messages missed since the last one
+				// we have.
+				s.NewHistoryRequest(target.name).
+					WithLimit(1000).
+					After(bounds.last)
+				continue
+			}
 			// CHATHISTORY BEFORE excludes its bound, so add 1ms
 			// (precision of the time tag) to include that last message.
 			target.last = target.last.Add(1 * time.Millisecond)
-			s.NewHistoryRequest(target.name).
-				WithLimit(500).
-				Before(target.last)
+			app.requestInitialHistory(s, target.name, target.last)
 		}
 	case irc.HistoryEvent:
 		var linesBefore []ui.Line
 		var linesAfter []ui.Line
-		bounds, hasBounds := app.messageBounds[boundKey{netID, ev.Target}]
+		target := ev.Target
+		bounds, hasBounds := app.messageBounds[app.messageBoundKey(netID, ev.Target)]
 		boundsNew := bounds
 		for _, m := range ev.Messages {
 			var line ui.Line
+			var edits string
 			switch ev := m.(type) {
 			case irc.MessageEvent:
-				_, line = app.formatMessage(s, ev)
+				if ev.TargetIsChannel {
+					app.addTalker(netID, ev.Target, ev.User, ev.Time)
+				}
+				_, line = app.formatMessage(s, ev, linesBefore, linesAfter)
+				edits = ev.Edits
 			default:
 				line = app.formatEvent(ev)
 			}
@@ -1436,9 +2536,21 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 				continue
 			}
 			boundsNew.Update(&line)
+			if edits != "" {
+				// The edited message is either in this page of
+				// history, or already in the buffer.
+				if app.editHistoryLine(s, linesBefore, edits, line) ||
+					app.editHistoryLine(s, linesAfter, edits, line) ||
+					app.editLine(s, target, edits, line) {
+					continue
+				}
+			}
 			if _, ok := m.(irc.MessageEvent); !ok && !app.cfg.StatusEnabled {
 				continue
 			}
+			if !app.showStatusEvent(netID, ev.Target, m) {
+				continue
+			}
 			if hasBounds {
 				c := bounds.Compare(&line)
 				if c < 0 {
@@ -1453,9 +2565,17 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 		app.win.AddLines(netID, ev.Target, linesBefore, linesAfter)
 
 		if !boundsNew.IsZero() {
-			app.messageBounds[boundKey{netID, ev.Target}] = boundsNew
+			app.messageBounds[app.messageBoundKey(netID, ev.Target)] = boundsNew
 		}
-		if len(ev.Messages) < 10 {
+		if !ev.Backward && hasBounds && len(linesBefore) > 0 {
+			// Older messages arrived anyway, e.g. after the backlog
+			// was truncated by the server: they might not be the
+			// oldest ones.
+			b := app.messageBounds[app.messageBoundKey(netID, ev.Target)]
+			b.complete = false
+			app.messageBounds[app.messageBoundKey(netID, ev.Target)] = b
+		}
+		if ev.Backward && len(ev.Messages) < 10 {
 			// We're getting a non-full page: mark as complete to avoid indefinitely fetching the history.
 			// This should ideally be equal to the CHATHISTORY LIMIT, but it can be non advertised, or
 			// a full page could sometimes be less than a limit (because it could be filtered).
@@ -1463,21 +2583,25 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 			// the second of the message (because some bouncers have a second-level resolution).
 			// Be safe and pick 10 messages: less messages means that this was not a full page and we are done
 			// with fetching the backlog.
-			b := app.messageBounds[boundKey{netID, ev.Target}]
+			b := app.messageBounds[app.messageBoundKey(netID, ev.Target)]
 			b.complete = true
-			app.messageBounds[boundKey{netID, ev.Target}] = b
+			app.messageBounds[app.messageBoundKey(netID, ev.Target)] = b
 		}
 	case irc.SearchEvent:
-		app.win.OpenOverlay("Press Escape to close the search results")
 		lines := make([]ui.Line, 0, len(ev.Messages))
 		for _, m := range ev.Messages {
-			_, line := app.formatMessage(s, m)
+			buffer, line := app.formatMessage(s, m)
 			if line.IsZero() {
 				continue
 			}
+			line.Data = searchResult{
+				netID:  netID,
+				buffer: buffer,
+				ev:     m,
+			}
 			lines = append(lines, line)
 		}
-		app.win.AddLines("", ui.Overlay, lines, nil)
+		app.openOverlay("Press Escape to close the search results", lines)
 	case irc.ReadEvent:
 		app.win.SetRead(netID, ev.Target, ev.Timestamp)
 	case irc.BouncerNetworkEvent:
@@ -1500,10 +2624,12 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 				delete(app.sessions, ev.ID)
 				delete(app.monitor, ev.ID)
 			}
+			delete(app.seenChannels, ev.ID)
 			app.win.RemoveNetworkBuffers(ev.ID)
 		}
 	case irc.ListEvent:
 		for _, item := range ev {
+			app.seeChannel(netID, item.Channel)
 			text := fmt.Sprintf("There are %4s users on channel %s", item.Count, item.Channel)
 			if item.Topic != "" {
 				text += " -- " + item.Topic
@@ -1517,7 +2643,32 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 				}),
 			})
 		}
+	case irc.ConnectProgressEvent:
+		if !app.cfg.ConnectProgress {
+			break
+		}
+		app.addStatusLine(netID, ui.Line{
+			At:   msg.TimeOrNow(),
+			Head: "--",
+			Body: ui.PlainString(ev.Message),
+		})
+	case irc.DisconnectEvent:
+		body := fmt.Sprintf("Disconnected by the server: %s", ev.Reason)
+		if ev.Killer != "" {
+			body = fmt.Sprintf("Killed by %s: %s", ev.Killer, ev.Reason)
+		}
+		app.addStatusLine(netID, ui.Line{
+			At:        msg.TimeOrNow(),
+			Head:      "!!",
+			HeadColor: ui.ColorRed,
+			Body: ui.Styled(body, vaxis.Style{
+				Foreground: ui.ColorRed,
+			}),
+		})
 	case irc.InfoEvent:
+		if app.isHiddenNumeric(msg) {
+			return
+		}
 		var head string
 		if ev.Prefix != "" {
 			head = ev.Prefix + " --"
@@ -1533,10 +2684,31 @@ func (app *App) handleIRCEvent(netID string, ev interface{}) {
 			}),
 		})
 		return
-	case irc.ErrorEvent:
-		var head string
-		var body string
-		switch ev.Severity {
+	case irc.MotdEvent:
+		if ev.Connect && !app.cfg.Motd {
+			return
+		}
+		for _, text := range ev.Lines {
+			line := ui.Line{
+				At:        msg.TimeOrNow(),
+				Head:      "MotD --",
+				HeadColor: app.cfg.Colors.Status,
+				Body:      ui.IRCString(text),
+			}
+			if ev.Connect {
+				app.win.AddLine(netID, "", line)
+			} else {
+				app.addStatusLine(netID, line)
+			}
+		}
+		return
+	case irc.ErrorEvent:
+		if app.isHiddenNumeric(msg) {
+			return
+		}
+		var head string
+		var body string
+		switch ev.Severity {
 		case irc.SeverityNote:
 			app.addStatusLine(netID, ui.Line{
 				At:        msg.TimeOrNow(),
@@ -1604,13 +2776,76 @@ func (app *App) isHighlight(s *irc.Session, content string) bool {
 	return false
 }
 
-// notifyHighlight executes the script at "on-highlight-path" according to the given
-// message context.
-func (app *App) notifyHighlight(buffer, nick, content string, current bool) {
+// isAccountHighlight reports whether messages from the given account are
+// highlights.
+func (app *App) isAccountHighlight(s *irc.Session, account string) bool {
+	if account == "" {
+		return false
+	}
+	accountCf := s.Casemap(account)
+	for _, a := range app.cfg.HighlightAccounts {
+		if s.Casemap(a) == accountCf {
+			return true
+		}
+	}
+	return false
+}
+
+// isHiddenNumeric returns whether msg is a numeric reply that should not be
+// displayed, as set by the user configuration.
+func (app *App) isHiddenNumeric(msg irc.Message) bool {
+	if !msg.IsReply() {
+		return false
+	}
+	_, ok := app.cfg.HiddenNumerics[msg.Command]
+	return ok
+}
+
+// queueHighlight notifies the user of a highlight in the given buffer, or
+// delays the notification if another one was recently sent for that buffer.
+func (app *App) queueHighlight(s *irc.Session, buffer string, h highlight) {
+	key := app.messageBoundKey(s.NetID(), buffer)
+	run, flushIn := app.highlightsPending.add(key, s, buffer, h, time.Now())
+	if flushIn > 0 {
+		time.AfterFunc(flushIn, func() {
+			app.events <- event{
+				src:     "*",
+				content: highlightFlush(key),
+			}
+		})
+	}
+	if run {
+		app.notifyHighlight(s, buffer, h)
+	}
+}
+
+// flushHighlight sends the notification for the highlights delayed by
+// queueHighlight in the given buffer, if any.
+func (app *App) flushHighlight(key boundKey) {
+	s, buffer, h, ok := app.highlightsPending.flush(key, time.Now())
+	if ok {
+		app.notifyHighlight(s, buffer, h)
+	}
+}
+
+// notifyHighlight notifies the user of the given highlight and executes the
+// script at "on-highlight-path" according to its context.
+func (app *App) notifyHighlight(s *irc.Session, buffer string, h highlight) {
+	netID := s.NetID()
+	curNetID, curBuffer := app.win.CurrentBuffer()
+	current := app.win.Focused() && curNetID == netID && curBuffer == buffer
+
 	if !current && app.cfg.OnHighlightBeep {
 		app.win.Beep()
 	}
 
+	body := h.body
+	if h.count > 1 {
+		body = fmt.Sprintf("%s (%d highlights)", body, h.count)
+	}
+	app.win.NotifyHighlight(netID, buffer, h.head, body)
+	app.notifyEvent(s, "highlight", buffer, h.nick, h.body)
+
 	if app.cfg.Transient {
 		return
 	}
@@ -1624,13 +2859,12 @@ func (app *App) notifyHighlight(buffer, nick, content string, current bool) {
 		path = defaultHighlightPath
 	}
 
-	netID, _ := app.win.CurrentBuffer()
 	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
 		// only error out if the user specified a highlight path
 		// if default path unreachable, simple bail
 		if app.cfg.OnHighlightPath != "" {
 			body := fmt.Sprintf("Unable to find on-highlight command at path: %q", path)
-			app.addStatusLine(netID, ui.Line{
+			app.addStatusLine(curNetID, ui.Line{
 				At:        time.Now(),
 				Head:      "!!",
 				HeadColor: ui.ColorRed,
@@ -1643,23 +2877,111 @@ func (app *App) notifyHighlight(buffer, nick, content string, current bool) {
 	if current {
 		here = "1"
 	}
-	cmd := exec.Command(path)
-	cmd.Env = append(os.Environ(),
+	app.runScript(curNetID, "on-highlight", path,
 		fmt.Sprintf("BUFFER=%s", buffer),
+		fmt.Sprintf("COUNT=%d", h.count),
 		fmt.Sprintf("HERE=%s", here),
-		fmt.Sprintf("SENDER=%s", nick),
-		fmt.Sprintf("MESSAGE=%s", content),
+		fmt.Sprintf("SENDER=%s", h.nick),
+		fmt.Sprintf("MESSAGE=%s", h.body),
+		fmt.Sprintf("MSGID=%s", h.msgID),
+		fmt.Sprintf("NETWORK=%s", s.NetworkName()),
+		fmt.Sprintf("NICK=%s", s.Nick()),
+	)
+}
+
+// notifyEvent runs the on-event command for an event of the given type, if
+// enabled in the configuration.
+func (app *App) notifyEvent(s *irc.Session, typ, buffer, sender, message string) {
+	if app.cfg.Transient || app.cfg.OnEventPath == "" {
+		return
+	}
+	if _, ok := app.cfg.OnEvents[typ]; !ok {
+		return
+	}
+	if !app.eventsLimiter.Allow() {
+		return
+	}
+	app.runScript(s.NetID(), "on-event", app.cfg.OnEventPath,
+		fmt.Sprintf("EVENT=%s", typ),
+		fmt.Sprintf("BUFFER=%s", buffer),
+		fmt.Sprintf("SENDER=%s", sender),
+		fmt.Sprintf("MESSAGE=%s", message),
+		fmt.Sprintf("NETWORK=%s", s.NetworkName()),
+		fmt.Sprintf("NICK=%s", s.Nick()),
 	)
-	output, err := cmd.CombinedOutput()
+}
+
+// runScript runs the given command in the background with the given
+// environment variables, and reports failures in the status buffer of netID.
+// The command is not run if too many commands are already running, which is
+// reported in debug mode.
+func (app *App) runScript(netID, name, path string, env ...string) {
+	select {
+	case app.scriptsRunning <- struct{}{}:
+	default:
+		if app.cfg.Debug {
+			app.addStatusLine(netID, ui.Line{
+				At:        time.Now(),
+				Head:      "--",
+				HeadColor: app.cfg.Colors.Status,
+				Body:      ui.PlainSprintf("Not running the %s command: %d commands are already running", name, scriptMaxRunning),
+			})
+		}
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(), env...)
+	go func() {
+		defer func() { <-app.scriptsRunning }()
+		defer cancel()
+		output, err := scriptOutput(cmd)
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %v", scriptTimeout)
+		}
+		if err != nil {
+			body := fmt.Sprintf("Failed to invoke %s command at path: %v. Output: %q", name, err, string(output))
+			app.queueStatusLine(netID, ui.Line{
+				At:        time.Now(),
+				Head:      "!!",
+				HeadColor: ui.ColorRed,
+				Body:      ui.PlainString(body),
+			})
+		}
+	}()
+}
+
+// scriptOutput runs cmd and returns its combined output, like
+// cmd.CombinedOutput, but without waiting more than a second after it exits
+// for children of the command that keep its output open.
+func scriptOutput(cmd *exec.Cmd) ([]byte, error) {
+	r, w, err := os.Pipe()
 	if err != nil {
-		body := fmt.Sprintf("Failed to invoke on-highlight command at path: %v. Output: %q", err, string(output))
-		app.addStatusLine(netID, ui.Line{
-			At:        time.Now(),
-			Head:      "!!",
-			HeadColor: ui.ColorRed,
-			Body:      ui.PlainString(body),
-		})
+		return nil, err
 	}
+	defer r.Close()
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+	var output bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&output, r)
+		close(copied)
+	}()
+	err = cmd.Wait()
+	select {
+	case <-copied:
+	case <-time.After(time.Second):
+		// Closing the pipe interrupts the copy.
+		r.Close()
+		<-copied
+	}
+	return output.Bytes(), err
 }
 
 // typing sends typing notifications to the IRC server according to the user
@@ -1670,7 +2992,7 @@ func (app *App) typing() {
 	if s == nil || !app.cfg.Typings {
 		return
 	}
-	if buffer == "" {
+	if buffer == "" || buffer == servicesBuffer {
 		return
 	}
 	input := app.win.InputContent()
@@ -1698,11 +3020,14 @@ func (app *App) completions(cursorIdx int, text []rune) []ui.Completion {
 		cs = app.completionsChannelTopic(cs, cursorIdx, text)
 		cs = app.completionsChannelMembers(cs, cursorIdx, text)
 	}
+	cs = app.completionsChannels(cs, cursorIdx, text)
 	cs = app.completionsJoin(cs, cursorIdx, text)
 	cs = app.completionsUpload(cs, cursorIdx, text)
 	cs = app.completionsMsg(cs, cursorIdx, text)
 	cs = app.completionsCommands(cs, cursorIdx, text)
+	cs = app.completionsRaw(cs, cursorIdx, text)
 	cs = app.completionsEmoji(cs, cursorIdx, text)
+	cs = app.completionsColor(cs, cursorIdx, text)
 
 	for i := 0; i < len(cs); i++ {
 		c := &cs[i]
@@ -1729,6 +3054,18 @@ type mergedEvent struct {
 	modeSet        string
 	modeUnset      string
 	channelMode    string
+	netsplit       bool // whether the last quit was caused by a netsplit
+	netjoin        bool // whether the last join was a rejoin after a netsplit
+}
+
+// split reports whether the user left because of a netsplit.
+func (f *mergedEvent) split() bool {
+	return f.firstConnected == -1 && f.lastConnected == -1 && f.netsplit
+}
+
+// rejoined reports whether the user joined back after a netsplit.
+func (f *mergedEvent) rejoined() bool {
+	return f.firstConnected == 1 && f.lastConnected == 1 && f.netjoin
 }
 
 // formatEvent returns a formatted ui.Line for an irc.Event.
@@ -1749,11 +3086,15 @@ func (app *App) formatEvent(ev irc.Event) ui.Line {
 			Head:      "--",
 			HeadColor: app.cfg.Colors.Status,
 			Body:      body.StyledString(),
+			Notify:    app.statusNotify(),
 			Mergeable: true,
 			Data:      []irc.Event{ev},
 			Readable:  true,
 		}
 	case irc.UserJoinEvent:
+		if app.cfg.Joins == JoinVerbosityCompact || ev.Netjoin {
+			return app.formatJoinSummary(ev, ev.Time, 1, 0)
+		}
 		var body ui.StyledStringBuilder
 		body.Grow(len(ev.User) + 1)
 		body.SetStyle(vaxis.Style{
@@ -1769,11 +3110,15 @@ func (app *App) formatEvent(ev irc.Event) ui.Line {
 			Head:      "--",
 			HeadColor: app.cfg.Colors.Status,
 			Body:      body.StyledString(),
+			Notify:    app.statusNotify(),
 			Mergeable: true,
 			Data:      []irc.Event{ev},
 			Readable:  true,
 		}
 	case irc.UserPartEvent:
+		if app.cfg.Joins == JoinVerbosityCompact {
+			return app.formatJoinSummary(ev, ev.Time, 0, 1)
+		}
 		var body ui.StyledStringBuilder
 		body.Grow(len(ev.User) + 1)
 		body.SetStyle(vaxis.Style{
@@ -1789,11 +3134,15 @@ func (app *App) formatEvent(ev irc.Event) ui.Line {
 			Head:      "--",
 			HeadColor: app.cfg.Colors.Status,
 			Body:      body.StyledString(),
+			Notify:    app.statusNotify(),
 			Mergeable: true,
 			Data:      []irc.Event{ev},
 			Readable:  true,
 		}
 	case irc.UserQuitEvent:
+		if app.cfg.Joins == JoinVerbosityCompact || ev.Netsplit {
+			return app.formatJoinSummary(ev, ev.Time, 0, 1)
+		}
 		var body ui.StyledStringBuilder
 		body.Grow(len(ev.User) + 1)
 		body.SetStyle(vaxis.Style{
@@ -1809,6 +3158,7 @@ func (app *App) formatEvent(ev irc.Event) ui.Line {
 			Head:      "--",
 			HeadColor: app.cfg.Colors.Status,
 			Body:      body.StyledString(),
+			Notify:    app.statusNotify(),
 			Mergeable: true,
 			Data:      []irc.Event{ev},
 			Readable:  true,
@@ -1836,6 +3186,7 @@ func (app *App) formatEvent(ev irc.Event) ui.Line {
 			Body: ui.Styled(body, vaxis.Style{
 				Foreground: app.cfg.Colors.Status,
 			}),
+			Notify:    app.statusNotify(),
 			Mergeable: true,
 			Data:      []irc.Event{ev},
 			Readable:  true,
@@ -1900,15 +3251,151 @@ func (app *App) formatEvent(ev irc.Event) ui.Line {
 	}
 }
 
+// writeReplyContext writes a short quoted preview of the message replied to,
+// if it can be found in the buffer or in the lines of batch.
+func (app *App) writeReplyContext(body *ui.StyledStringBuilder, s *irc.Session, buffer string, replyTo string, batch [][]ui.Line) {
+	if replyTo == "" {
+		return
+	}
+	parent, ok := app.win.LineByID(s.NetID(), buffer, replyTo)
+	for _, lines := range batch {
+		if ok {
+			break
+		}
+		parent, ok = lineByID(lines, replyTo)
+	}
+	if !ok {
+		return
+	}
+	ev, ok := parent.Data.(irc.MessageEvent)
+	if !ok {
+		return
+	}
+	content := strings.TrimSuffix(ev.Content, "\x01")
+	content = strings.TrimPrefix(content, "\x01ACTION ")
+	// The context is shown on a single row, even for multiline messages.
+	text := []rune(strings.ReplaceAll(ui.IRCString(content).String(), "\n", " "))
+	if len(text) > 40 {
+		text = append(text[:39], '…')
+	}
+	body.SetStyle(vaxis.Style{
+		Foreground: app.cfg.Colors.Status,
+	})
+	body.WriteString("↪ ")
+	body.WriteString(ev.User)
+	body.WriteString(": ")
+	body.WriteString(string(text))
+	body.WriteString(" ")
+	body.SetStyle(vaxis.Style{})
+}
+
+// lineByID returns the line of lines with the given message ID.
+func lineByID(lines []ui.Line, id string) (ui.Line, bool) {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if lines[i].HasID(id) {
+			return lines[i], true
+		}
+	}
+	return ui.Line{}, false
+}
+
+// editLine replaces the line of the message with the given ID by line, its new
+// version, and reports whether it was found.
+func (app *App) editLine(s *irc.Session, buffer, id string, line ui.Line) bool {
+	former, ok := app.win.LineByID(s.NetID(), buffer, id)
+	if !ok {
+		return false
+	}
+	line, ok = app.editedLine(s, former, line)
+	if !ok {
+		return false
+	}
+	return app.win.ReplaceLine(s.NetID(), buffer, id, line)
+}
+
+// editHistoryLine replaces the line of lines with the message ID id by line,
+// its new version, keeping its time, and reports whether it was found.
+func (app *App) editHistoryLine(s *irc.Session, lines []ui.Line, id string, line ui.Line) bool {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if !lines[i].HasID(id) {
+			continue
+		}
+		edited, ok := app.editedLine(s, lines[i], line)
+		if !ok {
+			return false
+		}
+		edited.At = lines[i].At
+		lines[i] = edited
+		return true
+	}
+	return false
+}
+
+// editedLine returns line, the new version of the message of former, as it
+// replaces former. It returns false if line is not from the same sender.
+func (app *App) editedLine(s *irc.Session, former, line ui.Line) (ui.Line, bool) {
+	formerEv, ok := former.Data.(irc.MessageEvent)
+	if !ok || s.Casemap(formerEv.User) != s.Casemap(line.Data.(irc.MessageEvent).User) {
+		return line, false
+	}
+	if app.cfg.EditedMarker {
+		var body ui.StyledStringBuilder
+		body.WriteStyledString(line.Body)
+		body.SetStyle(vaxis.Style{
+			Foreground: app.cfg.Colors.Status,
+		})
+		body.WriteString(" (edited)")
+		line.Body = body.StyledString()
+	}
+	// Keep the original ID, which replies and later edits refer to, but
+	// also resolve the ID of this edit to the line.
+	aliases := append([]string(nil), former.Aliases...)
+	if line.ID != "" {
+		aliases = append(aliases, line.ID)
+	}
+	line.ID = former.ID
+	line.Aliases = aliases
+	return line, true
+}
+
+// servicesBuffer is the name of the buffer where messages from and to services
+// are shown, with the services-buffer option. It is not a valid nickname.
+const servicesBuffer = "*services"
+
+// isService reports whether nick is one of the configured services, with the
+// casemapping of s. Users flagged as services in WHOIS replies are not
+// detected, because servers do not agree on how to flag them.
+func (app *App) isService(s *irc.Session, nick string) bool {
+	nickCf := s.Casemap(nick)
+	for _, service := range app.cfg.Services {
+		if s.Casemap(service) == nickCf {
+			return true
+		}
+	}
+	return false
+}
+
+// noticeBuffer returns the buffer of a notice that is not sent to a channel, of
+// the network netID, given the current buffer. Notices from services are
+// always shown in the server buffer, so that they can be found later.
+func noticeBuffer(routing NoticeRouting, netID, curNetID, curBuffer string, fromService bool) string {
+	if routing == NoticeRoutingCurrent && !fromService && curNetID == netID {
+		return curBuffer
+	}
+	return ""
+}
+
 // formatMessage sets how a given message must be formatted.
 //
 // It computes three things:
 // - which buffer the message must be added to,
 // - the UI line.
-func (app *App) formatMessage(s *irc.Session, ev irc.MessageEvent) (buffer string, line ui.Line) {
+//
+// batch are the lines of the history batch being added, if any, where the
+// message replied to is also looked up.
+func (app *App) formatMessage(s *irc.Session, ev irc.MessageEvent, batch ...[]ui.Line) (buffer string, line ui.Line) {
 	isFromSelf := s.IsMe(ev.User)
 	isToSelf := s.IsMe(ev.Target)
-	isHighlight := ev.TargetIsChannel && app.isHighlight(s, ev.Content)
 	isQuery := !ev.TargetIsChannel && ev.Command == "PRIVMSG"
 	isNotice := ev.Command == "NOTICE"
 
@@ -1916,8 +3403,8 @@ func (app *App) formatMessage(s *irc.Session, ev irc.MessageEvent) (buffer strin
 	content = strings.TrimRightFunc(content, unicode.IsSpace)
 
 	isAction := false
-	if strings.HasPrefix(ev.Content, "\x01") {
-		parts := strings.SplitN(ev.Content[1:], " ", 2)
+	if strings.HasPrefix(content, "\x01") {
+		parts := strings.SplitN(content[1:], " ", 2)
 		if len(parts) < 2 {
 			return
 		}
@@ -1930,11 +3417,15 @@ func (app *App) formatMessage(s *irc.Session, ev irc.MessageEvent) (buffer strin
 		content = parts[1]
 	}
 
-	if !ev.TargetIsChannel && (isNotice || ev.User == s.BouncerService()) {
+	// Match highlights against the text as shown, without the CTCP wrapper
+	// and formatting codes.
+	isHighlight := ev.TargetIsChannel && (app.isHighlight(s, ui.IRCString(content).String()) || app.isAccountHighlight(s, ev.Account))
+
+	if app.cfg.ServicesBuffer && !ev.TargetIsChannel && (app.isService(s, ev.User) || isFromSelf && app.isService(s, ev.Target)) {
+		buffer = servicesBuffer
+	} else if !ev.TargetIsChannel && (isNotice || ev.User == s.BouncerService()) {
 		curNetID, curBuffer := app.win.CurrentBuffer()
-		if curNetID == s.NetID() {
-			buffer = curBuffer
-		}
+		buffer = noticeBuffer(app.cfg.Notices, s.NetID(), curNetID, curBuffer, app.isService(s, ev.User))
 	} else if isToSelf {
 		buffer = ev.User
 	} else {
@@ -1968,27 +3459,33 @@ func (app *App) formatMessage(s *irc.Session, ev irc.MessageEvent) (buffer strin
 			}
 		}
 
-		headColor = ui.IdentColor(app.cfg.Colors.Nicks, head, isFromSelf)
+		headColor = ui.NickColor(app.cfg.Colors.Nicks, head, ev.Account, isFromSelf)
 	}
 
 	var body ui.StyledStringBuilder
+	var authorLen int
 	if isNotice {
-		color := ui.IdentColor(app.cfg.Colors.Nicks, ev.User, isFromSelf)
+		color := ui.NickColor(app.cfg.Colors.Nicks, ev.User, ev.Account, isFromSelf)
 		body.SetStyle(vaxis.Style{
 			Foreground: color,
 		})
 		body.WriteString(ev.User)
 		body.SetStyle(vaxis.Style{})
 		body.WriteString(": ")
+		app.writeReplyContext(&body, s, buffer, ev.ReplyTo, batch)
 		body.WriteStyledString(ui.IRCString(content))
 	} else if isAction {
-		color := ui.IdentColor(app.cfg.Colors.Nicks, ev.User, isFromSelf)
+		color := ui.NickColor(app.cfg.Colors.Nicks, ev.User, ev.Account, isFromSelf)
 		body.SetStyle(vaxis.Style{
 			Foreground: color,
 		})
 		body.WriteString(ev.User)
 		body.SetStyle(vaxis.Style{})
 		body.WriteString(" ")
+		app.writeReplyContext(&body, s, buffer, ev.ReplyTo, batch)
+		body.SetStyle(vaxis.Style{
+			Foreground: app.cfg.Colors.Action,
+		})
 		body.WriteStyledString(ui.IRCString(content))
 	} else {
 		body.SetStyle(vaxis.Style{Foreground: headColor})
@@ -2002,6 +3499,8 @@ func (app *App) formatMessage(s *irc.Session, ev irc.MessageEvent) (buffer strin
 		body.WriteString(">")
 		body.SetStyle(vaxis.Style{})
 		body.WriteString(" ")
+		authorLen = body.Len()
+		app.writeReplyContext(&body, s, buffer, ev.ReplyTo, batch)
 		body.WriteStyledString(ui.IRCString(content))
 	}
 
@@ -2013,12 +3512,19 @@ func (app *App) formatMessage(s *irc.Session, ev irc.MessageEvent) (buffer strin
 		Body:      body.StyledString(),
 		Highlight: hlLine,
 		Readable:  true,
+		Data:      ev,
+		ID:        ev.MsgID,
+	}
+	if authorLen > 0 {
+		line.Author = ev.User
+		line.AuthorLen = authorLen
 	}
 	return
 }
 
-func (app *App) mergeLine(former *ui.Line, addition ui.Line) {
-	events := append(former.Data.([]irc.Event), addition.Data.([]irc.Event)...)
+// mergeEvents folds a list of status events into one flow per user (plus
+// channel mode changes), keeping only their overall effect.
+func mergeEvents(events []irc.Event) []*mergedEvent {
 	flows := make([]*mergedEvent, 0, len(events))
 	flowNick := func(nick string) *mergedEvent {
 		nickCf := strings.ToLower(nick)
@@ -2062,11 +3568,13 @@ func (app *App) mergeLine(former *ui.Line, addition ui.Line) {
 				f.lastConnected = 1
 				f.modeSet = ""
 				f.modeUnset = ""
+				f.netjoin = ev.Netjoin
 			} else {
 				flows = append(flows, &mergedEvent{
 					nick:           ev.User,
 					firstConnected: 1,
 					lastConnected:  1,
+					netjoin:        ev.Netjoin,
 				})
 			}
 		case irc.UserPartEvent:
@@ -2094,11 +3602,13 @@ func (app *App) mergeLine(former *ui.Line, addition ui.Line) {
 				f.lastConnected = -1
 				f.modeSet = ""
 				f.modeUnset = ""
+				f.netsplit = ev.Netsplit
 			} else {
 				flows = append(flows, &mergedEvent{
 					nick:           ev.User,
 					firstConnected: -1,
 					lastConnected:  -1,
+					netsplit:       ev.Netsplit,
 				})
 			}
 		case irc.ModeChangeEvent:
@@ -2145,11 +3655,34 @@ func (app *App) mergeLine(former *ui.Line, addition ui.Line) {
 			}
 		}
 	}
+	return flows
+}
+
+func (app *App) mergeLine(former *ui.Line, addition ui.Line) {
+	events := append(former.Data.([]irc.Event), addition.Data.([]irc.Event)...)
+	flows := mergeEvents(events)
 
 	newBody := new(ui.StyledStringBuilder)
 	newBody.Grow(128)
 	first := true
+	if splits, rejoins := netsplitSummary(flows); splits != 0 || rejoins != 0 {
+		first = false
+		app.writeNetsplitSummary(newBody, splits, rejoins)
+	}
+	if app.cfg.Joins == JoinVerbosityCompact {
+		joins, parts := joinSummary(flows)
+		if joins != 0 || parts != 0 {
+			first = false
+			app.writeJoinSummary(newBody, joins, parts)
+		}
+	}
 	for _, f := range flows {
+		if f.split() || f.rejoined() {
+			continue
+		}
+		if app.cfg.Joins == JoinVerbosityCompact && f.firstConnected != 0 {
+			continue
+		}
 		l := app.formatEvent(f)
 		if l.IsZero() {
 			continue
@@ -2165,6 +3698,213 @@ func (app *App) mergeLine(former *ui.Line, addition ui.Line) {
 	former.Data = events
 }
 
+// joinSummary returns the number of users who joined and left in total,
+// ignoring users who joined then left or left then joined, and netsplits.
+func joinSummary(flows []*mergedEvent) (joins, parts int) {
+	for _, f := range flows {
+		if f.firstConnected == 0 || f.firstConnected != f.lastConnected {
+			continue
+		}
+		if f.split() || f.rejoined() {
+			continue
+		}
+		if f.firstConnected == 1 {
+			joins++
+		} else {
+			parts++
+		}
+	}
+	return joins, parts
+}
+
+// writeJoinSummary writes a "+3/-1" summary of joins and parts.
+func (app *App) writeJoinSummary(body *ui.StyledStringBuilder, joins, parts int) {
+	if joins != 0 {
+		body.SetStyle(vaxis.Style{
+			Foreground: vaxis.IndexColor(2),
+		})
+		fmt.Fprintf(body, "+%d", joins)
+	}
+	if joins != 0 && parts != 0 {
+		body.SetStyle(vaxis.Style{
+			Foreground: app.cfg.Colors.Status,
+		})
+		body.WriteByte('/')
+	}
+	if parts != 0 {
+		body.SetStyle(vaxis.Style{
+			Foreground: ui.ColorRed,
+		})
+		fmt.Fprintf(body, "-%d", parts)
+	}
+}
+
+// netsplitSummary returns the number of users who left because of a netsplit,
+// and who joined back after one.
+func netsplitSummary(flows []*mergedEvent) (splits, rejoins int) {
+	for _, f := range flows {
+		if f.split() {
+			splits++
+		} else if f.rejoined() {
+			rejoins++
+		}
+	}
+	return splits, rejoins
+}
+
+// writeNetsplitSummary writes a "netsplit: 3 users" summary of netsplits.
+func (app *App) writeNetsplitSummary(body *ui.StyledStringBuilder, splits, rejoins int) {
+	users := func(n int) string {
+		if n == 1 {
+			return "1 user"
+		}
+		return fmt.Sprintf("%d users", n)
+	}
+	if splits != 0 {
+		body.SetStyle(vaxis.Style{
+			Foreground: ui.ColorRed,
+		})
+		body.WriteString("netsplit: ")
+		body.WriteString(users(splits))
+	}
+	if splits != 0 && rejoins != 0 {
+		body.WriteString("  ")
+	}
+	if rejoins != 0 {
+		body.SetStyle(vaxis.Style{
+			Foreground: vaxis.IndexColor(2),
+		})
+		body.WriteString("netjoin: ")
+		body.WriteString(users(rejoins))
+	}
+}
+
+// statusNotify returns the notification type of status event lines, such as
+// joins and parts.
+func (app *App) statusNotify() ui.NotifyType {
+	if !app.cfg.StatusActivity {
+		return ui.NotifyNone
+	}
+	return ui.NotifyStatus
+}
+
+// formatJoinSummary returns the line of a single join, part or quit event
+// with the compact joins verbosity, or caused by a netsplit.
+func (app *App) formatJoinSummary(ev irc.Event, t time.Time, joins, parts int) ui.Line {
+	var body ui.StyledStringBuilder
+	switch ev := ev.(type) {
+	case irc.UserJoinEvent:
+		if ev.Netjoin {
+			app.writeNetsplitSummary(&body, 0, 1)
+		}
+	case irc.UserQuitEvent:
+		if ev.Netsplit {
+			app.writeNetsplitSummary(&body, 1, 0)
+		}
+	}
+	if body.Len() == 0 {
+		app.writeJoinSummary(&body, joins, parts)
+	}
+	return ui.Line{
+		At:        t,
+		Head:      "--",
+		HeadColor: app.cfg.Colors.Status,
+		Body:      body.StyledString(),
+		Notify:    app.statusNotify(),
+		Mergeable: true,
+		Data:      []irc.Event{ev},
+		Readable:  true,
+	}
+}
+
+// joinVisible reports whether a join, part or quit of a user must be shown
+// at the given time, given the time of their last message in the channel.
+func joinVisible(verbosity JoinVerbosity, lastMessage, t time.Time) bool {
+	switch verbosity {
+	case JoinVerbosityOff:
+		return false
+	case JoinVerbositySmart:
+		return !lastMessage.IsZero() && t.Sub(lastMessage) < smartJoinDelay
+	default:
+		return true
+	}
+}
+
+// showJoin reports whether a join, part or quit of a user must be shown in
+// a channel.
+func (app *App) showJoin(netID, channel, nick string, t time.Time) bool {
+	talkers := app.talkers[app.messageBoundKey(netID, channel)]
+	return joinVisible(app.cfg.Joins, talkers[app.casemap(netID, nick)], t)
+}
+
+// showStatusEvent reports whether a status event of a channel must be shown.
+func (app *App) showStatusEvent(netID, channel string, ev irc.Event) bool {
+	switch ev := ev.(type) {
+	case irc.UserJoinEvent:
+		return app.showJoin(netID, channel, ev.User, ev.Time)
+	case irc.UserPartEvent:
+		return app.showJoin(netID, channel, ev.User, ev.Time)
+	case irc.UserQuitEvent:
+		return app.showJoin(netID, channel, ev.User, ev.Time)
+	default:
+		return true
+	}
+}
+
+// addTalker records that a user sent a message to a channel, for the smart
+// joins verbosity and nick completions. Only the maxTalkers users who spoke
+// last are remembered.
+func (app *App) addTalker(netID, channel, nick string, t time.Time) {
+	k := app.messageBoundKey(netID, channel)
+	talkers, ok := app.talkers[k]
+	if !ok {
+		talkers = make(map[string]time.Time)
+		app.talkers[k] = talkers
+	}
+	nickCf := app.casemap(netID, nick)
+	if talkers[nickCf].Before(t) {
+		talkers[nickCf] = t
+	}
+	for len(talkers) > maxTalkers {
+		var oldest string
+		for nickCf, last := range talkers {
+			if oldest == "" || last.Before(talkers[oldest]) {
+				oldest = nickCf
+			}
+		}
+		delete(talkers, oldest)
+	}
+}
+
+// sessionStateType is the state of the connection to a network, as shown in
+// the prompt.
+type sessionStateType int
+
+const (
+	stateOffline sessionStateType = iota
+	stateConnecting
+	stateRegistered
+	stateAway
+	stateAuthFailed
+)
+
+// sessionState returns the state of the connection of s, which is nil when
+// disconnected.
+func sessionState(s *irc.Session) sessionStateType {
+	switch {
+	case s == nil:
+		return stateOffline
+	case !s.Registered():
+		return stateConnecting
+	case s.AuthFailed():
+		return stateAuthFailed
+	case s.IsAway():
+		return stateAway
+	default:
+		return stateRegistered
+	}
+}
+
 // updatePrompt changes the prompt text according to the application context.
 func (app *App) updatePrompt() {
 	netID, buffer := app.win.CurrentBuffer()
@@ -2176,17 +3916,82 @@ func (app *App) updatePrompt() {
 			Foreground: app.cfg.Colors.Prompt,
 		},
 		)
-	} else if s == nil {
-		prompt = ui.Styled("<offline>", vaxis.Style{
-			Foreground: ui.ColorRed,
-		},
-		)
 	} else {
-		prompt = ui.IdentString(app.cfg.Colors.Nicks, s.Nick(), true)
+		switch state := sessionState(s); state {
+		case stateOffline:
+			prompt = ui.Styled("<offline>", vaxis.Style{
+				Foreground: ui.ColorRed,
+			})
+		case stateConnecting:
+			prompt = ui.Styled("<connecting>", vaxis.Style{
+				Foreground: ui.ColorYellow,
+			})
+		default:
+			prompt = formatPrompt(app.cfg.PromptFormat, s.Nick(), buffer, s.IsAway(), app.cfg.Colors)
+			switch state {
+			case stateAway:
+				prompt = prompt.MapStyles(func(st vaxis.Style) vaxis.Style {
+					st.Attribute |= vaxis.AttrDim
+					return st
+				})
+			case stateAuthFailed:
+				// Marked in red, since we are not logged in as
+				// expected.
+				var sb ui.StyledStringBuilder
+				sb.SetStyle(vaxis.Style{
+					Foreground: ui.ColorRed,
+				})
+				sb.WriteString("!")
+				sb.WriteStyledString(prompt.MapStyles(func(st vaxis.Style) vaxis.Style {
+					st.Foreground = ui.ColorRed
+					return st
+				}))
+				prompt = sb.StyledString()
+			}
+		}
 	}
 	app.win.SetPrompt(prompt)
 }
 
+// formatPrompt replaces the placeholders of the prompt format: {nick},
+// {buffer} and {away}. Unknown placeholders are kept as is.
+func formatPrompt(format, nick, buffer string, away bool, colors ui.ConfigColors) ui.StyledString {
+	var sb ui.StyledStringBuilder
+	st := vaxis.Style{
+		Foreground: colors.Prompt,
+	}
+	sb.SetStyle(st)
+	for len(format) > 0 {
+		i := strings.IndexByte(format, '{')
+		if i < 0 {
+			sb.WriteString(format)
+			break
+		}
+		sb.WriteString(format[:i])
+		format = format[i:]
+		j := strings.IndexByte(format, '}')
+		if j < 0 {
+			sb.WriteString(format)
+			break
+		}
+		switch format[:j+1] {
+		case "{nick}":
+			sb.WriteStyledString(ui.IdentString(colors.Nicks, nick, true))
+			sb.SetStyle(st)
+		case "{buffer}":
+			sb.WriteString(buffer)
+		case "{away}":
+			if away {
+				sb.WriteString("away")
+			}
+		default:
+			sb.WriteString(format[:j+1])
+		}
+		format = format[j+1:]
+	}
+	return sb.StyledString()
+}
+
 func (app *App) printTopic(netID, buffer string) (ok bool) {
 	var body string
 	s := app.sessions[netID]
@@ -0,0 +1,907 @@
+package senpai
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sr.ht/~rockorager/vaxis"
+	"golang.org/x/time/rate"
+
+	"git.sr.ht/~delthas/senpai/irc"
+	"git.sr.ht/~delthas/senpai/ui"
+)
+
+// newTestSession returns a session with the nick senpai, and the channel of
+// the messages it sends. The session is closed at the end of the test.
+func newTestSession(t *testing.T) (*irc.Session, chan irc.Message) {
+	out := make(chan irc.Message, 128)
+	s := irc.NewSession(out, irc.SessionParams{
+		Nickname: "senpai",
+		Username: "senpai",
+		RealName: "senpai",
+	})
+	t.Cleanup(s.Close)
+	return s, out
+}
+
+// handle makes s handle the given raw messages, in order.
+func handle(t *testing.T, s *irc.Session, raws ...string) {
+	for _, raw := range raws {
+		msg, err := irc.ParseMessage(raw)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", raw, err)
+		}
+		if _, err := s.HandleMessage(msg); err != nil {
+			t.Fatalf("failed to handle %q: %v", raw, err)
+		}
+	}
+}
+
+func TestJoinVisible(t *testing.T) {
+	now := time.Now()
+	recent := now.Add(-time.Minute)
+	old := now.Add(-time.Hour)
+
+	tests := []struct {
+		verbosity   JoinVerbosity
+		lastMessage time.Time
+		expected    bool
+	}{
+		{JoinVerbosityFull, time.Time{}, true},
+		{JoinVerbosityFull, old, true},
+		{JoinVerbositySmart, time.Time{}, false},
+		{JoinVerbositySmart, old, false},
+		{JoinVerbositySmart, recent, true},
+		{JoinVerbosityCompact, time.Time{}, true},
+		{JoinVerbosityCompact, recent, true},
+		{JoinVerbosityOff, time.Time{}, false},
+		{JoinVerbosityOff, recent, false},
+	}
+	for _, test := range tests {
+		if v := joinVisible(test.verbosity, test.lastMessage, now); v != test.expected {
+			t.Errorf("verbosity %d, last message %v: expected %v, got %v", test.verbosity, test.lastMessage, test.expected, v)
+		}
+	}
+}
+
+func TestJoinSummary(t *testing.T) {
+	events := []irc.Event{
+		irc.UserJoinEvent{User: "alice", Channel: "#senpai"},
+		irc.UserJoinEvent{User: "bob", Channel: "#senpai"},
+		irc.UserPartEvent{User: "carol", Channel: "#senpai"},
+		irc.UserJoinEvent{User: "dave", Channel: "#senpai"},
+		irc.UserQuitEvent{User: "dave", Channels: []string{"#senpai"}},
+		irc.UserQuitEvent{User: "eve", Channels: []string{"#senpai"}},
+		irc.UserJoinEvent{User: "eve", Channel: "#senpai"},
+		irc.UserNickEvent{User: "bobby", FormerNick: "bob"},
+		irc.UserJoinEvent{User: "frank", Channel: "#senpai"},
+		irc.ModeChangeEvent{Channel: "#senpai", Mode: "+o frank"},
+	}
+	joins, parts := joinSummary(mergeEvents(events))
+	if joins != 3 || parts != 1 {
+		t.Errorf("expected +3/-1, got +%d/-%d", joins, parts)
+	}
+}
+
+func TestNetsplitSummary(t *testing.T) {
+	events := []irc.Event{
+		irc.UserQuitEvent{User: "alice", Netsplit: true},
+		irc.UserQuitEvent{User: "bob", Netsplit: true},
+		irc.UserQuitEvent{User: "carol", Netsplit: true},
+		irc.UserQuitEvent{User: "dave"},
+		irc.UserJoinEvent{User: "carol", Channel: "#senpai", Netjoin: true},
+		irc.UserJoinEvent{User: "eve", Channel: "#senpai", Netjoin: true},
+	}
+	flows := mergeEvents(events)
+	splits, rejoins := netsplitSummary(flows)
+	if splits != 2 || rejoins != 1 {
+		t.Errorf("expected 2 splits and 1 rejoin, got %d and %d", splits, rejoins)
+	}
+	joins, parts := joinSummary(flows)
+	if joins != 0 || parts != 1 {
+		t.Errorf("expected +0/-1 without netsplits, got +%d/-%d", joins, parts)
+	}
+}
+
+func TestFormatPrompt(t *testing.T) {
+	tests := []struct {
+		format   string
+		away     bool
+		expected string
+	}{
+		{"{nick}", false, "senpai"},
+		{"[{nick}]", false, "[senpai]"},
+		{"{buffer}>", false, "#kouhai>"},
+		{"{nick}{away}", true, "senpaiaway"},
+		{"{nick}{away}", false, "senpai"},
+		{"{unknown} {nick", false, "{unknown} {nick"},
+	}
+	for _, test := range tests {
+		prompt := formatPrompt(test.format, "senpai", "#kouhai", test.away, ui.ConfigColors{})
+		if prompt.String() != test.expected {
+			t.Errorf("format %q: expected %q, got %q", test.format, test.expected, prompt.String())
+		}
+	}
+}
+
+func TestAddTalker(t *testing.T) {
+	app := &App{
+		sessions: map[string]*irc.Session{},
+		talkers:  map[boundKey]map[string]time.Time{},
+	}
+	app.cfg.Joins = JoinVerbositySmart
+	now := time.Now()
+	app.addTalker("", "#Senpai[]", "Carol", now.Add(-smartJoinDelay))
+	app.addTalker("", "#senpai{}", "Dave{}", now)
+	talkers := app.talkers[app.messageBoundKey("", "#SENPAI{}")]
+	if len(talkers) != 2 || !talkers["dave{}"].Equal(now) {
+		t.Errorf("expected both talkers in the casemapped channel, got %v", talkers)
+	}
+	if !app.showJoin("", "#senpai[]", "DAVE[]", now) {
+		t.Errorf("expected the join of a recent talker to be shown")
+	}
+	if app.showJoin("", "#senpai[]", "carol", now) {
+		t.Errorf("expected the join of an old talker to be hidden")
+	}
+
+	// Completions still rank the old talker before the users who never spoke.
+	nicks := []string{"alice", "carol", "dave{}"}
+	rankNicks(nicks, talkers, irc.CasemapRFC1459)
+	if nicks[0] != "dave{}" || nicks[1] != "carol" || nicks[2] != "alice" {
+		t.Errorf("expected the talkers ranked by recency, got %v", nicks)
+	}
+
+	for i := 0; i < maxTalkers; i++ {
+		app.addTalker("", "#senpai[]", fmt.Sprintf("user%d", i), now.Add(time.Duration(i)*time.Second))
+	}
+	talkers = app.talkers[app.messageBoundKey("", "#senpai[]")]
+	if len(talkers) != maxTalkers {
+		t.Errorf("expected %d talkers, got %d", maxTalkers, len(talkers))
+	}
+	if _, ok := talkers["carol"]; ok {
+		t.Errorf("expected the oldest talker to be forgotten")
+	}
+}
+
+func TestRankNicks(t *testing.T) {
+	now := time.Now()
+	talkers := map[string]time.Time{
+		"carol": now.Add(-time.Hour),
+		"dave":  now.Add(-time.Minute),
+	}
+	nicks := []string{"Eve", "carol", "bob", "Dave", "alice"}
+	rankNicks(nicks, talkers, irc.CasemapRFC1459)
+	expected := []string{"Dave", "carol", "alice", "bob", "Eve"}
+	for i := range expected {
+		if nicks[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, nicks)
+		}
+	}
+}
+
+func TestReplaceWord(t *testing.T) {
+	text := []rune("/join #sen other")
+	start, word := wordBeforeCursor(10, text)
+	if start != 6 || string(word) != "#sen" {
+		t.Fatalf("expected the word %q at 6, got %q at %d", "#sen", string(word), start)
+	}
+	c := replaceWord(text, start, 10, []rune("#senpai "))
+	if string(c.Text) != "/join #senpai  other" || c.CursorIdx != 14 {
+		t.Errorf("expected the word to be replaced, got %q with the cursor at %d", string(c.Text), c.CursorIdx)
+	}
+}
+
+func TestAddSeenChannel(t *testing.T) {
+	seen := make(map[string]string)
+	for i := 0; i < maxSeenChannels+10; i++ {
+		addSeenChannel(seen, fmt.Sprintf("#%d", i))
+	}
+	if len(seen) != maxSeenChannels {
+		t.Errorf("expected %d seen channels, got %d", maxSeenChannels, len(seen))
+	}
+	addSeenChannel(seen, "#Senpai")
+	addSeenChannel(seen, "#senpai")
+	if seen["#senpai"] != "#senpai" || len(seen) != maxSeenChannels {
+		t.Errorf("expected a seen channel to be updated in place")
+	}
+}
+
+func TestRunScriptBackgroundChild(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "script")
+	// The child keeps the output of the script open after it exits, for
+	// longer than the test waits, but not so long that it lingers.
+	if err := os.WriteFile(path, []byte("#!/bin/sh\nsleep 3 &\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	app := &App{
+		events:         make(chan event, eventChanSize),
+		scriptsRunning: make(chan struct{}, scriptMaxRunning),
+	}
+	app.runScript("", "on-event", path)
+	select {
+	case ev := <-app.events:
+		if _, ok := ev.content.(statusLine); !ok {
+			t.Errorf("expected the failure to be reported, got %#v", ev.content)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the script not to wait for its child")
+	}
+}
+
+func TestNotifyEvent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "script")
+	out := filepath.Join(dir, "out")
+	script := "#!/bin/sh\nprintf '%s|%s|%s|%s|%s\\n' \"$EVENT\" \"$BUFFER\" \"$SENDER\" \"$MESSAGE\" \"$NICK\" >> " + out + "\n"
+	if err := os.WriteFile(path, []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestSession(t)
+	app := &App{
+		events:         make(chan event, eventChanSize),
+		scriptsRunning: make(chan struct{}, scriptMaxRunning),
+		eventsLimiter:  rate.NewLimiter(rate.Every(time.Second), 5),
+	}
+	app.cfg.OnEventPath = path
+	app.cfg.OnEvents = map[string]struct{}{"message": {}}
+
+	app.notifyEvent(s, "join", "#senpai", "alice", "")
+	app.notifyEvent(s, "message", "#senpai", "alice", "hello world")
+	deadline := time.Now().Add(5 * time.Second)
+	for len(app.scriptsRunning) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the command to exit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	buf, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "message|#senpai|alice|hello world|senpai\n"; string(buf) != expected {
+		t.Errorf("expected only the enabled event to run the command with %q, got %q", expected, string(buf))
+	}
+}
+
+func TestDebugOutputReconnect(t *testing.T) {
+	app := &App{
+		events: make(chan event, eventChanSize),
+	}
+	go func() {
+		for range app.events {
+		}
+	}()
+	defer close(app.events)
+
+	out := make(chan irc.Message, 16)
+	debugOut := make(chan irc.Message, cap(out))
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		app.debugOutput("n", debugOut, out, done)
+		close(exited)
+	}()
+	s := irc.NewSession(debugOut, irc.SessionParams{
+		Nickname: "senpai",
+		Username: "senpai",
+		RealName: "senpai",
+	})
+	<-out
+	// The connection is lost: nothing reads out anymore, but the session
+	// keeps sending until the disconnect is handled.
+	close(done)
+	for j := 0; j < 64; j++ {
+		s.SendRaw("PING senpai")
+	}
+	s.Close()
+	for range out {
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the debug output to stop once the session is closed")
+	}
+}
+
+func TestHighlightCoalescer(t *testing.T) {
+	now := time.Now()
+	key := boundKey{"n", "#senpai"}
+	other := boundKey{"n", "#other"}
+	c := newHighlightCoalescer(5 * time.Second)
+
+	if run, _ := c.add(key, nil, "#senpai", highlight{body: "a", count: 1}, now); !run {
+		t.Fatalf("expected the first highlight to run")
+	}
+	if run, _ := c.add(other, nil, "#other", highlight{body: "x", count: 1}, now); !run {
+		t.Fatalf("expected highlights in other buffers to run")
+	}
+	if _, _, _, ok := c.flush(key, now); ok {
+		t.Fatalf("expected no pending highlight")
+	}
+	run, flushIn := c.add(key, nil, "#senpai", highlight{body: "b", count: 1}, now.Add(time.Second))
+	if run || flushIn != 4*time.Second {
+		t.Fatalf("expected the second highlight to be delayed by 4s, got run=%v flushIn=%v", run, flushIn)
+	}
+	run, flushIn = c.add(key, nil, "#senpai", highlight{body: "c", count: 1}, now.Add(2*time.Second))
+	if run || flushIn != 0 {
+		t.Fatalf("expected the third highlight to be merged, got run=%v flushIn=%v", run, flushIn)
+	}
+	_, buffer, h, ok := c.flush(key, now.Add(5*time.Second))
+	if !ok || buffer != "#senpai" || h.body != "c" || h.count != 2 {
+		t.Fatalf("expected the merged highlight %q with count 2, got %q with count %d", "c", h.body, h.count)
+	}
+	if _, ok := c.last[other]; ok {
+		t.Errorf("expected the ended window of %q to be forgotten on flush", other.target)
+	}
+	// The flush starts a new window.
+	if run, _ := c.add(key, nil, "#senpai", highlight{body: "d", count: 1}, now.Add(6*time.Second)); run {
+		t.Fatalf("expected highlights right after a flush to be delayed")
+	}
+	if run, _ := c.add(other, nil, "#other", highlight{body: "y", count: 1}, now.Add(6*time.Second)); !run {
+		t.Fatalf("expected highlights after the window to run")
+	}
+	third := boundKey{"n", "#third"}
+	c.add(third, nil, "#third", highlight{body: "z", count: 1}, now.Add(12*time.Second))
+	if _, ok := c.last[other]; ok {
+		t.Errorf("expected the ended window of %q to be forgotten on add", other.target)
+	}
+
+	c = newHighlightCoalescer(0)
+	for i := 0; i < 3; i++ {
+		if run, _ := c.add(key, nil, "#senpai", highlight{count: 1}, now); !run {
+			t.Fatalf("expected all highlights to run without a window")
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("certificate")}
+	sum := sha256.Sum256(cert.Raw)
+
+	var colons []string
+	for _, b := range sum {
+		colons = append(colons, strings.ToUpper(hex.EncodeToString([]byte{b})))
+	}
+	for _, s := range []string{hex.EncodeToString(sum[:]), strings.Join(colons, ":")} {
+		fingerprint, err := parseFingerprint(s)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", s, err)
+		}
+		if err := verifyFingerprint(fingerprint)(tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}); err != nil {
+			t.Errorf("expected %q to match: %v", s, err)
+		}
+	}
+
+	other := &x509.Certificate{Raw: []byte("other")}
+	fingerprint, _ := parseFingerprint(hex.EncodeToString(sum[:]))
+	if err := verifyFingerprint(fingerprint)(tls.ConnectionState{PeerCertificates: []*x509.Certificate{other}}); err == nil {
+		t.Errorf("expected another certificate not to match")
+	}
+
+	for _, s := range []string{"", "zz", hex.EncodeToString(sum[:16])} {
+		if _, err := parseFingerprint(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestMessageBoundKey(t *testing.T) {
+	s, _ := newTestSession(t)
+	app := &App{
+		sessions: map[string]*irc.Session{
+			"n": s,
+		},
+		messageBounds: map[boundKey]bound{},
+	}
+
+	var b bound
+	b.Update(&ui.Line{At: time.Now()})
+	app.messageBounds[app.messageBoundKey("n", "#Foo")] = b
+	if _, ok := app.messageBounds[app.messageBoundKey("n", "#foo")]; !ok {
+		t.Errorf("expected #Foo and #foo to share their bounds")
+	}
+	if _, ok := app.messageBounds[app.messageBoundKey("m", "#foo")]; ok {
+		t.Errorf("expected bounds to be per network")
+	}
+	if app.messageBoundKey("m", "#Foo") != app.messageBoundKey("m", "#foo") {
+		t.Errorf("expected buffers to be casemapped without a session")
+	}
+}
+
+func TestMatchingChannels(t *testing.T) {
+	s, _ := newTestSession(t)
+	handle(t, s,
+		":irc.example.org 001 senpai :Welcome",
+		":senpai!senpai@example.org JOIN #Senpai",
+		":senpai!senpai@example.org JOIN #other",
+	)
+	seen := map[string]string{"#sekai": "#sekai", "#senpai": "#senpai"}
+
+	channels := matchingChannels(s, seen, "#se")
+	if strings.Join(channels, " ") != "#Senpai #sekai" {
+		t.Errorf("expected the joined and seen channels once each, got %v", channels)
+	}
+	if channels := matchingChannels(s, seen, "se"); len(channels) != 0 {
+		t.Errorf("expected no channels for a nick, got %v", channels)
+	}
+
+	other, _ := newTestSession(t)
+	app := &App{
+		sessions:     map[string]*irc.Session{"n": s, "m": other},
+		seenChannels: map[string]map[string]string{"m": {"#sekai": "#Sekai", "#seiza": "#seiza"}},
+	}
+	app.seeChannel("n", "#serif")
+	if channels := app.matchingChannels("n", "#Senpai", "#se"); strings.Join(channels, " ") != "#Senpai #serif" {
+		t.Errorf("expected the channels of the current network from a channel, got %v", channels)
+	}
+	if channels := app.matchingChannels("n", "", "#se"); strings.Join(channels, " ") != "#Sekai #Senpai #seiza #serif" {
+		t.Errorf("expected the channels of all networks from a server buffer, got %v", channels)
+	}
+}
+
+func TestIsService(t *testing.T) {
+	s, _ := newTestSession(t)
+	app := &App{}
+	app.cfg.Services = []string{"NickServ", "Serv[1]"}
+
+	for _, nick := range []string{"nickserv", "NICKSERV", "serv{1}"} {
+		if !app.isService(s, nick) {
+			t.Errorf("expected %q to be a service", nick)
+		}
+	}
+	if app.isService(s, "ChanServ") {
+		t.Errorf("expected unconfigured nicks not to be services")
+	}
+}
+
+func TestRestoreQueries(t *testing.T) {
+	for _, history := range []bool{false, true} {
+		s, out := newTestSession(t)
+		caps := "draft/read-marker"
+		if history {
+			caps += " draft/chathistory batch"
+		}
+		handle(t, s, ":irc.example.org CAP senpai ACK :"+caps)
+		for len(out) > 0 {
+			<-out
+		}
+		app := &App{
+			monitor: map[string]map[string]struct{}{
+				"": {"alice": {}},
+			},
+		}
+		app.restoreQueries(s)
+		markread := false
+		for len(out) > 0 {
+			if msg := <-out; msg.Command == "MARKREAD" {
+				markread = true
+			}
+		}
+		if markread == history {
+			t.Errorf("chathistory %v: expected MARKREAD to be sent only without chathistory", history)
+		}
+	}
+}
+
+func TestQueryStatus(t *testing.T) {
+	s, _ := newTestSession(t)
+	handle(t, s,
+		":irc.example.org CAP senpai ACK :away-notify",
+		":irc.example.org 001 senpai :Welcome",
+		":senpai!senpai@example.org JOIN #senpai",
+		":zoe!z@example.org JOIN #senpai",
+		":zoe!z@example.org AWAY :gone",
+	)
+	// Our own nick sorts before the peer's.
+	if status := queryStatus(s.Names("zoe")); status != "away" {
+		t.Errorf("expected the peer to be away, got %q", status)
+	}
+	if status := queryStatus(s.Names("bob")); status != "" {
+		t.Errorf("expected an unknown peer to have no status, got %q", status)
+	}
+}
+
+func TestStatusText(t *testing.T) {
+	s, _ := newTestSession(t)
+	topic := strings.Repeat("senpai ", 20)
+	handle(t, s,
+		":irc.example.org 001 senpai :Welcome",
+		":senpai!senpai@example.org JOIN #senpai",
+		":irc.example.org 332 senpai #senpai :"+topic,
+	)
+	status := statusText(s, "#senpai", []string{"libera", "oftc", "esper"})
+	parts := strings.Split(status, " | ")
+	if len(parts) != 3 {
+		t.Fatalf("expected a connection, offline and channel status, got %q", status)
+	}
+	if parts[0] != "connected" {
+		t.Errorf("expected the session to be connected, got %q", parts[0])
+	}
+	if parts[1] != "offline: libera, oftc, esper" {
+		t.Errorf("expected all offline networks to be listed, got %q", parts[1])
+	}
+	if n := len([]rune(parts[2])); n != 40 || !strings.HasSuffix(parts[2], "…") {
+		t.Errorf("expected the topic to be cut to 40 runes, got %q", parts[2])
+	}
+	if status := statusText(nil, "#senpai", nil); status != "offline" {
+		t.Errorf("expected a disconnected buffer to be offline, got %q", status)
+	}
+}
+
+func TestEditHistoryLine(t *testing.T) {
+	s, _ := newTestSession(t)
+	app := &App{}
+	at := time.Now()
+	lines := []ui.Line{{
+		At:   at,
+		ID:   "1",
+		Body: ui.PlainString("helo"),
+		Data: irc.MessageEvent{User: "alice"},
+	}}
+	edit := ui.Line{
+		At:   at.Add(time.Minute),
+		ID:   "2",
+		Body: ui.PlainString("hello"),
+		Data: irc.MessageEvent{User: "Alice", Edits: "1"},
+	}
+	if !app.editHistoryLine(s, lines, "1", edit) {
+		t.Fatalf("expected the edited line to be found")
+	}
+	if l := lines[0]; l.Body.String() != "hello" || !l.At.Equal(at) || l.ID != "1" || !l.HasID("2") {
+		t.Errorf("expected the line to be edited in place and known by both IDs, got %#v", l)
+	}
+
+	// A later edit refers to the ID of the first edit.
+	edit.ID = "3"
+	edit.Body = ui.PlainString("hello!")
+	if !app.editHistoryLine(s, lines, "2", edit) || lines[0].Body.String() != "hello!" || !lines[0].HasID("3") {
+		t.Errorf("expected edits to resolve through the IDs of former edits")
+	}
+
+	edit.Data = irc.MessageEvent{User: "mallory"}
+	if app.editHistoryLine(s, lines, "1", edit) {
+		t.Errorf("expected edits from another user to be ignored")
+	}
+}
+
+func TestNoticeBuffer(t *testing.T) {
+	tests := []struct {
+		routing     NoticeRouting
+		curNetID    string
+		curBuffer   string
+		fromService bool
+		expected    string
+	}{
+		{NoticeRoutingCurrent, "a", "#senpai", false, "#senpai"},
+		{NoticeRoutingCurrent, "a", "", false, ""},
+		{NoticeRoutingCurrent, "b", "#kouhai", false, ""},
+		{NoticeRoutingCurrent, "a", "#senpai", true, ""},
+		{NoticeRoutingCurrent, "b", "#kouhai", true, ""},
+		{NoticeRoutingServer, "a", "#senpai", false, ""},
+		{NoticeRoutingServer, "b", "#kouhai", false, ""},
+	}
+	for _, test := range tests {
+		if buffer := noticeBuffer(test.routing, "a", test.curNetID, test.curBuffer, test.fromService); buffer != test.expected {
+			t.Errorf("routing %d, current buffer %s/%s, from service %v: expected %q, got %q", test.routing, test.curNetID, test.curBuffer, test.fromService, test.expected, buffer)
+		}
+	}
+}
+
+func TestIsBan(t *testing.T) {
+	patterns := Defaults().BanPatterns
+	tests := []struct {
+		raw      string
+		quit     bool
+		expected bool
+	}{
+		{":irc.example.org 465 senpai :You are banned from this server", false, true},
+		{"ERROR :Closing Link: example.org (K-Lined)", false, true},
+		{"ERROR :Closing Link: example.org (You are BANNED)", false, true},
+		{":oper!oper@example.org KILL senpai :G-lined: spam", false, true},
+		{"ERROR :Closing Link: example.org (Ping timeout: 240 seconds)", false, false},
+		{":oper!oper@example.org KILL senpai :flooding", false, false},
+		{":irc.example.org NOTICE senpai :banned", false, false},
+		{"ERROR :Closing Link: example.org (Quit: banned words, brb)", true, false},
+	}
+	for _, test := range tests {
+		msg, err := irc.ParseMessage(test.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := isBan(msg, patterns, test.quit); v != test.expected {
+			t.Errorf("%q: expected %v, got %v", test.raw, test.expected, v)
+		}
+	}
+}
+
+func TestFormatActionHighlight(t *testing.T) {
+	s, _ := newTestSession(t)
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	app := &App{
+		cfg: Defaults(),
+	}
+
+	tests := []struct {
+		content   string
+		highlight bool
+		body      string
+	}{
+		{"\x01ACTION hugs senpai\x01", true, "kouhai hugs senpai"},
+		{"\x01ACTION hugs \x02senpai\x02\x01", true, "kouhai hugs senpai"},
+		{"\x01ACTION waves\x01", false, "kouhai waves"},
+	}
+	for _, test := range tests {
+		_, line := app.formatMessage(s, irc.MessageEvent{
+			User:            "kouhai",
+			Target:          "#senpai",
+			TargetIsChannel: true,
+			Command:         "PRIVMSG",
+			Content:         test.content,
+			Time:            time.Now(),
+		})
+		if line.Highlight != test.highlight {
+			t.Errorf("%q: expected highlight %v, got %v", test.content, test.highlight, line.Highlight)
+		}
+		if body := line.Body.String(); body != test.body {
+			t.Errorf("%q: expected body %q, got %q", test.content, test.body, body)
+		}
+	}
+
+	app.highlights = []string{"action"}
+	_, line := app.formatMessage(s, irc.MessageEvent{
+		User:            "kouhai",
+		Target:          "#senpai",
+		TargetIsChannel: true,
+		Command:         "PRIVMSG",
+		Content:         "\x01ACTION waves\x01",
+		Time:            time.Now(),
+	})
+	if line.Highlight {
+		t.Errorf("expected the CTCP command not to match highlights")
+	}
+}
+
+func TestWallClockGap(t *testing.T) {
+	last := time.Now()
+	if gap := wallClockGap(last, last.Add(5*time.Second), 5*time.Second); gap != 0 {
+		t.Errorf("expected no gap, got %v", gap)
+	}
+	// A wall clock reading only, as if the monotonic clock had stopped
+	// during sleep.
+	now := last.Round(0).Add(time.Hour)
+	if gap := wallClockGap(last, now, 5*time.Second); gap != time.Hour-5*time.Second {
+		t.Errorf("expected a gap of about an hour, got %v", gap)
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	tests := []struct {
+		command  string
+		rawArgs  string
+		expected []string
+	}{
+		{"MSG", "senpai if x:  ", []string{"senpai", "if x:  "}},
+		{"MSG", "  senpai   hi", []string{"senpai", "hi"}},
+		{"MSG", "senpai   ", []string{"senpai"}},
+		{"ME", "waves\t", []string{"waves\t"}},
+		{"QUERY", "senpai ", []string{"senpai"}},
+		{"JOIN", "#senpai key ", []string{"#senpai", "key"}},
+	}
+	for _, test := range tests {
+		args := commandArgs(commands[test.command], test.rawArgs)
+		if strings.Join(args, "|") != strings.Join(test.expected, "|") || len(args) != len(test.expected) {
+			t.Errorf("%s %q: expected %q, got %q", test.command, test.rawArgs, test.expected, args)
+		}
+	}
+}
+
+func TestMessageTextStart(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"hello world", 0},
+		{"//slash", 1},
+		{"/msg senpai  hi there", len("/msg senpai  ")},
+		{"/msg senpai", -1},
+		{"/query senpai", -1},
+		{"/me waves", len("/me ")},
+		{"/m waves", -1}, // ambiguous
+		{"/join #senpai", -1},
+		{"/msg hi hi", len("/msg hi ")},
+		{"/msg é ça va", len([]rune("/msg é "))},
+	}
+	for _, test := range tests {
+		if i := messageTextStart([]rune(test.input)); i != test.expected {
+			t.Errorf("%q: expected the message text at %d, got %d", test.input, test.expected, i)
+		}
+	}
+}
+
+func TestPastePreview(t *testing.T) {
+	lines := pastePreview("hello\n\x02world\x02\n", time.Now())
+	if len(lines) != 4 {
+		t.Fatalf("expected a prompt and 3 lines, got %d lines", len(lines))
+	}
+	if body := lines[0].Body.String(); !strings.Contains(body, "3 lines") {
+		t.Errorf("expected the prompt to show the line count, got %q", body)
+	}
+	for i, expected := range []string{"hello", "world", ""} {
+		if body := lines[i+1].Body.String(); body != expected {
+			t.Errorf("line %d: expected %q, got %q", i, expected, body)
+		}
+	}
+}
+
+func TestDecodePreviewImage(t *testing.T) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, image.NewRGBA(image.Rect(0, 0, 20, 10))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodePreviewImage(b.Bytes(), 200); err != nil {
+		t.Errorf("expected a 20x10 image to be decoded, got %v", err)
+	}
+	if _, err := decodePreviewImage(b.Bytes(), 199); err == nil {
+		t.Errorf("expected a 20x10 image to be rejected")
+	}
+}
+
+func TestKickArgs(t *testing.T) {
+	s, _ := newTestSession(t)
+	tests := []struct {
+		current string
+		args    []string
+		channel string
+		comment string
+	}{
+		{"#senpai", []string{"bob"}, "#senpai", ""},
+		{"#senpai", []string{"bob", "spam"}, "#senpai", "spam"},
+		{"#senpai", []string{"bob", "no", "spam"}, "#senpai", "no spam"},
+		{"#senpai", []string{"bob", "#kouhai"}, "#kouhai", ""},
+		{"", []string{"bob", "#kouhai", "spam"}, "#kouhai", "spam"},
+	}
+	for _, test := range tests {
+		channel, comment, err := kickArgs(s, test.current, test.args)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.args, err)
+		} else if channel != test.channel || comment != test.comment {
+			t.Errorf("%q: expected %q %q, got %q %q", test.args, test.channel, test.comment, channel, comment)
+		}
+	}
+	if _, _, err := kickArgs(s, "", []string{"bob", "spam"}); err == nil {
+		t.Errorf("expected an error without channel")
+	}
+}
+
+func TestUnbanMasks(t *testing.T) {
+	s, _ := newTestSession(t)
+	handle(t, s,
+		":irc.example.org 001 senpai :Welcome",
+		":senpai!senpai@example.org JOIN #senpai",
+		":bob!bob@host.example.org JOIN #senpai",
+	)
+	tests := []struct {
+		target   string
+		expected string
+	}{
+		{"bob", "*!*@host.example.org bob!*@*"},
+		{"carol", "carol!*@*"},
+		{"*!*@example.org", "*!*@example.org"},
+	}
+	for _, test := range tests {
+		if masks := strings.Join(unbanMasks(s, test.target), " "); masks != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.target, test.expected, masks)
+		}
+	}
+}
+
+func TestReplyContextInBatch(t *testing.T) {
+	s, _ := newTestSession(t)
+	app := &App{
+		win:      &ui.UI{},
+		sessions: map[string]*irc.Session{"": s},
+	}
+	parent := irc.MessageEvent{
+		User:            "alice",
+		Target:          "#senpai",
+		TargetIsChannel: true,
+		Command:         "PRIVMSG",
+		Content:         "hello\nworld",
+		MsgID:           "1",
+	}
+	_, line := app.formatMessage(s, parent)
+	reply := irc.MessageEvent{
+		User:            "bob",
+		Target:          "#senpai",
+		TargetIsChannel: true,
+		Command:         "PRIVMSG",
+		Content:         "hi",
+		MsgID:           "2",
+		ReplyTo:         "1",
+	}
+	_, line = app.formatMessage(s, reply, []ui.Line{line})
+	if body := line.Body.String(); body != "<bob> ↪ alice: hello world hi" {
+		t.Errorf("expected the parent in the batch as context, got %q", body)
+	}
+}
+
+func TestSaveLines(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+	lines := []ui.Line{
+		{At: at, Head: "--", Body: ui.PlainString("kouhai has joined")},
+		{At: at.Add(time.Minute), Body: ui.Styled("<kouhai> hi", vaxis.Style{Attribute: vaxis.AttrBold})},
+	}
+	path := filepath.Join(t.TempDir(), "saved.txt")
+	if err := saveLines(path, lines); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "2024-01-02 03:04:05 -- kouhai has joined\n2024-01-02 03:05:05 <kouhai> hi\n"
+	if string(buf) != expected {
+		t.Errorf("expected %q, got %q", expected, string(buf))
+	}
+}
+
+func TestAutoAway(t *testing.T) {
+	manual, manualOut := newTestSession(t)
+	handle(t, manual, ":irc.example.org 306 senpai :You have been marked as being away")
+	auto, autoOut := newTestSession(t)
+	app := &App{
+		win:       &ui.UI{},
+		sessions:  map[string]*irc.Session{"manual": manual, "auto": auto},
+		autoAways: make(map[string]struct{}),
+	}
+	app.cfg.AutoAway = time.Minute
+	app.cfg.AutoAwayReason = "idle"
+	drainAway := func(out chan irc.Message) (params []string, ok bool) {
+		for len(out) > 0 {
+			if msg := <-out; msg.Command == "AWAY" {
+				params, ok = msg.Params, true
+			}
+		}
+		return params, ok
+	}
+	drainAway(manualOut)
+	drainAway(autoOut)
+
+	app.lastActivity = time.Now()
+	app.checkAutoAway()
+	if _, ok := drainAway(autoOut); ok || app.autoAway {
+		t.Errorf("expected not to be marked away before the idle duration")
+	}
+
+	app.lastActivity = time.Now().Add(-time.Hour)
+	app.checkAutoAway()
+	if params, ok := drainAway(autoOut); !ok || len(params) != 1 || params[0] != "idle" {
+		t.Errorf("expected to be marked away with the auto-away reason, got %v", params)
+	}
+	if _, ok := drainAway(manualOut); ok {
+		t.Errorf("expected a manually set away message to be kept")
+	}
+
+	app.markActive()
+	if params, ok := drainAway(autoOut); !ok || len(params) != 0 {
+		t.Errorf("expected to be marked back, got %v", params)
+	}
+	if _, ok := drainAway(manualOut); ok {
+		t.Errorf("expected to stay away on the network away before auto-away")
+	}
+	if len(app.autoAways) != 0 || app.autoAway {
+		t.Errorf("expected auto-away to be over")
+	}
+}
@@ -8,11 +8,13 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"git.sr.ht/~delthas/senpai"
+	"git.sr.ht/~delthas/senpai/ui"
 )
 
 func main() {
@@ -133,6 +135,11 @@ func main() {
 		lastNetID, lastBuffer := getLastBuffer()
 		app.SwitchToBuffer(lastNetID, lastBuffer)
 		app.SetLastClose(getLastStamp())
+		app.SetScrollAnchors(getScrollAnchors())
+		app.SetBufferOrder(getBufferOrder())
+		if channelShown, memberShown, ok := getLayout(); ok {
+			app.SetLayout(channelShown, memberShown)
+		}
 	}
 
 	sigCh := make(chan os.Signal, 1)
@@ -148,6 +155,9 @@ func main() {
 	if !cfg.Transient {
 		writeLastBuffer(app)
 		writeLastStamp(app)
+		writeScrollAnchors(app)
+		writeBufferOrder(app)
+		writeLayout(app)
 	}
 }
 
@@ -191,6 +201,42 @@ func writeLastBuffer(app *senpai.App) {
 	}
 }
 
+func layoutPath() string {
+	return path.Join(cachePath(), "layout.txt")
+}
+
+// getLayout returns whether the buffer and member lists were shown when
+// senpai was last closed. Their widths come from the configuration.
+func getLayout() (channelShown, memberShown bool, ok bool) {
+	buf, err := os.ReadFile(layoutPath())
+	if err != nil {
+		return false, false, false
+	}
+
+	fields := strings.Fields(string(buf))
+	if len(fields) < 2 {
+		return false, false, false
+	}
+	channelShown, err = strconv.ParseBool(fields[0])
+	if err != nil {
+		return false, false, false
+	}
+	memberShown, err = strconv.ParseBool(fields[1])
+	if err != nil {
+		return false, false, false
+	}
+	return channelShown, memberShown, true
+}
+
+func writeLayout(app *senpai.App) {
+	layoutPath := layoutPath()
+	channelShown, memberShown := app.Layout()
+	err := os.WriteFile(layoutPath, []byte(fmt.Sprintf("%t %t", channelShown, memberShown)), 0666)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write layout at %q: %s\n", layoutPath, err)
+	}
+}
+
 func lastStampPath() string {
 	return path.Join(cachePath(), "laststamp.txt")
 }
@@ -220,3 +266,77 @@ func writeLastStamp(app *senpai.App) {
 		fmt.Fprintf(os.Stderr, "failed to write last stamp at %q: %s\n", lastStampPath, err)
 	}
 }
+
+func scrollAnchorsPath() string {
+	return path.Join(cachePath(), "scroll.txt")
+}
+
+func getScrollAnchors() map[ui.BufferKey]time.Time {
+	anchors := make(map[ui.BufferKey]time.Time)
+	buf, err := os.ReadFile(scrollAnchorsPath())
+	if err != nil {
+		return anchors
+	}
+
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			continue
+		}
+		anchors[ui.BufferKey{NetID: fields[1], Title: fields[2]}] = t
+	}
+	return anchors
+}
+
+func writeScrollAnchors(app *senpai.App) {
+	scrollAnchorsPath := scrollAnchorsPath()
+	var sb strings.Builder
+	for k, t := range app.ScrollAnchors() {
+		fmt.Fprintf(&sb, "%s\t%s\t%s\n", t.UTC().Format(time.RFC3339Nano), k.NetID, k.Title)
+	}
+	err := os.WriteFile(scrollAnchorsPath, []byte(sb.String()), 0666)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write scroll positions at %q: %s\n", scrollAnchorsPath, err)
+	}
+}
+
+func bufferOrderPath() string {
+	return path.Join(cachePath(), "bufferorder.txt")
+}
+
+func getBufferOrder() []ui.BufferKey {
+	buf, err := os.ReadFile(bufferOrderPath())
+	if err != nil {
+		return nil
+	}
+
+	order := []ui.BufferKey{}
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) < 2 {
+			continue
+		}
+		order = append(order, ui.BufferKey{NetID: fields[0], Title: fields[1]})
+	}
+	return order
+}
+
+func writeBufferOrder(app *senpai.App) {
+	bufferOrderPath := bufferOrderPath()
+	order := app.BufferOrder()
+	if order == nil {
+		return
+	}
+	var sb strings.Builder
+	for _, k := range order {
+		fmt.Fprintf(&sb, "%s\t%s\n", k.NetID, k.Title)
+	}
+	err := os.WriteFile(bufferOrderPath, []byte(sb.String()), 0666)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write buffer order at %q: %s\n", bufferOrderPath, err)
+	}
+}
@@ -1,14 +1,16 @@
 package senpai
 
 import (
-	"errors"
+	"bufio"
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"git.sr.ht/~rockorager/vaxis"
 	"github.com/delthas/go-libnp"
@@ -28,6 +30,7 @@ type command struct {
 	AllowHome bool
 	MinArgs   int
 	MaxArgs   int
+	Text      bool // whether the last argument is message text, sent as typed
 	Usage     string
 	Desc      string
 	Handle    func(app *App, args []string) error // nil = passthrough
@@ -59,12 +62,13 @@ func init() {
 			MinArgs:   1,
 			MaxArgs:   2,
 			Usage:     "<channels> [keys]",
-			Desc:      "join a channel",
+			Desc:      "join channels, separated by commas",
 			Handle:    commandDoJoin,
 		},
 		"ME": {
 			MinArgs: 1,
 			MaxArgs: 1,
+			Text:    true,
 			Usage:   "<message>",
 			Desc:    "send an action (reply to last query if sent from home)",
 			Handle:  commandDoMe,
@@ -85,6 +89,7 @@ func init() {
 			AllowHome: true,
 			MinArgs:   2,
 			MaxArgs:   2,
+			Text:      true,
 			Usage:     "<target> <message>",
 			Desc:      "send a message to the given target",
 			Handle:    commandDoMsg,
@@ -93,16 +98,23 @@ func init() {
 			AllowHome: true,
 			Desc:      "show the message of the day (MOTD)",
 		},
+		"MONITOR": {
+			AllowHome: true,
+			MinArgs:   1,
+			MaxArgs:   1,
+			Usage:     "list|clear",
+			Desc:      "show the online status of the users watched with MONITOR, or stop watching them",
+			Handle:    commandDoMonitor,
+		},
 		"NAMES": {
-			Desc:   "show the member list of the current channel",
+			Desc:   "show the member list of the current channel, or the channels shared with the current query",
 			Handle: commandDoNames,
 		},
 		"NICK": {
 			AllowHome: true,
-			MinArgs:   1,
 			MaxArgs:   1,
-			Usage:     "<nickname>",
-			Desc:      "change your nickname",
+			Usage:     "[nickname]",
+			Desc:      "change your nickname, or retry the last requested one",
 			Handle:    commandDoNick,
 		},
 		"OPER": {
@@ -119,6 +131,34 @@ func init() {
 			Desc:      "change channel or user modes",
 			Handle:    commandDoMode,
 		},
+		"OP": {
+			MinArgs: 1,
+			MaxArgs: maxArgsInfinite,
+			Usage:   "<nick> [nick...]",
+			Desc:    "give channel operator status to users in the current channel",
+			Handle:  commandDoMemberMode("+o"),
+		},
+		"DEOP": {
+			MinArgs: 1,
+			MaxArgs: maxArgsInfinite,
+			Usage:   "<nick> [nick...]",
+			Desc:    "remove channel operator status from users in the current channel",
+			Handle:  commandDoMemberMode("-o"),
+		},
+		"VOICE": {
+			MinArgs: 1,
+			MaxArgs: maxArgsInfinite,
+			Usage:   "<nick> [nick...]",
+			Desc:    "give voice to users in the current channel",
+			Handle:  commandDoMemberMode("+v"),
+		},
+		"DEVOICE": {
+			MinArgs: 1,
+			MaxArgs: maxArgsInfinite,
+			Usage:   "<nick> [nick...]",
+			Desc:    "remove voice from users in the current channel",
+			Handle:  commandDoMemberMode("-v"),
+		},
 		"PART": {
 			AllowHome: true,
 			MaxArgs:   2,
@@ -130,10 +170,21 @@ func init() {
 			AllowHome: true,
 			MinArgs:   1,
 			MaxArgs:   2,
-			Usage:     "[nick] [message]",
+			Text:      true,
+			Usage:     "<nick> [message]",
 			Desc:      "opens a buffer to a user",
 			Handle:    commandDoQuery,
 		},
+		"CLEAR": {
+			AllowHome: true,
+			Desc:      "clear the lines of the current buffer",
+			Handle:    commandDoClear,
+		},
+		"RECONNECT": {
+			AllowHome: true,
+			Desc:      "reconnect to the current network",
+			Handle:    commandDoReconnect,
+		},
 		"QUIT": {
 			AllowHome: true,
 			MaxArgs:   1,
@@ -149,6 +200,36 @@ func init() {
 			Desc:      "send raw protocol data",
 			Handle:    commandDoQuote,
 		},
+		"RAW": {
+			AllowHome: true,
+			MinArgs:   1,
+			MaxArgs:   1,
+			Usage:     "<raw message>",
+			Desc:      "send raw protocol data",
+			Handle:    commandDoQuote,
+		},
+		"RAWPASTE": {
+			AllowHome: true,
+			Desc:      "keep formatting codes in the next paste",
+			Handle:    commandDoRawPaste,
+		},
+		"COPY": {
+			AllowHome: true,
+			Desc:      "copy the last message of the current buffer to the clipboard",
+			Handle:    commandDoCopy,
+		},
+		"COPYURL": {
+			AllowHome: true,
+			Desc:      "copy the last link of the current buffer to the clipboard",
+			Handle:    commandDoCopyURL,
+		},
+		"SAVE": {
+			AllowHome: true,
+			MaxArgs:   1,
+			Usage:     "[path]",
+			Desc:      "save the messages shown in the current buffer to a file",
+			Handle:    commandDoSave,
+		},
 		"LIST": {
 			AllowHome: true,
 			MaxArgs:   1,
@@ -160,10 +241,19 @@ func init() {
 			AllowHome: true,
 			MinArgs:   1,
 			MaxArgs:   1,
+			Text:      true,
 			Usage:     "<message>",
 			Desc:      "reply to the last query",
 			Handle:    commandDoR,
 		},
+		"REPLYTO": {
+			MinArgs: 2,
+			MaxArgs: 2,
+			Text:    true,
+			Usage:   "<msgid> <message>",
+			Desc:    "reply to a specific message of the current buffer",
+			Handle:  commandDoReplyTo,
+		},
 		"TOPIC": {
 			MaxArgs: 1,
 			Usage:   "[topic]",
@@ -178,6 +268,19 @@ func init() {
 			Desc:      "switch to the buffer at the position or containing a substring",
 			Handle:    commandDoBuffer,
 		},
+		"BUFFERS": {
+			AllowHome: true,
+			Desc:      "list the buffers with their unread messages, most recently active first",
+			Handle:    commandDoBuffers,
+		},
+		"MOVE": {
+			AllowHome: true,
+			MinArgs:   1,
+			MaxArgs:   1,
+			Usage:     "<index|+n|-n>",
+			Desc:      "move the current buffer in the buffer list",
+			Handle:    commandDoMove,
+		},
 		"WHOIS": {
 			AllowHome: true,
 			MinArgs:   0,
@@ -214,15 +317,23 @@ func init() {
 			AllowHome: true,
 			MinArgs:   1,
 			MaxArgs:   2,
-			Usage:     "<nick> [channel]",
+			Usage:     "<nick/mask> [channel]",
 			Desc:      "ban someone from entering the channel",
 			Handle:    commandDoBan,
 		},
+		"KICKBAN": {
+			AllowHome: true,
+			MinArgs:   1,
+			MaxArgs:   3,
+			Usage:     "<nick> [channel] [message]",
+			Desc:      "ban someone from entering the channel, and eject them from it",
+			Handle:    commandDoKickBan,
+		},
 		"UNBAN": {
 			AllowHome: true,
 			MinArgs:   1,
 			MaxArgs:   2,
-			Usage:     "<nick> [channel]",
+			Usage:     "<nick/mask> [channel]",
 			Desc:      "remove effect of a ban from the user",
 			Handle:    commandDoUnban,
 		},
@@ -335,6 +446,9 @@ func noCommand(app *App, content string) error {
 	if buffer == "" {
 		return fmt.Errorf("can't send message to this buffer")
 	}
+	if buffer == servicesBuffer {
+		return fmt.Errorf("can't send message to this buffer, use /msg <service> <message> instead")
+	}
 	s := app.sessions[netID]
 	if s == nil {
 		return errOffline
@@ -356,21 +470,105 @@ func noCommand(app *App, content string) error {
 	return nil
 }
 
+// sendMultiline sends lines as a single multiline message to the current
+// buffer.
+func sendMultiline(app *App, lines []string) error {
+	netID, buffer := app.win.CurrentBuffer()
+	if buffer == "" || buffer == servicesBuffer {
+		return fmt.Errorf("can't send message to this buffer")
+	}
+	s := app.sessions[netID]
+	if s == nil {
+		return errOffline
+	}
+	if !s.CanMultiline(buffer, lines) {
+		return fmt.Errorf("the server does not accept these lines as a single message; press Enter to send them one message per line")
+	}
+
+	s.PrivMsgMultiline(buffer, lines)
+	if !s.HasCapability("echo-message") {
+		buffer, line := app.formatMessage(s, irc.MessageEvent{
+			User:            s.Nick(),
+			Target:          buffer,
+			TargetIsChannel: s.IsChannel(buffer),
+			Command:         "PRIVMSG",
+			Content:         strings.Join(lines, "\n"),
+			Time:            time.Now(),
+		})
+		app.win.AddLine(netID, buffer, line)
+	}
+	return nil
+}
+
+func commandDoBuffers(app *App, args []string) (err error) {
+	netID, buffer := app.win.CurrentBuffer()
+	now := time.Now()
+	for _, a := range app.win.Activity() {
+		name := a.Title
+		if name == "" {
+			name = a.NetName
+			if name == "" {
+				name = "home"
+			}
+		} else if a.NetName != "" {
+			name = fmt.Sprintf("%s (%s)", name, a.NetName)
+		}
+		parts := []string{fmt.Sprintf("%d unread", a.Unread)}
+		if a.Highlights > 0 {
+			parts = append(parts, fmt.Sprintf("%d highlights", a.Highlights))
+		}
+		if !a.Last.IsZero() {
+			last := a.Last.Local()
+			format := "15:04"
+			if y, m, d := last.Date(); y != now.Year() || m != now.Month() || d != now.Day() {
+				format = "2006-01-02 15:04"
+			}
+			parts = append(parts, "last message at "+last.Format(format))
+		}
+		app.win.AddLine(netID, buffer, ui.Line{
+			At:        now,
+			Head:      "--",
+			HeadColor: app.cfg.Colors.Status,
+			Body: ui.Styled(name+": "+strings.Join(parts, ", "), vaxis.Style{
+				Foreground: app.cfg.Colors.Status,
+			}),
+		})
+	}
+	return nil
+}
+
 func commandDoBuffer(app *App, args []string) error {
 	name := args[0]
 	i, err := strconv.Atoi(name)
 	if err == nil {
-		if app.win.JumpBufferIndex(i - 1) {
+		if app.win.JumpBufferPosition(i - 1) {
 			return nil
 		}
 	}
 	if !app.win.JumpBuffer(args[0]) {
+		if err == nil {
+			return fmt.Errorf("no buffer at position %d, there are %d buffers", i, app.win.BufferCount())
+		}
 		return fmt.Errorf("none of the buffers match %q", name)
 	}
 
 	return nil
 }
 
+func commandDoMove(app *App, args []string) error {
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid buffer position %q", args[0])
+	}
+	to := n - 1
+	if strings.HasPrefix(args[0], "+") || strings.HasPrefix(args[0], "-") {
+		to = app.win.CurrentBufferPosition() + n
+	}
+	app.win.MoveBuffer(to)
+	app.win.ScrollToBuffer()
+	return nil
+}
+
 func commandDoHelp(app *App, args []string) (err error) {
 	t := time.Now()
 	netID, buffer := app.win.CurrentBuffer()
@@ -452,6 +650,17 @@ func commandDoJoin(app *App, args []string) (err error) {
 	if len(args) == 2 {
 		key = args[1]
 	}
+	channels := strings.Split(channel, ",")
+	for _, c := range channels {
+		if c == "" {
+			return fmt.Errorf("empty channel name in %q", channel)
+		}
+	}
+	if key != "" {
+		if keys := strings.Split(key, ","); len(keys) > len(channels) {
+			return fmt.Errorf("too many keys: got %d keys for %d channels", len(keys), len(channels))
+		}
+	}
 	s.Join(channel, key)
 	return nil
 }
@@ -537,7 +746,7 @@ func commandDoNames(app *App, args []string) (err error) {
 		return errOffline
 	}
 	if !s.IsChannel(buffer) {
-		return fmt.Errorf("this is not a channel")
+		return commandDoNamesQuery(app, s, netID, buffer)
 	}
 	var sb ui.StyledStringBuilder
 	sb.SetStyle(vaxis.Style{
@@ -568,15 +777,139 @@ func commandDoNames(app *App, args []string) (err error) {
 	return nil
 }
 
-func commandDoNick(app *App, args []string) (err error) {
-	nick := args[0]
-	if i := strings.IndexAny(nick, " :"); i >= 0 {
-		return fmt.Errorf("illegal char %q in nickname", nick[i])
+// commandDoNamesQuery shows the online status of the target of a query, and
+// the channels we share with them.
+func commandDoNamesQuery(app *App, s *irc.Session, netID, buffer string) error {
+	status := queryStatus(s.Names(buffer))
+	channels := s.ChannelsSharedWith(buffer)
+	sort.Strings(channels)
+
+	var body string
+	switch {
+	case status == "":
+		body = fmt.Sprintf("%s is not known to be online", buffer)
+	case len(channels) == 0:
+		body = fmt.Sprintf("%s is %s, and shares no channels with you", buffer, status)
+	default:
+		body = fmt.Sprintf("%s is %s, and shares %d channels with you: %s", buffer, status, len(channels), strings.Join(channels, " "))
 	}
+	app.win.AddLine(netID, buffer, ui.Line{
+		At:        time.Now(),
+		Head:      "--",
+		HeadColor: app.cfg.Colors.Status,
+		Body:      ui.Styled(body, vaxis.Style{Foreground: app.cfg.Colors.Status}),
+	})
+	return nil
+}
+
+// queryStatus returns the status of the peer of a query, given the names of
+// the query, or "" if it is unknown.
+func queryStatus(names []irc.Member) string {
+	for _, u := range names {
+		if u.Self {
+			continue
+		}
+		switch {
+		case u.Disconnected:
+			return "offline"
+		case u.Away:
+			return "away"
+		default:
+			return "online"
+		}
+	}
+	return ""
+}
+
+func commandDoMonitor(app *App, args []string) error {
+	switch strings.ToLower(args[0]) {
+	case "list":
+		netIDs := make([]string, 0, len(app.sessions))
+		for netID := range app.sessions {
+			netIDs = append(netIDs, netID)
+		}
+		sort.Strings(netIDs)
+		var lines []string
+		for _, netID := range netIDs {
+			s := app.sessions[netID]
+			online, offline, unknown, ok := s.Monitors()
+			var parts []string
+			if !ok {
+				parts = append(parts, "MONITOR is not supported by the server")
+			}
+			if len(online) > 0 {
+				parts = append(parts, "online: "+strings.Join(online, " "))
+			}
+			if len(offline) > 0 {
+				parts = append(parts, "offline: "+strings.Join(offline, " "))
+			}
+			if len(unknown) > 0 {
+				parts = append(parts, "unknown: "+strings.Join(unknown, " "))
+			}
+			var missing []string
+			for target := range app.monitor[netID] {
+				if !s.IsMonitored(target) {
+					missing = append(missing, target)
+				}
+			}
+			if len(missing) > 0 {
+				sort.Strings(missing)
+				parts = append(parts, "not monitored: "+strings.Join(missing, " "))
+			}
+			if len(parts) == 0 {
+				parts = append(parts, "no monitored users")
+			}
+			name := app.win.NetworkName(netID)
+			if name == "" {
+				name = s.NetworkName()
+			}
+			lines = append(lines, name+": "+strings.Join(parts, "; "))
+		}
+		if len(lines) == 0 {
+			return errOffline
+		}
+		netID, buffer := app.win.CurrentBuffer()
+		for _, body := range lines {
+			app.win.AddLine(netID, buffer, ui.Line{
+				At:        time.Now(),
+				Head:      "--",
+				HeadColor: app.cfg.Colors.Status,
+				Body: ui.Styled(body, vaxis.Style{
+					Foreground: app.cfg.Colors.Status,
+				}),
+			})
+		}
+	case "clear":
+		netID, _ := app.win.CurrentBuffer()
+		s := app.sessions[netID]
+		if s == nil {
+			return errOffline
+		}
+		app.monitor[netID] = make(map[string]struct{})
+		s.MonitorClear()
+	default:
+		return fmt.Errorf("unknown subcommand %q, expected list or clear", args[0])
+	}
+	return nil
+}
+
+func commandDoNick(app *App, args []string) (err error) {
 	s := app.CurrentSession()
 	if s == nil {
 		return errOffline
 	}
+	var nick string
+	if len(args) > 0 {
+		nick = args[0]
+	} else {
+		nick = s.DesiredNick()
+		if s.IsMe(nick) {
+			return fmt.Errorf("you are already using your requested nickname %s", nick)
+		}
+	}
+	if i := strings.IndexAny(nick, " :"); i >= 0 {
+		return fmt.Errorf("illegal char %q in nickname", nick[i])
+	}
 	s.ChangeNick(nick)
 	return
 }
@@ -602,13 +935,30 @@ func commandDoMode(app *App, args []string) (err error) {
 	return nil
 }
 
+// commandDoMemberMode returns a command handler that sets a membership mode,
+// such as "+o", on each of the given nicks in the current channel.
+func commandDoMemberMode(mode string) func(app *App, args []string) error {
+	return func(app *App, args []string) error {
+		netID, channel := app.win.CurrentBuffer()
+		s := app.sessions[netID]
+		if s == nil {
+			return errOffline
+		}
+		if !s.IsChannel(channel) {
+			return fmt.Errorf("this is not a channel")
+		}
+		s.ChangeMemberModes(channel, mode, args)
+		return nil
+	}
+}
+
 func commandDoPart(app *App, args []string) (err error) {
 	netID, channel := app.win.CurrentBuffer()
 	s := app.sessions[netID]
 	if s == nil {
 		return errOffline
 	}
-	reason := ""
+	reason := app.cfg.PartMessage
 	if 0 < len(args) {
 		if s.IsChannel(args[0]) {
 			channel = args[0]
@@ -642,23 +992,15 @@ func commandDoQuery(app *App, args []string) (err error) {
 	if s.IsChannel(target) {
 		return fmt.Errorf("cannot query a channel, use JOIN instead")
 	}
-	i, added := app.win.AddBuffer(netID, "", target)
-	app.win.JumpBufferIndex(i)
+	app.openQuery(s, target)
 	if len(args) > 1 {
-		if err := commandSendMessage(app, target, args[1]); err != nil {
-			return err
-		}
-	}
-	if added {
-		s.MonitorAdd(target)
-		s.ReadGet(target)
-		s.NewHistoryRequest(target).WithLimit(200).Latest()
+		return commandSendMessage(app, target, args[1])
 	}
 	return nil
 }
 
 func commandDoQuit(app *App, args []string) (err error) {
-	reason := ""
+	reason := app.cfg.QuitMessage
 	if 0 < len(args) {
 		reason = args[0]
 	}
@@ -669,6 +1011,29 @@ func commandDoQuit(app *App, args []string) (err error) {
 	return nil
 }
 
+func commandDoClear(app *App, args []string) (err error) {
+	netID, buffer := app.win.CurrentBuffer()
+	app.win.ClearBuffer(netID, buffer)
+	// Forget what was fetched, so that scrolling up fetches the history
+	// again.
+	delete(app.messageBounds, app.messageBoundKey(netID, buffer))
+	return nil
+}
+
+func commandDoReconnect(app *App, args []string) (err error) {
+	netID, buffer := app.win.CurrentBuffer()
+	if s := app.sessions[netID]; s != nil {
+		s.Quit("Reconnecting")
+	}
+	app.reconnect(netID)
+	app.win.AddLine(netID, buffer, ui.Line{
+		At:   time.Now(),
+		Head: "--",
+		Body: ui.PlainString("Reconnecting..."),
+	})
+	return nil
+}
+
 func commandDoBouncer(app *App, args []string) (err error) {
 	b, err := getBouncerService(app)
 	if err != nil {
@@ -690,10 +1055,150 @@ func commandDoQuote(app *App, args []string) (err error) {
 	if s == nil {
 		return errOffline
 	}
+	if err := checkRaw(args[0]); err != nil {
+		return err
+	}
 	s.SendRaw(args[0])
 	return nil
 }
 
+// checkRaw returns an error if raw is not a well-formed IRC message, to
+// avoid desynchronizing the connection.
+func checkRaw(raw string) error {
+	if strings.ContainsAny(raw, "\r\n\x00") {
+		return fmt.Errorf("raw message must not contain line breaks or NUL characters")
+	}
+	msg, err := irc.ParseMessage(raw)
+	if err != nil {
+		return fmt.Errorf("invalid raw message: %v", err)
+	}
+	if !isRawCommand(msg.Command) {
+		return fmt.Errorf("invalid raw message command %q", msg.Command)
+	}
+	return nil
+}
+
+// isRawCommand reports whether command is a valid IRC command: either
+// letters, or a three-digit numeric.
+func isRawCommand(command string) bool {
+	if command == "" {
+		return false
+	}
+	if len(command) == 3 && strings.Trim(command, "0123456789") == "" {
+		return true
+	}
+	for _, r := range command {
+		if r < 'A' || 'Z' < r {
+			return false
+		}
+	}
+	return true
+}
+
+func commandDoRawPaste(app *App, args []string) (err error) {
+	app.rawPaste = true
+	netID, buffer := app.win.CurrentBuffer()
+	app.win.AddLine(netID, buffer, ui.Line{
+		At:   time.Now(),
+		Head: "--",
+		Body: ui.PlainString("The next paste will keep its formatting codes"),
+	})
+	return nil
+}
+
+func commandDoCopy(app *App, args []string) (err error) {
+	lines := app.win.CurrentLines()
+	for i := len(lines) - 1; i >= 0; i-- {
+		ev, ok := lines[i].Data.(irc.MessageEvent)
+		if !ok {
+			continue
+		}
+		content := ev.Content
+		if strings.HasPrefix(content, "\x01ACTION ") {
+			content = strings.TrimSuffix(content[len("\x01ACTION "):], "\x01")
+		}
+		app.win.CopyToClipboard(ui.IRCString(content).String())
+		return nil
+	}
+	return fmt.Errorf("no message to copy in this buffer")
+}
+
+func commandDoCopyURL(app *App, args []string) (err error) {
+	lines := app.win.CurrentLines()
+	for i := len(lines) - 1; i >= 0; i-- {
+		urls := lines[i].Body.URLs()
+		if len(urls) == 0 {
+			continue
+		}
+		app.win.CopyToClipboard(urls[len(urls)-1])
+		return nil
+	}
+	return fmt.Errorf("no link to copy in this buffer")
+}
+
+func commandDoSave(app *App, args []string) (err error) {
+	if app.cfg.Transient {
+		return fmt.Errorf("usage of SAVE is disabled")
+	}
+	netID, buffer := app.win.CurrentBuffer()
+	var path string
+	if len(args) > 0 {
+		path = args[0]
+	} else {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(cacheDir, "senpai", "saved")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		name := strings.Map(func(r rune) rune {
+			if r == '/' || r == filepath.Separator {
+				return '_'
+			}
+			return r
+		}, buffer)
+		if name == "" {
+			name = "home"
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s-%s.txt", name, time.Now().Format("20060102-150405")))
+	}
+
+	if err := saveLines(path, app.win.VisibleLines()); err != nil {
+		return err
+	}
+
+	app.win.AddLine(netID, buffer, ui.Line{
+		At:   time.Now(),
+		Head: "--",
+		Body: ui.PlainSprintf("Messages saved to %s", path),
+	})
+	return nil
+}
+
+// saveLines writes lines to a text file at path, without styles, each with its
+// time.
+func saveLines(path string, lines []ui.Line) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, line := range lines {
+		fmt.Fprint(w, line.At.Local().Format("2006-01-02 15:04:05"))
+		if line.Head != "" {
+			fmt.Fprintf(w, " %s", line.Head)
+		}
+		fmt.Fprintf(w, " %s\n", line.Body.String())
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func commandDoList(app *App, args []string) (err error) {
 	if app.cfg.Transient {
 		return fmt.Errorf("usage of LIST is disabled")
@@ -738,6 +1243,9 @@ func commandDoTopic(app *App, args []string) (err error) {
 	} else {
 		s := app.sessions[netID]
 		if s != nil {
+			if !s.IsChannel(buffer) {
+				return fmt.Errorf("this is not a channel")
+			}
 			s.ChangeTopic(buffer, args[0])
 			ok = true
 		}
@@ -809,25 +1317,35 @@ func commandDoKick(app *App, args []string) (err error) {
 	if s == nil {
 		return errOffline
 	}
+	channel, comment, err := kickArgs(s, channel, args)
+	if err != nil {
+		return err
+	}
+	s.Kick(nick, channel, comment)
+	return nil
+}
+
+// kickArgs returns the channel and the comment of the arguments of KICK and
+// KICKBAN, <nick> [channel] [message], given the current channel.
+func kickArgs(s *irc.Session, channel string, args []string) (string, string, error) {
 	// Check whether the argument after the user is a channel, to accept both:
 	// - KICK user #chan you are mean
 	// - KICK user you are mean
-	comment := ""
+	var comment []string
 	if len(args) >= 2 {
 		if s.IsChannel(args[1]) {
 			channel = args[1]
 		} else {
-			comment = args[1] + " "
+			comment = append(comment, args[1])
 		}
 	}
 	if channel == "" {
-		return fmt.Errorf("either send this command from a channel, or specify the channel")
+		return "", "", fmt.Errorf("either send this command from a channel, or specify the channel")
 	}
 	if len(args) == 3 {
-		comment += args[2]
+		comment = append(comment, args[2])
 	}
-	s.Kick(nick, channel, comment)
-	return nil
+	return channel, strings.Join(comment, " "), nil
 }
 
 func commandDoBan(app *App, args []string) (err error) {
@@ -842,7 +1360,23 @@ func commandDoBan(app *App, args []string) (err error) {
 	} else if channel == "" {
 		return fmt.Errorf("either send this command from a channel, or specify the channel")
 	}
-	s.ChangeMode(channel, "+b", []string{nick})
+	s.ChangeMode(channel, "+b", []string{s.BanMask(nick)})
+	return nil
+}
+
+func commandDoKickBan(app *App, args []string) (err error) {
+	nick := args[0]
+	netID, channel := app.win.CurrentBuffer()
+	s := app.sessions[netID]
+	if s == nil {
+		return errOffline
+	}
+	channel, comment, err := kickArgs(s, channel, args)
+	if err != nil {
+		return err
+	}
+	s.ChangeMode(channel, "+b", []string{s.BanMask(nick)})
+	s.Kick(nick, channel, comment)
 	return nil
 }
 
@@ -858,25 +1392,56 @@ func commandDoUnban(app *App, args []string) (err error) {
 	} else if channel == "" {
 		return fmt.Errorf("either send this command from a channel, or specify the channel")
 	}
-	s.ChangeMode(channel, "-b", []string{nick})
+	masks := unbanMasks(s, nick)
+	s.ChangeMode(channel, "-"+strings.Repeat("b", len(masks)), masks)
 	return nil
 }
 
+// unbanMasks returns the masks to remove to unban target: the mask BanMask
+// returns, and the mask of its nick, in case they were banned while their host
+// was unknown.
+func unbanMasks(s *irc.Session, target string) []string {
+	masks := []string{s.BanMask(target)}
+	if nickMask := target + "!*@*"; masks[0] != target && masks[0] != nickMask {
+		masks = append(masks, nickMask)
+	}
+	return masks
+}
+
 func commandDoSearch(app *App, args []string) (err error) {
 	if len(args) == 0 {
 		app.win.CloseOverlay()
+		app.overlayLines = nil
 		return nil
 	}
 	text := args[0]
+	app.win.CloseOverlay()
+	app.overlayLines = nil
 	netID, channel := app.win.CurrentBuffer()
 	s := app.sessions[netID]
-	if s == nil {
-		return errOffline
+	if s != nil && s.HasCapability("soju.im/search") {
+		s.Search(channel, text)
+		return nil
+	}
+	// Without server support, search the messages loaded in the buffer.
+	text = strings.ToLower(text)
+	var results []ui.Line
+	for _, line := range app.win.CurrentLines() {
+		ev, ok := line.Data.(irc.MessageEvent)
+		if !ok || !strings.Contains(strings.ToLower(ui.IRCString(ev.Content).String()), text) {
+			continue
+		}
+		line.Data = searchResult{
+			netID:  netID,
+			buffer: channel,
+			ev:     ev,
+		}
+		results = append(results, line)
 	}
-	if !s.HasCapability("soju.im/search") {
-		return errors.New("server does not support searching")
+	if len(results) == 0 {
+		return fmt.Errorf("no loaded message matches %q", args[0])
 	}
-	s.Search(channel, text)
+	app.openOverlay("Press Escape to close the search results", results)
 	return nil
 }
 
@@ -890,6 +1455,7 @@ func commandDoAway(app *App, args []string) (err error) {
 		return errOffline
 	}
 	s.Away(reason)
+	app.win.SetAway(time.Now())
 	return nil
 }
 
@@ -899,6 +1465,7 @@ func commandDoBack(app *App, args []string) (err error) {
 		return errOffline
 	}
 	s.Away("")
+	app.win.SetBack(time.Now())
 	return nil
 }
 
@@ -946,6 +1513,72 @@ func fieldsN(s string, n int) []string {
 	return a
 }
 
+// commandArgs splits the arguments of a command. Spaces around arguments are
+// dropped, except at the end of message text, which is sent as typed.
+func commandArgs(cmd *command, rawArgs string) []string {
+	if rawArgs == "" || cmd.MaxArgs == 0 {
+		return nil
+	}
+	args := fieldsN(rawArgs, cmd.MaxArgs)
+	if cmd.Text && len(args) == cmd.MaxArgs {
+		args[len(args)-1] += rawArgs[len(strings.TrimRightFunc(rawArgs, unicode.IsSpace)):]
+	}
+	return args
+}
+
+// findCommand returns the name of the command designated by cmdName: the
+// command of that name, or else the only one that starts with it. It returns
+// "" if there is no such command.
+func findCommand(cmdName string) (string, error) {
+	if strings.HasPrefix("BUFFER", cmdName) {
+		return "BUFFER", nil
+	}
+	if _, ok := commands[cmdName]; ok {
+		// An exact match takes precedence over prefix matches.
+		return cmdName, nil
+	}
+	var chosen string
+	for key := range commands {
+		if !strings.HasPrefix(key, cmdName) {
+			continue
+		}
+		if chosen != "" {
+			return "", fmt.Errorf("ambiguous command %q (could mean %v or %v)", cmdName, chosen, key)
+		}
+		chosen = key
+	}
+	return chosen, nil
+}
+
+// messageTextStart returns the index of the message text in the input text,
+// or -1 if it has none, as in commands whose arguments are only nicks or
+// channels, or whose message is not typed yet.
+func messageTextStart(text []rune) int {
+	content := string(text)
+	cmdName, rawArgs, isCommand := parseCommand(content)
+	if !isCommand {
+		return len(text) - len([]rune(rawArgs))
+	}
+	if cmdName == "" {
+		return -1
+	}
+	name, err := findCommand(cmdName)
+	if err != nil || name == "" {
+		return -1
+	}
+	cmd := commands[name]
+	if !cmd.Text {
+		return -1
+	}
+	args := fieldsN(rawArgs, cmd.MaxArgs)
+	if len(args) < cmd.MaxArgs {
+		return -1
+	}
+	// The message is the last argument, at the end of the input.
+	i := strings.LastIndex(content, args[len(args)-1])
+	return len([]rune(content[:i]))
+}
+
 func parseCommand(s string) (command, args string, isCommand bool) {
 	if len(s) == 0 || s[0] != '/' {
 		return "", s, false
@@ -963,13 +1596,22 @@ func parseCommand(s string) (command, args string, isCommand bool) {
 	return strings.ToUpper(s[1:i]), strings.TrimLeft(s[i:], " "), true
 }
 
+func commandDoReplyTo(app *App, args []string) (err error) {
+	_, buffer := app.win.CurrentBuffer()
+	return commandSendReply(app, buffer, args[1], args[0])
+}
+
 func commandSendMessage(app *App, target string, content string) error {
+	return commandSendReply(app, target, content, "")
+}
+
+func commandSendReply(app *App, target string, content string, replyTo string) error {
 	netID, _ := app.win.CurrentBuffer()
 	s := app.sessions[netID]
 	if s == nil {
 		return errOffline
 	}
-	s.PrivMsg(target, content)
+	s.PrivMsgReply(target, content, replyTo)
 	if !s.HasCapability("echo-message") {
 		buffer, line := app.formatMessage(s, irc.MessageEvent{
 			User:            s.Nick(),
@@ -978,8 +1620,11 @@ func commandSendMessage(app *App, target string, content string) error {
 			Command:         "PRIVMSG",
 			Content:         content,
 			Time:            time.Now(),
+			ReplyTo:         replyTo,
 		})
-		if buffer != "" && !s.IsChannel(target) {
+		if buffer == servicesBuffer {
+			app.win.AddBuffer(netID, "", buffer)
+		} else if buffer != "" && !s.IsChannel(target) {
 			app.monitor[netID][buffer] = struct{}{}
 			s.MonitorAdd(buffer)
 			s.ReadGet(buffer)
@@ -1020,23 +1665,12 @@ func (app *App) handleInput(buffer, content string) error {
 	if cmdName == "" {
 		return fmt.Errorf("lone slash at the beginning")
 	}
-	if strings.HasPrefix("BUFFER", cmdName) {
-		cmdName = "BUFFER"
-	}
 
-	var chosenCMDName string
-	var found bool
-	for key := range commands {
-		if !strings.HasPrefix(key, cmdName) {
-			continue
-		}
-		if found {
-			return fmt.Errorf("ambiguous command %q (could mean %v or %v)", cmdName, chosenCMDName, key)
-		}
-		chosenCMDName = key
-		found = true
+	chosenCMDName, err := findCommand(cmdName)
+	if err != nil {
+		return err
 	}
-	if !found {
+	if chosenCMDName == "" {
 		if confirmed {
 			if s := app.CurrentSession(); s != nil {
 				if rawArgs != "" {
@@ -1055,10 +1689,7 @@ func (app *App) handleInput(buffer, content string) error {
 
 	cmd := commands[chosenCMDName]
 
-	var args []string
-	if rawArgs != "" && cmd.MaxArgs != 0 {
-		args = fieldsN(rawArgs, cmd.MaxArgs)
-	}
+	args := commandArgs(cmd, rawArgs)
 
 	if len(args) < cmd.MinArgs {
 		return fmt.Errorf("usage: %s %s", chosenCMDName, cmd.Usage)
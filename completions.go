@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"git.sr.ht/~delthas/senpai/irc"
 	"git.sr.ht/~delthas/senpai/ui"
@@ -12,46 +14,153 @@ import (
 
 type completionAsync func(e irc.Event) []ui.Completion
 
-func (app *App) completionsChannelMembers(cs []ui.Completion, cursorIdx int, text []rune) []ui.Completion {
-	var start int
+// wordBeforeCursor returns the word of text that ends at the cursor, and the
+// index where it starts.
+func wordBeforeCursor(cursorIdx int, text []rune) (start int, word []rune) {
 	for start = cursorIdx - 1; 0 <= start; start-- {
 		if text[start] == ' ' {
 			break
 		}
 	}
 	start++
-	word := text[start:cursorIdx]
+	return start, text[start:cursorIdx]
+}
+
+// replaceWord returns the completion that replaces the word of text from
+// start to the cursor with comp.
+func replaceWord(text []rune, start, cursorIdx int, comp []rune) ui.Completion {
+	c := make([]rune, len(text)+len(comp)-(cursorIdx-start))
+	copy(c[:start], text[:start])
+	if cursorIdx < len(text) {
+		copy(c[start+len(comp):], text[cursorIdx:])
+	}
+	copy(c[start:], comp)
+	return ui.Completion{
+		StartIdx:  start,
+		EndIdx:    cursorIdx,
+		Text:      c,
+		CursorIdx: start + len(comp),
+	}
+}
+
+func (app *App) completionsChannelMembers(cs []ui.Completion, cursorIdx int, text []rune) []ui.Completion {
+	start, word := wordBeforeCursor(cursorIdx, text)
 	if len(word) == 0 {
 		return cs
 	}
 	netID, buffer := app.win.CurrentBuffer()
 	s := app.sessions[netID] // is not nil
 	wordCf := s.Casemap(string(word))
+	var nicks []string
 	for _, name := range s.Names(buffer) {
 		if strings.HasPrefix(s.Casemap(name.Name.Name), wordCf) {
-			nickComp := []rune(name.Name.Name)
-			if start == 0 {
-				nickComp = append(nickComp, ':')
-			}
+			nicks = append(nicks, name.Name.Name)
+		}
+	}
+	rankNicks(nicks, app.talkers[app.messageBoundKey(netID, buffer)], s.Casemap)
+	for _, nick := range nicks {
+		nickComp := []rune(nick)
+		if start == 0 {
+			nickComp = append(nickComp, []rune(app.cfg.NickSuffix)...)
+		} else {
 			nickComp = append(nickComp, ' ')
-			c := make([]rune, len(text)+len(nickComp)-len(word))
-			copy(c[:start], text[:start])
-			if cursorIdx < len(text) {
-				copy(c[start+len(nickComp):], text[cursorIdx:])
-			}
-			copy(c[start:], nickComp)
-			cs = append(cs, ui.Completion{
-				StartIdx:  start,
-				EndIdx:    cursorIdx,
-				Text:      c,
-				Display:   []rune(name.Name.Name),
-				CursorIdx: start + len(nickComp),
-			})
 		}
+		c := replaceWord(text, start, cursorIdx, nickComp)
+		c.Display = []rune(nick)
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// rankNicks sorts nicks so that the users who spoke last come first, and the
+// others in alphabetical order. talkers is keyed by nicks mapped with casemap.
+func rankNicks(nicks []string, talkers map[string]time.Time, casemap func(string) string) {
+	sort.SliceStable(nicks, func(i, j int) bool {
+		ti := talkers[casemap(nicks[i])]
+		tj := talkers[casemap(nicks[j])]
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return strings.ToLower(nicks[i]) < strings.ToLower(nicks[j])
+	})
+}
+
+// completionsChannels completes channel names from the channels we are in and
+// the ones seen in LIST and NAMES replies, on the network of the current
+// buffer. In the server buffer of a network, the channels of all networks are
+// suggested.
+func (app *App) completionsChannels(cs []ui.Completion, cursorIdx int, text []rune) []ui.Completion {
+	start, word := wordBeforeCursor(cursorIdx, text)
+	if len(word) == 0 {
+		return cs
+	}
+	netID, buffer := app.win.CurrentBuffer()
+	for _, channel := range app.matchingChannels(netID, buffer, string(word)) {
+		chanComp := append([]rune(channel), ' ')
+		cs = append(cs, replaceWord(text, start, cursorIdx, chanComp))
 	}
 	return cs
 }
 
+// matchingChannels returns the sorted names of the channels to complete word
+// with in the given buffer, as in completionsChannels.
+func (app *App) matchingChannels(netID, buffer, word string) []string {
+	var netIDs []string
+	if buffer == "" {
+		for id := range app.sessions {
+			if id != netID {
+				netIDs = append(netIDs, id)
+			}
+		}
+	}
+	// The names from the current network take precedence.
+	netIDs = append(netIDs, netID)
+	found := make(map[string]string)
+	for _, id := range netIDs {
+		s := app.sessions[id]
+		if s == nil {
+			continue
+		}
+		for _, channel := range matchingChannels(s, app.seenChannels[id], word) {
+			found[strings.ToLower(channel)] = channel
+		}
+	}
+	names := make([]string, 0, len(found))
+	for _, channel := range found {
+		names = append(names, channel)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// matchingChannels returns the sorted names of the channels of s and of seen
+// that start with word, if word is a channel name.
+func matchingChannels(s *irc.Session, seen map[string]string, word string) []string {
+	if !s.IsChannel(word) {
+		return nil
+	}
+	wordCf := strings.ToLower(word)
+	found := make(map[string]string)
+	var channels []string
+	for _, channel := range seen {
+		channels = append(channels, channel)
+	}
+	// The names of joined channels take precedence.
+	channels = append(channels, s.Channels()...)
+	for _, channel := range channels {
+		channelCf := strings.ToLower(channel)
+		if strings.HasPrefix(channelCf, wordCf) {
+			found[channelCf] = channel
+		}
+	}
+	names := make([]string, 0, len(found))
+	for _, channel := range found {
+		names = append(names, channel)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (app *App) completionsJoin(cs []ui.Completion, cursorIdx int, text []rune) []ui.Completion {
 	if !hasPrefix(text[:cursorIdx], []rune("/join #")) {
 		return cs
@@ -74,23 +183,34 @@ func (app *App) completionsJoin(cs []ui.Completion, cursorIdx int, text []rune)
 
 	s.List(string(channel) + "*")
 
+	// Channels already completed by completionsChannels.
+	offered := make(map[string]struct{})
+	for _, c := range cs {
+		if c.StartIdx == 6 {
+			name := strings.TrimSpace(string(c.Text[c.StartIdx:c.CursorIdx]))
+			offered[strings.ToLower(name)] = struct{}{}
+		}
+	}
 	cs = append(cs, ui.Completion{
 		Async: completionAsync(func(e irc.Event) []ui.Completion {
 			l, ok := e.(irc.ListEvent)
 			if !ok {
 				return nil
 			}
-			cs := make([]ui.Completion, len(l))
-			for i, e := range l {
+			cs := make([]ui.Completion, 0, len(l))
+			for _, e := range l {
+				if _, ok := offered[strings.ToLower(e.Channel)]; ok {
+					continue
+				}
 				text := []rune("/join ")
 				text = append(text, []rune(e.Channel)...)
 				text = append(text, post...)
-				cs[i] = ui.Completion{
+				cs = append(cs, ui.Completion{
 					StartIdx:  6,
 					EndIdx:    6 + len([]rune(e.Channel)),
 					Text:      text,
 					CursorIdx: cursorIdx + len([]rune(e.Channel)) - len(channel),
-				}
+				})
 			}
 			return cs
 		}),
@@ -252,6 +372,56 @@ func (app *App) completionsCommands(cs []ui.Completion, cursorIdx int, text []ru
 	return cs
 }
 
+// rawCommands is the list of IRC commands offered for completion of raw
+// messages.
+var rawCommands = []string{
+	"ADMIN", "AUTHENTICATE", "AWAY", "CAP", "CHATHISTORY", "INFO", "INVITE",
+	"ISON", "JOIN", "KICK", "KILL", "LINKS", "LIST", "LUSERS", "MODE", "MONITOR",
+	"MOTD", "NAMES", "NICK", "NOTICE", "OPER", "PART", "PING", "PONG",
+	"PRIVMSG", "QUIT", "SETNAME", "STATS", "TAGMSG", "TIME", "TOPIC", "USERHOST",
+	"VERSION", "WALLOPS", "WHO", "WHOIS", "WHOWAS",
+}
+
+func (app *App) completionsRaw(cs []ui.Completion, cursorIdx int, text []rune) []ui.Completion {
+	var prefix []rune
+	for _, p := range []string{"/quote ", "/raw "} {
+		if hasPrefix(text, []rune(p)) {
+			prefix = []rune(p)
+			break
+		}
+	}
+	if prefix == nil || cursorIdx < len(prefix) {
+		return cs
+	}
+	for i := len(prefix); i < cursorIdx; i++ {
+		if text[i] == ' ' {
+			return cs
+		}
+	}
+	if cursorIdx < len(text) && text[cursorIdx] != ' ' {
+		return cs
+	}
+
+	uText := strings.ToUpper(string(text[len(prefix):cursorIdx]))
+	for _, name := range rawCommands {
+		if strings.HasPrefix(name, uText) {
+			c := make([]rune, 0, len(text)+len(name)+1)
+			c = append(c, prefix...)
+			c = append(c, []rune(name)...)
+			c = append(c, ' ')
+			c = append(c, text[cursorIdx:]...)
+
+			cs = append(cs, ui.Completion{
+				StartIdx:  len(prefix),
+				EndIdx:    cursorIdx,
+				Text:      c,
+				CursorIdx: len(prefix) + len(name) + 1,
+			})
+		}
+	}
+	return cs
+}
+
 func (app *App) completionsEmoji(cs []ui.Completion, cursorIdx int, text []rune) []ui.Completion {
 	var start int
 	for start = cursorIdx - 1; start >= 0; start-- {
@@ -290,6 +460,47 @@ func (app *App) completionsEmoji(cs []ui.Completion, cursorIdx int, text []rune)
 	return cs
 }
 
+// ircColorNames are the names of the standard IRC colors, by color code.
+var ircColorNames = [16]string{
+	"white",
+	"black",
+	"blue",
+	"green",
+	"red",
+	"brown",
+	"magenta",
+	"orange",
+	"yellow",
+	"light green",
+	"cyan",
+	"light cyan",
+	"light blue",
+	"pink",
+	"grey",
+	"light grey",
+}
+
+func (app *App) completionsColor(cs []ui.Completion, cursorIdx int, text []rune) []ui.Completion {
+	if cursorIdx == 0 || text[cursorIdx-1] != 0x03 {
+		return cs
+	}
+	for code, name := range ircColorNames {
+		color := []rune(fmt.Sprintf("%02d", code))
+		c := make([]rune, 0, len(text)+len(color))
+		c = append(c, text[:cursorIdx]...)
+		c = append(c, color...)
+		c = append(c, text[cursorIdx:]...)
+		cs = append(cs, ui.Completion{
+			StartIdx:  cursorIdx,
+			EndIdx:    cursorIdx,
+			Text:      c,
+			Display:   []rune(fmt.Sprintf("%s (%s)", string(color), name)),
+			CursorIdx: cursorIdx + len(color),
+		})
+	}
+	return cs
+}
+
 func hasPrefix(s, prefix []rune) bool {
 	return len(prefix) <= len(s) && equal(prefix, s[:len(prefix)])
 }
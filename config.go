@@ -1,16 +1,24 @@
 package senpai
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"git.sr.ht/~rockorager/vaxis"
+	"github.com/rivo/uniseg"
 
+	"git.sr.ht/~delthas/senpai/irc"
 	"git.sr.ht/~delthas/senpai/ui"
 
 	"git.sr.ht/~emersion/go-scfg"
@@ -86,6 +94,29 @@ func parseColor(s string, c *vaxis.Color) error {
 	return nil
 }
 
+type NoticeRouting int
+
+const (
+	// NoticeRoutingCurrent shows server notices in the current buffer.
+	NoticeRoutingCurrent NoticeRouting = iota
+	// NoticeRoutingServer shows server notices in the server buffer.
+	NoticeRoutingServer
+)
+
+type JoinVerbosity int
+
+const (
+	// JoinVerbosityFull shows every join, part and quit.
+	JoinVerbosityFull JoinVerbosity = iota
+	// JoinVerbositySmart shows joins, parts and quits of users who talked
+	// recently in the channel.
+	JoinVerbositySmart
+	// JoinVerbosityCompact shows joins, parts and quits as a "+3/-1" summary.
+	JoinVerbosityCompact
+	// JoinVerbosityOff hides joins, parts and quits.
+	JoinVerbosityOff
+)
+
 type Config struct {
 	Addr          string
 	Nick          string
@@ -94,21 +125,68 @@ type Config struct {
 	Password      *string
 	TLS           bool
 	TLSSkipVerify bool
+	Proxy         *url.URL
+	LocalAddr     net.IP // local address to connect from, if any
+
+	TLSFingerprint []byte           // SHA-256 fingerprint of the pinned server certificate
+	TLSCertificate *tls.Certificate // client certificate, for CertFP
+
+	AllowPlaintextPassword bool // allow sending the password without TLS
 
-	Channels []string
+	Channels   []string
+	FloodLimit irc.FloodLimit
 
 	Typings bool
 	Mouse   bool
 
-	Highlights       []string
-	OnHighlightPath  string
-	OnHighlightBeep  bool
-	ChanColWidth     int
-	ChanColEnabled   bool
-	MemberColWidth   int
-	MemberColEnabled bool
-	TextMaxWidth     int
-	StatusEnabled    bool
+	ImagePreviews        bool
+	ImagePreviewsMaxSize int64
+
+	Highlights        []string
+	HighlightAccounts []string
+	OnHighlightPath   string
+	OnHighlightBeep   bool
+	HighlightWindow   time.Duration
+	GroupAuthors      time.Duration
+	OnEventPath       string
+	OnEvents          map[string]struct{}
+	ChanColWidth      int
+	ChanColEnabled    bool
+	MemberColWidth    int
+	MemberColEnabled  bool
+	TextMaxWidth      int
+	StatusEnabled     bool
+	StatusActivity    bool
+	CycleStatus       bool
+	HideServerBuffers bool
+	CompletionPopup   bool
+	CJKLineBreak      bool
+	EscapeBidi        bool
+	ConnectProgress   bool
+	ServicesBuffer    bool
+	Services          []string
+	EditedMarker      bool
+	UnreadRuler       rune // character of the unread ruler, or 0 to hide it
+
+	HomeName       string
+	PartMessage    string
+	QuitMessage    string
+	PromptFormat   string
+	NickSuffix     string
+	Notices        NoticeRouting
+	HiddenNumerics map[string]struct{}
+	BanPatterns    []string
+	Motd           bool
+	StripPaste     bool
+	PasteConfirm   int
+	Joins          JoinVerbosity
+	HistoryPage    int
+	HistoryInitial int
+	OverlayPage    int
+	DictionaryPath string
+	AutoAway       time.Duration
+	ResumeJump     time.Duration
+	AutoAwayReason string
 
 	Colors ui.ConfigColors
 
@@ -135,21 +213,55 @@ func Defaults() Config {
 		TLS:              true,
 		TLSSkipVerify:    false,
 		Channels:         nil,
+		FloodLimit:       irc.DefaultFloodLimit,
+		HistoryPage:      200,
+		HistoryInitial:   500,
+		OverlayPage:      500,
+		PasteConfirm:     5,
+		StripPaste:       true,
 		Typings:          true,
 		Mouse:            true,
 		Highlights:       nil,
 		OnHighlightPath:  "",
 		OnHighlightBeep:  false,
+		HighlightWindow:  5 * time.Second,
 		ChanColWidth:     16,
 		ChanColEnabled:   true,
 		MemberColWidth:   16,
 		MemberColEnabled: true,
 		TextMaxWidth:     0,
 		StatusEnabled:    true,
+		StatusActivity:   false,
+		EscapeBidi:       true,
+		CompletionPopup:  true,
+		ConnectProgress:  true,
+		Services:         []string{"NickServ", "ChanServ", "MemoServ", "OperServ", "HostServ", "BotServ"},
+		EditedMarker:     true,
+		UnreadRuler:      '─',
+		HomeName:         "",
+		PartMessage:      "senpai",
+		QuitMessage:      "senpai",
+		PromptFormat:     "{nick}",
+		NickSuffix:       ": ",
+		Notices:          NoticeRoutingCurrent,
+		AutoAwayReason:   "idle",
+		ResumeJump:       30 * time.Second,
+		BanPatterns:      []string{"banned", "K-lined", "G-lined", "Z-lined", "D-lined"},
+		HiddenNumerics: map[string]struct{}{
+			"002": {},
+			"003": {},
+			"004": {},
+			"422": {},
+		},
+		Motd:                 true,
+		ImagePreviewsMaxSize: 5 * 1024 * 1024,
 		Colors: ui.ConfigColors{
-			Status: ui.ColorGray,
-			Prompt: vaxis.Color(0),
-			Unread: vaxis.Color(0),
+			Status:       ui.ColorGray,
+			Prompt:       vaxis.Color(0),
+			Unread:       vaxis.Color(0),
+			UnreadStatus: ui.ColorGray,
+			Highlights:   ui.ColorRed,
+			Ruler:        ui.ColorGray,
 			Nicks: ui.ColorScheme{
 				Type:   ui.ColorSchemeBase,
 				Others: vaxis.Color(0),
@@ -169,7 +281,7 @@ func ParseAddr(addr string, cfg *Config) error {
 	if !strings.Contains(addr, "://") {
 		addr = "irc://" + addr
 	}
-	u, err := url.Parse(addr)
+	u, err := url.Parse(bracketIPv6(addr))
 	if err != nil {
 		return err
 	}
@@ -194,6 +306,9 @@ func ParseAddr(addr string, cfg *Config) error {
 			cfg.Password = nil
 		}
 	}
+	if _, err := addrWithPort(u.Host, cfg.TLS); err != nil {
+		return err
+	}
 	cfg.Addr = u.Host
 	target, _, _ := strings.Cut(strings.TrimLeft(u.Path, "/"), "/")
 	if target != "" {
@@ -202,6 +317,77 @@ func ParseAddr(addr string, cfg *Config) error {
 	return nil
 }
 
+// isLoopback reports whether addr, a host with an optional port, is on the
+// local machine, so that traffic to it cannot be intercepted.
+func isLoopback(addr string) bool {
+	addr, err := addrWithPort(addr, false)
+	if err != nil {
+		return false
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// bracketIPv6 wraps a bare IPv6 literal host of an IRC URL in brackets, so
+// that its colons are not mistaken for a port separator.
+func bracketIPv6(addr string) string {
+	scheme, rest, _ := strings.Cut(addr, "://")
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+	authority := rest[:end]
+	host := authority[strings.LastIndexByte(authority, '@')+1:]
+	if !isIPv6(host) {
+		return addr
+	}
+	userinfo := authority[:len(authority)-len(host)]
+	return scheme + "://" + userinfo + "[" + host + "]" + rest[end:]
+}
+
+// isIPv6 reports whether host is an IPv6 literal without brackets, with an
+// optional zone.
+func isIPv6(host string) bool {
+	ip, _, _ := strings.Cut(host, "%")
+	return strings.Contains(ip, ":") && net.ParseIP(ip) != nil
+}
+
+// addrWithPort returns addr, a host with an optional port, with the default
+// IRC port if it has none.
+func addrWithPort(addr string, tls bool) (string, error) {
+	if isIPv6(addr) {
+		addr = "[" + addr + "]"
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// No port, or malformed.
+		host = addr
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+			if !isIPv6(host) {
+				return "", fmt.Errorf("invalid address %q: expected an IPv6 address between brackets", addr)
+			}
+		} else if strings.ContainsAny(host, "[]:") {
+			return "", fmt.Errorf("invalid address %q", addr)
+		}
+		if tls {
+			port = "6697"
+		} else {
+			port = "6667"
+		}
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid address %q: invalid port %q", addr, port)
+	}
+	if host == "" {
+		return "", fmt.Errorf("invalid address %q: missing host", addr)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
 func LoadConfigFile(filename string) (Config, error) {
 	cfg := Defaults()
 
@@ -212,9 +398,24 @@ func LoadConfigFile(filename string) (Config, error) {
 	if err := ParseAddr(cfg.Addr, &cfg); err != nil {
 		return Config{}, err
 	}
+	if !cfg.TLS && (cfg.TLSFingerprint != nil || cfg.TLSCertificate != nil) {
+		return Config{}, errors.New("tls-fingerprint and tls-certificate require TLS")
+	}
 	return cfg, nil
 }
 
+// parseFingerprint parses a hex-encoded SHA-256 fingerprint, optionally with
+// colons between bytes, as printed by:
+//
+//	openssl x509 -noout -fingerprint -sha256
+func parseFingerprint(s string) ([]byte, error) {
+	fingerprint, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(fingerprint) != sha256.Size {
+		return nil, fmt.Errorf("invalid TLS fingerprint %q: must be a hex-encoded SHA-256 hash", s)
+	}
+	return fingerprint, nil
+}
+
 func unmarshal(filename string, cfg *Config) (err error) {
 	directives, err := scfg.Load(filename)
 	if err != nil {
@@ -272,6 +473,8 @@ func unmarshal(filename string, cfg *Config) (err error) {
 			cfg.Channels = append(cfg.Channels, d.Params...)
 		case "highlight":
 			cfg.Highlights = append(cfg.Highlights, d.Params...)
+		case "highlight-account":
+			cfg.HighlightAccounts = append(cfg.HighlightAccounts, d.Params...)
 		case "on-highlight-path":
 			if err := d.ParseParams(&cfg.OnHighlightPath); err != nil {
 				return err
@@ -285,6 +488,173 @@ func unmarshal(filename string, cfg *Config) (err error) {
 			if cfg.OnHighlightBeep, err = strconv.ParseBool(onHighlightBeep); err != nil {
 				return err
 			}
+		case "on-highlight-coalesce":
+			var window string
+			if err := d.ParseParams(&window); err != nil {
+				return err
+			}
+
+			if cfg.HighlightWindow, err = time.ParseDuration(window); err != nil {
+				return err
+			}
+			if cfg.HighlightWindow < 0 {
+				return fmt.Errorf("invalid on-highlight-coalesce duration: %s", window)
+			}
+		case "group-authors":
+			var window string
+			if err := d.ParseParams(&window); err != nil {
+				return err
+			}
+
+			if cfg.GroupAuthors, err = time.ParseDuration(window); err != nil {
+				return err
+			}
+			if cfg.GroupAuthors < 0 {
+				return fmt.Errorf("invalid group-authors duration: %s", window)
+			}
+		case "auto-away":
+			var idle string
+			if err := d.ParseParams(&idle); err != nil {
+				return err
+			}
+
+			if cfg.AutoAway, err = time.ParseDuration(idle); err != nil {
+				return err
+			}
+			if cfg.AutoAway < 0 {
+				return fmt.Errorf("invalid auto-away duration: %s", idle)
+			}
+			if len(d.Params) > 1 {
+				cfg.AutoAwayReason = d.Params[1]
+			}
+		case "reconnect-on-resume":
+			var jump string
+			if err := d.ParseParams(&jump); err != nil {
+				return err
+			}
+
+			if cfg.ResumeJump, err = time.ParseDuration(jump); err != nil {
+				return err
+			}
+			if cfg.ResumeJump < 0 {
+				return fmt.Errorf("invalid reconnect-on-resume duration: %s", jump)
+			}
+		case "services-buffer":
+			var servicesBuffer string
+			if err := d.ParseParams(&servicesBuffer); err != nil {
+				return err
+			}
+
+			if cfg.ServicesBuffer, err = strconv.ParseBool(servicesBuffer); err != nil {
+				return err
+			}
+		case "services":
+			cfg.Services = d.Params
+		case "edited-marker":
+			var marker string
+			if err := d.ParseParams(&marker); err != nil {
+				return err
+			}
+
+			if cfg.EditedMarker, err = strconv.ParseBool(marker); err != nil {
+				return err
+			}
+		case "connect-progress":
+			var progress string
+			if err := d.ParseParams(&progress); err != nil {
+				return err
+			}
+
+			if cfg.ConnectProgress, err = strconv.ParseBool(progress); err != nil {
+				return err
+			}
+		case "allow-plaintext-password":
+			var allow string
+			if err := d.ParseParams(&allow); err != nil {
+				return err
+			}
+
+			if cfg.AllowPlaintextPassword, err = strconv.ParseBool(allow); err != nil {
+				return err
+			}
+		case "tls-skip-verify":
+			var skip string
+			if err := d.ParseParams(&skip); err != nil {
+				return err
+			}
+
+			if cfg.TLSSkipVerify, err = strconv.ParseBool(skip); err != nil {
+				return err
+			}
+		case "tls-fingerprint":
+			var fingerprint string
+			if err := d.ParseParams(&fingerprint); err != nil {
+				return err
+			}
+
+			if cfg.TLSFingerprint, err = parseFingerprint(fingerprint); err != nil {
+				return err
+			}
+		case "tls-certificate":
+			var certFile string
+			if err := d.ParseParams(&certFile); err != nil {
+				return err
+			}
+			keyFile := certFile
+			if len(d.Params) > 1 {
+				keyFile = d.Params[1]
+			}
+
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return fmt.Errorf("failed to load the TLS client certificate: %v", err)
+			}
+			cfg.TLSCertificate = &cert
+		case "proxy":
+			var proxy string
+			if err := d.ParseParams(&proxy); err != nil {
+				return err
+			}
+
+			u, err := url.Parse(proxy)
+			if err != nil {
+				return fmt.Errorf("invalid proxy URL: %v", err)
+			}
+			switch u.Scheme {
+			case "socks5", "socks5h", "http":
+			default:
+				return fmt.Errorf("unsupported proxy scheme %q: must be socks5, socks5h or http", u.Scheme)
+			}
+			if u.Host == "" {
+				return fmt.Errorf("invalid proxy URL %q: missing host", proxy)
+			}
+			cfg.Proxy = u
+		case "bind":
+			var addr string
+			if err := d.ParseParams(&addr); err != nil {
+				return err
+			}
+
+			if cfg.LocalAddr = net.ParseIP(addr); cfg.LocalAddr == nil {
+				return fmt.Errorf("invalid bind address %q: must be an IP address", addr)
+			}
+		case "on-event":
+			if len(d.Params) < 2 {
+				return fmt.Errorf("on-event requires a path and at least one event type")
+			}
+			if cfg.OnEventPath != "" {
+				return fmt.Errorf("on-event can only be specified once")
+			}
+			cfg.OnEventPath = d.Params[0]
+			cfg.OnEvents = make(map[string]struct{})
+			for _, typ := range d.Params[1:] {
+				switch typ {
+				case "highlight", "query", "invite", "connect", "disconnect":
+				default:
+					return fmt.Errorf("unknown on-event event type %q", typ)
+				}
+				cfg.OnEvents[typ] = struct{}{}
+			}
 		case "pane-widths":
 			for _, child := range d.Children {
 				switch child.Name {
@@ -337,6 +707,153 @@ func unmarshal(filename string, cfg *Config) (err error) {
 					return fmt.Errorf("unknown directive %q", child.Name)
 				}
 			}
+		case "home-name":
+			if err := d.ParseParams(&cfg.HomeName); err != nil {
+				return err
+			}
+		case "notices":
+			var notices string
+			if err := d.ParseParams(&notices); err != nil {
+				return err
+			}
+
+			switch notices {
+			case "current":
+				cfg.Notices = NoticeRoutingCurrent
+			case "server":
+				cfg.Notices = NoticeRoutingServer
+			default:
+				return fmt.Errorf("unknown notices value %q", notices)
+			}
+		case "hidden-numerics":
+			cfg.HiddenNumerics = make(map[string]struct{}, len(d.Params))
+			for _, numeric := range d.Params {
+				if len(numeric) != 3 || strings.Trim(numeric, "0123456789") != "" {
+					return fmt.Errorf("invalid numeric %q: must be three digits", numeric)
+				}
+				cfg.HiddenNumerics[numeric] = struct{}{}
+			}
+		case "ban-patterns":
+			cfg.BanPatterns = d.Params
+		case "motd":
+			var motd string
+			if err := d.ParseParams(&motd); err != nil {
+				return err
+			}
+
+			if cfg.Motd, err = strconv.ParseBool(motd); err != nil {
+				return err
+			}
+		case "strip-paste":
+			var stripPaste string
+			if err := d.ParseParams(&stripPaste); err != nil {
+				return err
+			}
+
+			if cfg.StripPaste, err = strconv.ParseBool(stripPaste); err != nil {
+				return err
+			}
+		case "paste-confirm":
+			var lines string
+			if err := d.ParseParams(&lines); err != nil {
+				return err
+			}
+
+			if cfg.PasteConfirm, err = strconv.Atoi(lines); err != nil {
+				return err
+			}
+			if cfg.PasteConfirm < 0 {
+				return fmt.Errorf("paste-confirm must be non-negative")
+			}
+		case "joins":
+			var joins string
+			if err := d.ParseParams(&joins); err != nil {
+				return err
+			}
+
+			switch joins {
+			case "full":
+				cfg.Joins = JoinVerbosityFull
+			case "smart":
+				cfg.Joins = JoinVerbositySmart
+			case "compact":
+				cfg.Joins = JoinVerbosityCompact
+			case "off":
+				cfg.Joins = JoinVerbosityOff
+			default:
+				return fmt.Errorf("unknown joins value %q", joins)
+			}
+		case "part-message":
+			if err := d.ParseParams(&cfg.PartMessage); err != nil {
+				return err
+			}
+		case "quit-message":
+			if err := d.ParseParams(&cfg.QuitMessage); err != nil {
+				return err
+			}
+		case "prompt":
+			if err := d.ParseParams(&cfg.PromptFormat); err != nil {
+				return err
+			}
+		case "nick-completion-suffix":
+			if err := d.ParseParams(&cfg.NickSuffix); err != nil {
+				return err
+			}
+		case "history-page-size":
+			var size string
+			if err := d.ParseParams(&size); err != nil {
+				return err
+			}
+
+			if cfg.HistoryPage, err = strconv.Atoi(size); err != nil {
+				return err
+			}
+			if cfg.HistoryPage <= 0 {
+				return fmt.Errorf("history-page-size must be positive")
+			}
+		case "history-initial":
+			var size string
+			if err := d.ParseParams(&size); err != nil {
+				return err
+			}
+
+			if cfg.HistoryInitial, err = strconv.Atoi(size); err != nil {
+				return err
+			}
+			if cfg.HistoryInitial < 0 {
+				return fmt.Errorf("history-initial must not be negative")
+			}
+		case "overlay-page-size":
+			var size string
+			if err := d.ParseParams(&size); err != nil {
+				return err
+			}
+
+			if cfg.OverlayPage, err = strconv.Atoi(size); err != nil {
+				return err
+			}
+			if cfg.OverlayPage <= 0 {
+				return fmt.Errorf("overlay-page-size must be positive")
+			}
+		case "flood-limit":
+			var lines, interval string
+			if err := d.ParseParams(&lines, &interval); err != nil {
+				return err
+			}
+
+			if cfg.FloodLimit.Lines, err = strconv.Atoi(lines); err != nil {
+				return err
+			}
+			if cfg.FloodLimit.Interval, err = time.ParseDuration(interval); err != nil {
+				return err
+			}
+			if cfg.FloodLimit.Lines < 0 || cfg.FloodLimit.Interval <= 0 {
+				return fmt.Errorf("invalid flood limit: %s lines per %s", lines, interval)
+			}
+		case "dictionary":
+			if err := d.ParseParams(&cfg.DictionaryPath); err != nil {
+				return err
+			}
 		case "tls":
 			var tls string
 			if err := d.ParseParams(&tls); err != nil {
@@ -364,6 +881,90 @@ func unmarshal(filename string, cfg *Config) (err error) {
 			if cfg.Mouse, err = strconv.ParseBool(mouse); err != nil {
 				return err
 			}
+		case "status-activity":
+			var statusActivity string
+			if err := d.ParseParams(&statusActivity); err != nil {
+				return err
+			}
+
+			if cfg.StatusActivity, err = strconv.ParseBool(statusActivity); err != nil {
+				return err
+			}
+		case "unread-cycle-status":
+			var cycleStatus string
+			if err := d.ParseParams(&cycleStatus); err != nil {
+				return err
+			}
+
+			if cfg.CycleStatus, err = strconv.ParseBool(cycleStatus); err != nil {
+				return err
+			}
+		case "hide-server-buffers":
+			var hideServerBuffers string
+			if err := d.ParseParams(&hideServerBuffers); err != nil {
+				return err
+			}
+
+			if cfg.HideServerBuffers, err = strconv.ParseBool(hideServerBuffers); err != nil {
+				return err
+			}
+		case "completion-popup":
+			var completionPopup string
+			if err := d.ParseParams(&completionPopup); err != nil {
+				return err
+			}
+
+			if cfg.CompletionPopup, err = strconv.ParseBool(completionPopup); err != nil {
+				return err
+			}
+		case "unread-ruler":
+			cfg.UnreadRuler = 0
+			if len(d.Params) > 0 {
+				r := []rune(d.Params[0])
+				if len(r) != 1 || uniseg.StringWidth(d.Params[0]) != 1 {
+					return fmt.Errorf("invalid unread-ruler %q: must be a single narrow character", d.Params[0])
+				}
+				cfg.UnreadRuler = r[0]
+			}
+		case "cjk-line-break":
+			var cjkLineBreak string
+			if err := d.ParseParams(&cjkLineBreak); err != nil {
+				return err
+			}
+
+			if cfg.CJKLineBreak, err = strconv.ParseBool(cjkLineBreak); err != nil {
+				return err
+			}
+		case "escape-bidi":
+			var escapeBidi string
+			if err := d.ParseParams(&escapeBidi); err != nil {
+				return err
+			}
+
+			if cfg.EscapeBidi, err = strconv.ParseBool(escapeBidi); err != nil {
+				return err
+			}
+		case "image-previews":
+			var imagePreviews string
+			if err := d.ParseParams(&imagePreviews); err != nil {
+				return err
+			}
+
+			if cfg.ImagePreviews, err = strconv.ParseBool(imagePreviews); err != nil {
+				return err
+			}
+		case "image-previews-max-size":
+			var maxSize string
+			if err := d.ParseParams(&maxSize); err != nil {
+				return err
+			}
+
+			if cfg.ImagePreviewsMaxSize, err = strconv.ParseInt(maxSize, 10, 64); err != nil {
+				return err
+			}
+			if cfg.ImagePreviewsMaxSize <= 0 {
+				return fmt.Errorf("image-previews-max-size must be positive")
+			}
 		case "colors":
 			for _, child := range d.Children {
 				var colorStr string
@@ -393,6 +994,20 @@ func unmarshal(filename string, cfg *Config) (err error) {
 					default:
 						return fmt.Errorf("unknown nick color scheme %q", colorStr)
 					}
+					for _, nicksChild := range child.Children {
+						switch nicksChild.Name {
+						case "account":
+							var byAccount string
+							if err := nicksChild.ParseParams(&byAccount); err != nil {
+								return err
+							}
+							if cfg.Colors.Nicks.ByAccount, err = strconv.ParseBool(byAccount); err != nil {
+								return err
+							}
+						default:
+							return fmt.Errorf("unknown nicks directive %q", nicksChild.Name)
+						}
+					}
 					continue
 				case "status":
 					if colorStr == "disabled" {
@@ -410,8 +1025,16 @@ func unmarshal(filename string, cfg *Config) (err error) {
 					cfg.Colors.Prompt = color
 				case "unread":
 					cfg.Colors.Unread = color
+				case "unread-status":
+					cfg.Colors.UnreadStatus = color
+				case "highlights":
+					cfg.Colors.Highlights = color
 				case "status":
 					cfg.Colors.Status = color
+				case "action":
+					cfg.Colors.Action = color
+				case "ruler":
+					cfg.Colors.Ruler = color
 				default:
 					return fmt.Errorf("unknown colors directive %q", child.Name)
 				}
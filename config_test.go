@@ -0,0 +1,178 @@
+package senpai
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.sr.ht/~rockorager/vaxis"
+
+	"git.sr.ht/~delthas/senpai/ui"
+)
+
+func TestAddrWithPort(t *testing.T) {
+	tests := []struct {
+		addr     string
+		tls      bool
+		expected string
+	}{
+		{"irc.example.org", true, "irc.example.org:6697"},
+		{"irc.example.org", false, "irc.example.org:6667"},
+		{"irc.example.org:7000", true, "irc.example.org:7000"},
+		{"1.2.3.4", true, "1.2.3.4:6697"},
+		{"[::1]", true, "[::1]:6697"},
+		{"[::1]", false, "[::1]:6667"},
+		{"[::1]:7000", true, "[::1]:7000"},
+		{"::1", true, "[::1]:6697"},
+		{"2001:db8::1", false, "[2001:db8::1]:6667"},
+		{"fe80::1%eth0", true, "[fe80::1%eth0]:6697"},
+	}
+	for _, test := range tests {
+		addr, err := addrWithPort(test.addr, test.tls)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.addr, err)
+		} else if addr != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.addr, test.expected, addr)
+		}
+	}
+
+	for _, addr := range []string{"", ":6697", "[]", "[irc.example.org]", "irc.example.org:", "irc.example.org:port", "irc.example.org:99999", "[::1"} {
+		if _, err := addrWithPort(addr, true); err == nil {
+			t.Errorf("%q: expected an error", addr)
+		}
+	}
+}
+
+func TestParseAddrIPv6(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected string
+	}{
+		{"::1", "[::1]"},
+		{"ircs://::1", "[::1]"},
+		{"ircs://user@::1/#senpai", "[::1]"},
+		{"[::1]:7000", "[::1]:7000"},
+		{"irc.example.org:7000", "irc.example.org:7000"},
+	}
+	for _, test := range tests {
+		cfg := Defaults()
+		if err := ParseAddr(test.addr, &cfg); err != nil {
+			t.Errorf("%q: unexpected error: %v", test.addr, err)
+		} else if cfg.Addr != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.addr, test.expected, cfg.Addr)
+		}
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		addr     string
+		expected bool
+	}{
+		{"localhost", true},
+		{"localhost:6667", true},
+		{"127.0.0.1", true},
+		{"127.0.0.1:6667", true},
+		{"[::1]:6667", true},
+		{"::1", true},
+		{"irc.example.org", false},
+		{"192.0.2.1:6667", false},
+		{"[2001:db8::1]", false},
+	}
+	for _, test := range tests {
+		if v := isLoopback(test.addr); v != test.expected {
+			t.Errorf("%q: expected %v, got %v", test.addr, test.expected, v)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "senpai.scfg")
+	for _, test := range []struct {
+		bind     string
+		expected string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"eth0", ""},
+		{"192.0.2.1:6667", ""},
+	} {
+		content := "address irc.example.org\nnickname senpai\nbind " + test.bind + "\n"
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfigFile(path)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.bind)
+			}
+		} else if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.bind, err)
+		} else if cfg.LocalAddr.String() != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.bind, test.expected, cfg.LocalAddr)
+		}
+	}
+}
+
+func TestDefaultsStripPaste(t *testing.T) {
+	cfg := Defaults()
+	bold := vaxis.Key{Keycode: 'b', Modifiers: vaxis.ModCtrl}
+	if r, ok := pasteKeyRune(bold, cfg.StripPaste); ok {
+		t.Errorf("expected formatting codes to be stripped from pastes by default, got %q", r)
+	}
+	if r, ok := pasteKeyRune(bold, false); !ok || r != 0x02 {
+		t.Errorf("expected the bold code to be kept in raw pastes, got %q", r)
+	}
+	if r, ok := pasteKeyRune(vaxis.Key{Keycode: '\r'}, cfg.StripPaste); !ok || r != '\n' {
+		t.Errorf("expected line breaks to be kept in pastes, got %q", r)
+	}
+}
+
+func TestOnEventOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "senpai.scfg")
+	content := "address irc.example.org\nnickname senpai\non-event /bin/a highlight\non-event /bin/b query\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfigFile(path); err == nil {
+		t.Errorf("expected an error for a repeated on-event")
+	}
+}
+
+func TestUnreadRulerWidth(t *testing.T) {
+	for _, test := range []struct {
+		ruler string
+		valid bool
+	}{
+		{"─", true},
+		{"-", true},
+		{"━━", false},
+		{"＝", false},
+		{"😀", false},
+	} {
+		path := filepath.Join(t.TempDir(), "senpai.scfg")
+		content := fmt.Sprintf("address irc.example.org\nnickname senpai\nunread-ruler %q\n", test.ruler)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfigFile(path); (err == nil) != test.valid {
+			t.Errorf("%q: expected valid to be %v, got error %v", test.ruler, test.valid, err)
+		}
+	}
+}
+
+func TestNickColorsAccount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "senpai.scfg")
+	content := "address irc.example.org\nnickname senpai\ncolors {\n\tnicks extended {\n\t\taccount true\n\t}\n}\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Colors.Nicks.ByAccount || cfg.Colors.Nicks.Type != ui.ColorSchemeExtended {
+		t.Errorf("expected extended nick colors by account, got %+v", cfg.Colors.Nicks)
+	}
+}
@@ -31,10 +31,21 @@ type EventClickLink struct {
 	Mouse bool
 }
 
+// EventClickLine is sent when the time of a line of an overlay is clicked.
+type EventClickLine struct {
+	EventClick
+	Data interface{} // data of the line
+}
+
 type EventImageLoaded struct {
 	Image image.Image // nil if error
 }
 
+type EventPreviewLoaded struct {
+	Link  string
+	Image image.Image // nil if error
+}
+
 type EventFileUpload struct {
 	Progress float64
 	Location string
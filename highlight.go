@@ -0,0 +1,97 @@
+package senpai
+
+import (
+	"time"
+
+	"git.sr.ht/~delthas/senpai/irc"
+)
+
+// highlight is a message notified to the user.
+type highlight struct {
+	nick  string // nickname of the sender
+	head  string // head of the line, as shown in the timeline
+	body  string
+	msgID string
+	count int // number of highlights coalesced into this one
+}
+
+// highlightFlush is sent to app.events when the highlights delayed for a
+// buffer should be notified.
+type highlightFlush boundKey
+
+type pendingHighlight struct {
+	s      *irc.Session
+	buffer string
+	h      highlight
+}
+
+// highlightCoalescer limits highlight notifications to one per window per
+// buffer. Highlights received during the window are merged into a single
+// notification, sent when the window ends.
+type highlightCoalescer struct {
+	window  time.Duration
+	last    map[boundKey]time.Time // time of the last notification per buffer
+	pending map[boundKey]*pendingHighlight
+}
+
+func newHighlightCoalescer(window time.Duration) highlightCoalescer {
+	return highlightCoalescer{
+		window:  window,
+		last:    make(map[boundKey]time.Time),
+		pending: make(map[boundKey]*pendingHighlight),
+	}
+}
+
+// add registers a highlight received at now in buffer, whose key is key. The
+// windows that ended are forgotten.
+//
+// run reports whether the highlight should be notified immediately. Otherwise,
+// if flushIn is positive, flush must be called after flushIn to notify the
+// highlights delayed so far.
+func (c *highlightCoalescer) add(key boundKey, s *irc.Session, buffer string, h highlight, now time.Time) (run bool, flushIn time.Duration) {
+	if c.window <= 0 {
+		return true, 0
+	}
+	c.forgetEnded(now)
+	last, ok := c.last[key]
+	if !ok || now.Sub(last) >= c.window {
+		c.last[key] = now
+		return true, 0
+	}
+	if p, ok := c.pending[key]; ok {
+		h.count += p.h.count
+		p.s = s
+		p.buffer = buffer
+		p.h = h
+		return false, 0
+	}
+	c.pending[key] = &pendingHighlight{
+		s:      s,
+		buffer: buffer,
+		h:      h,
+	}
+	return false, last.Add(c.window).Sub(now)
+}
+
+// flush returns the highlights delayed in the given buffer, merged into one,
+// and starts a new window at now. The windows that ended are forgotten.
+func (c *highlightCoalescer) flush(key boundKey, now time.Time) (s *irc.Session, buffer string, h highlight, ok bool) {
+	c.forgetEnded(now)
+	p, ok := c.pending[key]
+	if !ok {
+		return nil, "", highlight{}, false
+	}
+	delete(c.pending, key)
+	c.last[key] = now
+	return p.s, p.buffer, p.h, true
+}
+
+// forgetEnded forgets the buffers whose window ended at now, without pending
+// highlights.
+func (c *highlightCoalescer) forgetEnded(now time.Time) {
+	for k, last := range c.last {
+		if _, ok := c.pending[k]; !ok && now.Sub(last) >= c.window {
+			delete(c.last, k)
+		}
+	}
+}
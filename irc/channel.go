@@ -9,6 +9,8 @@ import (
 	"sync/atomic"
 	"time"
 	"unicode"
+
+	"golang.org/x/time/rate"
 )
 
 // special internal Message commands to propagate labeled response status to the writing goroutine
@@ -17,9 +19,106 @@ var labelDisableCommand = ":disable_labeled_response"
 
 const chanCapacity = 64
 
-func ChanInOut(conn net.Conn) (in <-chan Message, out chan<- Message) {
+// lagPrefix prefixes the payload of the PINGs sent to measure the lag.
+const lagPrefix = "lag-"
+
+func lagToken(t time.Time) string {
+	return lagPrefix + strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// parseLagToken returns the time at which the PING with the given payload was
+// sent, if it was sent to measure the lag.
+func parseLagToken(token string) (time.Time, bool) {
+	if !strings.HasPrefix(token, lagPrefix) {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(token[len(lagPrefix):], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
+
+// FloodLimit limits the rate of outgoing messages so as not to be
+// disconnected by the flood protection of servers: at most Lines messages are
+// sent per Interval. Messages exceeding the limit are queued.
+type FloodLimit struct {
+	Lines    int // if zero, the rate is not limited.
+	Interval time.Duration
+}
+
+// DefaultFloodLimit is similar to the limits of common servers: a burst of 10
+// messages, then one message per second.
+var DefaultFloodLimit = FloodLimit{
+	Lines:    10,
+	Interval: 10 * time.Second,
+}
+
+func (fl FloodLimit) limiter() *rate.Limiter {
+	if fl.Lines <= 0 || fl.Interval <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(float64(fl.Lines)/fl.Interval.Seconds()), fl.Lines)
+}
+
+// isUrgent reports whether msg is sent ahead of the other messages, without
+// waiting for the flood limit: replies to the PINGs of the server, which
+// disconnects us if they are late, and QUIT.
+func isUrgent(msg Message) bool {
+	return msg.Command == "PONG" || msg.Command == "QUIT"
+}
+
+// queueMessages forwards messages from in to out in order, buffering as many
+// as needed so that senders never block. Urgent messages are forwarded to
+// urgent instead, in order. It stops when in is closed and all messages are
+// forwarded, or when done is closed.
+func queueMessages(in <-chan Message, out, urgent chan<- Message, done <-chan struct{}) {
+	defer close(out)
+	defer close(urgent)
+	var queue, urgentQueue []Message
+	for in != nil || len(queue) > 0 || len(urgentQueue) > 0 {
+		var next, nextUrgent chan<- Message
+		var head, urgentHead Message
+		if len(queue) > 0 {
+			next = out
+			head = queue[0]
+		}
+		if len(urgentQueue) > 0 {
+			nextUrgent = urgent
+			urgentHead = urgentQueue[0]
+		}
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			if isUrgent(msg) {
+				urgentQueue = append(urgentQueue, msg)
+			} else {
+				queue = append(queue, msg)
+			}
+		case next <- head:
+			queue = queue[1:]
+		case nextUrgent <- urgentHead:
+			urgentQueue = urgentQueue[1:]
+		case <-done:
+			if in != nil {
+				for range in {
+				}
+			}
+			return
+		}
+	}
+}
+
+func ChanInOut(conn net.Conn, flood FloodLimit) (in <-chan Message, out chan<- Message) {
 	in_ := make(chan Message, chanCapacity)
 	out_ := make(chan Message, chanCapacity)
+	queued := make(chan Message)
+	urgent := make(chan Message)
+	done := make(chan struct{})
+	go queueMessages(out_, queued, urgent, done)
 
 	const keepAlive = 30 * time.Second
 	const maxRTT = 10 * time.Second
@@ -44,14 +143,33 @@ func ChanInOut(conn net.Conn) (in <-chan Message, out chan<- Message) {
 	}()
 
 	go func() {
+		defer close(done)
 		t := time.NewTicker(time.Second)
 		defer t.Stop()
+		limiter := flood.limiter()
 		labelOff := 1
 		labeledResponse := false
+		lastPing := time.Now()
+
+		// While a message waits for the flood limit, no other message is
+		// taken from queued, but urgent messages and keepalives are still
+		// handled.
+		var pending Message
+		var limited <-chan time.Time
+		send := func(msg Message) error {
+			last.Store(time.Now())
+			// TODO send messages by batches
+			_, err := fmt.Fprintf(conn, "%s\r\n", msg.String())
+			return err
+		}
 	outer:
 		for {
+			next := queued
+			if limited != nil {
+				next = nil
+			}
 			select {
-			case msg, ok := <-out_:
+			case msg, ok := <-next:
 				if !ok {
 					break outer
 				}
@@ -73,24 +191,44 @@ func ChanInOut(conn net.Conn) (in <-chan Message, out chan<- Message) {
 					}
 				}
 
-				last.Store(time.Now())
-				// TODO send messages by batches
-				_, err := fmt.Fprintf(conn, "%s\r\n", msg.String())
-				if err != nil {
+				if limiter != nil {
+					if d := limiter.Reserve().Delay(); d > 0 {
+						pending = msg
+						limited = time.After(d)
+						continue
+					}
+				}
+				if err := send(msg); err != nil {
 					break outer
 				}
-			case <-t.C:
-				now := time.Now()
-				if last.Load().(time.Time).Add(keepAlive).After(now) {
+			case msg, ok := <-urgent:
+				if !ok {
+					urgent = nil
 					continue
 				}
+				if err := send(msg); err != nil {
+					break outer
+				}
+			case <-limited:
+				limited = nil
+				if err := send(pending); err != nil {
+					break outer
+				}
+			case <-t.C:
+				now := time.Now()
 				if last.Load().(time.Time).Add(keepAlive + maxRTT).Before(now) {
 					// probably out of sleep, reset connection
 					conn.Close()
 					continue
 				}
+				// Ping periodically even when there is traffic, to
+				// measure the lag.
+				if lastPing.Add(keepAlive).After(now) {
+					continue
+				}
 				last.Store(now)
-				_, err := fmt.Fprint(conn, "PING _\r\n")
+				lastPing = now
+				_, err := fmt.Fprintf(conn, "PING %s\r\n", lagToken(now))
 				if err != nil {
 					break outer
 				}
@@ -0,0 +1,106 @@
+package irc
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFloodLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	const n = 6
+	flood := FloodLimit{
+		Lines:    2,
+		Interval: 100 * time.Millisecond,
+	}
+	_, out := ChanInOut(client, flood)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		out <- NewMessage("PRIVMSG", "#senpai", strconv.Itoa(i))
+	}
+	close(out)
+
+	r := bufio.NewScanner(server)
+	for i := 0; i < n; i++ {
+		if !r.Scan() {
+			t.Fatalf("expected %d messages, got %d", n, i)
+		}
+		msg, err := ParseMessage(r.Text())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Params[1] != strconv.Itoa(i) {
+			t.Fatalf("expected message #%d, got %q", i, msg.Params[1])
+		}
+	}
+	// 2 messages are sent at once, then one every 50ms.
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("expected messages to be delayed, all were sent in %v", d)
+	}
+}
+
+func TestFloodLimitUrgent(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	flood := FloodLimit{
+		Lines:    1,
+		Interval: time.Hour,
+	}
+	_, out := ChanInOut(client, flood)
+	r := bufio.NewScanner(server)
+	out <- NewMessage("PRIVMSG", "#senpai", "0")
+	if !r.Scan() {
+		t.Fatalf("expected the first message to be sent")
+	}
+	// The limit is reached: the next message waits for an hour.
+	out <- NewMessage("PRIVMSG", "#senpai", "1")
+	out <- NewMessage("PONG", "irc.example.org")
+	out <- NewMessage("QUIT", "bye")
+
+	for _, expected := range []string{"PONG", "QUIT"} {
+		if !r.Scan() {
+			t.Fatalf("expected %s to be sent", expected)
+		}
+		msg, err := ParseMessage(r.Text())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Command != expected {
+			t.Fatalf("expected %s to be sent ahead of the limited messages, got %q", expected, r.Text())
+		}
+	}
+}
+
+func TestSessionGoroutines(t *testing.T) {
+	client, server := net.Pipe()
+	in, out := ChanInOut(client, DefaultFloodLimit)
+	s := NewSession(out, SessionParams{
+		Nickname: "senpai",
+		Username: "senpai",
+		RealName: "senpai",
+	})
+	s.typings.Active("#senpai", "alice")
+
+	server.Close()
+	for range in {
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		s.Close()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the typing goroutines to stop when the session is closed")
+	}
+	if _, ok := <-s.TypingStops(); ok {
+		t.Errorf("expected the typing stops channel to be closed")
+	}
+}
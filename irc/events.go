@@ -17,6 +17,28 @@ type ErrorEvent struct {
 
 type RegisteredEvent struct{}
 
+// DisconnectEvent is sent when the server closes the connection on purpose,
+// with ERROR, or when an operator kills us with KILL.
+type DisconnectEvent struct {
+	Killer string // name of who killed us, empty unless killed
+	Reason string
+}
+
+// ConnectProgressEvent is sent when a step of the connection to the server is
+// done, before registration completes.
+type ConnectProgressEvent struct {
+	Message string
+}
+
+type NetworkNameEvent struct {
+	Name string
+}
+
+type MotdEvent struct {
+	Lines   []string
+	Connect bool // whether this is the message of the day sent on connection
+}
+
 type SelfNickEvent struct {
 	FormerNick string
 }
@@ -38,6 +60,7 @@ type UserJoinEvent struct {
 	User    string
 	Channel string
 	Time    time.Time
+	Netjoin bool // whether the user is rejoining after a netsplit
 }
 
 type SelfPartEvent struct {
@@ -54,6 +77,14 @@ type UserQuitEvent struct {
 	User     string
 	Channels []string
 	Time     time.Time
+	Message  string
+	Netsplit bool // whether the user quit because of a netsplit
+}
+
+type UserAwayEvent struct {
+	User    string
+	Message string
+	Time    time.Time
 }
 
 type UserOnlineEvent struct {
@@ -83,6 +114,14 @@ type InviteEvent struct {
 	Channel string
 }
 
+// WallopsEvent is a message broadcast to operators, or to users with the
+// wallops (+w) mode.
+type WallopsEvent struct {
+	Sender  string
+	Message string
+	Time    time.Time
+}
+
 type MessageEvent struct {
 	User            string
 	Target          string
@@ -90,6 +129,11 @@ type MessageEvent struct {
 	Command         string
 	Content         string
 	Time            time.Time
+	MsgID           string // unique ID of the message, if any
+	ReplyTo         string // ID of the message this message replies to, if any
+	Edits           string // ID of the message this message is a new version of, if any
+	Account         string // account of the sender, if known
+	FromServer      bool   // sent by a server (User is its name, or empty) rather than a user
 }
 
 type ListItem struct {
@@ -103,6 +147,7 @@ type ListEvent []ListItem
 type HistoryEvent struct {
 	Target   string
 	Messages []Event
+	Backward bool // whether older messages were requested (CHATHISTORY BEFORE or LATEST)
 }
 
 type HistoryTargetsEvent struct {
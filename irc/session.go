@@ -49,12 +49,71 @@ func (auth *SASLPlain) Respond(challenge string) (res string, err error) {
 	return
 }
 
+// SASLExternal authenticates with credentials sent outside of IRC, usually a
+// TLS client certificate (CertFP).
+type SASLExternal struct{}
+
+func (auth *SASLExternal) Early() bool {
+	return true
+}
+
+func (auth *SASLExternal) Handshake() (mech string) {
+	mech = "EXTERNAL"
+	return
+}
+
+func (auth *SASLExternal) Respond(challenge string) (res string, err error) {
+	if challenge != "+" {
+		err = errors.New("unexpected challenge")
+		return
+	}
+	res = "+"
+	return
+}
+
+// saslStrength ranks SASL mechanisms, the strongest first.
+func saslStrength(mech string) int {
+	switch {
+	case mech == "EXTERNAL":
+		return 3
+	case strings.HasPrefix(mech, "SCRAM-"):
+		return 2
+	case mech == "PLAIN":
+		return 1
+	default:
+		return 0
+	}
+}
+
+// selectSASL returns the strongest of clients whose mechanism is in mechs, or
+// nil if there is none.
+func selectSASL(clients []SASLClient, mechs []string) SASLClient {
+	var best SASLClient
+	for _, c := range clients {
+		mech := c.Handshake()
+		offered := false
+		for _, m := range mechs {
+			if strings.EqualFold(m, mech) {
+				offered = true
+				break
+			}
+		}
+		if offered && (best == nil || saslStrength(mech) > saslStrength(best.Handshake())) {
+			best = c
+		}
+	}
+	return best
+}
+
 // SupportedCapabilities is the set of capabilities supported by this library.
 var SupportedCapabilities = map[string]struct{}{
+	"account-notify":   {},
+	"account-tag":      {},
 	"away-notify":      {},
 	"batch":            {},
 	"cap-notify":       {},
 	"echo-message":     {},
+	"extended-join":    {},
 	"extended-monitor": {},
 	"invite-notify":    {},
 	"labeled-response": {},
@@ -67,6 +126,7 @@ var SupportedCapabilities = map[string]struct{}{
 
 	"draft/chathistory":               {},
 	"draft/event-playback":            {},
+	"draft/multiline":                 {},
 	"draft/read-marker":               {},
 	"soju.im/bouncer-networks-notify": {},
 	"soju.im/bouncer-networks":        {},
@@ -82,10 +142,71 @@ const (
 	TypingDone
 )
 
+// netjoinDelay is how long after quitting in a netsplit the joins of a user
+// are considered part of the netsplit recovery.
+const netjoinDelay = time.Hour
+
+// defaultHistoryLimit is the number of messages fetched by history requests
+// when no limit is set, and the server limit when it does not advertise one.
+const defaultHistoryLimit = 100
+
+// awayReplyInterval is how long the same RPL_AWAY reply for a user is not
+// reported again.
+const awayReplyInterval = 10 * time.Minute
+
+type awayReply struct {
+	message string
+	at      time.Time
+}
+
+// multiline is a draft/multiline batch being received.
+type multiline struct {
+	start Message   // the BATCH message opening the batch.
+	lines []Message // the lines of the batch.
+}
+
+// message merges the lines of the batch into a single message, with the tags
+// of the batch, such as its msgid. Lines are joined with line feeds, except
+// those with the draft/multiline-concat tag, which continue the previous
+// line.
+func (ml *multiline) message() (Message, bool) {
+	if len(ml.lines) == 0 || len(ml.lines[0].Params) < 2 {
+		return Message{}, false
+	}
+	first := ml.lines[0]
+	tags := make(map[string]string, len(first.Tags)+len(ml.start.Tags))
+	for k, v := range first.Tags {
+		tags[k] = v
+	}
+	delete(tags, "batch")
+	delete(tags, "draft/multiline-concat")
+	for k, v := range ml.start.Tags {
+		tags[k] = v
+	}
+	var text strings.Builder
+	for i, line := range ml.lines {
+		if len(line.Params) < 2 {
+			continue
+		}
+		if _, ok := line.Tags["draft/multiline-concat"]; i > 0 && !ok {
+			text.WriteByte('\n')
+		}
+		text.WriteString(line.Params[1])
+	}
+	return Message{
+		Tags:    tags,
+		Prefix:  first.Prefix,
+		Command: first.Command,
+		Params:  []string{first.Params[0], text.String()},
+	}, true
+}
+
 // User is a known IRC user.
 type User struct {
 	Name         *Prefix // the nick, user and hostname of the user if known.
 	Away         bool    // whether the user is away or not
+	AwayMessage  string  // the away message of the user, if known.
+	Account      string  // the account of the user, or "" if unknown or logged out.
 	Disconnected bool    // can only be true for monitored users.
 }
 
@@ -96,6 +217,7 @@ type Channel struct {
 	Topic     string           // the topic of the channel, or "" if absent.
 	TopicWho  *Prefix          // the name of the last user who set the topic.
 	TopicTime time.Time        // the last time the topic has been changed.
+	Modes     map[byte]string  // the set of channel modes associated with their parameter, except list modes.
 	Read      time.Time        // the time until which messages were read.
 
 	complete bool // whether this structure is fully initialized.
@@ -107,24 +229,36 @@ type SessionParams struct {
 	Username string
 	RealName string
 	NetID    string
-	Auth     SASLClient
+	Auths    []SASLClient // available credentials, the strongest is used.
 }
 
 type Session struct {
 	out          chan<- Message
 	closed       bool
+	quit         bool
 	registered   bool
 	typings      *Typings               // incoming typing notifications.
 	typingStamps map[string]typingStamp // user typing instants.
 
-	nick   string
-	nickCf string // casemapped nickname.
-	user   string
-	real   string
-	acct   string
-	host   string
-	netID  string
-	auth   SASLClient
+	nick        string
+	nickCf      string // casemapped nickname.
+	desiredNick string // nickname we want, which might differ from nick if it was taken.
+	away        bool   // whether we are marked as away.
+	lag         time.Duration
+	pingSent    time.Time // when the PING of Ping was sent, zero once answered.
+	user        string
+	real        string
+	acct        string
+	authing     bool       // whether a SASL exchange is in progress.
+	authFailed  bool       // whether the last SASL exchange failed.
+	killed      bool       // whether an operator killed us.
+	earlyAuth   SASLClient // credentials used early, kept to authenticate again later.
+	host        string
+	netID       string
+	auth        SASLClient
+	auths       []SASLClient // all available credentials.
+	authMech    string       // mechanism of the last SASL exchange.
+	saslMechs   []string     // mechanisms advertised by the server, if known.
 
 	availableCaps map[string]string
 	enabledCaps   map[string]struct{}
@@ -134,8 +268,10 @@ type Session struct {
 	casemap       func(string) string
 	chanmodes     [4]string
 	chantypes     string
+	networkName   string
 	linelen       int
-	historyLimit  int
+	maxModes      int // maximum number of modes with a parameter per MODE command, or 0 if unlimited.
+	historyLimit  int // maximum number of messages per CHATHISTORY request, or 0 if unlimited.
 	prefixSymbols string
 	prefixModes   string
 	monitor       bool
@@ -146,18 +282,24 @@ type Session struct {
 	users          map[string]*User        // known users.
 	channels       map[string]Channel      // joined channels.
 	chBatches      map[string]HistoryEvent // channel history batches being processed.
-	chReqs         map[string]struct{}     // set of targets for which history is currently requested.
+	chReqs         map[string]string       // targets for which history is currently requested, with the CHATHISTORY subcommand.
 	targetsBatchID string                  // ID of the channel history targets batch being processed.
 	targetsBatch   HistoryTargetsEvent     // channel history targets batch being processed.
 	searchBatchID  string                  // ID of the search targets batch being processed.
 	searchBatch    SearchEvent             // search batch being processed.
+	multilines     map[string]*multiline   // multiline batches being received.
+	batchRef       int                     // number of multiline batches sent.
 	monitors       map[string]struct{}     // set of users we want to monitor (and keep even if they are disconnected).
 	pendingList    ListEvent               // current list response being received (flushed on list end).
+	pendingMotd    []string                // current motd response being received (flushed on motd end).
 
 	pendingChannels map[string]time.Time // set of join requests stamps for channels.
+	splitUsers      map[string]time.Time // set of users who quit in a netsplit, with the time they quit.
+	awayReplies     map[string]awayReply // last RPL_AWAY reply reported for each user.
 
 	receivedISupport bool
 	receivedUserMode bool
+	receivedMotd     bool
 }
 
 func NewSession(out chan<- Message, params SessionParams) *Session {
@@ -167,24 +309,35 @@ func NewSession(out chan<- Message, params SessionParams) *Session {
 		typingStamps:    map[string]typingStamp{},
 		nick:            params.Nickname,
 		nickCf:          CasemapASCII(params.Nickname),
+		desiredNick:     params.Nickname,
 		user:            params.Username,
 		real:            params.RealName,
 		netID:           params.NetID,
-		auth:            params.Auth,
+		auths:           params.Auths,
 		availableCaps:   map[string]string{},
 		enabledCaps:     map[string]struct{}{},
 		casemap:         CasemapRFC1459,
 		chantypes:       "#&",
 		linelen:         512,
-		historyLimit:    100,
+		maxModes:        3,
+		historyLimit:    defaultHistoryLimit,
 		prefixSymbols:   "@+",
 		prefixModes:     "ov",
 		users:           map[string]*User{},
 		channels:        map[string]Channel{},
 		chBatches:       map[string]HistoryEvent{},
-		chReqs:          map[string]struct{}{},
+		chReqs:          map[string]string{},
+		multilines:      map[string]*multiline{},
 		monitors:        map[string]struct{}{},
 		pendingChannels: map[string]time.Time{},
+		splitUsers:      map[string]time.Time{},
+		awayReplies:     map[string]awayReply{},
+	}
+
+	for _, auth := range s.auths {
+		if s.auth == nil || saslStrength(auth.Handshake()) > saslStrength(s.auth.Handshake()) {
+			s.auth = auth
+		}
 	}
 
 	s.out <- NewMessage("CAP", "LS", "302")
@@ -195,6 +348,7 @@ func NewSession(out chan<- Message, params SessionParams) *Session {
 	s.out <- NewMessage("USER", s.user, "0", "*", s.real)
 	if s.auth != nil && s.auth.Early() {
 		h := s.auth.Handshake()
+		s.authMech = h
 		s.out <- NewMessage("AUTHENTICATE", h)
 		res, err := s.auth.Respond("+")
 		if err != nil {
@@ -202,6 +356,7 @@ func NewSession(out chan<- Message, params SessionParams) *Session {
 		} else {
 			s.out <- NewMessage("AUTHENTICATE", res)
 		}
+		s.earlyAuth = s.auth
 		s.auth = nil
 	}
 
@@ -228,6 +383,12 @@ func (s *Session) HasCapability(capability string) bool {
 	return ok
 }
 
+// tagsEnabled reports whether client tags can be sent to the server. Servers
+// without message-tags might reject messages with tags.
+func (s *Session) tagsEnabled() bool {
+	return s.HasCapability("message-tags")
+}
+
 // BouncerService returns the optional nick of the bouncer service user.
 func (s *Session) BouncerService() string {
 	switch s.serverName {
@@ -250,6 +411,55 @@ func (s *Session) Nick() string {
 	return s.nick
 }
 
+// Registered reports whether the connection registration is complete.
+func (s *Session) Registered() bool {
+	return s.registered
+}
+
+// AuthFailed reports whether we failed to authenticate with SASL.
+func (s *Session) AuthFailed() bool {
+	return s.authFailed
+}
+
+// Ping sends a PING to the server, to check that the connection is alive. See
+// PingPending.
+func (s *Session) Ping() {
+	now := time.Now()
+	if s.pingSent.IsZero() {
+		s.pingSent = now
+	}
+	s.out <- NewMessage("PING", lagToken(now))
+}
+
+// PingPending reports whether the server did not answer the PING of Ping
+// yet.
+func (s *Session) PingPending() bool {
+	return !s.pingSent.IsZero()
+}
+
+// Lag returns the round-trip time of the last PING sent to the server, or 0
+// if it is not known yet.
+func (s *Session) Lag() time.Duration {
+	return s.lag
+}
+
+// IsAway reports whether the server marked us as away.
+func (s *Session) IsAway() bool {
+	return s.away
+}
+
+// DesiredNick returns the nickname we last tried to use, which might be
+// different from Nick if the server rejected it.
+func (s *Session) DesiredNick() string {
+	return s.desiredNick
+}
+
+// NetworkName returns the name of the network advertised by the server, if
+// any.
+func (s *Session) NetworkName() string {
+	return s.networkName
+}
+
 func (s *Session) NetID() string {
 	return s.netID
 }
@@ -280,6 +490,15 @@ func (s *Session) Users() []string {
 	return users
 }
 
+// Channels returns the names of the channels the session is in.
+func (s *Session) Channels() []string {
+	channels := make([]string, 0, len(s.channels))
+	for _, c := range s.channels {
+		channels = append(channels, c.Name)
+	}
+	return channels
+}
+
 // Names returns the list of users in the given target, or nil if the target
 // is not a known channel or nick in the session.
 // The list is sorted according to member name.
@@ -294,6 +513,7 @@ func (s *Session) Names(target string) []Member {
 					Name:         u.Name.Copy(),
 					Away:         u.Away,
 					Disconnected: u.Disconnected,
+					Account:      u.Account,
 					Self:         s.nickCf == s.casemap(u.Name.Name),
 				})
 			}
@@ -303,6 +523,7 @@ func (s *Session) Names(target string) []Member {
 			Name:         u.Name.Copy(),
 			Away:         u.Away,
 			Disconnected: u.Disconnected,
+			Account:      u.Account,
 		})
 		names = append(names, Member{
 			Name: &Prefix{
@@ -364,6 +585,55 @@ func (s *Session) Topic(channel string) (topic string, who *Prefix, at time.Time
 	return
 }
 
+// ChannelModes returns the known modes of a channel, as a mode string
+// followed by the mode parameters, e.g. "+lnt 42".
+func (s *Session) ChannelModes(channel string) string {
+	c, ok := s.channels[s.Casemap(channel)]
+	if !ok || len(c.Modes) == 0 {
+		return ""
+	}
+	modes := make([]byte, 0, len(c.Modes))
+	for mode := range c.Modes {
+		modes = append(modes, mode)
+	}
+	sort.Slice(modes, func(i, j int) bool {
+		return modes[i] < modes[j]
+	})
+	var sb strings.Builder
+	sb.WriteByte('+')
+	sb.Write(modes)
+	for _, mode := range modes {
+		if param := c.Modes[mode]; param != "" {
+			sb.WriteByte(' ')
+			sb.WriteString(param)
+		}
+	}
+	return sb.String()
+}
+
+// expireSplitUsers forgets the users who quit in a netsplit for longer than
+// netjoinDelay at time t, whose joins are no longer part of the netjoin.
+func (s *Session) expireSplitUsers(t time.Time) {
+	for nickCf, split := range s.splitUsers {
+		if t.Sub(split) >= netjoinDelay {
+			delete(s.splitUsers, nickCf)
+		}
+	}
+}
+
+// BanMask returns a ban mask for target. If target is a nick whose host is
+// known, the mask matches the host of the user; otherwise it matches the nick.
+// Targets that are already masks are returned as is.
+func (s *Session) BanMask(target string) string {
+	if strings.ContainsAny(target, "!@*?") {
+		return target
+	}
+	if u, ok := s.users[s.Casemap(target)]; ok && u.Name.Host != "" {
+		return "*!*@" + u.Name.Host
+	}
+	return target + "!*@*"
+}
+
 func (s *Session) SendRaw(raw string) {
 	s.out <- NewMessage(raw)
 }
@@ -380,8 +650,15 @@ func (s *Session) List(pattern string) {
 	}
 }
 
+// Join joins the given channel, or comma-separated list of channels, with the
+// given key or comma-separated list of keys. Only the first channel is marked
+// as requested, see SelfJoinEvent.
 func (s *Session) Join(channel, key string) {
-	channelCf := s.Casemap(channel)
+	first := channel
+	if i := strings.IndexByte(channel, ','); i >= 0 {
+		first = channel[:i]
+	}
+	channelCf := s.Casemap(first)
 	s.pendingChannels[channelCf] = time.Now()
 	if key == "" {
 		s.out <- NewMessage("JOIN", channel)
@@ -391,25 +668,39 @@ func (s *Session) Join(channel, key string) {
 }
 
 func (s *Session) Part(channel, reason string) {
-	s.out <- NewMessage("PART", channel, reason)
+	if reason == "" {
+		s.out <- NewMessage("PART", channel)
+	} else {
+		s.out <- NewMessage("PART", channel, reason)
+	}
 }
 
 func (s *Session) ChangeTopic(channel, topic string) {
 	s.out <- NewMessage("TOPIC", channel, topic)
 }
 
+// Quit sends a QUIT message, unless one was already sent.
 func (s *Session) Quit(reason string) {
-	s.out <- NewMessage("QUIT", reason)
+	if s.closed || s.quit {
+		return
+	}
+	s.quit = true
+	if reason == "" {
+		s.out <- NewMessage("QUIT")
+	} else {
+		s.out <- NewMessage("QUIT", reason)
+	}
 }
 
 func (s *Session) ChangeNick(nick string) {
+	s.desiredNick = nick
 	s.out <- NewMessage("NICK", nick)
 }
 
 func (s *Session) Who(target string) {
 	if s.whox {
 		// only request what we need, to optimize server who cache hits and reduce traffic
-		s.out <- NewMessage("WHO", target, "%uhnf")
+		s.out <- NewMessage("WHO", target, "%uhnfa")
 	} else {
 		s.out <- NewMessage("WHO", target)
 	}
@@ -424,6 +715,23 @@ func (s *Session) ChangeMode(channel, flags string, args []string) {
 	s.out <- NewMessage("MODE", args...)
 }
 
+// ChangeMemberModes sets a membership mode, such as "+o", on each of the given
+// nicks in a channel, with as few MODE commands as the server allows.
+func (s *Session) ChangeMemberModes(channel, mode string, nicks []string) {
+	n := s.maxModes
+	if n <= 0 {
+		n = len(nicks)
+	}
+	for len(nicks) > 0 {
+		if n > len(nicks) {
+			n = len(nicks)
+		}
+		flags := mode[:1] + strings.Repeat(mode[1:], n)
+		s.ChangeMode(channel, flags, nicks[:n])
+		nicks = nicks[n:]
+	}
+}
+
 func (s *Session) Search(target, text string) {
 	if _, ok := s.enabledCaps["soju.im/search"]; !ok {
 		return
@@ -468,26 +776,86 @@ func splitChunks(s string, chunkLen int) (chunks []string) {
 }
 
 func (s *Session) PrivMsg(target, content string) {
+	s.PrivMsgReply(target, content, "")
+}
+
+// PrivMsgReply sends a message to target, as a reply to the message with the
+// ID replyTo, if not empty.
+func (s *Session) PrivMsgReply(target, content, replyTo string) {
+	chunks := splitChunks(content, s.maxMessageLen(target))
+	for _, chunk := range chunks {
+		msg := NewMessage("PRIVMSG", target, chunk)
+		if replyTo != "" && s.tagsEnabled() {
+			msg = msg.WithTag("+draft/reply", replyTo)
+		}
+		s.out <- msg
+	}
+	targetCf := s.Casemap(target)
+	delete(s.typingStamps, targetCf)
+}
+
+// maxMessageLen returns the maximum length of the content of a PRIVMSG to
+// target, so that the message relayed by the server fits in a line.
+func (s *Session) maxMessageLen(target string) int {
 	hostLen := len(s.host)
 	if hostLen == 0 {
 		hostLen = len("255.255.255.255")
 	}
-	maxMessageLen := s.linelen -
+	return s.linelen -
 		len(":!@ PRIVMSG  :\r\n") -
 		len(s.nick) -
 		len(s.user) -
 		hostLen -
 		len(target)
-	chunks := splitChunks(content, maxMessageLen)
-	for _, chunk := range chunks {
-		s.out <- NewMessage("PRIVMSG", target, chunk)
+}
+
+// CanMultiline returns whether lines can be sent to target as a single
+// message, that is whether the server supports draft/multiline and lines
+// fit within its limits.
+func (s *Session) CanMultiline(target string, lines []string) bool {
+	if _, ok := s.enabledCaps["draft/multiline"]; !ok {
+		return false
+	}
+	var maxBytes, maxLines int
+	for _, kv := range strings.Split(s.availableCaps["draft/multiline"], ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "max-bytes":
+			maxBytes, _ = strconv.Atoi(v)
+		case "max-lines":
+			maxLines, _ = strconv.Atoi(v)
+		}
+	}
+	if maxBytes <= 0 || (maxLines > 0 && len(lines) > maxLines) {
+		return false
+	}
+	n := len(lines) - 1 // line feeds
+	maxLen := s.maxMessageLen(target)
+	for _, line := range lines {
+		if len(line) > maxLen {
+			return false
+		}
+		n += len(line)
 	}
+	return n <= maxBytes
+}
+
+// PrivMsgMultiline sends lines to target as a single message, in a
+// draft/multiline batch. CanMultiline must have returned true for them.
+func (s *Session) PrivMsgMultiline(target string, lines []string) {
+	s.batchRef++
+	ref := fmt.Sprintf("ml%d", s.batchRef)
+	s.out <- NewMessage("BATCH", "+"+ref, "draft/multiline", target)
+	for _, line := range lines {
+		s.out <- NewMessage("PRIVMSG", target, line).WithTag("batch", ref)
+	}
+	s.out <- NewMessage("BATCH", "-"+ref)
 	targetCf := s.Casemap(target)
 	delete(s.typingStamps, targetCf)
 }
 
 func (s *Session) Typing(target string) {
-	if !s.HasCapability("message-tags") {
+	if !s.tagsEnabled() {
 		return
 	}
 	targetCf := s.casemap(target)
@@ -509,7 +877,7 @@ func (s *Session) Typing(target string) {
 }
 
 func (s *Session) TypingStop(target string) {
-	if !s.HasCapability("message-tags") {
+	if !s.tagsEnabled() {
 		return
 	}
 	targetCf := s.casemap(target)
@@ -563,6 +931,47 @@ func (s *Session) MonitorRemove(target string) {
 	}
 }
 
+// IsMonitored reports whether the given user is monitored.
+func (s *Session) IsMonitored(target string) bool {
+	_, ok := s.monitors[s.casemap(target)]
+	return ok
+}
+
+// MonitorClear stops monitoring all users.
+func (s *Session) MonitorClear() {
+	monitors := s.monitors
+	s.monitors = map[string]struct{}{}
+	if s.monitor && len(monitors) > 0 {
+		s.out <- NewMessage("MONITOR", "C")
+	}
+	for nickCf := range monitors {
+		if u, ok := s.users[nickCf]; ok {
+			s.cleanUser(u)
+		}
+	}
+}
+
+// Monitors returns the sorted names of the monitored users, split by whether
+// the server reported them as online, offline, or did not report them yet.
+// ok is false if the server does not support MONITOR.
+func (s *Session) Monitors() (online, offline, unknown []string, ok bool) {
+	for nickCf := range s.monitors {
+		u, ok := s.users[nickCf]
+		switch {
+		case !ok:
+			unknown = append(unknown, nickCf)
+		case u.Disconnected:
+			offline = append(offline, u.Name.Name)
+		default:
+			online = append(online, u.Name.Name)
+		}
+	}
+	sort.Strings(online)
+	sort.Strings(offline)
+	sort.Strings(unknown)
+	return online, offline, unknown, s.monitor
+}
+
 type HistoryRequest struct {
 	s       *Session
 	target  string
@@ -577,12 +986,13 @@ func formatTimestamp(t time.Time) string {
 		t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/1e6)
 }
 
+// WithLimit sets the maximum number of messages to fetch, clamped to the
+// maximum advertised by the server.
 func (r *HistoryRequest) WithLimit(limit int) *HistoryRequest {
-	if limit < r.s.historyLimit {
-		r.limit = limit
-	} else {
-		r.limit = r.s.historyLimit
+	if r.s.historyLimit > 0 && limit > r.s.historyLimit {
+		limit = r.s.historyLimit
 	}
+	r.limit = limit
 	return r
 }
 
@@ -595,7 +1005,7 @@ func (r *HistoryRequest) doRequest() {
 	if _, ok := r.s.chReqs[targetCf]; ok {
 		return
 	}
-	r.s.chReqs[targetCf] = struct{}{}
+	r.s.chReqs[targetCf] = r.command
 
 	args := make([]string, 0, len(r.bounds)+3)
 	args = append(args, r.command)
@@ -632,12 +1042,35 @@ func (r *HistoryRequest) Targets(start time.Time, end time.Time) {
 	r.doRequest()
 }
 
+// failHistoryRequest forgets the history request refused by a FAIL
+// CHATHISTORY, given the parameters following its code: the subcommand, then
+// the target, if any. When the target is unknown, all requests are forgotten
+// since it cannot be told which one failed.
+func (s *Session) failHistoryRequest(params []string) {
+	if len(params) >= 1 && params[0] == "TARGETS" {
+		delete(s.chReqs, "")
+		return
+	}
+	if len(params) >= 2 {
+		delete(s.chReqs, s.Casemap(params[1]))
+		return
+	}
+	s.chReqs = map[string]string{}
+}
+
+// HistoryPending reports whether history was requested for target and is
+// not received yet.
+func (s *Session) HistoryPending(target string) bool {
+	_, ok := s.chReqs[s.Casemap(target)]
+	return ok
+}
+
 func (s *Session) NewHistoryRequest(target string) *HistoryRequest {
-	return &HistoryRequest{
+	r := &HistoryRequest{
 		s:      s,
 		target: target,
-		limit:  s.historyLimit,
 	}
+	return r.WithLimit(defaultHistoryLimit)
 }
 
 func (s *Session) Whois(nick string) {
@@ -660,6 +1093,94 @@ func (s *Session) Kick(nick, channel, comment string) {
 	}
 }
 
+// authenticate starts a SASL exchange, unless there are no credentials, we
+// are already logged in, or an exchange is already in progress. If the
+// mechanisms supported by the server are known, the strongest of them we have
+// credentials for is used; an error event is returned if there is none.
+func (s *Session) authenticate() Event {
+	if s.acct != "" || s.authing {
+		return nil
+	}
+	if s.auth == nil {
+		if !s.registered || s.earlyAuth == nil {
+			return nil
+		}
+		// Early authentication did not succeed, but the server now
+		// supports SASL.
+		s.auth = s.earlyAuth
+	}
+	if len(s.saslMechs) > 0 {
+		auth := selectSASL(s.auths, s.saslMechs)
+		if auth == nil {
+			return s.noSASLMechanism()
+		}
+		s.auth = auth
+	}
+	s.authing = true
+	h := s.auth.Handshake()
+	s.authMech = h
+	s.out <- NewMessage("AUTHENTICATE", h)
+	return nil
+}
+
+// noSASLMechanism gives up authenticating because the server supports none of
+// the mechanisms we have credentials for.
+func (s *Session) noSASLMechanism() Event {
+	mechs := make([]string, 0, len(s.auths))
+	for _, auth := range s.auths {
+		mechs = append(mechs, auth.Handshake())
+	}
+	if s.auth != nil {
+		// Otherwise, registration was ended along with early
+		// authentication.
+		s.endRegistration()
+	}
+	s.auth = nil
+	s.earlyAuth = nil
+	s.authFailed = true
+	return ErrorEvent{
+		Severity: SeverityFail,
+		Code:     "SASL",
+		Message: fmt.Sprintf("Authentication failed: the server only supports the %s SASL mechanisms, but credentials are only configured for %s",
+			strings.Join(s.saslMechs, ", "), strings.Join(mechs, ", ")),
+	}
+}
+
+// setSASLMechanisms records the SASL mechanisms advertised by the server, as
+// a comma-separated list.
+func (s *Session) setSASLMechanisms(mechs string) {
+	s.saslMechs = nil
+	for _, mech := range strings.Split(mechs, ",") {
+		if mech != "" {
+			s.saslMechs = append(s.saslMechs, strings.ToUpper(mech))
+		}
+	}
+}
+
+// disableCapability stops using a capability that was disabled by the client
+// or removed by the server.
+func (s *Session) disableCapability(name string) {
+	if _, ok := s.enabledCaps[name]; !ok {
+		return
+	}
+	delete(s.enabledCaps, name)
+	switch name {
+	case "labeled-response":
+		s.out <- Message{
+			Command: labelDisableCommand,
+		}
+	case "message-tags":
+		// Typing notifications and labels are sent and received as tags.
+		s.typings.Clear()
+		s.typingStamps = map[string]typingStamp{}
+		if s.HasCapability("labeled-response") {
+			s.out <- Message{
+				Command: labelDisableCommand,
+			}
+		}
+	}
+}
+
 func (s *Session) HandleMessage(msg Message) (Event, error) {
 	if s.registered {
 		return s.handleRegistered(msg)
@@ -678,9 +1199,18 @@ func (s *Session) handleUnregistered(msg Message) (Event, error) {
 
 		s.out <- NewMessage("NICK", nick+"_")
 	case rplSaslsuccess:
+		s.authing = false
+		s.authFailed = false
 		if s.auth != nil {
 			s.endRegistration()
 		}
+		body := "Authenticated"
+		if s.acct != "" {
+			body = fmt.Sprintf("Authenticated as %s", s.acct)
+		}
+		return ConnectProgressEvent{
+			Message: body,
+		}, nil
 	default:
 		return s.handleRegistered(msg)
 	}
@@ -689,6 +1219,10 @@ func (s *Session) handleUnregistered(msg Message) (Event, error) {
 
 func (s *Session) handleRegistered(msg Message) (Event, error) {
 	if id, ok := msg.Tags["batch"]; ok {
+		if ml, ok := s.multilines[id]; ok {
+			ml.lines = append(ml.lines, msg)
+			return nil, nil
+		}
 		if id == s.targetsBatchID {
 			var target, timestamp string
 			if err := msg.ParseParams(nil, &target, &timestamp); err != nil {
@@ -752,7 +1286,41 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		prefix := ParsePrefix(nuh)
 		s.user = prefix.User
 		s.host = prefix.Host
-	case errNicklocked, errSaslfail, errSasltoolong, errSaslaborted, errSaslalready, rplSaslmechs:
+	case rplSaslsuccess:
+		// Authenticated after registration (before registration, this
+		// is handled by handleUnregistered).
+		s.authing = false
+		s.authFailed = false
+	case rplLoggedout:
+		s.acct = ""
+	case rplSaslmechs:
+		var mechs string
+		if err := msg.ParseParams(nil, &mechs); err != nil {
+			return nil, err
+		}
+		s.setSASLMechanisms(mechs)
+	case errNicklocked, errSaslfail, errSasltoolong, errSaslaborted, errSaslalready:
+		s.authing = false
+		s.authFailed = msg.Command != errSaslalready
+		if msg.Command == errSaslfail && len(s.saslMechs) > 0 {
+			// The server told us which mechanisms it supports
+			// (RPL_SASLMECHS): retry with another one if possible.
+			auth := selectSASL(s.auths, s.saslMechs)
+			if auth == nil {
+				return s.noSASLMechanism(), nil
+			}
+			if auth.Handshake() != s.authMech && (s.registered || s.auth != nil) {
+				s.auth = auth
+				return s.authenticate(), nil
+			}
+		}
+		if s.registered {
+			return ErrorEvent{
+				Severity: SeverityFail,
+				Code:     msg.Command,
+				Message:  fmt.Sprintf("Authentication failed: %s", strings.Join(msg.Params[1:], " ")),
+			}, nil
+		}
 		if s.auth != nil {
 			s.endRegistration()
 		}
@@ -778,25 +1346,35 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		if err := msg.ParseParams(nil, nil, &s.serverName); err != nil {
 			return nil, err
 		}
+		return InfoEvent{
+			Prefix:  "Server",
+			Message: strings.Join(msg.Params[1:], " "),
+		}, nil
 	case rplIsupport:
 		if len(msg.Params) < 3 {
 			return nil, msg.errNotEnoughParams(3)
 		}
+		networkName := s.networkName
 		s.updateFeatures(msg.Params[1 : len(msg.Params)-1])
 		if !s.receivedISupport {
 			// notify only on first RPL_ISUPPORT
 			s.receivedISupport = true
 			return RegisteredEvent{}, nil
 		}
+		if s.networkName != networkName {
+			return NetworkNameEvent{
+				Name: s.networkName,
+			}, nil
+		}
 		return nil, nil
 	case rplWhoreply, rplWhospecialreply:
-		var nick, host, flags, username string
+		var nick, host, flags, username, account string
 		var err error
 		if msg.Command == rplWhoreply {
 			err = msg.ParseParams(nil, nil, &username, &host, nil, &nick, &flags, nil)
 		} else {
-			// we always request WHOX with %uhnf
-			err = msg.ParseParams(nil, &username, &host, &nick, &flags)
+			// we always request WHOX with %uhnfa
+			err = msg.ParseParams(nil, &username, &host, &nick, &flags, &account)
 		}
 		if err != nil {
 			return nil, err
@@ -812,41 +1390,55 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 
 		if u, ok := s.users[nickCf]; ok {
 			u.Away = away
+			if msg.Command == rplWhospecialreply {
+				u.Account = accountParam(account, "0")
+			}
 		}
 	case rplEndofwho:
 		// do nothing
 	case "CAP":
-		var subcommand, caps string
-		if err := msg.ParseParams(nil, &subcommand, &caps); err != nil {
+		var subcommand string
+		if err := msg.ParseParams(nil, &subcommand); err != nil {
 			return nil, err
 		}
+		caps := capsParam(msg.Params[2:])
 
+		var ev Event
 		switch subcommand {
+		case "LS", "LIST":
+			for _, c := range ParseCaps(caps) {
+				s.availableCaps[c.Name] = c.Value
+				if c.Name == "sasl" && c.Value != "" {
+					s.setSASLMechanisms(c.Value)
+				}
+			}
+			if subcommand == "LS" && !s.registered && len(msg.Params) == 3 {
+				// Last line of the CAP LS reply.
+				ev = ConnectProgressEvent{
+					Message: "Negotiating capabilities",
+				}
+			}
 		case "ACK":
 			for _, c := range ParseCaps(caps) {
 				if c.Enable {
 					s.enabledCaps[c.Name] = struct{}{}
 				} else {
-					delete(s.enabledCaps, c.Name)
+					s.disableCapability(c.Name)
+					continue
 				}
 
-				if s.auth != nil && c.Name == "sasl" {
-					h := s.auth.Handshake()
-					s.out <- NewMessage("AUTHENTICATE", h)
+				if c.Name == "sasl" {
+					ev = s.authenticate()
 				} else if len(s.channels) != 0 && c.Name == "multi-prefix" {
 					// TODO merge NAMES commands
 					for channel := range s.channels {
 						s.out <- NewMessage("NAMES", channel)
 					}
-				} else if c.Name == "labeled-response" {
-					if c.Enable {
-						s.out <- Message{
-							Command: labelEnableCommand,
-						}
-					} else {
-						s.out <- Message{
-							Command: labelDisableCommand,
-						}
+				} else if (c.Name == "labeled-response" || c.Name == "message-tags") && s.HasCapability("labeled-response") && s.tagsEnabled() {
+					// Labels are tags: only send them once both
+					// capabilities are enabled.
+					s.out <- Message{
+						Command: labelEnableCommand,
 					}
 				}
 			}
@@ -855,10 +1447,19 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		case "NEW":
 			for _, c := range ParseCaps(caps) {
 				s.availableCaps[c.Name] = c.Value
+				if c.Name == "sasl" && c.Value != "" {
+					s.setSASLMechanisms(c.Value)
+				}
 				if _, ok := SupportedCapabilities[c.Name]; !ok {
 					continue
 				}
 				if _, ok := s.enabledCaps[c.Name]; ok {
+					if c.Name == "sasl" {
+						// The server might have new mechanisms or
+						// credentials (e.g. a bouncer that enables
+						// SASL late): try again if not logged in.
+						ev = s.authenticate()
+					}
 					continue
 				}
 				s.out <- NewMessage("CAP", "REQ", c.Name)
@@ -866,14 +1467,12 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		case "DEL":
 			for _, c := range ParseCaps(caps) {
 				delete(s.availableCaps, c.Name)
-				delete(s.enabledCaps, c.Name)
-				if c.Name == "labeled-response" {
-					s.out <- Message{
-						Command: labelDisableCommand,
-					}
-				}
+				s.disableCapability(c.Name)
 			}
 		}
+		if ev != nil {
+			return ev, nil
+		}
 	case "JOIN":
 		if msg.Prefix == nil {
 			return nil, errMissingPrefix
@@ -899,6 +1498,7 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			s.channels[channelCf] = Channel{
 				Name:    msg.Params[0],
 				Members: map[*User]string{},
+				Modes:   map[byte]string{},
 			}
 			if _, ok := s.enabledCaps["away-notify"]; ok {
 				// Only try to know who is away if the list is
@@ -911,10 +1511,18 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				s.users[nickCf] = &User{Name: msg.Prefix.Copy()}
 			}
 			c.Members[s.users[nickCf]] = ""
+			if len(msg.Params) >= 2 {
+				// extended-join
+				s.users[nickCf].Account = accountParam(msg.Params[1], "*")
+			}
+			t := msg.TimeOrNow()
+			s.expireSplitUsers(t)
+			_, netjoin := s.splitUsers[nickCf]
 			return UserJoinEvent{
 				User:    msg.Prefix.Name,
 				Channel: c.Name,
-				Time:    msg.TimeOrNow(),
+				Time:    t,
+				Netjoin: netjoin,
 			}, nil
 		}
 	case "PART":
@@ -1004,15 +1612,30 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			return nil, errMissingPrefix
 		}
 
+		var reason string
+		if len(msg.Params) > 0 {
+			reason = msg.Params[0]
+		}
+		netsplit := isNetsplit(reason)
+
 		if playback {
 			return UserQuitEvent{
-				User: msg.Prefix.Name,
-				Time: msg.TimeOrNow(),
+				User:     msg.Prefix.Name,
+				Time:     msg.TimeOrNow(),
+				Message:  reason,
+				Netsplit: netsplit,
 			}, nil
 		}
 
 		nickCf := s.Casemap(msg.Prefix.Name)
 
+		s.expireSplitUsers(msg.TimeOrNow())
+		if netsplit {
+			s.splitUsers[nickCf] = msg.TimeOrNow()
+		} else {
+			delete(s.splitUsers, nickCf)
+		}
+
 		if u, ok := s.users[nickCf]; ok {
 			u.Disconnected = true
 			var channels []string
@@ -1028,6 +1651,8 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				User:     u.Name.Name,
 				Channels: channels,
 				Time:     msg.TimeOrNow(),
+				Message:  reason,
+				Netsplit: netsplit,
 			}, nil
 		}
 	case rplMononline:
@@ -1240,6 +1865,7 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 				}
 				c.Members[user] = string(newMembership)
 			}
+			s.updateChannelModes(c, modeChanges)
 			s.channels[channelCf] = c
 			return ModeChangeEvent{
 				Channel: c.Name,
@@ -1262,6 +1888,21 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			Invitee: nick,
 			Channel: channel,
 		}, nil
+	case "WALLOPS":
+		if msg.Prefix == nil {
+			return nil, errMissingPrefix
+		}
+
+		var message string
+		if err := msg.ParseParams(&message); err != nil {
+			return nil, err
+		}
+
+		return WallopsEvent{
+			Sender:  msg.Prefix.Name,
+			Message: message,
+			Time:    msg.TimeOrNow(),
+		}, nil
 	case rplInviting:
 		var nick, channel string
 		if err := msg.ParseParams(nil, &nick, &channel); err != nil {
@@ -1282,18 +1923,38 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 
 		if u, ok := s.users[nickCf]; ok {
 			u.Away = len(msg.Params) == 1
+			u.AwayMessage = ""
+			if u.Away {
+				u.AwayMessage = msg.Params[0]
+			}
 		}
-	case "PRIVMSG", "NOTICE":
+		if len(msg.Params) == 0 {
+			delete(s.awayReplies, nickCf)
+		}
+	case "ACCOUNT":
 		if msg.Prefix == nil {
 			return nil, errMissingPrefix
 		}
 
+		var account string
+		if err := msg.ParseParams(&account); err != nil {
+			return nil, err
+		}
+
+		if u, ok := s.users[s.Casemap(msg.Prefix.Name)]; ok {
+			u.Account = accountParam(account, "*")
+		}
+	case "PRIVMSG", "NOTICE":
+		if msg.Prefix == nil && msg.Command != "NOTICE" {
+			return nil, errMissingPrefix
+		}
+
 		var target string
 		if err := msg.ParseParams(&target); err != nil {
 			return nil, err
 		}
 
-		if playback {
+		if playback || msg.Prefix == nil {
 			return s.newMessageEvent(msg)
 		}
 
@@ -1364,11 +2025,27 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			case "soju.im/search":
 				s.searchBatchID = id
 				s.searchBatch = SearchEvent{}
+			case "draft/multiline":
+				s.multilines[id] = &multiline{start: msg}
 			}
 		} else {
+			if ml, ok := s.multilines[id]; ok {
+				delete(s.multilines, id)
+				if msg, ok := ml.message(); ok {
+					// Handled as a single message, possibly of an outer
+					// batch.
+					return s.handleRegistered(msg)
+				}
+				return nil, nil
+			}
 			if b, ok := s.chBatches[id]; ok {
 				delete(s.chBatches, id)
-				delete(s.chReqs, s.Casemap(b.Target))
+				targetCf := s.Casemap(b.Target)
+				switch s.chReqs[targetCf] {
+				case "BEFORE", "LATEST":
+					b.Backward = true
+				}
+				delete(s.chReqs, targetCf)
 				return b, nil
 			} else if s.targetsBatchID == id {
 				s.targetsBatchID = ""
@@ -1402,12 +2079,19 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		newNickCf := s.Casemap(newNick)
 
 		if formerUser, ok := s.users[nickCf]; ok {
+			// Channel members refer to users by pointer, so they
+			// follow the rename.
 			formerUser.Name.Name = newNick
 			delete(s.users, nickCf)
 			s.users[newNickCf] = formerUser
 		} else {
 			break
 		}
+		s.typings.DoneUser(nickCf)
+		if reply, ok := s.awayReplies[nickCf]; ok {
+			delete(s.awayReplies, nickCf)
+			s.awayReplies[newNickCf] = reply
+		}
 
 		if s.IsMe(msg.Prefix.Name) {
 			s.nick = newNick
@@ -1477,14 +2161,59 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		}
 
 		s.out <- NewMessage("PONG", payload)
+	case "PONG":
+		var token string
+		if err := msg.ParseParams(nil, &token); err != nil {
+			return nil, err
+		}
+		if t, ok := parseLagToken(token); ok {
+			s.lag = time.Since(t)
+			if !s.pingSent.IsZero() && !t.Before(s.pingSent) {
+				s.pingSent = time.Time{}
+			}
+		}
+	case "KILL":
+		var reason string
+		if err := msg.ParseParams(nil, &reason); err != nil {
+			return nil, err
+		}
+		var killer string
+		if msg.Prefix != nil {
+			killer = msg.Prefix.Name
+		}
+		s.killed = true
+		return DisconnectEvent{
+			Killer: killer,
+			Reason: reason,
+		}, nil
 	case "ERROR":
+		var reason string
+		if len(msg.Params) > 0 {
+			reason = msg.Params[0]
+		}
 		s.Close()
+		if s.killed || s.quit {
+			// Already reported with the kill reason, or the answer to our
+			// own QUIT.
+			return nil, nil
+		}
+		return DisconnectEvent{
+			Reason: reason,
+		}, nil
 	case "FAIL", "WARN", "NOTE":
 		var severity Severity
-		var code string
-		if err := msg.ParseParams(nil, &code); err != nil {
+		var command, code string
+		if err := msg.ParseParams(&command, &code); err != nil {
 			return nil, err
 		}
+		if msg.Command == "FAIL" && command == "CHATHISTORY" {
+			// The request will not be answered with a batch.
+			var params []string
+			if len(msg.Params) > 3 {
+				params = msg.Params[2 : len(msg.Params)-1] // without the description
+			}
+			s.failHistoryRequest(params)
+		}
 
 		switch msg.Command {
 		case "FAIL":
@@ -1500,16 +2229,77 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			Code:     code,
 			Message:  strings.Join(msg.Params[2:], " "),
 		}, nil
+	case errNicknameinuse, errErroneusnickname:
+		var nick, reason string
+		if err := msg.ParseParams(nil, &nick, &reason); err != nil {
+			return nil, err
+		}
+		return ErrorEvent{
+			Severity: SeverityFail,
+			Code:     msg.Command,
+			Message:  fmt.Sprintf("cannot change nickname to %s: %s", nick, reason),
+		}, nil
+	case errChanoprivsneeded:
+		var channel string
+		if err := msg.ParseParams(nil, &channel); err != nil {
+			return nil, err
+		}
+		return ErrorEvent{
+			Severity: SeverityFail,
+			Code:     msg.Command,
+			Message:  fmt.Sprintf("you need to be a channel operator in %s to do that", channel),
+		}, nil
 	case errMonlistisfull:
 		// silence monlist full error, we don't care because we do it best-effort
 	case rplAway:
-		// we display user away status, we don't care about automatic AWAY replies
+		var nick, message string
+		if err := msg.ParseParams(nil, &nick, &message); err != nil {
+			return nil, err
+		}
+
+		nickCf := s.Casemap(nick)
+		if u, ok := s.users[nickCf]; ok {
+			u.Away = true
+			u.AwayMessage = message
+		}
+
+		t := msg.TimeOrNow()
+		if last, ok := s.awayReplies[nickCf]; ok && last.message == message && t.Sub(last.at) < awayReplyInterval {
+			break
+		}
+		s.awayReplies[nickCf] = awayReply{
+			message: message,
+			at:      t,
+		}
+		return UserAwayEvent{
+			User:    nick,
+			Message: message,
+			Time:    t,
+		}, nil
 	case rplYourhost, rplCreated:
-		// useless conection messages
+		return InfoEvent{
+			Prefix:  "Server",
+			Message: msg.Params[len(msg.Params)-1],
+		}, nil
 	case rplAdminme:
 		// useless admin info header
-	case rplMotdstart, rplEndofmotd, errNomotd:
-		// useless motd related messages
+	case rplMotdstart:
+		s.pendingMotd = nil
+	case errNomotd:
+		s.receivedMotd = true
+		return ErrorEvent{
+			Severity: SeverityNote,
+			Code:     msg.Command,
+			Message:  strings.Join(msg.Params[1:], " "),
+		}, nil
+	case rplEndofmotd:
+		ev := MotdEvent{
+			Lines:   s.pendingMotd,
+			Connect: !s.receivedMotd,
+		}
+		s.pendingMotd = nil
+		s.receivedMotd = true
+		return ev, nil
 	case rplHostHidden:
 		// useless host message
 	case rplEndofstats:
@@ -1649,10 +2439,12 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			Message: fmt.Sprintf("%s %s", nick, text),
 		}, nil
 	case rplUnaway:
+		s.away = false
 		return InfoEvent{
 			Message: "You are now marked as back from being away",
 		}, nil
 	case rplNowaway:
+		s.away = true
 		return InfoEvent{
 			Message: "You are now marked as away",
 		}, nil
@@ -1759,6 +2551,16 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 		if err := msg.ParseParams(nil, &channel); err != nil {
 			return nil, err
 		}
+		channelCf := s.Casemap(channel)
+		if c, ok := s.channels[channelCf]; ok && len(msg.Params) > 2 {
+			modeChanges, err := ParseChannelMode(msg.Params[2], msg.Params[3:], s.chanmodes, s.prefixModes)
+			if err != nil {
+				return nil, err
+			}
+			c.Modes = map[byte]string{}
+			s.updateChannelModes(c, modeChanges)
+			s.channels[channelCf] = c
+		}
 		text := fmt.Sprintf("%s has modes %s", channel, strings.Join(msg.Params[2:], " "))
 		return InfoEvent{
 			Message: text,
@@ -1903,10 +2705,11 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 			Message: text,
 		}, nil
 	case rplMotd:
-		return InfoEvent{
-			Prefix:  "MotD",
-			Message: msg.Params[1],
-		}, nil
+		var text string
+		if err := msg.ParseParams(nil, &text); err != nil {
+			return nil, err
+		}
+		s.pendingMotd = append(s.pendingMotd, strings.TrimPrefix(text, "- "))
 	case rplWhoishost:
 		var nick, text string
 		if err := msg.ParseParams(nil, &nick, &text); err != nil {
@@ -1984,8 +2787,24 @@ func (s *Session) handleMessageRegistered(msg Message, playback bool) (Event, er
 	return nil, nil
 }
 
+// updateChannelModes applies mode changes to the modes of a channel, ignoring
+// list and membership modes.
+func (s *Session) updateChannelModes(c Channel, changes []ModeChange) {
+	for _, change := range changes {
+		if strings.IndexByte(s.prefixModes, change.Mode) >= 0 || strings.IndexByte(s.chanmodes[ModeTypeA], change.Mode) >= 0 {
+			continue
+		}
+		if change.Enable {
+			c.Modes[change.Mode] = change.Param
+		} else {
+			delete(c.Modes, change.Mode)
+		}
+	}
+}
+
 func (s *Session) newMessageEvent(msg Message) (ev MessageEvent, err error) {
-	if msg.Prefix == nil {
+	fromServer := msg.Command == "NOTICE" && isServerPrefix(msg.Prefix)
+	if msg.Prefix == nil && !fromServer {
 		return ev, errMissingPrefix
 	}
 
@@ -1994,12 +2813,24 @@ func (s *Session) newMessageEvent(msg Message) (ev MessageEvent, err error) {
 		return ev, err
 	}
 
+	var user string
+	if msg.Prefix != nil {
+		user = msg.Prefix.Name
+	}
 	ev = MessageEvent{
-		User:    msg.Prefix.Name, // TODO correctly casemap
-		Target:  target,          // TODO correctly casemap
-		Command: msg.Command,
-		Content: content,
-		Time:    msg.TimeOrNow(),
+		User:       user,   // TODO correctly casemap
+		Target:     target, // TODO correctly casemap
+		Command:    msg.Command,
+		Content:    content,
+		Time:       msg.TimeOrNow(),
+		MsgID:      msg.Tags["msgid"],
+		ReplyTo:    msg.Tags["+draft/reply"],
+		Edits:      msg.Tags["+draft/edit"],
+		Account:    msg.Tags["account"],
+		FromServer: fromServer,
+	}
+	if u, ok := s.users[s.Casemap(user)]; ok && ev.Account == "" && !fromServer {
+		ev.Account = u.Account
 	}
 
 	if s.IsMe(target) {
@@ -2016,6 +2847,13 @@ func (s *Session) newMessageEvent(msg Message) (ev MessageEvent, err error) {
 	return ev, nil
 }
 
+// isServerPrefix reports whether a message with the given prefix was sent by
+// a server rather than a user: either it has no prefix, or its prefix is a
+// server name, which contains a dot unlike nicknames.
+func isServerPrefix(p *Prefix) bool {
+	return p == nil || (p.User == "" && p.Host == "" && strings.ContainsRune(p.Name, '.'))
+}
+
 func (s *Session) cleanUser(parted *User) {
 	nameCf := s.Casemap(parted.Name.Name)
 	if _, ok := s.monitors[nameCf]; ok {
@@ -2063,6 +2901,8 @@ func (s *Session) updateFeatures(features []string) {
 		switch key {
 		case "BOUNCER_NETID":
 			s.netID = value
+		case "NETWORK":
+			s.networkName = value
 		case "CASEMAPPING":
 			switch value {
 			case "ascii":
@@ -2079,8 +2919,9 @@ func (s *Session) updateFeatures(features []string) {
 		case "CHANTYPES":
 			s.chantypes = value
 		case "CHATHISTORY":
+			// 0 means that the server has no limit.
 			historyLimit, err := strconv.Atoi(value)
-			if err == nil {
+			if err == nil && historyLimit >= 0 {
 				s.historyLimit = historyLimit
 			}
 		case "ELIST":
@@ -2090,6 +2931,12 @@ func (s *Session) updateFeatures(features []string) {
 			if err == nil && linelen != 0 {
 				s.linelen = linelen
 			}
+		case "MODES":
+			// No value means that the server has no limit.
+			maxModes, err := strconv.Atoi(value)
+			if value == "" || (err == nil && maxModes >= 0) {
+				s.maxModes = maxModes
+			}
 		case "MONITOR":
 			monitor, err := strconv.Atoi(value)
 			if err == nil && monitor > 0 {
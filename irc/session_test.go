@@ -0,0 +1,977 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSession() (*Session, chan Message) {
+	out := make(chan Message, 128)
+	s := NewSession(out, SessionParams{
+		Nickname: "senpai",
+		Username: "senpai",
+		RealName: "senpai",
+	})
+	drain(out)
+	return s, out
+}
+
+func drain(out chan Message) (msgs []Message) {
+	for {
+		select {
+		case msg := <-out:
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+func mustParse(t *testing.T, raw string) Message {
+	msg, err := ParseMessage(raw)
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", raw, err)
+	}
+	return msg
+}
+
+func handle(t *testing.T, s *Session, raw string) {
+	msg := mustParse(t, raw)
+	if _, err := s.HandleMessage(msg); err != nil {
+		t.Fatalf("failed to handle %q: %v", raw, err)
+	}
+}
+
+func hasTypingMessage(msgs []Message) bool {
+	for _, msg := range msgs {
+		if msg.Command == "TAGMSG" {
+			if _, ok := msg.Tags["+typing"]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestCapDelMessageTags(t *testing.T) {
+	s, out := newTestSession()
+
+	handle(t, s, ":irc.example.org CAP senpai ACK :message-tags")
+	s.Typing("#senpai")
+	if !hasTypingMessage(drain(out)) {
+		t.Fatalf("expected a typing notification with message-tags enabled")
+	}
+
+	handle(t, s, ":irc.example.org CAP senpai DEL :message-tags")
+	if s.HasCapability("message-tags") {
+		t.Fatalf("expected message-tags to be disabled after CAP DEL")
+	}
+	s.Typing("#senpai")
+	s.TypingStop("#senpai")
+	if hasTypingMessage(drain(out)) {
+		t.Errorf("expected no typing notification after message-tags was removed")
+	}
+}
+
+func countCommand(msgs []Message, command string) int {
+	n := 0
+	for _, msg := range msgs {
+		if msg.Command == command {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCapNewSasl(t *testing.T) {
+	out := make(chan Message, 128)
+	s := NewSession(out, SessionParams{
+		Nickname: "senpai",
+		Username: "senpai",
+		RealName: "senpai",
+		Auths:    []SASLClient{&SASLPlain{Username: "senpai", Password: "hunter2"}},
+	})
+	drain(out)
+
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	handle(t, s, ":irc.example.org CAP senpai NEW :sasl")
+	handle(t, s, ":irc.example.org CAP senpai ACK :sasl")
+	msgs := drain(out)
+	if n := countCommand(msgs, "AUTHENTICATE"); n != 1 {
+		t.Fatalf("expected an authentication attempt when sasl is added, got %d", n)
+	}
+
+	handle(t, s, ":irc.example.org CAP senpai NEW :sasl")
+	if n := countCommand(drain(out), "AUTHENTICATE"); n != 0 {
+		t.Fatalf("expected no authentication attempt while one is in progress, got %d", n)
+	}
+
+	handle(t, s, "AUTHENTICATE +")
+	handle(t, s, ":irc.example.org 900 senpai senpai!senpai@example.org senpai :You are now logged in as senpai")
+	handle(t, s, ":irc.example.org 903 senpai :SASL authentication successful")
+	drain(out)
+
+	handle(t, s, ":irc.example.org CAP senpai NEW :sasl")
+	if n := countCommand(drain(out), "AUTHENTICATE"); n != 0 {
+		t.Errorf("expected no authentication attempt once logged in, got %d", n)
+	}
+}
+
+type testSASL string
+
+func (auth testSASL) Early() bool                    { return false }
+func (auth testSASL) Handshake() string              { return string(auth) }
+func (auth testSASL) Respond(string) (string, error) { return "+", nil }
+
+func TestSelectSASL(t *testing.T) {
+	clients := []SASLClient{
+		&SASLPlain{Username: "senpai", Password: "hunter2"},
+		testSASL("SCRAM-SHA-256"),
+		testSASL("EXTERNAL"),
+	}
+	tests := []struct {
+		mechs    []string
+		expected string
+	}{
+		{[]string{"PLAIN"}, "PLAIN"},
+		{[]string{"PLAIN", "SCRAM-SHA-256"}, "SCRAM-SHA-256"},
+		{[]string{"plain", "EXTERNAL", "SCRAM-SHA-256"}, "EXTERNAL"},
+		{[]string{"OAUTHBEARER"}, ""},
+	}
+	for _, test := range tests {
+		var got string
+		if auth := selectSASL(clients, test.mechs); auth != nil {
+			got = auth.Handshake()
+		}
+		if got != test.expected {
+			t.Errorf("mechanisms %v: expected %q, got %q", test.mechs, test.expected, got)
+		}
+	}
+}
+
+func TestSASLMechanismFallback(t *testing.T) {
+	out := make(chan Message, 128)
+	s := NewSession(out, SessionParams{
+		Nickname: "senpai",
+		Username: "senpai",
+		RealName: "senpai",
+		Auths: []SASLClient{
+			&SASLPlain{Username: "senpai", Password: "hunter2"},
+			testSASL("EXTERNAL"),
+		},
+	})
+	msgs := drain(out)
+	if len(msgs) == 0 || msgs[len(msgs)-1].Command == "CAP" && msgs[len(msgs)-1].Params[0] == "END" {
+		t.Fatalf("expected registration to wait for authentication")
+	}
+
+	handle(t, s, ":irc.example.org CAP * LS :sasl=PLAIN multi-prefix")
+	handle(t, s, ":irc.example.org CAP senpai ACK :sasl")
+	msgs = drain(out)
+	if len(msgs) != 1 || msgs[0].Command != "AUTHENTICATE" || msgs[0].Params[0] != "PLAIN" {
+		t.Fatalf("expected authentication with PLAIN, got %v", msgs)
+	}
+
+	handle(t, s, ":irc.example.org 908 senpai SCRAM-SHA-1 :are available SASL mechanisms")
+	ev, err := s.HandleMessage(mustParse(t, ":irc.example.org 904 senpai :SASL authentication failed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ev.(ErrorEvent); !ok {
+		t.Fatalf("expected an error when no mechanism is supported, got %#v", ev)
+	}
+	if n := countCommand(drain(out), "CAP"); n != 1 {
+		t.Errorf("expected registration to end, got %d CAP messages", n)
+	}
+}
+
+func TestLag(t *testing.T) {
+	s, _ := newTestSession()
+
+	handle(t, s, ":irc.example.org PONG irc.example.org :_")
+	if lag := s.Lag(); lag != 0 {
+		t.Fatalf("expected no lag for a foreign PONG, got %v", lag)
+	}
+
+	sent := time.Now().Add(-150 * time.Millisecond)
+	handle(t, s, ":irc.example.org PONG irc.example.org :"+lagToken(sent))
+	if lag := s.Lag(); lag < 150*time.Millisecond || lag > time.Minute {
+		t.Fatalf("expected a lag of about 150ms, got %v", lag)
+	}
+}
+
+func TestAwayReply(t *testing.T) {
+	s, _ := newTestSession()
+
+	ev, err := s.HandleMessage(mustParse(t, ":irc.example.org 301 senpai kouhai :gone fishing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if away, ok := ev.(UserAwayEvent); !ok || away.User != "kouhai" || away.Message != "gone fishing" {
+		t.Fatalf("expected an away event, got %#v", ev)
+	}
+
+	ev, _ = s.HandleMessage(mustParse(t, ":irc.example.org 301 senpai kouhai :gone fishing"))
+	if ev != nil {
+		t.Fatalf("expected a repeated away reply to be ignored, got %#v", ev)
+	}
+
+	ev, _ = s.HandleMessage(mustParse(t, ":irc.example.org 301 senpai kouhai :back soon"))
+	if _, ok := ev.(UserAwayEvent); !ok {
+		t.Fatalf("expected a new away message to be reported, got %#v", ev)
+	}
+}
+
+func TestCapLsMultiline(t *testing.T) {
+	s, _ := newTestSession()
+
+	handle(t, s, ":irc.example.org CAP * LS * :away-notify batch")
+	handle(t, s, ":irc.example.org CAP * LS * :sasl=PLAIN,EXTERNAL")
+	handle(t, s, ":irc.example.org CAP * LS :")
+	for _, c := range []string{"away-notify", "batch", "sasl"} {
+		if _, ok := s.availableCaps[c]; !ok {
+			t.Errorf("expected capability %q to be available", c)
+		}
+	}
+	if _, ok := s.availableCaps["*"]; ok {
+		t.Errorf("expected the continuation marker not to be parsed as a capability")
+	}
+	if s.availableCaps["sasl"] != "PLAIN,EXTERNAL" {
+		t.Errorf("expected sasl value %q, got %q", "PLAIN,EXTERNAL", s.availableCaps["sasl"])
+	}
+
+	s, _ = newTestSession()
+	handle(t, s, ":irc.example.org CAP * LS * :message-tags")
+	handle(t, s, ":irc.example.org CAP * LS *")
+	handle(t, s, ":irc.example.org CAP * LS")
+	if len(s.availableCaps) != 1 {
+		t.Errorf("expected only message-tags to be available, got %v", s.availableCaps)
+	}
+}
+
+func TestNickChange(t *testing.T) {
+	s, _ := newTestSession()
+
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	for _, channel := range []string{"#senpai", "#kouhai"} {
+		handle(t, s, ":senpai!senpai@example.org JOIN "+channel)
+		handle(t, s, ":irc.example.org 353 senpai = "+channel+" :senpai alice")
+		handle(t, s, ":irc.example.org 366 senpai "+channel+" :End of /NAMES list")
+	}
+
+	handle(t, s, ":alice!alice@example.org NICK Alicia")
+	if _, ok := s.users["alice"]; ok {
+		t.Errorf("expected the former nick to be forgotten")
+	}
+
+	ev, err := s.HandleMessage(mustParse(t, ":Alicia!alice@example.org PART #senpai"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if part, ok := ev.(UserPartEvent); !ok || part.User != "Alicia" || part.Channel != "#senpai" {
+		t.Fatalf("expected Alicia to part #senpai, got %#v", ev)
+	}
+	hasMember := func(channel, nick string) bool {
+		for _, m := range s.Names(channel) {
+			if m.Name.Name == nick {
+				return true
+			}
+		}
+		return false
+	}
+	if hasMember("#senpai", "Alicia") {
+		t.Errorf("expected Alicia not to be in #senpai anymore")
+	}
+	if !hasMember("#kouhai", "Alicia") {
+		t.Errorf("expected Alicia to still be in #kouhai")
+	}
+
+	handle(t, s, ":Alicia!alice@example.org PART #kouhai")
+	if _, ok := s.users["alicia"]; ok {
+		t.Errorf("expected Alicia to be forgotten after leaving all channels")
+	}
+}
+
+func TestNickChangePowerLevel(t *testing.T) {
+	s, _ := newTestSession()
+
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	handle(t, s, ":senpai!senpai@example.org JOIN #senpai")
+	handle(t, s, ":irc.example.org 353 senpai = #senpai :senpai @alice +bob")
+	handle(t, s, ":irc.example.org 366 senpai #senpai :End of /NAMES list")
+
+	handle(t, s, ":alice!alice@example.org NICK Alicia")
+	levels := map[string]string{}
+	for _, m := range s.Names("#senpai") {
+		levels[m.Name.Name] = m.PowerLevel
+	}
+	if levels["Alicia"] != "@" {
+		t.Errorf("expected Alicia to still be an operator, got power level %q", levels["Alicia"])
+	}
+	if levels["bob"] != "+" {
+		t.Errorf("expected bob to still be voiced, got power level %q", levels["bob"])
+	}
+}
+
+func TestChannelModeParams(t *testing.T) {
+	s, _ := newTestSession()
+
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	handle(t, s, ":irc.example.org 005 senpai CHANMODES=b,k,l,nt PREFIX=(ov)@+ :are supported by this server")
+	handle(t, s, ":senpai!senpai@example.org JOIN #senpai")
+	handle(t, s, ":irc.example.org 353 senpai = #senpai :@senpai alice")
+	handle(t, s, ":irc.example.org 366 senpai #senpai :End of /NAMES list")
+
+	handle(t, s, ":senpai!senpai@example.org MODE #senpai +ntk-l+bo secret *!*@spam alice")
+	if modes := s.ChannelModes("#senpai"); modes != "+knt secret" {
+		t.Errorf("expected the key to be kept, without the list and membership modes, got %q", modes)
+	}
+	handle(t, s, ":senpai!senpai@example.org MODE #senpai +l 42")
+	if modes := s.ChannelModes("#senpai"); modes != "+klnt secret 42" {
+		t.Errorf("expected the limit to be added, got %q", modes)
+	}
+	handle(t, s, ":senpai!senpai@example.org MODE #senpai -k+l secret 12")
+	if modes := s.ChannelModes("#senpai"); modes != "+lnt 12" {
+		t.Errorf("expected the key to be removed and the limit updated, got %q", modes)
+	}
+	for _, m := range s.Names("#senpai") {
+		if m.Name.Name == "alice" && m.PowerLevel != "@" {
+			t.Errorf("expected alice to be an operator, got power level %q", m.PowerLevel)
+		}
+	}
+	handle(t, s, ":senpai!senpai@example.org MODE #senpai -o alice")
+	for _, m := range s.Names("#senpai") {
+		if m.Name.Name == "alice" && m.PowerLevel != "" {
+			t.Errorf("expected alice not to be an operator anymore, got power level %q", m.PowerLevel)
+		}
+	}
+}
+
+func TestChangeMemberModes(t *testing.T) {
+	s, out := newTestSession()
+	nicks := []string{"a", "b", "c", "d", "e"}
+
+	tests := []struct {
+		isupport string
+		mode     string
+		expected []string
+	}{
+		{"MODES=3", "+o", []string{"#senpai +ooo a b c", "#senpai +oo d e"}},
+		{"MODES=2", "-o", []string{"#senpai -oo a b", "#senpai -oo c d", "#senpai -o e"}},
+		{"MODES", "+o", []string{"#senpai +ooooo a b c d e"}},
+	}
+	for _, test := range tests {
+		handle(t, s, ":irc.example.org 005 senpai "+test.isupport+" :are supported by this server")
+		s.ChangeMemberModes("#senpai", test.mode, nicks)
+		msgs := drain(out)
+		if len(msgs) != len(test.expected) {
+			t.Fatalf("%s: expected %d MODE commands, got %v", test.isupport, len(test.expected), msgs)
+		}
+		for i, msg := range msgs {
+			if params := strings.Join(msg.Params, " "); msg.Command != "MODE" || params != test.expected[i] {
+				t.Errorf("%s: expected MODE %s, got %s %s", test.isupport, test.expected[i], msg.Command, params)
+			}
+		}
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	s, out := newTestSession()
+	handle(t, s, ":irc.example.org CAP senpai ACK :draft/chathistory")
+	drain(out)
+
+	tests := []struct {
+		isupport string
+		limit    int
+		expected string
+	}{
+		{"CHATHISTORY=50", 200, "50"},
+		{"CHATHISTORY=500", 200, "200"},
+		{"CHATHISTORY=0", 1000, "1000"},
+	}
+	for _, test := range tests {
+		handle(t, s, ":irc.example.org 005 senpai "+test.isupport+" :are supported by this server")
+		s.NewHistoryRequest("#senpai").WithLimit(test.limit).Latest()
+		msgs := drain(out)
+		if len(msgs) != 1 || msgs[0].Command != "CHATHISTORY" {
+			t.Fatalf("%s: expected a CHATHISTORY request, got %v", test.isupport, msgs)
+		}
+		if limit := msgs[0].Params[len(msgs[0].Params)-1]; limit != test.expected {
+			t.Errorf("%s: expected limit %s, got %s", test.isupport, test.expected, limit)
+		}
+		delete(s.chReqs, "#senpai")
+	}
+}
+
+func TestHistoryPending(t *testing.T) {
+	s, out := newTestSession()
+	handle(t, s, ":irc.example.org CAP senpai ACK :draft/chathistory")
+
+	s.NewHistoryRequest("#senpai").Latest()
+	s.NewHistoryRequest("#kouhai").Latest()
+	drain(out)
+
+	handle(t, s, ":irc.example.org FAIL CHATHISTORY MESSAGE_ERROR LATEST #SENPAI :Messages could not be retrieved")
+	if s.HistoryPending("#senpai") {
+		t.Errorf("expected history of #senpai not to be pending after a failure")
+	}
+	if !s.HistoryPending("#kouhai") {
+		t.Errorf("expected history of #kouhai to still be pending")
+	}
+	s.NewHistoryRequest("#kouhai").Latest()
+	if n := countCommand(drain(out), "CHATHISTORY"); n != 0 {
+		t.Errorf("expected no request for #kouhai while one is in flight, got %d", n)
+	}
+
+	handle(t, s, ":irc.example.org FAIL CHATHISTORY INVALID_PARAMS LATEST :Invalid parameters")
+	if s.HistoryPending("#kouhai") {
+		t.Errorf("expected history not to be pending after a failure without target")
+	}
+}
+
+func TestHistoryBackward(t *testing.T) {
+	s, out := newTestSession()
+	handle(t, s, ":irc.example.org CAP senpai ACK :draft/chathistory")
+	handle(t, s, ":irc.example.org CAP senpai ACK :batch")
+
+	tests := []struct {
+		request  func(r *HistoryRequest)
+		backward bool
+	}{
+		{func(r *HistoryRequest) { r.Latest() }, true},
+		{func(r *HistoryRequest) { r.Before(time.Now()) }, true},
+		{func(r *HistoryRequest) { r.After(time.Now()) }, false},
+	}
+	for i, test := range tests {
+		test.request(s.NewHistoryRequest("#senpai"))
+		drain(out)
+		handle(t, s, ":irc.example.org BATCH +1 chathistory #senpai")
+		ev, err := s.HandleMessage(mustParse(t, ":irc.example.org BATCH -1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, ok := ev.(HistoryEvent)
+		if !ok {
+			t.Fatalf("request #%d: expected a history event, got %#v", i, ev)
+		}
+		if h.Backward != test.backward {
+			t.Errorf("request #%d: expected backward to be %v", i, test.backward)
+		}
+	}
+}
+
+func TestChannels(t *testing.T) {
+	s, _ := newTestSession()
+
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	handle(t, s, ":senpai!senpai@example.org JOIN #Senpai")
+	handle(t, s, ":senpai!senpai@example.org JOIN #kouhai")
+	handle(t, s, ":senpai!senpai@example.org PART #kouhai")
+
+	channels := s.Channels()
+	if len(channels) != 1 || channels[0] != "#Senpai" {
+		t.Errorf("expected [#Senpai], got %v", channels)
+	}
+}
+
+func TestAccountTracking(t *testing.T) {
+	s, _ := newTestSession()
+
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	handle(t, s, ":senpai!senpai@example.org JOIN #senpai")
+	handle(t, s, ":alice!alice@example.org JOIN #senpai alice :Alice")
+	handle(t, s, ":bob!bob@example.org JOIN #senpai * :Bob")
+
+	account := func(raw string) string {
+		ev, err := s.HandleMessage(mustParse(t, raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, ok := ev.(MessageEvent)
+		if !ok {
+			t.Fatalf("expected a message event, got %#v", ev)
+		}
+		return msg.Account
+	}
+
+	if a := account(":alice!alice@example.org PRIVMSG #senpai :hi"); a != "alice" {
+		t.Errorf("expected account alice from extended-join, got %q", a)
+	}
+	if a := account(":bob!bob@example.org PRIVMSG #senpai :hi"); a != "" {
+		t.Errorf("expected no account for bob, got %q", a)
+	}
+
+	handle(t, s, ":alice!alice@example.org NICK alicia")
+	if a := account(":alicia!alice@example.org PRIVMSG #senpai :hi"); a != "alice" {
+		t.Errorf("expected the account to follow the nick change, got %q", a)
+	}
+
+	handle(t, s, ":bob!bob@example.org ACCOUNT bobby")
+	if a := account(":bob!bob@example.org PRIVMSG #senpai :hi"); a != "bobby" {
+		t.Errorf("expected account bobby from account-notify, got %q", a)
+	}
+	handle(t, s, ":bob!bob@example.org ACCOUNT *")
+	if a := account("@account=robert :bob!bob@example.org PRIVMSG #senpai :hi"); a != "robert" {
+		t.Errorf("expected account robert from the message tag, got %q", a)
+	}
+}
+
+func TestJoinMultiple(t *testing.T) {
+	s, out := newTestSession()
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	drain(out)
+
+	s.Join("#a,#b", "key")
+	msgs := drain(out)
+	if len(msgs) != 1 || msgs[0].Command != "JOIN" || len(msgs[0].Params) != 2 || msgs[0].Params[0] != "#a,#b" || msgs[0].Params[1] != "key" {
+		t.Fatalf("expected a single JOIN #a,#b key, got %v", msgs)
+	}
+
+	requested := make(map[string]bool)
+	for _, c := range []string{"#b", "#a"} {
+		handle(t, s, ":senpai!senpai@example.org JOIN "+c)
+		ev, err := s.HandleMessage(mustParse(t, ":irc.example.org 366 senpai "+c+" :End of /NAMES list"))
+		if err != nil {
+			t.Fatalf("failed to handle end of names: %v", err)
+		}
+		join, ok := ev.(SelfJoinEvent)
+		if !ok {
+			t.Fatalf("expected a SelfJoinEvent for %s, got %#v", c, ev)
+		}
+		requested[join.Channel] = join.Requested
+	}
+	if !requested["#a"] || requested["#b"] {
+		t.Errorf("expected only #a to be requested, got %v", requested)
+	}
+}
+
+func TestConnectProgress(t *testing.T) {
+	s, _ := newTestSession()
+
+	for _, test := range []struct {
+		raw      string
+		progress bool
+	}{
+		{":irc.example.org CAP * LS * :multi-prefix", false},
+		{":irc.example.org CAP * LS :sasl=PLAIN", true},
+		{":irc.example.org 900 * senpai!senpai@example.org senpai :You are now logged in as senpai", false},
+		{":irc.example.org 903 * :SASL authentication successful", true},
+	} {
+		ev, err := s.HandleMessage(mustParse(t, test.raw))
+		if err != nil {
+			t.Fatalf("failed to handle %q: %v", test.raw, err)
+		}
+		if _, ok := ev.(ConnectProgressEvent); ok != test.progress {
+			t.Errorf("%q: expected progress %v, got %#v", test.raw, test.progress, ev)
+		}
+	}
+
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	ev, err := s.HandleMessage(mustParse(t, ":irc.example.org CAP senpai LS :sasl"))
+	if err != nil {
+		t.Fatalf("failed to handle CAP LS: %v", err)
+	}
+	if _, ok := ev.(ConnectProgressEvent); ok {
+		t.Errorf("expected no progress after registration")
+	}
+}
+
+func TestServerNotice(t *testing.T) {
+	s, _ := newTestSession()
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+
+	for _, test := range []struct {
+		raw        string
+		user       string
+		fromServer bool
+	}{
+		{":irc.example.org NOTICE senpai :*** Looking up your hostname", "irc.example.org", true},
+		{"NOTICE senpai :*** No prefix", "", true},
+		{":NickServ!NickServ@services.example.org NOTICE senpai :This nickname is registered", "NickServ", false},
+		{":alice!alice@example.org NOTICE senpai :hi", "alice", false},
+	} {
+		ev, err := s.HandleMessage(mustParse(t, test.raw))
+		if err != nil {
+			t.Fatalf("failed to handle %q: %v", test.raw, err)
+		}
+		msg, ok := ev.(MessageEvent)
+		if !ok {
+			t.Fatalf("%q: expected a MessageEvent, got %#v", test.raw, ev)
+		}
+		if msg.User != test.user || msg.FromServer != test.fromServer {
+			t.Errorf("%q: expected user %q from server %v, got %q from server %v", test.raw, test.user, test.fromServer, msg.User, msg.FromServer)
+		}
+	}
+
+	if _, err := s.HandleMessage(mustParse(t, "PRIVMSG senpai :no prefix")); err == nil {
+		t.Errorf("expected an error for a PRIVMSG without prefix")
+	}
+}
+
+func TestTopicWhoTime(t *testing.T) {
+	s, _ := newTestSession()
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+
+	handle(t, s, ":senpai!senpai@example.org JOIN #senpai")
+	handle(t, s, ":irc.example.org 332 senpai #senpai :Welcome to #senpai")
+	handle(t, s, ":irc.example.org 333 senpai #senpai alice!alice@example.org 1700000000")
+	topic, who, at := s.Topic("#senpai")
+	if topic != "Welcome to #senpai" {
+		t.Errorf("expected the topic to be set, got %q", topic)
+	}
+	if who == nil || who.Name != "alice" {
+		t.Errorf("expected the topic to be set by alice, got %v", who)
+	}
+	if !at.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("expected the topic time to be set, got %v", at)
+	}
+
+	handle(t, s, ":bob!bob@example.org TOPIC #senpai :New topic")
+	topic, who, _ = s.Topic("#senpai")
+	if topic != "New topic" || who == nil || who.Name != "bob" {
+		t.Errorf("expected the topic to be set by bob, got %q by %v", topic, who)
+	}
+}
+
+func TestNoTagsWithoutMessageTags(t *testing.T) {
+	s, out := newTestSession()
+	handle(t, s, ":irc.example.org CAP * ACK :labeled-response")
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	drain(out)
+
+	s.PrivMsgReply("#senpai", "hello", "msgid")
+	s.Typing("#senpai")
+	s.TypingStop("#senpai")
+	s.ReadSet("#senpai", time.Now())
+	for _, msg := range drain(out) {
+		if len(msg.Tags) != 0 {
+			t.Errorf("expected no tags without message-tags, got %v", msg)
+		}
+		if msg.Command == labelEnableCommand {
+			t.Errorf("expected labels to stay disabled without message-tags")
+		}
+	}
+
+	handle(t, s, ":irc.example.org CAP senpai ACK :message-tags")
+	msgs := drain(out)
+	if len(msgs) != 1 || msgs[0].Command != labelEnableCommand {
+		t.Errorf("expected labels to be enabled with message-tags, got %v", msgs)
+	}
+	s.PrivMsgReply("#senpai", "hello", "msgid")
+	msgs = drain(out)
+	if len(msgs) != 1 || msgs[0].Tags["+draft/reply"] != "msgid" {
+		t.Errorf("expected a reply tag with message-tags, got %v", msgs)
+	}
+
+	handle(t, s, ":irc.example.org CAP senpai DEL :message-tags")
+	msgs = drain(out)
+	if len(msgs) != 1 || msgs[0].Command != labelDisableCommand {
+		t.Errorf("expected labels to be disabled without message-tags, got %v", msgs)
+	}
+}
+
+func TestMonitors(t *testing.T) {
+	s, out := newTestSession()
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	handle(t, s, ":irc.example.org 005 senpai MONITOR=100 :are supported by this server")
+	drain(out)
+
+	s.MonitorAdd("Alice")
+	s.MonitorAdd("bob")
+	s.MonitorAdd("carol")
+	drain(out)
+	handle(t, s, ":irc.example.org 730 senpai :Alice!alice@example.org")
+	handle(t, s, ":irc.example.org 731 senpai :bob")
+
+	online, offline, unknown, ok := s.Monitors()
+	if !ok {
+		t.Errorf("expected MONITOR to be supported")
+	}
+	if len(online) != 1 || online[0] != "Alice" || len(offline) != 1 || offline[0] != "bob" || len(unknown) != 1 || unknown[0] != "carol" {
+		t.Errorf("expected online Alice, offline bob, unknown carol; got %v, %v, %v", online, offline, unknown)
+	}
+	if !s.IsMonitored("alice") {
+		t.Errorf("expected alice to be monitored")
+	}
+
+	s.MonitorClear()
+	msgs := drain(out)
+	if len(msgs) != 1 || msgs[0].Command != "MONITOR" || msgs[0].Params[0] != "C" {
+		t.Errorf("expected MONITOR C, got %v", msgs)
+	}
+	online, offline, unknown, _ = s.Monitors()
+	if len(online)+len(offline)+len(unknown) != 0 {
+		t.Errorf("expected no monitored users after clearing, got %v, %v, %v", online, offline, unknown)
+	}
+}
+
+func TestReadMarker(t *testing.T) {
+	s, out := newTestSession()
+	handle(t, s, ":irc.example.org CAP * ACK :draft/read-marker")
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	drain(out)
+
+	s.ReadGet("alice")
+	msgs := drain(out)
+	if len(msgs) != 1 || msgs[0].Command != "MARKREAD" || msgs[0].Params[0] != "alice" {
+		t.Errorf("expected MARKREAD alice, got %v", msgs)
+	}
+
+	ev, err := s.HandleMessage(mustParse(t, ":irc.example.org MARKREAD alice timestamp=2024-01-02T03:04:05.000Z"))
+	if err != nil {
+		t.Fatalf("failed to handle MARKREAD: %v", err)
+	}
+	read, ok := ev.(ReadEvent)
+	if !ok || read.Target != "alice" || !read.Timestamp.Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("expected a read event for alice, got %#v", ev)
+	}
+
+	if ev, err := s.HandleMessage(mustParse(t, ":irc.example.org MARKREAD alice *")); err != nil || ev != nil {
+		t.Errorf("expected no event without read marker, got %#v (%v)", ev, err)
+	}
+}
+
+func TestAuthFailed(t *testing.T) {
+	out := make(chan Message, 128)
+	s := NewSession(out, SessionParams{
+		Nickname: "senpai",
+		Username: "senpai",
+		RealName: "senpai",
+		Auths:    []SASLClient{&SASLPlain{Username: "senpai", Password: "hunter2"}},
+	})
+	drain(out)
+
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	handle(t, s, ":irc.example.org CAP senpai NEW :sasl")
+	handle(t, s, ":irc.example.org CAP senpai ACK :sasl")
+	handle(t, s, "AUTHENTICATE +")
+	if s.AuthFailed() {
+		t.Fatalf("expected no failure while authenticating")
+	}
+	handle(t, s, ":irc.example.org 904 senpai :SASL authentication failed")
+	if !s.AuthFailed() {
+		t.Fatalf("expected the failure to be recorded")
+	}
+
+	handle(t, s, ":irc.example.org CAP senpai NEW :sasl")
+	handle(t, s, ":irc.example.org 903 senpai :SASL authentication successful")
+	if s.AuthFailed() {
+		t.Errorf("expected the failure to be cleared on success")
+	}
+}
+
+func TestKill(t *testing.T) {
+	s, _ := newTestSession()
+
+	ev, err := s.HandleMessage(mustParse(t, ":oper!oper@example.org KILL senpai :flooding"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev, ok := ev.(DisconnectEvent); !ok || ev.Killer != "oper" || ev.Reason != "flooding" {
+		t.Fatalf("expected the kill to be reported, got %#v", ev)
+	}
+	ev, err = s.HandleMessage(mustParse(t, "ERROR :Closing Link: example.org (Killed (oper (flooding)))"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev != nil {
+		t.Errorf("expected the kill not to be reported twice, got %#v", ev)
+	}
+}
+
+func TestQuitError(t *testing.T) {
+	s, _ := newTestSession()
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+
+	s.Quit("Reconnecting")
+	ev, err := s.HandleMessage(mustParse(t, "ERROR :Closing Link: example.org (Quit: Reconnecting)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev != nil {
+		t.Errorf("expected the answer to our QUIT not to be reported, got %#v", ev)
+	}
+}
+
+func TestWallops(t *testing.T) {
+	s, _ := newTestSession()
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+
+	ev, err := s.HandleMessage(mustParse(t, ":oper!oper@example.org WALLOPS :Server maintenance in 5 minutes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev, ok := ev.(WallopsEvent); !ok || ev.Sender != "oper" || ev.Message != "Server maintenance in 5 minutes" {
+		t.Errorf("expected a wallops event, got %#v", ev)
+	}
+}
+
+func TestPrivMsgTrailingSpaces(t *testing.T) {
+	s, out := newTestSession()
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	drain(out)
+
+	s.PrivMsg("#senpai", "if x:  ")
+	msgs := drain(out)
+	if len(msgs) != 1 {
+		t.Fatalf("expected a message, got %v", msgs)
+	}
+	// Send it through the wire, as echoed back by the server.
+	msg := mustParse(t, ":senpai!senpai@example.org "+msgs[0].String())
+	ev, err := s.HandleMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev, ok := ev.(MessageEvent); !ok || ev.Content != "if x:  " {
+		t.Errorf("expected the trailing spaces to be kept, got %#v", ev)
+	}
+}
+
+func TestSplitUsersExpire(t *testing.T) {
+	s, _ := newTestSession()
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	handle(t, s, ":senpai!senpai@example.org JOIN #senpai")
+	handle(t, s, ":alice!alice@example.org JOIN #senpai")
+	handle(t, s, ":bob!bob@example.org JOIN #senpai")
+
+	handle(t, s, "@time=2024-01-01T10:00:00.000Z :alice!alice@example.org QUIT :hub.example.org leaf.example.org")
+	handle(t, s, "@time=2024-01-01T10:30:00.000Z :bob!bob@example.org QUIT :hub.example.org leaf.example.org")
+	if len(s.splitUsers) != 2 {
+		t.Fatalf("expected 2 split users, got %v", s.splitUsers)
+	}
+
+	// alice never comes back: they are forgotten once the netjoin window is
+	// over.
+	ev, err := s.HandleMessage(mustParse(t, "@time=2024-01-01T11:15:00.000Z :bob!bob@example.org JOIN #senpai"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev, ok := ev.(UserJoinEvent); !ok || !ev.Netjoin {
+		t.Errorf("expected a netjoin, got %#v", ev)
+	}
+	if _, ok := s.splitUsers["alice"]; ok || len(s.splitUsers) != 1 {
+		t.Errorf("expected only bob to be left, got %v", s.splitUsers)
+	}
+}
+
+func TestPing(t *testing.T) {
+	s, out := newTestSession()
+	handle(t, s, ":irc.example.org 001 senpai :Welcome")
+	drain(out)
+
+	s.Ping()
+	msgs := drain(out)
+	if len(msgs) != 1 || msgs[0].Command != "PING" {
+		t.Fatalf("expected a PING, got %v", msgs)
+	}
+	if !s.PingPending() {
+		t.Fatalf("expected the PING to be pending")
+	}
+	handle(t, s, ":irc.example.org PONG irc.example.org :lag-1")
+	if !s.PingPending() {
+		t.Errorf("expected the PING to be pending after the PONG of an older PING")
+	}
+	handle(t, s, ":irc.example.org PONG irc.example.org :"+msgs[0].Params[0])
+	if s.PingPending() {
+		t.Errorf("expected the PING to be answered")
+	}
+}
+
+func TestMultiline(t *testing.T) {
+	s, out := newTestSession()
+	if s.CanMultiline("#senpai", []string{"a", "b"}) {
+		t.Fatalf("expected multiline messages to be unsupported without draft/multiline")
+	}
+	handle(t, s, ":irc.example.org CAP * LS :batch draft/multiline=max-bytes=8,max-lines=3")
+	handle(t, s, ":irc.example.org CAP senpai ACK :batch draft/multiline")
+
+	tests := []struct {
+		lines []string
+		ok    bool
+	}{
+		{[]string{"a", "b"}, true},
+		{[]string{"abc", "defg"}, true},
+		{[]string{"abc", "defgh"}, false},
+		{[]string{"a", "b", "c", "d"}, false},
+	}
+	for _, test := range tests {
+		if ok := s.CanMultiline("#senpai", test.lines); ok != test.ok {
+			t.Errorf("%q: expected %v, got %v", test.lines, test.ok, ok)
+		}
+	}
+
+	drain(out)
+	s.PrivMsgMultiline("#senpai", []string{"a", "b"})
+	msgs := drain(out)
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(msgs))
+	}
+	if msgs[0].Command != "BATCH" || msgs[0].Params[1] != "draft/multiline" || msgs[3].Command != "BATCH" {
+		t.Fatalf("expected the lines to be sent in a multiline batch, got %v", msgs)
+	}
+	ref := msgs[0].Params[0][1:]
+	for _, msg := range msgs[1:3] {
+		if msg.Command != "PRIVMSG" || msg.Tags["batch"] != ref {
+			t.Errorf("expected a PRIVMSG in batch %q, got %v", ref, msg)
+		}
+	}
+	if msgs[3].Params[0] != "-"+ref {
+		t.Errorf("expected the batch %q to be closed, got %v", ref, msgs[3])
+	}
+}
+
+func TestMultilineHistory(t *testing.T) {
+	s, out := newTestSession()
+	handle(t, s, ":irc.example.org CAP senpai ACK :draft/chathistory")
+	handle(t, s, ":irc.example.org CAP senpai ACK :batch")
+
+	s.NewHistoryRequest("#senpai").Latest()
+	drain(out)
+	handle(t, s, ":irc.example.org BATCH +1 chathistory #senpai")
+	handle(t, s, "@batch=1;msgid=ml :kouhai!k@example.org BATCH +2 draft/multiline #senpai")
+	handle(t, s, "@batch=2 :kouhai!k@example.org PRIVMSG #senpai :hello")
+	handle(t, s, "@batch=2 :kouhai!k@example.org PRIVMSG #senpai :world")
+	handle(t, s, "@batch=1 :irc.example.org BATCH -2")
+	ev, err := s.HandleMessage(mustParse(t, ":irc.example.org BATCH -1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, ok := ev.(HistoryEvent)
+	if !ok {
+		t.Fatalf("expected a history event, got %#v", ev)
+	}
+	if len(h.Messages) != 1 {
+		t.Fatalf("expected the multiline message as one message in history, got %d messages", len(h.Messages))
+	}
+	if m, ok := h.Messages[0].(MessageEvent); !ok || m.Content != "hello\nworld" || m.MsgID != "ml" {
+		t.Errorf("expected the lines joined with the ID of the batch, got %#v", h.Messages[0])
+	}
+	if len(s.multilines) != 0 {
+		t.Errorf("expected the multiline batch to be forgotten")
+	}
+}
+
+func TestMultilineReceive(t *testing.T) {
+	s, _ := newTestSession()
+	handle(t, s, ":irc.example.org CAP senpai ACK :batch draft/multiline")
+
+	handle(t, s, "@msgid=ml;time=2024-01-02T03:04:05.000Z :kouhai!k@example.org BATCH +1 draft/multiline #senpai")
+	handle(t, s, "@batch=1 :kouhai!k@example.org PRIVMSG #senpai :hello")
+	handle(t, s, "@batch=1;draft/multiline-concat :kouhai!k@example.org PRIVMSG #senpai : world")
+	handle(t, s, "@batch=1 :kouhai!k@example.org PRIVMSG #senpai :bye")
+	ev, err := s.HandleMessage(mustParse(t, ":kouhai!k@example.org BATCH -1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := ev.(MessageEvent)
+	if !ok {
+		t.Fatalf("expected a single message event, got %#v", ev)
+	}
+	if m.Content != "hello world\nbye" {
+		t.Errorf("expected the concatenated lines, got %q", m.Content)
+	}
+	if m.MsgID != "ml" || m.User != "kouhai" || m.Time.Year() != 2024 {
+		t.Errorf("expected the ID and time of the batch, got %#v", m)
+	}
+}
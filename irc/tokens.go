@@ -337,7 +337,7 @@ func (msg *Message) String() string {
 			sb.WriteString(p)
 		}
 		lastParam := msg.Params[len(msg.Params)-1]
-		if !strings.ContainsRune(lastParam, ' ') && !strings.HasPrefix(lastParam, ":") {
+		if lastParam != "" && !strings.ContainsRune(lastParam, ' ') && !strings.HasPrefix(lastParam, ":") {
 			sb.WriteRune(' ')
 			sb.WriteString(lastParam)
 		} else {
@@ -432,6 +432,46 @@ type Cap struct {
 	Enable bool
 }
 
+// isNetsplit reports whether a quit message is the one sent by servers on a
+// netsplit, that is, two distinct server hostnames separated by a space.
+func isNetsplit(reason string) bool {
+	servers := strings.Split(reason, " ")
+	if len(servers) != 2 || servers[0] == servers[1] {
+		return false
+	}
+	for _, server := range servers {
+		if !strings.Contains(server, ".") || strings.HasPrefix(server, ".") || strings.HasSuffix(server, ".") {
+			return false
+		}
+		for _, r := range server {
+			if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '.' || r == '-' || r == '*') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// capsParam returns the capability list of a CAP reply from its parameters
+// following the subcommand. The continuation marker of multiline replies
+// ("CAP <nick> LS * :<caps>") is skipped, and the list may be missing or
+// empty, as in the last line of some multiline replies.
+func capsParam(params []string) string {
+	if len(params) > 0 && params[0] == "*" {
+		params = params[1:]
+	}
+	return strings.Join(params, " ")
+}
+
+// accountParam returns the account name in a parameter of an account-notify,
+// extended-join or WHOX reply, where none marks a user that is not logged in.
+func accountParam(account, none string) string {
+	if account == none {
+		return ""
+	}
+	return account
+}
+
 // ParseCaps parses the last argument (capability list) of "CAP LS/LIST/NEW/DEL"
 // server responses.
 func ParseCaps(caps string) (diff []Cap) {
@@ -467,7 +507,8 @@ type Member struct {
 	Name         *Prefix
 	Away         bool
 	Disconnected bool
-	Self         bool // Added by senpai
+	Account      string // empty if unknown
+	Self         bool   // Added by senpai
 }
 
 type members struct {
@@ -0,0 +1,21 @@
+package irc
+
+import "testing"
+
+func TestMessageString(t *testing.T) {
+	tests := []struct {
+		msg      Message
+		expected string
+	}{
+		{NewMessage("PART", "#senpai"), "PART #senpai"},
+		{NewMessage("PART", "#senpai", "bye"), "PART #senpai bye"},
+		{NewMessage("PART", "#senpai", "see you"), "PART #senpai :see you"},
+		{NewMessage("QUIT", ":)"), "QUIT ::)"},
+		{NewMessage("QUIT", ""), "QUIT :"},
+	}
+	for _, test := range tests {
+		if s := test.msg.String(); s != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, s)
+		}
+	}
+}
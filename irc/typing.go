@@ -20,6 +20,8 @@ type Typings struct {
 	targets  map[Typing]time.Time // @+typing TAGMSG timestamps.
 	timeouts chan Typing          // transmits unfiltered timeout notifications.
 	stops    chan Typing          // transmits filtered timeout notifications.
+	done     chan struct{}        // closed by Close, to stop all goroutines.
+	wg       sync.WaitGroup       // running goroutines.
 }
 
 // NewTypings initializes the Typings structures and filtering coroutine.
@@ -28,16 +30,32 @@ func NewTypings() *Typings {
 		targets:  map[Typing]time.Time{},
 		timeouts: make(chan Typing, 16),
 		stops:    make(chan Typing, 16),
+		done:     make(chan struct{}),
 	}
+	ts.wg.Add(1)
 	go func() {
-		for t := range ts.timeouts {
+		defer ts.wg.Done()
+		// Only this goroutine sends to stops, so it closes it once done,
+		// whether or not stops is being read.
+		defer close(ts.stops)
+		for {
+			var t Typing
+			select {
+			case t = <-ts.timeouts:
+			case <-ts.done:
+				return
+			}
 			now := time.Now()
 			ts.l.Lock()
 			oldT, ok := ts.targets[t]
 			if ok && 6.0 < now.Sub(oldT).Seconds() {
 				delete(ts.targets, t)
 				ts.l.Unlock()
-				ts.stops <- t
+				select {
+				case ts.stops <- t:
+				case <-ts.done:
+					return
+				}
 			} else {
 				ts.l.Unlock()
 			}
@@ -46,14 +64,17 @@ func NewTypings() *Typings {
 	return ts
 }
 
-// Close cleanly closes all channels and stops all goroutines.
+// Close cleanly closes all channels and stops all goroutines, waiting for
+// them to return.
 func (ts *Typings) Close() {
 	ts.l.Lock()
-	defer ts.l.Unlock()
-
-	close(ts.timeouts)
-	close(ts.stops)
-	ts.closed = true
+	if !ts.closed {
+		close(ts.done)
+		ts.closed = true
+	}
+	ts.l.Unlock()
+	// The goroutines take the lock, so wait for them without holding it.
+	ts.wg.Wait()
 }
 
 // Stops is a channel that transmits typing timeouts.
@@ -64,19 +85,24 @@ func (ts *Typings) Stops() <-chan Typing {
 // Active should be called when a user is typing to some target.
 func (ts *Typings) Active(target, name string) {
 	ts.l.Lock()
+	defer ts.l.Unlock()
+	if ts.closed {
+		return
+	}
 	t := Typing{target, name}
 	ts.targets[t] = time.Now()
-	ts.l.Unlock()
 
+	ts.wg.Add(1)
 	go func() {
-		time.Sleep(6 * time.Second)
-
-		ts.l.Lock()
-		closed := ts.closed
-		ts.l.Unlock()
-
-		if !closed {
-			ts.timeouts <- t
+		defer ts.wg.Done()
+		select {
+		case <-time.After(6 * time.Second):
+		case <-ts.done:
+			return
+		}
+		select {
+		case ts.timeouts <- t:
+		case <-ts.done:
 		}
 	}()
 }
@@ -88,6 +114,26 @@ func (ts *Typings) Done(target, name string) {
 	ts.l.Unlock()
 }
 
+// DoneUser should be called when a user is done typing to all targets, for
+// example when they change their nickname.
+func (ts *Typings) DoneUser(name string) {
+	ts.l.Lock()
+	for t := range ts.targets {
+		if t.Name == name {
+			delete(ts.targets, t)
+		}
+	}
+	ts.l.Unlock()
+}
+
+// Clear forgets all users currently typing, for example when typing
+// notifications become unsupported.
+func (ts *Typings) Clear() {
+	ts.l.Lock()
+	ts.targets = map[Typing]time.Time{}
+	ts.l.Unlock()
+}
+
 func (ts *Typings) List(target string) []string {
 	ts.l.Lock()
 	defer ts.l.Unlock()
@@ -0,0 +1,75 @@
+package senpai
+
+import "sync"
+
+// netEvents queues the events of each network separately, so that a network
+// flooding events does not delay those of the others: the queues are taken
+// from in turn.
+type netEvents struct {
+	lock   sync.Mutex
+	queues map[string]chan event
+	ids    []string // networks with a queue, in the order they are taken from
+	next   int      // index in ids of the next queue to take from
+
+	// ready is signaled after an event is pushed.
+	ready chan struct{}
+}
+
+func newNetEvents() *netEvents {
+	return &netEvents{
+		queues: make(map[string]chan event),
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// push queues ev for the given network. It blocks while the queue of that
+// network is full, without affecting other networks.
+func (q *netEvents) push(netID string, ev event) {
+	q.lock.Lock()
+	ch, ok := q.queues[netID]
+	if !ok {
+		ch = make(chan event, eventChanSize)
+		q.queues[netID] = ch
+		q.ids = append(q.ids, netID)
+	}
+	q.lock.Unlock()
+
+	ch <- ev
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// rearm signals ready again if events are still queued, for when the
+// consumer stops taking events before the queues are empty.
+func (q *netEvents) rearm() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, ch := range q.queues {
+		if len(ch) > 0 {
+			select {
+			case q.ready <- struct{}{}:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// pop returns the next event of the first network with pending events,
+// starting from the one after the network of the last event returned.
+func (q *netEvents) pop() (ev event, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i := 0; i < len(q.ids); i++ {
+		j := (q.next + i) % len(q.ids)
+		select {
+		case ev := <-q.queues[q.ids[j]]:
+			q.next = (j + 1) % len(q.ids)
+			return ev, true
+		default:
+		}
+	}
+	return event{}, false
+}
@@ -0,0 +1,99 @@
+package senpai
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestNetEventsFair(t *testing.T) {
+	q := newNetEvents()
+	for i := 0; i < eventChanSize; i++ {
+		q.push("flood", event{src: "flood", content: i})
+	}
+	for i := 0; i < 3; i++ {
+		q.push("quiet", event{src: "quiet", content: i})
+	}
+
+	quiet := 0
+	for i := 0; i < 6; i++ {
+		ev, ok := q.pop()
+		if !ok {
+			t.Fatalf("expected an event")
+		}
+		if ev.src == "quiet" {
+			if ev.content != quiet {
+				t.Fatalf("expected event %d, got %v", quiet, ev.content)
+			}
+			quiet++
+		}
+	}
+	if quiet != 3 {
+		t.Errorf("expected the events of the quiet network to be taken in turn with the flood, got %d of 3", quiet)
+	}
+}
+
+func TestNetEventsStress(t *testing.T) {
+	const floodCount = 20 * eventChanSize
+	const quietCount = 100
+	q := newNetEvents()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < floodCount; i++ {
+			q.push("flood", event{src: "flood", content: i})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < quietCount; i++ {
+			q.push("quiet", event{src: "quiet", content: i})
+		}
+	}()
+
+	next := map[string]int{}
+	for next["flood"] < floodCount || next["quiet"] < quietCount {
+		ev, ok := q.pop()
+		if !ok {
+			<-q.ready
+			continue
+		}
+		if ev.content != next[ev.src] {
+			t.Fatalf("%s: expected event %d, got %v", ev.src, next[ev.src], ev.content)
+		}
+		next[ev.src]++
+	}
+	wg.Wait()
+}
+
+func TestNetEventsRearm(t *testing.T) {
+	q := newNetEvents()
+	for i := 0; i < 3; i++ {
+		q.push("flood", event{src: "flood", content: i})
+	}
+	<-q.ready
+	if _, ok := q.pop(); !ok {
+		t.Fatalf("expected an event")
+	}
+
+	// The consumer stops here, as on its deadline, with events still queued.
+	q.rearm()
+	select {
+	case <-q.ready:
+	default:
+		t.Fatalf("expected ready to be signaled while events are queued")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, ok := q.pop(); !ok {
+			t.Fatalf("expected an event")
+		}
+	}
+	q.rearm()
+	select {
+	case <-q.ready:
+		t.Errorf("expected ready not to be signaled once the queues are empty")
+	default:
+	}
+}
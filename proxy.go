@@ -0,0 +1,98 @@
+package senpai
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyDialer returns a dialer connecting through the proxy at u, one of
+// socks5://, socks5h:// or http://, with optional credentials in its user
+// info.
+func proxyDialer(u *url.URL, forward *net.Dialer) (proxy.ContextDialer, error) {
+	if u.Scheme == "http" {
+		return &httpProxyDialer{
+			url:     u,
+			forward: forward,
+		}, nil
+	}
+	d, err := proxy.FromURL(u, forward)
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported proxy: %v", u.Redacted())
+	}
+	return cd, nil
+}
+
+// httpProxyDialer connects through an HTTP proxy with the CONNECT method.
+type httpProxyDialer struct {
+	url     *url.URL
+	forward *net.Dialer
+}
+
+func (d *httpProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host := d.url.Host
+	if d.url.Port() == "" {
+		host = net.JoinHostPort(d.url.Hostname(), "80")
+	}
+	conn, err := d.forward.DialContext(ctx, network, host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.url.User != nil {
+		password, _ := d.url.User.Password()
+		credentials := d.url.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy: %s", res.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{
+		Conn: conn,
+		r:    r,
+	}, nil
+}
+
+// bufferedConn is a connection whose first bytes were read into r.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,60 @@
+package senpai
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestHTTPProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			done <- err
+			return
+		}
+		if req.Method != http.MethodConnect || req.Host != "irc.example.org:6697" {
+			t.Errorf("expected CONNECT irc.example.org:6697, got %s %s", req.Method, req.Host)
+		}
+		if auth := req.Header.Get("Proxy-Authorization"); auth != "Basic c2VucGFpOmhhbmFrbw==" {
+			t.Errorf("expected the proxy credentials, got %q", auth)
+		}
+		// The server speaks first: this must not be lost with the response.
+		_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nNOTICE * :hello\r\n"))
+		done <- err
+	}()
+
+	u, _ := url.Parse("http://senpai:hanako@" + ln.Addr().String())
+	d, err := proxyDialer(u, &net.Dialer{})
+	if err != nil {
+		t.Fatalf("failed to create the proxy dialer: %v", err)
+	}
+	conn, err := d.DialContext(context.Background(), "tcp", "irc.example.org:6697")
+	if err != nil {
+		t.Fatalf("failed to connect through the proxy: %v", err)
+	}
+	defer conn.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("proxy failed: %v", err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "NOTICE * :hello\r\n" {
+		t.Errorf("expected the first line from the server, got %q (%v)", line, err)
+	}
+}
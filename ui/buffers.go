@@ -3,8 +3,10 @@ package ui
 import (
 	"fmt"
 	"math"
+	"sort"
 	"strings"
 	"time"
+	"unicode"
 
 	"git.sr.ht/~rockorager/vaxis"
 
@@ -17,16 +19,32 @@ func IsSplitRune(r rune) bool {
 	return r == ' ' || r == '\t'
 }
 
+// isCJKRune reports whether r is a CJK character, before and after which
+// lines can be wrapped even without whitespace.
+func isCJKRune(r rune) bool {
+	switch {
+	case 0x3000 <= r && r <= 0x303F: // CJK symbols and punctuation
+		return true
+	case 0xFF00 <= r && r <= 0xFFEF: // halfwidth and fullwidth forms
+		return true
+	}
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
 type point struct {
 	X     int // in cells
 	I     int // in bytes
 	Split bool
+	Break bool // a line feed, after which the line always wraps.
 }
 
 type NotifyType int
 
+// Notification types, in increasing order of importance. They are also the
+// activity levels of buffers.
 const (
-	NotifyNone NotifyType = iota
+	NotifyNone   NotifyType = iota
+	NotifyStatus            // status events, such as joins and parts
 	NotifyUnread
 	NotifyHighlight
 )
@@ -49,38 +67,84 @@ type Line struct {
 	Readable  bool
 	Mergeable bool
 	Data      interface{}
+	ID        string   // unique ID of the message (msgid), if any.
+	Aliases   []string // other IDs of the message, such as the IDs of its edits.
+
+	// Author is the sender of a message whose Body starts with its
+	// nickname on AuthorLen bytes, omitted when grouping messages by author.
+	Author    string
+	AuthorLen int
 
 	splitPoints []point
 	width       int
 	newLines    []int
 }
 
+// groupedWith reports whether l is from the same author as prev, the line
+// before it, and sent less than window after it, so that its author can be
+// omitted.
+func (l *Line) groupedWith(prev *Line, window time.Duration) bool {
+	if window <= 0 || l.Author == "" || prev.Author != l.Author {
+		return false
+	}
+	d := l.At.Sub(prev.At)
+	return 0 <= d && d < window
+}
+
+// HasID reports whether id is the ID of the message of the line, or one of
+// its aliases.
+func (l *Line) HasID(id string) bool {
+	if id == "" {
+		return false
+	}
+	if l.ID == id {
+		return true
+	}
+	for _, alias := range l.Aliases {
+		if alias == id {
+			return true
+		}
+	}
+	return false
+}
+
 func (l *Line) IsZero() bool {
 	return l.Body.string == ""
 }
 
-func (l *Line) computeSplitPoints(vx *Vaxis) {
+// computeSplitPoints computes where the line can be wrapped. If cjk is true,
+// it can also be wrapped between CJK characters.
+func (l *Line) computeSplitPoints(vx *Vaxis, cjk bool) {
 	if l.splitPoints == nil {
 		l.splitPoints = []point{}
 	}
 
 	width := 0
 	lastWasSplit := false
+	lastWasCJK := false
+	lastWasBreak := false
 	l.splitPoints = l.splitPoints[:0]
 
 	for i, r := range l.Body.string {
-		curIsSplit := IsSplitRune(r)
+		curIsBreak := r == '\n'
+		curIsSplit := IsSplitRune(r) || curIsBreak
+		curIsCJK := cjk && isCJKRune(r)
 
-		if i == 0 || lastWasSplit != curIsSplit {
+		if i == 0 || lastWasSplit != curIsSplit || curIsBreak || lastWasBreak || (!curIsSplit && (curIsCJK || lastWasCJK)) {
 			l.splitPoints = append(l.splitPoints, point{
 				X:     width,
 				I:     i,
 				Split: curIsSplit,
+				Break: curIsBreak,
 			})
 		}
 
 		lastWasSplit = curIsSplit
-		width += runeWidth(vx, r)
+		lastWasCJK = curIsCJK
+		lastWasBreak = curIsBreak
+		if !curIsBreak {
+			width += runeWidth(vx, r)
+		}
 	}
 
 	if !lastWasSplit {
@@ -124,14 +188,23 @@ func (l *Line) NewLines(vx *Vaxis, width int) []int {
 		sp1 := l.splitPoints[i-1]
 		sp2 := l.splitPoints[i]
 
-		if 0 < len(l.newLines) && x == 0 && sp1.Split {
+		if sp1.Break {
+			// A line feed, from a multiline message: always start a new
+			// row after it, unless the row was already full.
+			x = 0
+			if n := len(l.newLines); 0 < n && l.newLines[n-1] == sp1.I && !l.splitPoints[i-2].Break {
+				l.newLines[n-1] = sp2.I
+			} else {
+				l.newLines = append(l.newLines, sp2.I)
+			}
+		} else if 0 < len(l.newLines) && x == 0 && sp1.Split {
 			// Except for the first row, let's skip the whitespace at the start
 			// of the row.
 		} else if !sp1.Split && sp2.X-sp1.X == width {
 			// Some word occupies the width of the terminal, lets place a
 			// newline at the PREVIOUS split point (i-2, which is whitespace)
 			// ONLY if there isn't already one.
-			if 1 < i && 0 < len(l.newLines) && l.newLines[len(l.newLines)-1] != l.splitPoints[i-2].I {
+			if 1 < i && l.splitPoints[i-2].Split && 0 < len(l.newLines) && l.newLines[len(l.newLines)-1] != l.splitPoints[i-2].I {
 				l.newLines = append(l.newLines, l.splitPoints[i-2].I)
 			}
 			// and also place a newline after the word.
@@ -199,8 +272,9 @@ type buffer struct {
 	netName       string
 	title         string
 	highlights    int
+	unread        int // number of unread messages, counted as highlights
 	notifications []int
-	unread        bool
+	activity      NotifyType // highest notification type of the unread lines
 	read          time.Time
 	openedOnce    bool
 
@@ -218,8 +292,24 @@ type buffer struct {
 	lines []Line
 	topic StyledString
 
-	scrollAmt int // offset in lines from the bottom
-	isAtTop   bool
+	scrollAmt      int // offset in lines from the bottom
+	isAtTop        bool
+	cleared        bool // whether lines were cleared, and not scrolled up since
+	loadingHistory bool // whether older lines are being fetched
+
+	selecting bool // whether a line is selected
+	selected  int  // index of the selected line in lines
+
+	// Position of the "away since" divider, if any: it is drawn before the
+	// first line after awayMarker, and shows when the away period started.
+	awayMarker time.Time
+	awaySince  time.Time
+}
+
+// BufferKey identifies a buffer.
+type BufferKey struct {
+	NetID string
+	Title string
 }
 
 type BufferList struct {
@@ -237,6 +327,19 @@ type BufferList struct {
 
 	filterBuffers      bool
 	filterBuffersQuery string // lowercased
+
+	// The last away period, during which buffers receiving unread lines
+	// get an "away since" divider. awayUntil is zero while still away.
+	awaySince time.Time
+	awayUntil time.Time
+
+	// Scroll positions to restore once the lines they refer to are added,
+	// as the time of the line at the bottom of the timeline.
+	scrollAnchors map[BufferKey]time.Time
+
+	// Manual order of the buffers, once they have been moved. New buffers
+	// are appended rather than sorted by name. nil while sorted by name.
+	order []BufferKey
 }
 
 // NewBufferList returns a new BufferList.
@@ -278,6 +381,10 @@ func (bs *BufferList) To(i int) bool {
 		return false
 	}
 	if 0 <= i {
+		if 0 <= bs.current && bs.current < len(bs.list) {
+			// The divider was seen, the buffer is read.
+			bs.list[bs.current].awayMarker = time.Time{}
+		}
 		bs.current = i
 		if len(bs.list) <= bs.current {
 			bs.current = len(bs.list) - 1
@@ -308,18 +415,85 @@ func (bs *BufferList) FilterBuffers(enable bool, query string) {
 
 func (bs *BufferList) Next() {
 	c := (bs.current + 1) % len(bs.list)
+	for c != bs.current && bs.isHidden(c) {
+		c = (c + 1) % len(bs.list)
+	}
 	bs.To(c)
 }
 
 func (bs *BufferList) Previous() {
 	c := (bs.current - 1 + len(bs.list)) % len(bs.list)
+	for c != bs.current && bs.isHidden(c) {
+		c = (c - 1 + len(bs.list)) % len(bs.list)
+	}
 	bs.To(c)
 }
 
+// isHidden reports whether the buffer at index i is left out of buffer lists,
+// because it is a server buffer without activity that is not current.
+func (bs *BufferList) isHidden(i int) bool {
+	return !bs.isNumbered(i) && i != bs.current
+}
+
+// isNumbered reports whether the buffer at index i has a position in buffer
+// lists. Server buffers without activity have none, even when shown because
+// they are current, so that positions do not depend on the current buffer.
+func (bs *BufferList) isNumbered(i int) bool {
+	b := &bs.list[i]
+	return !bs.ui.config.HideServerBuffers || b.title != "" || b.activity != NotifyNone
+}
+
+// visibleCount returns the number of buffers numbered in buffer lists.
+func (bs *BufferList) visibleCount() int {
+	n := 0
+	for i := range bs.list {
+		if bs.isNumbered(i) {
+			n++
+		}
+	}
+	return n
+}
+
+// position returns the index of the buffer at position n (from 0) among the
+// buffers numbered in buffer lists, or -1 if there is none.
+func (bs *BufferList) position(n int) int {
+	for i := range bs.list {
+		if !bs.isNumbered(i) {
+			continue
+		}
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return -1
+}
+
+// positionOf returns the position (from 0) of the buffer at index i among
+// the buffers numbered in buffer lists.
+func (bs *BufferList) positionOf(i int) int {
+	n := 0
+	for j := 0; j < i; j++ {
+		if bs.isNumbered(j) {
+			n++
+		}
+	}
+	return n
+}
+
+// isUnread reports whether a buffer is visited when cycling through unread
+// buffers.
+func (bs *BufferList) isUnread(b *buffer) bool {
+	if b.activity == NotifyStatus {
+		return bs.ui.config.CycleStatus
+	}
+	return b.activity != NotifyNone
+}
+
 func (bs *BufferList) NextUnread() {
 	for i := 0; i < len(bs.list); i++ {
 		c := (bs.current + i) % len(bs.list)
-		if bs.list[c].unread {
+		if bs.isUnread(&bs.list[c]) {
 			bs.To(c)
 			return
 		}
@@ -329,14 +503,61 @@ func (bs *BufferList) NextUnread() {
 func (bs *BufferList) PreviousUnread() {
 	for i := 0; i < len(bs.list); i++ {
 		c := (bs.current - i + len(bs.list)) % len(bs.list)
-		if bs.list[c].unread {
+		if bs.isUnread(&bs.list[c]) {
 			bs.To(c)
 			return
 		}
 	}
 }
 
+// SetLoadingHistory sets whether older lines of a buffer are being fetched,
+// which is shown above its first line.
+func (bs *BufferList) SetLoadingHistory(netID, title string, loading bool) {
+	if _, b := bs.at(netID, title); b != nil {
+		b.loadingHistory = loading
+	}
+}
+
+// NetworkName returns the display name of a network, or "" if it has no
+// buffers.
+func (bs *BufferList) NetworkName(netID string) string {
+	for _, b := range bs.list {
+		if b.netID == netID {
+			return b.netName
+		}
+	}
+	return ""
+}
+
+// SetNetworkName renames the buffers of a network, and sorts the buffer list
+// again.
+func (bs *BufferList) SetNetworkName(netID, netName string) {
+	changed := false
+	for i := range bs.list {
+		if bs.list[i].netID == netID && bs.list[i].netName != netName {
+			bs.list[i].netName = netName
+			changed = true
+		}
+	}
+	if !changed || bs.order != nil {
+		return
+	}
+	curNetID, curTitle := bs.list[bs.current].netID, bs.list[bs.current].title
+	sort.SliceStable(bs.list, func(i, j int) bool {
+		a, b := &bs.list[i], &bs.list[j]
+		if a.netName != b.netName {
+			return a.netName < b.netName
+		}
+		return strings.ToLower(a.title) < strings.ToLower(b.title)
+	})
+	bs.current, _ = bs.at(curNetID, curTitle)
+	bs.clicked = -1
+}
+
 func (bs *BufferList) Add(netID, netName, title string) (i int, added bool) {
+	if bs.order != nil {
+		return bs.addOrdered(netID, netName, title)
+	}
 	i = 0
 	lTitle := strings.ToLower(title)
 	for bi, b := range bs.list {
@@ -361,14 +582,39 @@ func (bs *BufferList) Add(netID, netName, title string) (i int, added bool) {
 		break
 	}
 
-	if i <= bs.current && bs.current < len(bs.list) {
-		bs.current++
-	}
+	bs.insert(i, buffer{
+		netID:   netID,
+		netName: netName,
+		title:   title,
+	})
+	return i, true
+}
 
-	b := buffer{
+// addOrdered adds a buffer according to the manual order of the list.
+func (bs *BufferList) addOrdered(netID, netName, title string) (i int, added bool) {
+	if i, _ := bs.at(netID, title); i >= 0 {
+		return i, false
+	}
+	rank := bs.orderRank(netID, title)
+	for bi, b := range bs.list {
+		if netName == "" && b.netID == netID {
+			netName = b.netName
+		}
+		if bs.orderRank(b.netID, b.title) < rank {
+			i = bi + 1
+		}
+	}
+	bs.insert(i, buffer{
 		netID:   netID,
 		netName: netName,
 		title:   title,
+	})
+	return i, true
+}
+
+func (bs *BufferList) insert(i int, b buffer) {
+	if i <= bs.current && bs.current < len(bs.list) {
+		bs.current++
 	}
 	if i == len(bs.list) {
 		bs.list = append(bs.list, b)
@@ -376,7 +622,147 @@ func (bs *BufferList) Add(netID, netName, title string) (i int, added bool) {
 		bs.list = append(bs.list[:i+1], bs.list[i:]...)
 		bs.list[i] = b
 	}
-	return i, true
+}
+
+// orderRank returns the position of a buffer in the manual order, appending
+// it to the order if it is not part of it yet.
+func (bs *BufferList) orderRank(netID, title string) int {
+	lTitle := strings.ToLower(title)
+	for i, k := range bs.order {
+		if k.NetID == netID && strings.ToLower(k.Title) == lTitle {
+			return i
+		}
+	}
+	bs.order = append(bs.order, BufferKey{netID, title})
+	return len(bs.order) - 1
+}
+
+// Move moves the current buffer to the given index, switching the list to a
+// manual order. Buffers stay grouped by network, with channels below the
+// server buffer of their network.
+func (bs *BufferList) Move(to int) {
+	for _, b := range bs.list {
+		bs.orderRank(b.netID, b.title)
+	}
+	b := bs.list[bs.current]
+	bs.list = append(bs.list[:bs.current], bs.list[bs.current+1:]...)
+	if to < 0 {
+		to = 0
+	} else if to > len(bs.list) {
+		to = len(bs.list)
+	}
+	// Bounds of the other buffers of the network of b.
+	first, last := -1, -1
+	for i, sb := range bs.list {
+		if sb.netID != b.netID {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		last = i
+	}
+	if b.title != "" {
+		if first >= 0 {
+			min := first
+			if bs.list[first].title == "" {
+				min = first + 1
+			}
+			if to < min {
+				to = min
+			} else if to > last+1 {
+				to = last + 1
+			}
+		}
+	} else if first >= 0 {
+		// The server buffer moves along with its channels.
+		n := last - first + 1
+		group := append([]buffer{}, bs.list[first:last+1]...)
+		bs.list = append(bs.list[:first], bs.list[last+1:]...)
+		if to > first {
+			to -= n
+			if to < first {
+				to = first
+			}
+		}
+		to = bs.groupStart(to)
+		bs.list = append(bs.list[:to], append(append([]buffer{b}, group...), bs.list[to:]...)...)
+		bs.current = to
+		bs.clicked = -1
+		bs.reorder(to, n+1)
+		return
+	} else {
+		to = bs.groupStart(to)
+	}
+	bs.list = append(bs.list[:to], append([]buffer{b}, bs.list[to:]...)...)
+	bs.current = to
+	bs.clicked = -1
+	bs.reorder(to, 1)
+}
+
+// reorder updates the manual order after the n buffers from index i were
+// moved there, keeping the place of the buffers which are not open.
+func (bs *BufferList) reorder(i, n int) {
+	moved := make([]BufferKey, 0, n)
+	for _, b := range bs.list[i : i+n] {
+		moved = append(moved, BufferKey{b.netID, b.title})
+		bs.forget(b.netID, b.title)
+	}
+	rank := len(bs.order)
+	if i+n < len(bs.list) {
+		rank = bs.orderRank(bs.list[i+n].netID, bs.list[i+n].title)
+	}
+	bs.order = append(bs.order[:rank], append(moved, bs.order[rank:]...)...)
+}
+
+// groupStart returns the index where a network can be inserted at or before
+// i, so that it does not split the buffers of another network.
+func (bs *BufferList) groupStart(i int) int {
+	for 0 < i && i < len(bs.list) && bs.list[i-1].netID == bs.list[i].netID {
+		i--
+	}
+	return i
+}
+
+// forget removes a buffer from the manual order.
+func (bs *BufferList) forget(netID, title string) {
+	lTitle := strings.ToLower(title)
+	for i, k := range bs.order {
+		if k.NetID == netID && strings.ToLower(k.Title) == lTitle {
+			bs.order = append(bs.order[:i], bs.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// Order returns the manual order of the buffers, or nil if they are sorted by
+// name.
+func (bs *BufferList) Order() []BufferKey {
+	if bs.order == nil {
+		return nil
+	}
+	return append([]BufferKey{}, bs.order...)
+}
+
+// SetOrder sets the manual order of the buffers, typically from a previous
+// session. Buffers missing from it are put last.
+func (bs *BufferList) SetOrder(order []BufferKey) {
+	if order == nil {
+		return
+	}
+	bs.order = append([]BufferKey{}, order...)
+	if len(bs.list) == 0 {
+		return
+	}
+	for _, b := range bs.list {
+		bs.orderRank(b.netID, b.title)
+	}
+	curNetID, curTitle := bs.list[bs.current].netID, bs.list[bs.current].title
+	sort.SliceStable(bs.list, func(i, j int) bool {
+		return bs.orderRank(bs.list[i].netID, bs.list[i].title) < bs.orderRank(bs.list[j].netID, bs.list[j].title)
+	})
+	bs.current, _ = bs.at(curNetID, curTitle)
+	bs.clicked = -1
 }
 
 func (bs *BufferList) Remove(netID, title string) bool {
@@ -392,6 +778,7 @@ func (bs *BufferList) Remove(netID, title string) bool {
 
 	bs.clearRead(idx)
 	bs.list = append(bs.list[:idx], bs.list[idx+1:]...)
+	bs.forget(netID, title)
 	if bs.current >= idx {
 		bs.current--
 	}
@@ -415,6 +802,7 @@ func (bs *BufferList) RemoveNetwork(netID string) {
 			updated = true
 		}
 		bs.clearRead(idx)
+		bs.forget(b.netID, b.title)
 		bs.list = append(bs.list[:idx], bs.list[idx+1:]...)
 		if bs.current >= idx {
 			bs.current--
@@ -429,13 +817,21 @@ func (bs *BufferList) RemoveNetwork(netID string) {
 	}
 }
 
+func (bs *BufferList) canMerge(former, addition *Line) bool {
+	if !former.Mergeable || !addition.Mergeable {
+		return false
+	}
+	window := bs.ui.config.MergeWindow
+	return window == 0 || addition.At.Sub(former.At) < window
+}
+
 func (bs *BufferList) mergeLine(former *Line, addition Line) (keepLine bool) {
 	bs.ui.config.MergeLine(former, addition)
 	if former.Body.string == "" {
 		return false
 	}
 	former.width = 0
-	former.computeSplitPoints(bs.ui.vx)
+	former.computeSplitPoints(bs.ui.vx, bs.ui.config.CJKLineBreak)
 	return true
 }
 
@@ -448,31 +844,42 @@ func (bs *BufferList) AddLine(netID, title string, line Line) {
 
 	n := len(b.lines)
 	line.At = line.At.UTC()
+	if bs.ui.config.EscapeBidi {
+		line.Body = line.Body.EscapeBidi()
+	}
 
 	if !line.Mergeable && b.openedOnce {
 		line.Body = line.Body.ParseURLs()
 	}
 
-	if line.Mergeable && n != 0 && b.lines[n-1].Mergeable {
+	if n != 0 && bs.canMerge(&b.lines[n-1], &line) {
 		l := &b.lines[n-1]
 		if !bs.mergeLine(l, line) {
 			b.lines = b.lines[:n-1]
+			if b.selecting && b.selected == n-1 {
+				b.selected--
+				b.selecting = b.selected >= 0
+			}
 		}
 		// TODO change b.scrollAmt if it's not 0 and bs.current is idx.
 	} else {
-		line.computeSplitPoints(bs.ui.vx)
+		line.computeSplitPoints(bs.ui.vx, bs.ui.config.CJKLineBreak)
+		bs.markAway(b, &line)
 		b.lines = append(b.lines, line)
 		if b == current && 0 < b.scrollAmt {
-			b.scrollAmt += len(line.NewLines(bs.ui.vx, bs.textWidth)) + 1
+			b.scrollAmt += bs.rowHeight(b, len(b.lines)-1)
 		}
 	}
 
-	if line.Notify != NotifyNone && (!bs.focused || b != current) {
-		b.unread = true
+	if b.activity < line.Notify && (!bs.focused || b != current) {
+		b.activity = line.Notify
 	}
 	if line.Notify == NotifyHighlight && (!bs.focused || b != current) {
 		b.highlights++
 	}
+	if line.Readable && line.Notify >= NotifyUnread && (!bs.focused || b != current) {
+		b.unread++
+	}
 	if b == current && b.unreadSkip == optionalUnset && len(b.lines) > 0 {
 		if b.unreadRuler.IsZero() || !b.lines[len(b.lines)-1].At.After(b.unreadRuler) {
 			b.unreadSkip = optionalTrue
@@ -488,36 +895,66 @@ func (bs *BufferList) AddLines(netID, title string, before, after []Line) {
 		return
 	}
 	updateRead := (!bs.focused || b != bs.cur()) && !b.read.IsZero()
+	anchor := bs.scrollAnchor(b)
 
+	selected := -1
 	lines := make([]Line, 0, len(before)+len(b.lines)+len(after))
 	for _, buf := range []*[]Line{&before, &b.lines, &after} {
-		for _, line := range *buf {
-			if line.Mergeable && len(lines) > 0 && lines[len(lines)-1].Mergeable {
+		for i, line := range *buf {
+			if len(lines) > 0 && bs.canMerge(&lines[len(lines)-1], &line) {
 				l := &lines[len(lines)-1]
 				if !bs.mergeLine(l, line) {
 					lines = lines[:len(lines)-1]
 				}
 			} else {
 				if buf != &b.lines {
+					if bs.ui.config.EscapeBidi {
+						line.Body = line.Body.EscapeBidi()
+					}
 					if b.openedOnce {
 						line.Body = line.Body.ParseURLs()
 					}
-					line.computeSplitPoints(bs.ui.vx)
+					line.computeSplitPoints(bs.ui.vx, bs.ui.config.CJKLineBreak)
+					bs.markAway(b, &line)
 				}
 				lines = append(lines, line)
 			}
+			if b.selecting && buf == &b.lines && i == b.selected {
+				// Lines might have been added before or merged with
+				// the selected line.
+				selected = len(lines) - 1
+			}
 
 			if updateRead && line.At.After(b.read) {
-				if line.Notify != NotifyNone {
-					b.unread = true
+				if b.activity < line.Notify {
+					b.activity = line.Notify
 				}
 				if line.Notify == NotifyHighlight {
 					b.highlights++
 				}
+				if line.Readable && line.Notify >= NotifyUnread {
+					b.unread++
+				}
 			}
 		}
 	}
 	b.lines = lines
+	if !anchor.IsZero() {
+		// Keep the same lines on screen when adding lines after them.
+		bs.scrollToAnchor(b, anchor)
+	} else if anchor, ok := bs.scrollAnchors[BufferKey{b.netID, b.title}]; ok {
+		if bs.scrollToAnchor(b, anchor) {
+			delete(bs.scrollAnchors, BufferKey{b.netID, b.title})
+		}
+	}
+	if b.selecting {
+		// The selected line might have been removed by a merge since.
+		if selected >= len(b.lines) {
+			selected = len(b.lines) - 1
+		}
+		b.selected = selected
+		b.selecting = selected >= 0
+	}
 	if b == bs.cur() && b.unreadSkip == optionalUnset && len(b.lines) > 0 {
 		if b.unreadRuler.IsZero() || !b.lines[len(b.lines)-1].At.After(b.unreadRuler) {
 			b.unreadSkip = optionalTrue
@@ -527,6 +964,39 @@ func (bs *BufferList) AddLines(netID, title string, before, after []Line) {
 	}
 }
 
+// SetAway starts an away period.
+func (bs *BufferList) SetAway(since time.Time) {
+	bs.awaySince = since
+	bs.awayUntil = time.Time{}
+}
+
+// SetBack ends the current away period, if any.
+func (bs *BufferList) SetBack(until time.Time) {
+	if !bs.awaySince.IsZero() && bs.awayUntil.IsZero() {
+		bs.awayUntil = until
+	}
+}
+
+// markAway places the "away since" divider of a buffer at its read position,
+// if the given line is the first unread line it receives during the away
+// period.
+func (bs *BufferList) markAway(b *buffer, line *Line) {
+	if bs.awaySince.IsZero() || !b.awayMarker.IsZero() {
+		return
+	}
+	if !line.Readable || line.Notify < NotifyUnread || !line.At.After(b.read) {
+		return
+	}
+	if !line.At.After(bs.awaySince) || (!bs.awayUntil.IsZero() && line.At.After(bs.awayUntil)) {
+		return
+	}
+	b.awayMarker = b.read
+	if b.awayMarker.IsZero() {
+		b.awayMarker = bs.awaySince
+	}
+	b.awaySince = bs.awaySince
+}
+
 func (bs *BufferList) Focused() bool {
 	return bs.focused
 }
@@ -543,13 +1013,17 @@ func (bs *BufferList) SetTopic(netID, title string, topic StyledString) {
 	if b == nil {
 		return
 	}
+	if bs.ui.config.EscapeBidi {
+		topic = topic.EscapeBidi()
+	}
 	b.topic = topic
 }
 
 func (bs *BufferList) clearRead(i int) {
 	b := &bs.list[i]
 	b.highlights = 0
-	b.unread = false
+	b.unread = 0
+	b.activity = NotifyNone
 	if len(b.notifications) > 0 {
 		for _, id := range b.notifications {
 			notifyClose(id)
@@ -576,6 +1050,12 @@ func (bs *BufferList) SetRead(netID, title string, timestamp time.Time) {
 	}
 	if clearRead {
 		bs.clearRead(i)
+		if i != bs.current {
+			// Read from another client: the divider would only show lines
+			// already seen there. That of the current buffer is cleared
+			// when leaving it.
+			b.awayMarker = time.Time{}
+		}
 	}
 	if b.read.Before(timestamp) {
 		b.read = timestamp
@@ -583,6 +1063,12 @@ func (bs *BufferList) SetRead(netID, title string, timestamp time.Time) {
 		if b.unreadRuler.IsZero() {
 			b.unreadRuler = b.read
 		}
+		// Once every line of the current buffer was read elsewhere, the
+		// ruler has nothing left to point at.
+		if i == bs.current && len(b.lines) > 0 && !b.lines[len(b.lines)-1].At.After(b.read) {
+			b.unreadRuler = b.read
+			b.unreadSkip = optionalTrue
+		}
 	}
 }
 
@@ -595,7 +1081,7 @@ func (bs *BufferList) UpdateRead() (netID, title string, timestamp time.Time) {
 		if y >= b.scrollAmt && line.Readable {
 			break
 		}
-		y += len(line.NewLines(bs.ui.vx, bs.textWidth)) + 1
+		y += bs.rowHeight(b, i)
 	}
 	if line != nil && line.At.After(b.read) {
 		b.read = line.At
@@ -619,6 +1105,7 @@ func (bs *BufferList) Current() (netID, title string) {
 
 func (bs *BufferList) ScrollUp(n int) {
 	b := bs.cur()
+	b.cleared = false
 	if b.isAtTop {
 		return
 	}
@@ -644,7 +1131,7 @@ func (bs *BufferList) ScrollUpHighlight() bool {
 			b.scrollAmt = y - bs.tlHeight + 1
 			return true
 		}
-		y += len(line.NewLines(bs.ui.vx, bs.textWidth)) + 1
+		y += bs.rowHeight(b, i)
 	}
 	return false
 }
@@ -658,12 +1145,183 @@ func (bs *BufferList) ScrollDownHighlight() bool {
 		if line.Highlight {
 			yLastHighlight = y
 		}
-		y += len(line.NewLines(bs.ui.vx, bs.textWidth)) + 1
+		y += bs.rowHeight(b, i)
 	}
 	b.scrollAmt = yLastHighlight
 	return b.scrollAmt != 0
 }
 
+// scrollAnchor returns the time of the line at the bottom of the timeline of
+// a buffer, or zero if it is not scrolled.
+func (bs *BufferList) scrollAnchor(b *buffer) time.Time {
+	if b.scrollAmt == 0 {
+		return time.Time{}
+	}
+	y := 0
+	for i := len(b.lines) - 1; 0 <= i; i-- {
+		line := &b.lines[i]
+		if y >= b.scrollAmt {
+			return line.At
+		}
+		y += bs.rowHeight(b, i)
+	}
+	if len(b.lines) > 0 {
+		return b.lines[0].At
+	}
+	return time.Time{}
+}
+
+// scrollToAnchor scrolls a buffer so that the last line at or before anchor
+// is at the bottom of the timeline. It returns false if the buffer does not
+// have lines that old.
+func (bs *BufferList) scrollToAnchor(b *buffer, anchor time.Time) bool {
+	if len(b.lines) == 0 || b.lines[0].At.After(anchor) {
+		return false
+	}
+	y := 0
+	for i := len(b.lines) - 1; 0 <= i; i-- {
+		line := &b.lines[i]
+		if !line.At.After(anchor) {
+			break
+		}
+		y += bs.rowHeight(b, i)
+	}
+	b.scrollAmt = y
+	b.isAtTop = false
+	return true
+}
+
+// ScrollAnchors returns the scroll position of all scrolled buffers, as the
+// time of the line at the bottom of their timeline. Positions still to be
+// restored are kept, unless their buffer was closed.
+func (bs *BufferList) ScrollAnchors() map[BufferKey]time.Time {
+	anchors := make(map[BufferKey]time.Time, len(bs.scrollAnchors))
+	for k, anchor := range bs.scrollAnchors {
+		if _, b := bs.at(k.NetID, k.Title); b != nil {
+			anchors[k] = anchor
+		}
+	}
+	for i := range bs.list {
+		b := &bs.list[i]
+		if anchor := bs.scrollAnchor(b); !anchor.IsZero() {
+			anchors[BufferKey{b.netID, b.title}] = anchor
+		}
+	}
+	return anchors
+}
+
+// SetScrollAnchors sets scroll positions to restore when the lines of the
+// buffers are added, typically from a previous session.
+func (bs *BufferList) SetScrollAnchors(anchors map[BufferKey]time.Time) {
+	bs.scrollAnchors = anchors
+}
+
+// SelectLine enters the line selection mode of the current buffer, selecting
+// its last line. It returns false if the buffer has no lines.
+func (bs *BufferList) SelectLine() bool {
+	b := bs.cur()
+	if len(b.lines) == 0 {
+		return false
+	}
+	b.selecting = true
+	b.selected = len(b.lines) - 1
+	bs.scrollToSelection()
+	return true
+}
+
+// SelectUp moves the selection to the previous line of the current buffer.
+func (bs *BufferList) SelectUp() {
+	b := bs.cur()
+	if !b.selecting {
+		bs.SelectLine()
+		return
+	}
+	if b.selected > 0 {
+		b.selected--
+	}
+	bs.scrollToSelection()
+}
+
+// SelectDown moves the selection to the next line of the current buffer.
+func (bs *BufferList) SelectDown() {
+	b := bs.cur()
+	if !b.selecting {
+		return
+	}
+	if b.selected < len(b.lines)-1 {
+		b.selected++
+	}
+	bs.scrollToSelection()
+}
+
+// ClearSelection exits the line selection mode of the current buffer.
+func (bs *BufferList) ClearSelection() bool {
+	b := bs.cur()
+	if !b.selecting {
+		return false
+	}
+	b.selecting = false
+	return true
+}
+
+// Selection returns the selected line of the current buffer, if any.
+func (bs *BufferList) Selection() (Line, bool) {
+	b := bs.cur()
+	if !b.selecting {
+		return Line{}, false
+	}
+	return b.lines[b.selected], true
+}
+
+// JumpToLine switches to a buffer and selects its line with the given message
+// ID, or else its last line at or before the given time. It returns false if
+// the buffer does not exist or does not have lines that old.
+func (bs *BufferList) JumpToLine(netID, title, id string, at time.Time) bool {
+	i, b := bs.at(netID, title)
+	if b == nil {
+		return false
+	}
+	selected := -1
+	for j := len(b.lines) - 1; j >= 0; j-- {
+		line := &b.lines[j]
+		if line.HasID(id) {
+			selected = j
+			break
+		}
+		if selected < 0 && !line.At.After(at) {
+			selected = j
+			if id == "" {
+				break
+			}
+		}
+	}
+	bs.To(i)
+	if selected < 0 {
+		b.selecting = false
+		return false
+	}
+	b.selecting = true
+	b.selected = selected
+	bs.scrollToSelection()
+	return true
+}
+
+// scrollToSelection scrolls the current buffer so that its selected line is
+// fully visible.
+func (bs *BufferList) scrollToSelection() {
+	b := bs.cur()
+	yBottom := 0
+	for i := len(b.lines) - 1; b.selected < i; i-- {
+		yBottom += bs.rowHeight(b, i)
+	}
+	yTop := yBottom + bs.rowHeight(b, b.selected)
+	if yBottom < b.scrollAmt {
+		b.scrollAmt = yBottom
+	} else if b.scrollAmt+bs.tlHeight < yTop {
+		b.scrollAmt = yTop - bs.tlHeight
+	}
+}
+
 // LinesAboveOffset returns a rough approximate of the number of lines
 // above the offset (that is, starting from the bottom of the screen,
 // up to the first line).
@@ -680,6 +1338,56 @@ func (bs *BufferList) Highlights() int {
 	return n
 }
 
+// BufferActivity summarizes the activity of a buffer.
+type BufferActivity struct {
+	NetID      string
+	NetName    string
+	Title      string
+	Unread     int       // number of unread messages
+	Highlights int       // number of unread highlights
+	Last       time.Time // time of the last message, or zero if there is none
+}
+
+// Activity returns the activity of all buffers, most recently active first.
+func (bs *BufferList) Activity() []BufferActivity {
+	activity := make([]BufferActivity, 0, len(bs.list))
+	for _, b := range bs.list {
+		a := BufferActivity{
+			NetID:      b.netID,
+			NetName:    b.netName,
+			Title:      b.title,
+			Highlights: b.highlights,
+		}
+		for i := len(b.lines) - 1; i >= 0; i-- {
+			line := &b.lines[i]
+			if !line.Readable {
+				continue
+			}
+			if a.Last.IsZero() {
+				a.Last = line.At
+			}
+			if b.read.IsZero() {
+				// Without a read marker, count the messages received
+				// since the buffer was last focused, as shown in the
+				// buffer list.
+				a.Unread = b.unread
+				break
+			}
+			if !line.At.After(b.read) {
+				break
+			}
+			if line.Notify >= NotifyUnread {
+				a.Unread++
+			}
+		}
+		activity = append(activity, a)
+	}
+	sort.SliceStable(activity, func(i, j int) bool {
+		return activity[i].Last.After(activity[j].Last)
+	})
+	return activity
+}
+
 func (bs *BufferList) at(netID, title string) (int, *buffer) {
 	if netID == "" && title == Overlay {
 		return -1, bs.overlay
@@ -693,6 +1401,91 @@ func (bs *BufferList) at(netID, title string) (int, *buffer) {
 	return -1, nil
 }
 
+// Clear removes all lines of a buffer.
+func (bs *BufferList) Clear(netID, title string) {
+	_, b := bs.at(netID, title)
+	if b == nil {
+		return
+	}
+	b.lines = nil
+	b.scrollAmt = 0
+	b.isAtTop = false
+	b.cleared = true
+	b.selecting = false
+	b.awayMarker = time.Time{}
+	delete(bs.scrollAnchors, BufferKey{netID, title})
+}
+
+// Cleared reports whether the current buffer was cleared, and not scrolled up
+// since.
+func (bs *BufferList) Cleared() bool {
+	return bs.cur().cleared
+}
+
+// LineByID returns the line of a buffer with the given message ID.
+func (bs *BufferList) LineByID(netID, title, id string) (Line, bool) {
+	_, b := bs.at(netID, title)
+	if b == nil || id == "" {
+		return Line{}, false
+	}
+	for i := len(b.lines) - 1; i >= 0; i-- {
+		if b.lines[i].HasID(id) {
+			return b.lines[i], true
+		}
+	}
+	return Line{}, false
+}
+
+// ReplaceLine replaces the line of a buffer with the given message ID by line,
+// keeping the original time for ordering. It reports whether the line was
+// found.
+func (bs *BufferList) ReplaceLine(netID, title, id string, line Line) bool {
+	_, b := bs.at(netID, title)
+	if b == nil || id == "" {
+		return false
+	}
+	for i := len(b.lines) - 1; i >= 0; i-- {
+		if !b.lines[i].HasID(id) {
+			continue
+		}
+		line.At = b.lines[i].At
+		if bs.ui.config.EscapeBidi {
+			line.Body = line.Body.EscapeBidi()
+		}
+		if b.openedOnce {
+			line.Body = line.Body.ParseURLs()
+		}
+		line.computeSplitPoints(bs.ui.vx, bs.ui.config.CJKLineBreak)
+		b.lines[i] = line
+		return true
+	}
+	return false
+}
+
+// CurrentLines returns the lines of the current buffer.
+// The result must not be modified.
+func (bs *BufferList) CurrentLines() []Line {
+	return bs.cur().lines
+}
+
+// VisibleLines returns the lines shown in the timeline of the current buffer,
+// even partially, at its current scroll position.
+func (bs *BufferList) VisibleLines() []Line {
+	b := bs.cur()
+	i := len(b.lines)
+	end := i
+	y := 0
+	for 0 < i && y < b.scrollAmt+bs.tlHeight {
+		i--
+		h := bs.rowHeight(b, i)
+		if y+h <= b.scrollAmt {
+			end = i
+		}
+		y += h
+	}
+	return b.lines[i:end]
+}
+
 func (bs *BufferList) cur() *buffer {
 	if bs.overlay != nil {
 		return bs.overlay
@@ -700,11 +1493,34 @@ func (bs *BufferList) cur() *buffer {
 	return &bs.list[bs.current]
 }
 
+// activityStyle returns the style of the name of a buffer in buffer lists,
+// according to its activity level.
+func (bs *BufferList) activityStyle(b *buffer) vaxis.Style {
+	var st vaxis.Style
+	switch b.activity {
+	case NotifyStatus:
+		st.Foreground = bs.ui.config.Colors.UnreadStatus
+	case NotifyUnread, NotifyHighlight:
+		st.Attribute |= vaxis.AttrBold
+		st.Foreground = bs.ui.config.Colors.Unread
+	}
+	return st
+}
+
 func (bs *BufferList) DrawVerticalBufferList(vx *Vaxis, x0, y0, width, height int, offset *int) {
-	if y0+len(bs.list)-*offset < height {
-		*offset = y0 + len(bs.list) - height
-		if *offset < 0 {
-			*offset = 0
+	if *offset > len(bs.list) {
+		*offset = len(bs.list)
+	}
+	rows := 0
+	for i := *offset; i < len(bs.list); i++ {
+		if !bs.isHidden(i) {
+			rows++
+		}
+	}
+	for *offset > 0 && y0+rows < height {
+		*offset--
+		if !bs.isHidden(*offset) {
+			rows++
 		}
 	}
 	off := bs.VerticalBufferOffset(0, *offset)
@@ -716,16 +1532,21 @@ func (bs *BufferList) DrawVerticalBufferList(vx *Vaxis, x0, y0, width, height in
 	drawVerticalLine(vx, x0+width, y0, height)
 	clearArea(vx, x0, y0, width, height)
 
-	indexPadding := 1 + int(math.Ceil(math.Log10(float64(len(bs.list)))))
+	indexPadding := 1 + int(math.Ceil(math.Log10(float64(bs.visibleCount()))))
+	// Position of the buffer among the shown ones, as used by Alt+N.
+	no := bs.positionOf(off)
 	y := y0
 	for i, b := range bs.list[off:] {
 		bi := off + i
-		x := x0
-		var st vaxis.Style
-		if b.unread {
-			st.Attribute |= vaxis.AttrBold
-			st.Foreground = bs.ui.config.Colors.Unread
+		if bs.isHidden(bi) {
+			continue
 		}
+		numbered := bs.isNumbered(bi)
+		if numbered {
+			no++
+		}
+		x := x0
+		st := bs.activityStyle(&b)
 		if bi == bs.current || bi == bs.clicked {
 			st.Attribute |= vaxis.AttrReverse
 		}
@@ -741,10 +1562,12 @@ func (bs *BufferList) DrawVerticalBufferList(vx *Vaxis, x0, y0, width, height in
 			if !strings.Contains(strings.ToLower(title), bs.filterBuffersQuery) {
 				continue
 			}
-			indexSt := st
-			indexSt.Foreground = ColorGray
-			indexText := fmt.Sprintf("%d:", bi+1)
-			printString(vx, &x, y, Styled(indexText, indexSt))
+			if numbered {
+				indexSt := st
+				indexSt.Foreground = ColorGray
+				indexText := fmt.Sprintf("%d:", no)
+				printString(vx, &x, y, Styled(indexText, indexSt))
+			}
 			x = x0 + indexPadding
 		}
 
@@ -774,7 +1597,7 @@ func (bs *BufferList) DrawVerticalBufferList(vx *Vaxis, x0, y0, width, height in
 
 		if b.highlights != 0 {
 			highlightSt := st
-			highlightSt.Foreground = ColorRed
+			highlightSt.Foreground = bs.ui.config.Colors.Highlights
 			highlightSt.Attribute |= vaxis.AttrReverse
 			highlightText := fmt.Sprintf(" %d ", b.highlights)
 			x = x0 + width - len(highlightText)
@@ -791,6 +1614,9 @@ func (bs *BufferList) HorizontalBufferOffset(x int, offset int) int {
 	}
 	i := 0
 	for bi, b := range bs.list[offset:] {
+		if bs.isHidden(offset + bi) {
+			continue
+		}
 		if bs.filterBuffers {
 			var title string
 			if b.title == "" {
@@ -818,11 +1644,15 @@ func (bs *BufferList) HorizontalBufferOffset(x int, offset int) int {
 }
 
 func (bs *BufferList) VerticalBufferOffset(y int, offset int) int {
-	if !bs.filterBuffers {
-		return offset + y
+	if bs.filterBuffers {
+		offset = 0
 	}
 
-	for i, b := range bs.list {
+	for i := offset; i < len(bs.list); i++ {
+		b := &bs.list[i]
+		if bs.isHidden(i) {
+			continue
+		}
 		var title string
 		if b.title == "" {
 			title = b.netName
@@ -843,6 +1673,22 @@ func (bs *BufferList) VerticalBufferOffset(y int, offset int) int {
 	return -1
 }
 
+// GetTopMost returns the smallest offset of the vertical buffer list that
+// keeps the current buffer visible in the given height.
+func (bs *BufferList) GetTopMost(height int) int {
+	rows := 0
+	for topMost := bs.current; topMost >= 0; topMost-- {
+		if bs.isHidden(topMost) {
+			continue
+		}
+		rows++
+		if rows > height {
+			return topMost + 1 // Went offscreen, need to go one step back
+		}
+	}
+	return 0
+}
+
 func (bs *BufferList) GetLeftMost(screenWidth int) int {
 	if len(bs.list) == 0 {
 		return 0
@@ -852,6 +1698,9 @@ func (bs *BufferList) GetLeftMost(screenWidth int) int {
 	var leftMost int
 
 	for leftMost = bs.current; leftMost >= 0; leftMost-- {
+		if bs.isHidden(leftMost) {
+			continue
+		}
 		if leftMost < bs.current {
 			width++
 		}
@@ -864,6 +1713,8 @@ func (bs *BufferList) GetLeftMost(screenWidth int) int {
 	return 0
 }
 
+// bufferWidth returns the display width of a buffer in the horizontal buffer
+// list, as drawn by DrawHorizontalBufferList, without the separating space.
 func (bs *BufferList) bufferWidth(b *buffer) int {
 	width := 0
 	if b.title == "" {
@@ -880,6 +1731,9 @@ func (bs *BufferList) bufferWidth(b *buffer) int {
 func (bs *BufferList) DrawHorizontalBufferList(vx *Vaxis, x0, y0, width int, offset *int) {
 	x := width
 	for i := len(bs.list) - 1; i >= 0; i-- {
+		if bs.isHidden(i) {
+			continue
+		}
 		b := &bs.list[i]
 		x--
 		x -= bs.bufferWidth(b)
@@ -902,11 +1756,11 @@ func (bs *BufferList) DrawHorizontalBufferList(vx *Vaxis, x0, y0, width int, off
 		if width <= x-x0 {
 			break
 		}
-		var st vaxis.Style
-		if b.unread {
-			st.Attribute |= vaxis.AttrBold
-			st.Foreground = bs.ui.config.Colors.Unread
-		} else if i == bs.current {
+		if bs.isHidden(i) {
+			continue
+		}
+		st := bs.activityStyle(&b)
+		if b.activity == NotifyNone && i == bs.current {
 			st.UnderlineStyle = vaxis.UnderlineSingle
 		}
 		if i == bs.clicked {
@@ -927,11 +1781,11 @@ func (bs *BufferList) DrawHorizontalBufferList(vx *Vaxis, x0, y0, width int, off
 			}
 		}
 
-		title = truncate(vx, title, width-x, "\u2026")
+		title = truncate(vx, title, x0+width-x, "\u2026")
 		printString(vx, &x, y0, Styled(title, st))
 
 		if 0 < b.highlights {
-			st.Foreground = ColorRed
+			st.Foreground = bs.ui.config.Colors.Highlights
 			st.Attribute |= vaxis.AttrReverse
 			setCell(vx, x, y0, ' ', st)
 			x++
@@ -948,6 +1802,74 @@ func (bs *BufferList) DrawHorizontalBufferList(vx *Vaxis, x0, y0, width int, off
 	}
 }
 
+// keepScrollPreview keeps the lines shown in the timeline in place when the
+// preview of link is about to be shown, by scrolling up by the height of the
+// preview for each line below the top of the timeline it is added to. When
+// the timeline is not scrolled, its bottom stays in place instead.
+func (bs *BufferList) keepScrollPreview(link string) {
+	b := bs.cur()
+	if b.scrollAmt == 0 {
+		return
+	}
+	y := 0
+	for i := len(b.lines) - 1; 0 <= i && y < b.scrollAmt+bs.tlHeight; i-- {
+		line := &b.lines[i]
+		y += bs.rowHeight(b, i)
+		if bs.ui.linePreview(line) != nil {
+			continue
+		}
+		for _, l := range line.Body.URLs() {
+			if l == link {
+				b.scrollAmt += previewHeight
+				break
+			}
+		}
+	}
+}
+
+// lineHeight returns the number of rows taken by line in the timeline,
+// including its preview.
+func (bs *BufferList) lineHeight(line *Line) int {
+	h := len(line.NewLines(bs.ui.vx, bs.textWidth)) + 1
+	if bs.ui.linePreview(line) != nil {
+		h += previewHeight
+	}
+	return h
+}
+
+// rowHeight returns the number of rows taken by the line i of b in the
+// timeline, including the "away since" divider drawn above it.
+func (bs *BufferList) rowHeight(b *buffer, i int) int {
+	h := bs.lineHeight(&b.lines[i])
+	if isAwayDividerAbove(b, i) {
+		h++
+	}
+	return h
+}
+
+// isAwayDividerAbove reports whether the "away since" divider of b is drawn
+// right above its line i.
+func isAwayDividerAbove(b *buffer, i int) bool {
+	if b.awayMarker.IsZero() || i == 0 {
+		return false
+	}
+	return b.lines[i].At.After(b.awayMarker) && !b.lines[i-1].At.After(b.awayMarker)
+}
+
+// unreadRulerIndex returns the index of the line of b after which the unread
+// ruler is drawn, or -1 if there is none.
+func (bs *BufferList) unreadRulerIndex(b *buffer) int {
+	if b.unreadSkip != optionalFalse || b.unreadRuler.IsZero() || b.title == "" || bs.ui.config.UnreadRuler == 0 {
+		return -1
+	}
+	for i := len(b.lines) - 1; i >= 0; i-- {
+		if !b.lines[i].At.After(b.unreadRuler) {
+			return i
+		}
+	}
+	return -1
+}
+
 func (bs *BufferList) DrawTimeline(ui *UI, x0, y0 int) {
 	vx := ui.vx
 	clearArea(vx, x0, y0, bs.tlInnerWidth+9, bs.tlHeight+2)
@@ -1009,7 +1931,7 @@ func (bs *BufferList) DrawTimeline(ui *UI, x0, y0 int) {
 	}
 
 	yi := b.scrollAmt + y0 + bs.tlHeight
-	rulerDrawn := b.unreadSkip != optionalFalse || b.unreadRuler.IsZero() || b.title == ""
+	rulerAt := bs.unreadRulerIndex(b)
 	for i := len(b.lines) - 1; 0 <= i; i-- {
 		if yi < y0 {
 			break
@@ -1020,33 +1942,79 @@ func (bs *BufferList) DrawTimeline(ui *UI, x0, y0 int) {
 		line := &b.lines[i]
 		nls := line.NewLines(bs.ui.vx, bs.textWidth)
 
-		if !rulerDrawn {
-			isRead := !line.At.After(b.unreadRuler)
-			if isRead && yi > y0 {
-				yi--
-				st := vaxis.Style{
-					Foreground: ColorGray,
-				}
-				printIdent(vx, x0+7, yi, 0, Styled("--", st))
-				drawHorizontalLine(vx, x0, yi, 9+bs.tlInnerWidth)
-				rulerDrawn = true
+		if i == rulerAt && yi > y0 {
+			yi--
+			st := vaxis.Style{
+				Foreground: bs.ui.config.Colors.Ruler,
 			}
+			printIdent(vx, x0+7, yi, 0, Styled("--", st))
+			drawRuler(vx, x0, yi, 9+bs.textWidth, bs.ui.config.UnreadRuler, st)
+		}
+		if i+1 < len(b.lines) && isAwayDividerAbove(b, i+1) && yi > y0 {
+			yi--
+			bs.drawAwayDivider(vx, x0, yi, b.awaySince)
+		}
+
+		grouped := false
+		if i > 0 && b != bs.overlay {
+			prev := &b.lines[i-1]
+			// Keep the author of the first line after the unread ruler.
+			grouped = i-1 != rulerAt && line.groupedWith(prev, bs.ui.config.GroupAuthors)
 		}
 
-		yi -= len(nls) + 1
+		img := ui.linePreview(line)
+		ph := 0
+		if img != nil {
+			ph = previewHeight
+		}
+
+		yi -= len(nls) + 1 + ph
 		if y0+bs.tlHeight <= yi {
 			continue
 		}
+		ui.requestPreviews(line)
+
+		if img != nil {
+			// Images cannot be partially drawn: only draw previews that
+			// fit entirely in the timeline.
+			py := yi + len(nls) + 1
+			if y0 <= py && py+previewHeight <= y0+bs.tlHeight {
+				img.Draw(vx.window.New(x1, py, bs.textWidth, previewHeight))
+			}
+		}
+
+		isSelected := b.selecting && i == b.selected
 
 		if yi >= y0 {
-			printTime(vx, x0, yi, vaxis.Style{
+			st := vaxis.Style{
 				Attribute: vaxis.AttrBold,
-			}, line.At.Local())
+			}
+			if isSelected {
+				st.Attribute |= vaxis.AttrReverse
+			}
+			printTime(vx, x0, yi, st, line.At.Local())
+			if b == bs.overlay && line.Data != nil {
+				ui.clickEvents = append(ui.clickEvents, clickEvent{
+					xb: x0,
+					xe: x0 + 8,
+					y:  yi,
+					event: &events.EventClickLine{
+						EventClick: events.EventClick{
+							NetID:  b.netID,
+							Buffer: b.title,
+						},
+						Data: line.Data,
+					},
+				})
+			}
 		}
 
 		x := x1
 		y := yi
 		var style vaxis.Style
+		if isSelected {
+			style.Attribute = vaxis.AttrReverse
+		}
 		nextStyles := line.Body.styles
 
 		lbi := 0
@@ -1059,6 +2027,9 @@ func (bs *BufferList) DrawTimeline(ui *UI, x0, y0 int) {
 				if bs.ui.mouseLinks && style.Hyperlink != "" && style.UnderlineStyle == 0 {
 					style.UnderlineStyle = vaxis.UnderlineDotted
 				}
+				if isSelected {
+					style.Attribute |= vaxis.AttrReverse
+				}
 			}
 			if 0 < len(nls) && lbi == nls[0] {
 				x = x1
@@ -1069,11 +2040,19 @@ func (bs *BufferList) DrawTimeline(ui *UI, x0, y0 int) {
 				}
 			}
 
-			if y != yi && x == x1 && IsSplitRune(l[0]) {
+			if l[0] == '\n' || (y != yi && x == x1 && IsSplitRune(l[0])) {
 				lbi += len(string(l[0]))
 				l = l[1:]
 				continue
 			}
+			if grouped && lbi < line.AuthorLen {
+				// Leave the author blank, keeping the text aligned.
+				c, cw := firstCluster(vx, l)
+				x += cw
+				lbi += len(c)
+				l = l[len([]rune(c)):]
+				continue
+			}
 
 			xb := x
 			if y >= y0 {
@@ -1106,5 +2085,40 @@ func (bs *BufferList) DrawTimeline(ui *UI, x0, y0 int) {
 		}
 	}
 
+	if b.loadingHistory && y0 < yi {
+		st := vaxis.Style{
+			Foreground: ColorGray,
+			Attribute:  vaxis.AttrItalic,
+		}
+		x := x0 + 9
+		printString(vx, &x, yi-1, Styled("loading history…", st))
+	}
+
 	b.isAtTop = y0 <= yi
 }
+
+// drawAwayDivider draws the "away since" divider, which is a double line
+// rather than the single line of the unread ruler.
+func (bs *BufferList) drawAwayDivider(vx *Vaxis, x0, y int, since time.Time) {
+	st := vaxis.Style{
+		Foreground: bs.ui.config.Colors.Ruler,
+	}
+	for x := x0; x < x0+9+bs.textWidth; x++ {
+		setCell(vx, x, y, '═', st)
+	}
+	st.Attribute = vaxis.AttrBold
+	x := x0 + 9
+	printString(vx, &x, y, Styled(awayDividerLabel(since, time.Now()), st))
+}
+
+// awayDividerLabel returns the label of the away divider, with the date of
+// since unless it is the same day as now.
+func awayDividerLabel(since, now time.Time) string {
+	since = since.Local()
+	y1, m1, d1 := since.Date()
+	y2, m2, d2 := now.Local().Date()
+	if y1 == y2 && m1 == m2 && d1 == d2 {
+		return " away since " + since.Format("15:04") + " "
+	}
+	return " away since " + since.Format("Jan 2 15:04") + " "
+}
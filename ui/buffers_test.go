@@ -1,13 +1,15 @@
 package ui
 
 import (
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 )
 
 func assertSplitPoints(t *testing.T, body string, expected []point) {
 	l := Line{Body: PlainString(body)}
-	l.computeSplitPoints(nil)
+	l.computeSplitPoints(nil, false)
 
 	if len(l.splitPoints) != len(expected) {
 		t.Errorf("%q: expected %d split points got %d", body, len(expected), len(l.splitPoints))
@@ -72,7 +74,7 @@ func showSplit(s string, nls []int) string {
 
 func assertNewLines(t *testing.T, body string, width int, expected int) {
 	l := Line{Body: PlainString(body)}
-	l.computeSplitPoints(nil)
+	l.computeSplitPoints(nil, false)
 
 	actual := l.NewLines(nil, width)
 
@@ -141,4 +143,836 @@ func TestRenderedHeight(t *testing.T) {
 	assertNewLines(t, "have a good day!", 17, 1) // |have a good day! |
 
 	assertNewLines(t, "cc en direct du word wrapping des familles le tests ça v a va va v a va", 46, 2)
+
+	// Line feeds of multiline messages.
+	assertNewLines(t, "take\ncare", 20, 2)   // |take|care|
+	assertNewLines(t, "take\n\ncare", 20, 3) // |take||care|
+	assertNewLines(t, "take care\nof", 4, 3) // |take|care|of|
+	assertNewLines(t, "take\n", 20, 1)       // |take|
+}
+
+func TestCJKLineBreak(t *testing.T) {
+	tests := []struct {
+		body     string
+		width    int
+		cjk      bool
+		expected []int
+	}{
+		{"hello 日本語で", 10, false, []int{6}},
+		{"hello 日本語で", 10, true, []int{12}},
+		{"日本語abc日本", 7, false, []int{10}},
+		{"日本語abc日本", 7, true, []int{9}},
+		{"日本語、テスト", 6, true, []int{9, 18}},
+	}
+	for _, test := range tests {
+		l := Line{Body: PlainString(test.body)}
+		l.computeSplitPoints(nil, test.cjk)
+		actual := l.NewLines(nil, test.width)
+		if len(actual) != len(test.expected) {
+			t.Errorf("%q with width=%d, cjk=%t: expected newlines at %v, got %v", test.body, test.width, test.cjk, test.expected, actual)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != test.expected[i] {
+				t.Errorf("%q with width=%d, cjk=%t: expected newlines at %v, got %v", test.body, test.width, test.cjk, test.expected, actual)
+				break
+			}
+		}
+	}
+}
+
+func TestTextMaxWidth(t *testing.T) {
+	const innerWidth = 200
+	if w := timelineTextWidth(innerWidth, 0); w != innerWidth {
+		t.Errorf("expected text width without maximum to be %d, got %d", innerWidth, w)
+	}
+	if w := timelineTextWidth(innerWidth, 80); w != 80 {
+		t.Errorf("expected text width with maximum 80 to be 80, got %d", w)
+	}
+	if w := timelineTextWidth(40, 80); w != 40 {
+		t.Errorf("expected text width with maximum 80 on a narrow timeline to be 40, got %d", w)
+	}
+
+	bs := NewBufferList(&UI{})
+	bs.ResizeTimeline(innerWidth, 40, timelineTextWidth(innerWidth, 80))
+	body := strings.Repeat("lorem ipsum ", 15)
+	l := Line{Body: PlainString(body)}
+	l.computeSplitPoints(nil, false)
+	if n := len(l.NewLines(nil, bs.textWidth)) + 1; n != 3 {
+		t.Errorf("expected a %d-long line to take 3 lines with a maximum width of 80, takes %d", len(body), n)
+	}
+}
+
+func TestClear(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.ResizeTimeline(80, 10, 80)
+	bs.Add("", "", "#senpai")
+	for i := 0; i < 20; i++ {
+		bs.AddLine("", "#senpai", Line{Body: PlainString("lorem ipsum")})
+	}
+	bs.ScrollUp(5)
+
+	bs.Clear("", "#senpai")
+	if n := len(bs.CurrentLines()); n != 0 {
+		t.Errorf("expected no lines after clearing, got %d", n)
+	}
+	if b := bs.cur(); b.scrollAmt != 0 {
+		t.Errorf("expected scroll to be reset after clearing, got %d", b.scrollAmt)
+	}
+	if !bs.Cleared() {
+		t.Errorf("expected buffer to be cleared")
+	}
+	bs.ScrollUp(1)
+	if bs.Cleared() {
+		t.Errorf("expected buffer to no longer be cleared after scrolling up")
+	}
+}
+
+func TestReplaceLine(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.ResizeTimeline(80, 10, 80)
+	bs.Add("", "", "#senpai")
+	at := time.Now().Add(-time.Minute).UTC()
+	bs.AddLine("", "#senpai", Line{At: at, Body: PlainString("helo"), ID: "a"})
+	bs.AddLine("", "#senpai", Line{At: at.Add(time.Second), Body: PlainString("world"), ID: "b"})
+
+	if bs.ReplaceLine("", "#senpai", "c", Line{Body: PlainString("hello")}) {
+		t.Errorf("expected no line to be replaced for an unknown ID")
+	}
+	if !bs.ReplaceLine("", "#senpai", "a", Line{At: time.Now(), Body: PlainString("hello"), ID: "a"}) {
+		t.Fatalf("expected the line to be replaced")
+	}
+	lines := bs.CurrentLines()
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(lines))
+	}
+	if lines[0].Body.String() != "hello" || !lines[0].At.Equal(at) {
+		t.Errorf("expected the line to be replaced in place, got %q at %v", lines[0].Body.String(), lines[0].At)
+	}
+}
+
+func TestSetNetworkName(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.Add("", "(home)", "")
+	bs.Add("", "", "#senpai")
+	bs.Add("other", "b-net", "")
+	bs.current = 1
+
+	bs.SetNetworkName("", "c-net")
+	expected := []string{"other/", "/", "/#senpai"}
+	for i, b := range bs.list {
+		if got := b.netID + "/" + b.title; got != expected[i] {
+			t.Errorf("expected buffer #%d to be %q, got %q", i, expected[i], got)
+		}
+		if b.netID == "" && b.netName != "c-net" {
+			t.Errorf("expected buffer %q to be renamed, got %q", b.title, b.netName)
+		}
+	}
+	if bs.current != 2 {
+		t.Errorf("expected current buffer to follow #senpai, got %d", bs.current)
+	}
+}
+
+func TestActivity(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.Add("", "(home)", "")
+	bs.Add("", "", "#senpai")
+	bs.current = 0
+
+	bs.AddLine("", "#senpai", Line{At: time.Now(), Notify: NotifyStatus, Readable: true})
+	if a := bs.list[1].activity; a != NotifyStatus {
+		t.Errorf("expected status activity, got %d", a)
+	}
+	bs.AddLine("", "#senpai", Line{At: time.Now(), Notify: NotifyUnread, Readable: true})
+	bs.AddLine("", "#senpai", Line{At: time.Now(), Notify: NotifyStatus, Readable: true})
+	if a := bs.list[1].activity; a != NotifyUnread {
+		t.Errorf("expected unread activity, got %d", a)
+	}
+	bs.To(1)
+	if a := bs.list[1].activity; a != NotifyNone {
+		t.Errorf("expected no activity after opening the buffer, got %d", a)
+	}
+}
+
+func TestNextUnreadStatus(t *testing.T) {
+	ui := &UI{}
+	bs := NewBufferList(ui)
+	bs.Add("", "(home)", "")
+	bs.Add("", "", "#kouhai")
+	bs.Add("", "", "#senpai")
+	bs.current = 0
+
+	bs.AddLine("", "#kouhai", Line{At: time.Now(), Notify: NotifyStatus, Readable: true})
+	bs.AddLine("", "#senpai", Line{At: time.Now(), Notify: NotifyUnread, Readable: true})
+	bs.NextUnread()
+	if bs.current != 2 {
+		t.Errorf("expected to skip the buffer with only status activity, got %d", bs.current)
+	}
+
+	ui.config.CycleStatus = true
+	bs.NextUnread()
+	if bs.current != 1 {
+		t.Errorf("expected to go to the buffer with status activity, got %d", bs.current)
+	}
+}
+
+func TestMove(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.Add("", "(home)", "")
+	bs.Add("", "", "#b")
+	bs.Add("", "", "#c")
+	bs.current = 2
+
+	titles := func() string {
+		var s []string
+		for _, b := range bs.list {
+			s = append(s, b.title)
+		}
+		return strings.Join(s, ",")
+	}
+
+	bs.Move(0)
+	if got := titles(); got != ",#c,#b" || bs.current != 1 {
+		t.Errorf("expected #c to be moved first, below the server buffer, got %q, current %d", got, bs.current)
+	}
+	bs.Add("", "", "#a")
+	if got := titles(); got != ",#c,#b,#a" {
+		t.Errorf("expected new buffers to be appended, got %q", got)
+	}
+
+	// Closed buffers are forgotten, whatever the case of their name.
+	bs.Remove("", "#C")
+	if len(bs.Order()) != 3 {
+		t.Errorf("expected the closed buffer to be removed from the order, got %v", bs.Order())
+	}
+	bs.Add("", "", "#c")
+	if got := titles(); got != ",#b,#a,#c" {
+		t.Errorf("expected #c to be appended, got %q", got)
+	}
+
+	order := bs.Order()
+	bs = NewBufferList(&UI{})
+	bs.Add("", "(home)", "")
+	bs.SetOrder(order)
+	bs.Add("", "", "#a")
+	bs.Add("", "", "#d")
+	bs.Add("", "", "#c")
+	if got := titles(); got != ",#a,#c,#d" {
+		t.Errorf("expected the order to be restored, got %q", got)
+	}
+}
+
+func TestMoveNetworks(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.Add("a", "a", "")
+	bs.Add("a", "", "#a1")
+	bs.Add("a", "", "#a2")
+	bs.Add("b", "b", "")
+	bs.Add("b", "", "#b1")
+
+	titles := func() string {
+		var s []string
+		for _, b := range bs.list {
+			s = append(s, b.netID+b.title)
+		}
+		return strings.Join(s, ",")
+	}
+
+	// Channels stay within their network.
+	bs.current = 1
+	bs.Move(4)
+	if got := titles(); got != "a,a#a2,a#a1,b,b#b1" || bs.current != 2 {
+		t.Errorf("expected #a1 to stay in its network, got %q, current %d", got, bs.current)
+	}
+	bs.current = 4
+	bs.Move(0)
+	if got := titles(); got != "a,a#a2,a#a1,b,b#b1" || bs.current != 4 {
+		t.Errorf("expected #b1 to stay below its server buffer, got %q, current %d", got, bs.current)
+	}
+
+	// Server buffers move along with their channels, between networks.
+	bs.current = 3
+	bs.Move(1)
+	if got := titles(); got != "b,b#b1,a,a#a2,a#a1" || bs.current != 0 {
+		t.Errorf("expected network b to be moved first, got %q, current %d", got, bs.current)
+	}
+	bs.current = 0
+	bs.Move(10)
+	if got := titles(); got != "a,a#a2,a#a1,b,b#b1" || bs.current != 3 {
+		t.Errorf("expected network b to be moved last, got %q, current %d", got, bs.current)
+	}
+	order := bs.Order()
+	if len(order) != 5 || order[3] != (BufferKey{"b", ""}) {
+		t.Errorf("expected the order to follow the list, got %v", order)
+	}
+}
+
+func TestHideServerBuffers(t *testing.T) {
+	ui := &UI{}
+	ui.config.HideServerBuffers = true
+	bs := NewBufferList(ui)
+	bs.Add("", "(home)", "")
+	bs.Add("", "", "#kouhai")
+	bs.Add("", "", "#senpai")
+	bs.current = 2
+
+	bs.Next()
+	if bs.current != 1 {
+		t.Errorf("expected to skip the hidden server buffer, got %d", bs.current)
+	}
+	if bs.isHidden(1) {
+		t.Errorf("expected the current buffer not to be hidden")
+	}
+
+	bs.AddLine("", "", Line{At: time.Now(), Notify: NotifyUnread, Readable: true})
+	bs.Previous()
+	if bs.current != 0 {
+		t.Errorf("expected the server buffer to be shown on activity, got %d", bs.current)
+	}
+}
+
+func TestBufferPosition(t *testing.T) {
+	ui := &UI{}
+	ui.config.HideServerBuffers = true
+	bs := NewBufferList(ui)
+	bs.Add("", "(home)", "")
+	bs.Add("", "", "#kouhai")
+	bs.Add("n", "network", "")
+	bs.Add("n", "", "#senpai")
+	bs.current = 1
+
+	if n := bs.visibleCount(); n != 2 {
+		t.Errorf("expected 2 buffers to be shown, got %d", n)
+	}
+	for i, expected := range []int{1, 3, -1} {
+		if j := bs.position(i); j != expected {
+			t.Errorf("position %d: expected buffer %d, got %d", i, expected, j)
+		}
+	}
+	if p := bs.positionOf(3); p != 1 {
+		t.Errorf("expected #senpai to be shown at position 1, got %d", p)
+	}
+
+	// The current hidden server buffer is shown without renumbering others.
+	bs.current = 2
+	if bs.isHidden(2) {
+		t.Errorf("expected the current server buffer to be shown")
+	}
+	if n := bs.visibleCount(); n != 2 {
+		t.Errorf("expected 2 numbered buffers with a current server buffer, got %d", n)
+	}
+	if j := bs.position(1); j != 3 {
+		t.Errorf("expected #senpai to stay at position 1, got buffer %d", j)
+	}
+	if p := bs.positionOf(3); p != 1 {
+		t.Errorf("expected #senpai to stay at position 1, got %d", p)
+	}
+}
+
+func TestHorizontalBufferOffset(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.Add("", "", "#日本語")
+	bs.Add("", "", "#a")
+	bs.Add("", "", "#b")
+	bs.list[0].highlights = 12
+	bs.list[1].highlights = 3
+
+	// "#日本語 12 " is 11 columns wide, "#a 3 " 5 columns.
+	tests := []struct {
+		x        int
+		expected int
+	}{
+		{0, 0},
+		{10, 0},
+		{11, -1},
+		{12, 1},
+		{16, 1},
+		{17, -1},
+		{18, 2},
+		{19, 2},
+		{20, -1},
+	}
+	for _, test := range tests {
+		if i := bs.HorizontalBufferOffset(test.x, 0); i != test.expected {
+			t.Errorf("x %d: expected buffer %d, got %d", test.x, test.expected, i)
+		}
+	}
+	if i := bs.HorizontalBufferOffset(0, 1); i != 1 {
+		t.Errorf("expected buffer 1 with an offset, got %d", i)
+	}
+}
+
+func TestGetTopMost(t *testing.T) {
+	ui := &UI{}
+	ui.config.HideServerBuffers = true
+	bs := NewBufferList(ui)
+	for i := 0; i < 20; i++ {
+		bs.Add("", "", fmt.Sprintf("#%02d", i))
+	}
+	bs.Add("n", "network", "")
+	for i := 0; i < 5; i++ {
+		bs.Add("n", "", fmt.Sprintf("#n%d", i))
+	}
+
+	bs.current = 3
+	if first := bs.GetTopMost(10); first != 0 {
+		t.Errorf("expected no scrolling for a buffer on the first page, got %d", first)
+	}
+	bs.current = 15
+	if first := bs.GetTopMost(10); first != 6 {
+		t.Errorf("expected the buffer to be on the last row, got offset %d", first)
+	}
+	// The hidden server buffer at 20 does not take a row.
+	bs.current = 25
+	if first := bs.GetTopMost(10); first != 15 {
+		t.Errorf("expected hidden buffers to be skipped, got offset %d", first)
+	}
+}
+
+func TestJumpToLine(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.ResizeTimeline(80, 10, 80)
+	bs.Add("", "", "#kouhai")
+	bs.Add("", "", "#senpai")
+	at := time.Now().Add(-time.Hour).UTC()
+	for i := 0; i < 20; i++ {
+		bs.AddLine("", "#senpai", Line{At: at.Add(time.Duration(i) * time.Minute), Body: PlainString("lorem ipsum"), ID: fmt.Sprint(i)})
+	}
+	bs.OpenOverlay()
+
+	if !bs.JumpToLine("", "#senpai", "5", time.Time{}) {
+		t.Fatalf("expected the line to be found")
+	}
+	if bs.HasOverlay() {
+		t.Errorf("expected the overlay to be closed")
+	}
+	if netID, title := bs.Current(); netID != "" || title != "#senpai" {
+		t.Errorf("expected to jump to #senpai, got %q", title)
+	}
+	if line, ok := bs.Selection(); !ok || line.ID != "5" {
+		t.Errorf("expected the line to be selected, got %v", line.ID)
+	}
+	if bs.cur().scrollAmt == 0 {
+		t.Errorf("expected the buffer to be scrolled up to the line")
+	}
+
+	if !bs.JumpToLine("", "#senpai", "", at.Add(90*time.Second)) {
+		t.Fatalf("expected a line to be found by time")
+	}
+	if line, _ := bs.Selection(); line.ID != "1" {
+		t.Errorf("expected the last line before the time to be selected, got %v", line.ID)
+	}
+	if bs.JumpToLine("", "#senpai", "", at.Add(-time.Minute)) {
+		t.Errorf("expected no line older than the history")
+	}
+}
+
+func TestSetReadUnfocused(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.ResizeTimeline(80, 10, 80)
+	bs.Add("", "", "#kouhai")
+	bs.Add("", "", "#senpai")
+	bs.SetFocused(true)
+
+	at := time.Now().Add(-time.Minute).UTC()
+	for i := 0; i < 3; i++ {
+		bs.AddLine("", "#senpai", Line{At: at.Add(time.Duration(i) * time.Second), Body: PlainString("senpai: hi"), Notify: NotifyHighlight, Readable: true})
+	}
+	_, b := bs.at("", "#senpai")
+	if b.highlights != 3 || b.activity != NotifyHighlight {
+		t.Fatalf("expected 3 highlights in the unfocused buffer, got %d", b.highlights)
+	}
+
+	// Read on another device, up to the second message.
+	bs.SetRead("", "#senpai", at.Add(time.Second))
+	if b.highlights != 3 {
+		t.Errorf("expected the highlights to be kept while a message is unread, got %d", b.highlights)
+	}
+	bs.SetRead("", "#senpai", at.Add(2*time.Second))
+	if b.highlights != 0 || b.activity != NotifyNone {
+		t.Errorf("expected the buffer to be read, got %d highlights", b.highlights)
+	}
+	if !b.read.Equal(at.Add(2 * time.Second)) {
+		t.Errorf("expected the read marker to be set, got %v", b.read)
+	}
+	bs.SetRead("", "#senpai", at)
+	if !b.read.Equal(at.Add(2 * time.Second)) {
+		t.Errorf("expected the read marker not to go back, got %v", b.read)
+	}
+}
+
+func TestGroupedWith(t *testing.T) {
+	at := time.Now()
+	prev := Line{At: at, Author: "senpai", AuthorLen: len("<senpai> ")}
+	tests := []struct {
+		line     Line
+		window   time.Duration
+		expected bool
+	}{
+		{Line{At: at.Add(time.Minute), Author: "senpai"}, 5 * time.Minute, true},
+		{Line{At: at.Add(time.Minute), Author: "senpai"}, 0, false},
+		{Line{At: at.Add(10 * time.Minute), Author: "senpai"}, 5 * time.Minute, false},
+		{Line{At: at.Add(-time.Minute), Author: "senpai"}, 5 * time.Minute, false},
+		{Line{At: at.Add(time.Minute), Author: "kouhai"}, 5 * time.Minute, false},
+		{Line{At: at.Add(time.Minute)}, 5 * time.Minute, false},
+	}
+	for i, test := range tests {
+		if v := test.line.groupedWith(&prev, test.window); v != test.expected {
+			t.Errorf("test %d: expected %v, got %v", i, test.expected, v)
+		}
+	}
+}
+
+func TestActivitySummary(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.ResizeTimeline(80, 10, 80)
+	bs.Add("", "", "")
+	bs.Add("", "", "#kouhai")
+	bs.Add("", "", "#senpai")
+
+	at := time.Now().Add(-time.Hour).UTC()
+	bs.AddLine("", "#kouhai", Line{At: at, Body: PlainString("<senpai> hi"), Notify: NotifyUnread, Readable: true})
+	for i := 1; i <= 3; i++ {
+		notify := NotifyUnread
+		if i == 3 {
+			notify = NotifyHighlight
+		}
+		bs.AddLine("", "#senpai", Line{At: at.Add(time.Duration(i) * time.Minute), Body: PlainString("<kouhai> senpai"), Notify: notify, Readable: true})
+	}
+	bs.SetRead("", "#senpai", at.Add(time.Minute))
+	bs.SetRead("", "#kouhai", at.Add(-time.Minute))
+	bs.Add("", "", "#lurk")
+	bs.AddLine("", "#lurk", Line{At: at.Add(-time.Minute), Body: PlainString("<kouhai> hi"), Notify: NotifyUnread, Readable: true})
+
+	activity := bs.Activity()
+	if len(activity) != 4 {
+		t.Fatalf("expected 4 buffers, got %d", len(activity))
+	}
+	if a := activity[0]; a.Title != "#senpai" || a.Unread != 2 || a.Highlights != 1 || !a.Last.Equal(at.Add(3*time.Minute)) {
+		t.Errorf("expected #senpai first with 2 unread messages, got %+v", a)
+	}
+	if a := activity[1]; a.Title != "#kouhai" || a.Unread != 1 || a.Highlights != 0 {
+		t.Errorf("expected #kouhai second with 1 unread message, got %+v", a)
+	}
+	if a := activity[2]; a.Title != "#lurk" || a.Unread != 1 {
+		t.Errorf("expected #lurk third with 1 unread message without a read marker, got %+v", a)
+	}
+	if a := activity[3]; a.Title != "" || !a.Last.IsZero() {
+		t.Errorf("expected the server buffer last, got %+v", a)
+	}
+
+	// Messages seen before focusing a buffer without a read marker are
+	// not counted.
+	bs.To(3)
+	bs.To(0)
+	bs.AddLine("", "#lurk", Line{At: at, Body: PlainString("<kouhai> hi"), Notify: NotifyHighlight, Readable: true})
+	for _, a := range bs.Activity() {
+		if a.Title == "#lurk" && (a.Unread != 1 || a.Highlights != 1) {
+			t.Errorf("expected #lurk with 1 unread highlight, got %+v", a)
+		}
+	}
+}
+
+func TestUnreadRuler(t *testing.T) {
+	bs := NewBufferList(&UI{config: Config{UnreadRuler: '─'}})
+	bs.ResizeTimeline(80, 10, 80)
+	bs.Add("", "", "")
+	i, _ := bs.Add("", "", "#senpai")
+	_, b := bs.at("", "#senpai")
+
+	at := time.Now().Add(-time.Hour).UTC()
+	add := func(n int) {
+		for j := 0; j < n; j++ {
+			at = at.Add(time.Second)
+			bs.AddLine("", "#senpai", Line{At: at, Body: PlainString("<kouhai> hi"), Notify: NotifyUnread, Readable: true})
+		}
+	}
+	add(2)
+	bs.SetRead("", "#senpai", at)
+	add(2)
+
+	bs.To(i)
+	if r := bs.unreadRulerIndex(b); r != 1 {
+		t.Fatalf("expected the ruler after the read lines, got %d", r)
+	}
+	add(2)
+	if r := bs.unreadRulerIndex(b); r != 1 {
+		t.Errorf("expected the ruler to stay while the buffer is open, got %d", r)
+	}
+
+	// Read, then new messages arrive while in another buffer.
+	bs.To(0)
+	bs.SetRead("", "#senpai", at)
+	add(3)
+	bs.To(i)
+	if r := bs.unreadRulerIndex(b); r != 5 {
+		t.Errorf("expected a single ruler after the newly read lines, got %d", r)
+	}
+	for _, line := range b.lines {
+		if strings.Contains(line.Body.String(), "─") {
+			t.Errorf("expected the ruler not to be added as a line")
+		}
+	}
+
+	// Everything is read from another client while the buffer is open.
+	bs.SetRead("", "#senpai", at)
+	if r := bs.unreadRulerIndex(b); r != -1 {
+		t.Errorf("expected no ruler once all lines are read, got %d", r)
+	}
+
+	bs.ui.config.UnreadRuler = 0
+	if r := bs.unreadRulerIndex(b); r != -1 {
+		t.Errorf("expected no ruler when disabled, got %d", r)
+	}
+}
+
+func TestKeepScrollPreview(t *testing.T) {
+	ui := &UI{}
+	bs := NewBufferList(ui)
+	bs.ResizeTimeline(80, 10, 80)
+	bs.Add("", "", "#senpai")
+	link := "https://example.org/a.png"
+	bs.AddLine("", "#senpai", Line{Body: PlainString("old " + link).ParseURLs()})
+	for i := 0; i < 20; i++ {
+		bs.AddLine("", "#senpai", Line{Body: PlainString("lorem ipsum")})
+	}
+	bs.AddLine("", "#senpai", Line{Body: PlainString("new " + link).ParseURLs()})
+	ui.previews = map[string]*preview{link: {}}
+
+	bs.keepScrollPreview(link)
+	if b := bs.cur(); b.scrollAmt != 0 {
+		t.Errorf("expected the timeline to stay at the bottom, got offset %d", b.scrollAmt)
+	}
+
+	// Only the newest line, below the timeline, gets taller.
+	bs.ScrollUp(5)
+	bs.keepScrollPreview(link)
+	if b := bs.cur(); b.scrollAmt != 5+previewHeight {
+		t.Errorf("expected offset %d, got %d", 5+previewHeight, b.scrollAmt)
+	}
+}
+
+func TestEvictPreviews(t *testing.T) {
+	ui := &UI{
+		previews: map[string]*preview{},
+	}
+	for i := 0; i < maxPreviews+5; i++ {
+		ui.previews[fmt.Sprintf("https://example.org/%d.png", i)] = &preview{used: uint64(i)}
+	}
+	ui.evictPreviews()
+	if len(ui.previews) != maxPreviews {
+		t.Fatalf("expected %d previews, got %d", maxPreviews, len(ui.previews))
+	}
+	for i := 0; i < 5; i++ {
+		if _, ok := ui.previews[fmt.Sprintf("https://example.org/%d.png", i)]; ok {
+			t.Errorf("expected the least recently used preview %d to be dropped", i)
+		}
+	}
+}
+
+func TestRemoveCurrent(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.Add("", "", "")
+	bs.Add("", "", "#senpai")
+	bs.To(1)
+	if !bs.Remove("", "#senpai") {
+		t.Fatalf("expected the buffer to be removed")
+	}
+	if bs.current != 0 {
+		t.Errorf("expected the previous buffer to be current, got %d", bs.current)
+	}
+}
+
+func TestAwayDivider(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.ResizeTimeline(80, 10, 80)
+	bs.Add("", "", "")
+	i, _ := bs.Add("", "", "#senpai")
+	_, b := bs.at("", "#senpai")
+
+	at := time.Now().Add(-time.Hour).UTC()
+	add := func(n int) {
+		for j := 0; j < n; j++ {
+			at = at.Add(time.Second)
+			bs.AddLine("", "#senpai", Line{At: at, Body: PlainString("<kouhai> hi"), Notify: NotifyUnread, Readable: true})
+		}
+	}
+	add(2)
+	bs.SetRead("", "#senpai", at)
+	bs.SetAway(at)
+	add(3)
+	if !isAwayDividerAbove(b, 2) {
+		t.Fatalf("expected the divider above the first unread line")
+	}
+	if h := bs.rowHeight(b, 2); h != bs.lineHeight(&b.lines[2])+1 {
+		t.Errorf("expected the divider to be counted in the height of the line, got %d", h)
+	}
+
+	// Scrolling to the last read line keeps the divider in view.
+	bs.To(i)
+	bs.scrollToAnchor(b, b.lines[1].At)
+	if b.scrollAmt != 3*bs.lineHeight(&b.lines[2])+1 {
+		t.Errorf("expected the divider row in the scroll amount, got %d", b.scrollAmt)
+	}
+
+	// Leaving the buffer clears its divider.
+	bs.To(0)
+	if !b.awayMarker.IsZero() {
+		t.Errorf("expected no divider after leaving the buffer")
+	}
+
+	// Reading the buffer from another client clears its divider.
+	bs.SetAway(at)
+	add(2)
+	if b.awayMarker.IsZero() {
+		t.Fatalf("expected a divider for the new away period")
+	}
+	bs.SetRead("", "#senpai", at)
+	if !b.awayMarker.IsZero() {
+		t.Errorf("expected no divider once read from another client")
+	}
+}
+
+func TestAwayDividerLabel(t *testing.T) {
+	now := time.Date(2024, time.March, 10, 12, 0, 0, 0, time.Local)
+	if l := awayDividerLabel(now.Add(-time.Hour), now); l != " away since 11:00 " {
+		t.Errorf("expected only the time on the same day, got %q", l)
+	}
+	if l := awayDividerLabel(now.AddDate(0, 0, -1), now); l != " away since Mar 9 12:00 " {
+		t.Errorf("expected the date on another day, got %q", l)
+	}
+	// The same day of another year is another day.
+	if l := awayDividerLabel(now.AddDate(-1, 0, 0), now); l != " away since Mar 10 12:00 " {
+		t.Errorf("expected the date on another year, got %q", l)
+	}
+}
+
+func TestScrollAnchors(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.ResizeTimeline(80, 10, 80)
+	bs.Add("", "", "")
+	bs.Add("", "", "#senpai")
+	bs.Add("", "", "#kouhai")
+
+	at := time.Now().Add(-time.Hour).UTC()
+	var lines []Line
+	for i := 0; i < 30; i++ {
+		lines = append(lines, Line{At: at.Add(time.Duration(i) * time.Minute), Body: PlainString("hi")})
+	}
+	anchor := lines[20].At
+	bs.SetScrollAnchors(map[BufferKey]time.Time{
+		{"", "#senpai"}: anchor,
+		{"", "#kouhai"}: anchor,
+		{"", "#gone"}:   anchor,
+	})
+
+	bs.AddLines("", "#senpai", lines, nil)
+	_, b := bs.at("", "#senpai")
+	if a := bs.scrollAnchor(b); !a.Equal(anchor) {
+		t.Errorf("expected the scroll position to be restored at %v, got %v", anchor, a)
+	}
+
+	anchors := bs.ScrollAnchors()
+	if len(anchors) != 2 {
+		t.Errorf("expected the anchors of the open buffers only, got %v", anchors)
+	}
+	if a := anchors[BufferKey{"", "#senpai"}]; !a.Equal(anchor) {
+		t.Errorf("expected the restored scroll position to be saved, got %v", a)
+	}
+	if a := anchors[BufferKey{"", "#kouhai"}]; !a.Equal(anchor) {
+		t.Errorf("expected the scroll position still to be restored to be saved, got %v", a)
+	}
+
+	bs.Remove("", "#kouhai")
+	if anchors := bs.ScrollAnchors(); len(anchors) != 1 {
+		t.Errorf("expected the anchor of the closed buffer to be dropped, got %v", anchors)
+	}
+}
+
+func TestVisibleLines(t *testing.T) {
+	bs := NewBufferList(&UI{})
+	bs.ResizeTimeline(80, 6, 80)
+	bs.Add("", "", "#senpai")
+	for i := 0; i < 10; i++ {
+		bs.AddLine("", "#senpai", Line{Body: PlainString(fmt.Sprintf("%d", i))})
+	}
+
+	bodies := func() string {
+		var s []string
+		for _, line := range bs.VisibleLines() {
+			s = append(s, line.Body.String())
+		}
+		return strings.Join(s, ",")
+	}
+	if got := bodies(); got != "6,7,8,9" {
+		t.Errorf("expected the last lines, got %q", got)
+	}
+	bs.ScrollUp(3)
+	if got := bodies(); got != "3,4,5,6" {
+		t.Errorf("expected the lines shown once scrolled, got %q", got)
+	}
+}
+
+func TestSelectionMerge(t *testing.T) {
+	ui := &UI{}
+	ui.config.MergeLine = func(former *Line, addition Line) {
+		if addition.Body.String() == "-" {
+			former.Body = PlainString("")
+			return
+		}
+		former.Body = PlainString(former.Body.String() + addition.Body.String())
+	}
+	bs := NewBufferList(ui)
+	bs.ResizeTimeline(80, 10, 80)
+	bs.Add("", "", "#senpai")
+	at := time.Now().Add(-time.Hour)
+	line := func(min int, body string, mergeable bool) Line {
+		return Line{At: at.Add(time.Duration(min) * time.Minute), Body: PlainString(body), Mergeable: mergeable}
+	}
+	selection := func() string {
+		l, ok := bs.Selection()
+		if !ok {
+			return "none"
+		}
+		return l.Body.String()
+	}
+
+	bs.AddLine("", "#senpai", line(10, "a", false))
+	bs.AddLine("", "#senpai", line(11, "b", true))
+	bs.SelectLine()
+
+	// The selected line is merged with a new one.
+	bs.AddLine("", "#senpai", line(12, "c", true))
+	if s := selection(); s != "bc" {
+		t.Errorf("expected the merged line to stay selected, got %q", s)
+	}
+	// The selected line is removed by a merge.
+	bs.AddLine("", "#senpai", line(13, "-", true))
+	if s := selection(); s != "a" {
+		t.Errorf("expected the previous line to be selected, got %q", s)
+	}
+	bs.SelectDown()
+	if s := selection(); s != "a" {
+		t.Errorf("expected the selection to stay on the last line, got %q", s)
+	}
+
+	// Lines are added before the selected line.
+	bs.AddLines("", "#senpai", []Line{line(1, "x", false), line(2, "y", true)}, nil)
+	if s := selection(); s != "a" {
+		t.Errorf("expected the selection to follow its line, got %q", s)
+	}
+	bs.SelectUp()
+	if s := selection(); s != "y" {
+		t.Errorf("expected the line before to be selected, got %q", s)
+	}
+
+	// A line added before is merged with the selected line.
+	bs.Add("", "", "#kouhai")
+	bs.To(1)
+	bs.AddLine("", "#kouhai", line(5, "m", true))
+	bs.SelectLine()
+	bs.AddLines("", "#kouhai", []Line{line(1, "k", true)}, nil)
+	if s := selection(); s != "km" {
+		t.Errorf("expected the line merged with the selected one to stay selected, got %q", s)
+	}
 }
@@ -9,14 +9,16 @@ import (
 )
 
 var ColorRed = vaxis.IndexColor(9)
+var ColorYellow = vaxis.IndexColor(11)
 var ColorGray = vaxis.IndexColor(8)
 
 type ColorSchemeType int
 
 type ColorScheme struct {
-	Type   ColorSchemeType
-	Others vaxis.Color
-	Self   vaxis.Color
+	Type      ColorSchemeType
+	Others    vaxis.Color
+	Self      vaxis.Color
+	ByAccount bool // whether colors are derived from accounts rather than nicks, when known
 }
 
 const (
@@ -117,6 +119,15 @@ func CapLetter(value byte) byte {
 	return value
 }
 
+// NickColor returns the color of a user with the given nick and account, the
+// latter being empty if unknown.
+func NickColor(scheme ColorScheme, nick, account string, self bool) vaxis.Color {
+	if scheme.ByAccount && account != "" {
+		return IdentColor(scheme, account, self)
+	}
+	return IdentColor(scheme, nick, self)
+}
+
 func IdentString(scheme ColorScheme, ident string, self bool) StyledString {
 	color := IdentColor(scheme, ident, self)
 	style := vaxis.Style{
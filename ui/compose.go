@@ -0,0 +1,77 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	"git.sr.ht/~rockorager/vaxis"
+)
+
+// maxComposeRows is the maximum number of rows of the compose area, shown
+// above the status bar while the input spans multiple lines.
+const maxComposeRows = 10
+
+// composeHeight returns the number of rows of the compose area for an input
+// of n lines, given the height available to both the timeline and the
+// compose area. Single-line inputs have no compose area, and the timeline is
+// always left at least two thirds of the height.
+func composeHeight(n, height int) int {
+	if n <= 1 {
+		return 0
+	}
+	rows := n
+	if rows > maxComposeRows {
+		rows = maxComposeRows
+	}
+	if max := height / 3; rows > max {
+		rows = max
+	}
+	if max := height - minTimelineHeight; rows > max {
+		rows = max
+	}
+	if rows < 0 {
+		rows = 0
+	}
+	return rows
+}
+
+// timelineHeight returns the height of the timeline and of the compose area
+// in a terminal of height h.
+func (ui *UI) timelineHeight(h int) (timeline int, compose int) {
+	height := h - 2 // status bar and editor
+	if ui.channelWidth == 0 {
+		height-- // horizontal buffer list
+	}
+	n := strings.Count(string(ui.e.Content()), "\n") + 1
+	compose = composeHeight(n, height)
+	return height - compose, compose
+}
+
+// drawCompose draws the lines of a multi-line input from row y0, scrolled
+// so that the line of the cursor is shown.
+func (ui *UI) drawCompose(x0, y0, width, height int) {
+	clearArea(ui.vx, x0, y0, width, height)
+	if height <= 0 {
+		return
+	}
+	lines := strings.Split(string(ui.e.Content()), "\n")
+	cursor := ui.e.CursorLine()
+	first := 0
+	if cursor >= height {
+		first = cursor - height + 1
+	}
+	for i := first; i < len(lines) && i < first+height; i++ {
+		y := y0 + i - first
+		st := vaxis.Style{
+			Foreground: ColorGray,
+		}
+		if i == cursor {
+			st.Foreground = ui.config.Colors.Status
+			st.Attribute = vaxis.AttrBold
+		}
+		printIdent(ui.vx, x0+1, y, 7, Styled(fmt.Sprintf("%d/%d", i+1, len(lines)), st))
+
+		x := x0 + 9
+		printStringLimit(ui.vx, &x, y, x0+width, IRCString(lines[i]))
+	}
+}
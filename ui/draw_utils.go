@@ -24,7 +24,7 @@ var runeWidthMap = make(map[rune]int)
 
 func runeWidth(vx *Vaxis, r rune) int {
 	if vx == nil { // For tests only
-		return 1
+		return uniseg.StringWidth(string(r))
 	}
 	if r == '\n' {
 		r = '↲'
@@ -45,7 +45,7 @@ func runeWidth(vx *Vaxis, r rune) int {
 
 func stringWidth(vx *Vaxis, s string) int {
 	if vx == nil { // For tests only
-		return len(s)
+		return uniseg.StringWidth(s)
 	}
 	if len(s) == 1 { // Single-character ASCII fast path
 		if s[0] <= 0x1F {
@@ -62,6 +62,9 @@ func stringWidth(vx *Vaxis, s string) int {
 	return vx.RenderedWidth(s)
 }
 
+// truncate shortens s to at most w cells, ending it with tail if it was cut.
+// Wide characters are never split: when one does not fit, the result is padded
+// with a space so that it is exactly w cells wide.
 func truncate(vx *Vaxis, s string, w int, tail string) string {
 	if stringWidth(vx, s) <= w {
 		return s
@@ -79,6 +82,9 @@ func truncate(vx *Vaxis, s string, w int, tail string) string {
 		sb.WriteString(c.Grapheme)
 	}
 	sb.WriteString(tail)
+	for ; width < w; width++ {
+		sb.WriteByte(' ')
+	}
 	return sb.String()
 }
 
@@ -145,6 +151,12 @@ func printCluster(vx *Vaxis, x int, y int, limit int, r []rune, st vaxis.Style)
 }
 
 func printString(vx *Vaxis, x *int, y int, s StyledString) {
+	printStringLimit(vx, x, y, -1, s)
+}
+
+// printStringLimit is printString, stopping before the column limit (-1
+// meaning no limit).
+func printStringLimit(vx *Vaxis, x *int, y int, limit int, s StyledString) {
 	var st vaxis.Style
 	nextStyles := s.styles
 
@@ -155,7 +167,10 @@ func printString(vx *Vaxis, x *int, y int, s StyledString) {
 			st = nextStyles[0].Style
 			nextStyles = nextStyles[1:]
 		}
-		dx, di := printCluster(vx, *x, y, -1, sr, st)
+		dx, di := printCluster(vx, *x, y, limit, sr, st)
+		if di == 0 {
+			break
+		}
 		*x += dx
 		i += len(string(sr[:di]))
 		sr = sr[di:]
@@ -258,10 +273,15 @@ func clearArea(vx *Vaxis, x0, y0, width, height int) {
 }
 
 func drawHorizontalLine(vx *Vaxis, x0, y, width int) {
+	drawRuler(vx, x0, y, width, '─', vaxis.Style{
+		Foreground: ColorGray,
+	})
+}
+
+// drawRuler draws a horizontal line of r.
+func drawRuler(vx *Vaxis, x0, y, width int, r rune, st vaxis.Style) {
 	for x := x0; x < x0+width; x++ {
-		setCell(vx, x, y, '─', vaxis.Style{
-			Foreground: ColorGray,
-		})
+		setCell(vx, x, y, r, st)
 	}
 }
 
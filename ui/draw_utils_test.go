@@ -0,0 +1,28 @@
+package ui
+
+import "testing"
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s        string
+		w        int
+		expected string
+	}{
+		{"senpai", 6, "senpai"},
+		{"senpai", 5, "senp…"},
+		{"日本語", 6, "日本語"},
+		{"日本語", 5, "日本…"},
+		{"日本語", 4, "日… "},
+		{"a日本", 4, "a日…"},
+		{"a日本", 3, "a… "},
+	}
+	for _, test := range tests {
+		s := truncate(nil, test.s, test.w, "…")
+		if s != test.expected {
+			t.Errorf("truncate(%q, %d): expected %q, got %q", test.s, test.w, test.expected, s)
+		}
+		if w := stringWidth(nil, s); w > test.w {
+			t.Errorf("truncate(%q, %d): got %d cells", test.s, test.w, w)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package ui
 
 import (
 	"strings"
+	"unicode"
 
 	"git.sr.ht/~rockorager/vaxis"
 )
@@ -17,6 +18,28 @@ type Completion struct {
 	CursorIdx int // in runes
 }
 
+// formatRunes maps IRC formatting codes to the letter shown in their place in
+// the editor.
+var formatRunes = map[rune]rune{
+	0x02: 'B',
+	0x03: 'C',
+	0x04: 'H',
+	0x0F: 'O',
+	0x16: 'R',
+	0x1D: 'I',
+	0x1E: 'S',
+	0x1F: 'U',
+}
+
+// formatCode returns the formatting code starting at the beginning of r,
+// including its parameters, if any.
+func formatCode(r []rune) string {
+	if len(r) > 8 {
+		r = r[:8]
+	}
+	return string(r)
+}
+
 type editorLine struct {
 	runes    []rune
 	clusters []int
@@ -99,6 +122,19 @@ func (e *Editor) Content() []rune {
 	return e.text[e.lineIdx].runes
 }
 
+// CursorLine returns the index of the line of the cursor, in a text made of
+// several lines separated by newlines.
+func (e *Editor) CursorLine() int {
+	ci := e.text[e.lineIdx].clusters[e.cursorIdx]
+	n := 0
+	for _, r := range e.text[e.lineIdx].runes[:ci] {
+		if r == '\n' {
+			n++
+		}
+	}
+	return n
+}
+
 func (e *Editor) Empty() bool {
 	return len(e.text[e.lineIdx].runes) == 0
 }
@@ -114,7 +150,11 @@ func (e *Editor) recompute() {
 		c = append(c, nc)
 		w = append(w, nw)
 		nc += len([]rune(g.Grapheme))
-		nw += stringWidth(e.ui.vx, g.Grapheme)
+		if _, ok := formatRunes[rune(g.Grapheme[0])]; ok && len(g.Grapheme) == 1 {
+			nw += 1
+		} else {
+			nw += stringWidth(e.ui.vx, g.Grapheme)
+		}
 	}
 	c = append(c, nc)
 	w = append(w, nw)
@@ -530,6 +570,66 @@ func (e *Editor) bumpOldestChange() {
 	}
 }
 
+// messageTextStart returns the index of the message text in text, or -1 if it
+// has none. Without Config.MessageText, only command names are skipped.
+func (e *Editor) messageTextStart(text []rune) int {
+	if f := e.ui.config.MessageText; f != nil {
+		return f(text)
+	}
+	start := 0
+	if len(text) > 0 && text[0] == '/' {
+		// skip the command name
+		for start < len(text) && !unicode.IsSpace(text[start]) {
+			start++
+		}
+	}
+	return start
+}
+
+// misspelledRunes returns, for each rune of text, whether it is part of a word
+// missing from dictionary. Only the text from start is checked. Words
+// containing symbols or digits (such as links) and the word being typed at
+// cursorIdx are not checked.
+func misspelledRunes(text []rune, start, cursorIdx int, dictionary map[string]struct{}) []bool {
+	misspelled := make([]bool, len(text))
+	for start < len(text) {
+		if unicode.IsSpace(text[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(text) && !unicode.IsSpace(text[end]) {
+			end++
+		}
+		ws, we := start, end
+		for ws < we && strings.ContainsRune(`("'`, text[ws]) {
+			ws++
+		}
+		for we > ws && strings.ContainsRune(`.,;:!?)"'`, text[we-1]) {
+			we--
+		}
+		word := text[ws:we]
+		if len(word) > 0 && end != cursorIdx && isWord(word) {
+			if _, ok := dictionary[strings.ToLower(string(word))]; !ok {
+				for j := ws; j < we; j++ {
+					misspelled[j] = true
+				}
+			}
+		}
+		start = end
+	}
+	return misspelled
+}
+
+func isWord(word []rune) bool {
+	for _, r := range word {
+		if !unicode.IsLetter(r) && r != '\'' {
+			return false
+		}
+	}
+	return true
+}
+
 func (e *Editor) Draw(vx *Vaxis, x0, y int, hint string) {
 	var st vaxis.Style
 
@@ -553,13 +653,41 @@ func (e *Editor) Draw(vx *Vaxis, x0, y int, hint string) {
 		autoEnd = e.autoCache[e.autoCacheIdx].EndIdx
 	}
 
+	// Formatting codes are shown as reversed letters, and style the text
+	// following them.
+	fst := st
+	if showCursor {
+		for j := 0; j < i; j++ {
+			if _, ok := formatRunes[text[j]]; ok {
+				fst, _ = ircFormat(fst, formatCode(text[j:]))
+			}
+		}
+	}
+
 	ci := e.text[e.lineIdx].clusters[e.cursorIdx]
+	var misspelled []bool
+	if showCursor && e.ui.config.Dictionary != nil {
+		if start := e.messageTextStart(text); start >= 0 {
+			misspelled = misspelledRunes(text, start, ci, e.ui.config.Dictionary)
+		}
+	}
 	for i < len(text) {
 		r := text[i:]
-		s := st
+		s := fst
+		if f, ok := formatRunes[r[0]]; ok && showCursor {
+			fst, _ = ircFormat(fst, formatCode(r))
+			s = vaxis.Style{
+				Attribute: vaxis.AttrReverse,
+			}
+			r = []rune{f}
+		}
 		if e.backsearch && i < ci && i >= ci-len(e.backsearchPattern) {
 			s.UnderlineStyle = vaxis.UnderlineSingle
 		}
+		if misspelled != nil && misspelled[i] {
+			s.UnderlineStyle = vaxis.UnderlineCurly
+			s.UnderlineColor = ColorRed
+		}
 		if i >= autoStart && i < autoEnd {
 			s.UnderlineStyle = vaxis.UnderlineSingle
 		}
@@ -588,6 +716,9 @@ func (e *Editor) Draw(vx *Vaxis, x0, y int, hint string) {
 	}
 
 	autoCount := y - 2
+	if !e.ui.config.CompletionPopup {
+		autoCount = 0
+	}
 	if autoCount < 0 {
 		autoCount = 0
 	} else if autoCount > len(e.autoCache) {
@@ -605,19 +736,17 @@ func (e *Editor) Draw(vx *Vaxis, x0, y int, hint string) {
 		}
 	}
 
-	for ci, completion := range e.autoCache[autoOff : autoOff+autoCount] {
-		display := completion.Display
-		if display == nil {
-			display = completion.Text[completion.StartIdx:]
-		}
-		var unselectable bool
-		if completion.Async != nil {
-			display = []rune("Loading...")
-			unselectable = true
-		} else if (ci == 0 && autoOff > 0) || (ci == autoCount-1 && autoOff+autoCount < len(e.autoCache)) {
-			display = []rune("...")
-			unselectable = true
+	// Pad all entries to the same width, so that the list is drawn as a box.
+	autoWidth := 0
+	for ci := 0; ci < autoCount; ci++ {
+		display, _ := e.completionLabel(autoOff, autoCount, ci)
+		if w := stringWidth(vx, string(display)); w > autoWidth {
+			autoWidth = w
 		}
+	}
+
+	for ci := 0; ci < autoCount; ci++ {
+		display, unselectable := e.completionLabel(autoOff, autoCount, ci)
 
 		x := autoX
 		y := y - ci - 1
@@ -642,6 +771,14 @@ func (e *Editor) Draw(vx *Vaxis, x0, y int, hint string) {
 			x += dx
 			i += di
 		}
+		for x < autoX+autoWidth && x < x0+e.width {
+			s := vaxis.Style{
+				Background: vaxis.IndexColor(0),
+				Attribute:  vaxis.AttrReverse | vaxis.AttrDim,
+			}
+			setCell(vx, x, y, ' ', s)
+			x++
+		}
 	}
 
 	if showCursor {
@@ -652,6 +789,28 @@ func (e *Editor) Draw(vx *Vaxis, x0, y int, hint string) {
 	}
 }
 
+// completionLabel returns the text of the row ci of the auto-completion
+// dialog, which shows autoCount completions from autoOff, and whether it is
+// a placeholder rather than a completion.
+func (e *Editor) completionLabel(autoOff, autoCount, ci int) (display []rune, unselectable bool) {
+	completion := e.autoCache[autoOff+ci]
+	if completion.Async != nil {
+		return []rune("Loading..."), true
+	} else if (ci == 0 && autoOff > 0) || (ci == autoCount-1 && autoOff+autoCount < len(e.autoCache)) {
+		return []rune("..."), true
+	}
+	return completionDisplay(completion), false
+}
+
+// completionDisplay returns the text shown for a completion in the
+// auto-completion dialog.
+func completionDisplay(c Completion) []rune {
+	if c.Display != nil {
+		return c.Display
+	}
+	return c.Text[c.StartIdx:]
+}
+
 // runeOffset returns the lowercase version of a rune
 // TODO: len(strings.ToLower(string(r))) == len(strings.ToUpper(string(r))) for all x?
 func runeToLower(r rune) rune {
@@ -124,3 +124,100 @@ func TestLeftAndRem(t *testing.T) {
 	e.PutRune('l')
 	assertEditorEq(t, e, hell)
 }
+
+func TestMisspelledRunes(t *testing.T) {
+	dictionary := map[string]struct{}{
+		"hello": {},
+		"world": {},
+		"don't": {},
+	}
+	text := []rune("/msg Helo, wrold! don't see https://x.org typ")
+	misspelled := misspelledRunes(text, len("/msg Helo,"), len(text), dictionary)
+	var got []string
+	var word []rune
+	for i, r := range text {
+		if misspelled[i] {
+			word = append(word, r)
+		} else if word != nil {
+			got = append(got, string(word))
+			word = nil
+		}
+	}
+	if word != nil {
+		got = append(got, string(word))
+	}
+	expected := []string{"wrold", "see"}
+	if len(got) != len(expected) {
+		t.Fatalf("expected misspelled words %q, got %q", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("expected misspelled words %q, got %q", expected, got)
+		}
+	}
+}
+
+func TestCursorLine(t *testing.T) {
+	e := NewEditor(&UI{})
+	e.Resize(20)
+	for _, r := range "a\nb\nc" {
+		e.PutRune(r)
+	}
+	if l := e.CursorLine(); l != 2 {
+		t.Errorf("expected the cursor on line 2, got %d", l)
+	}
+	e.Left()
+	e.Left()
+	if l := e.CursorLine(); l != 1 {
+		t.Errorf("expected the cursor on line 1, got %d", l)
+	}
+	e.Home()
+	if l := e.CursorLine(); l != 0 {
+		t.Errorf("expected the cursor on line 0, got %d", l)
+	}
+}
+
+func TestComposeHeight(t *testing.T) {
+	tests := []struct {
+		lines    int
+		height   int
+		expected int
+	}{
+		{1, 30, 0},
+		{3, 30, 3},
+		{20, 60, maxComposeRows},
+		{8, 12, 4},
+		{2, 2, 0},
+		{2, 1, 0},
+	}
+	for _, test := range tests {
+		if rows := composeHeight(test.lines, test.height); rows != test.expected {
+			t.Errorf("%d lines in %d rows: expected %d rows, got %d", test.lines, test.height, test.expected, rows)
+		}
+	}
+}
+
+func TestCompletionLabel(t *testing.T) {
+	e := NewEditor(&UI{})
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		e.autoCache = append(e.autoCache, Completion{Text: []rune(name)})
+	}
+	e.autoCache = append(e.autoCache, Completion{Async: func(interface{}) []Completion { return nil }})
+
+	tests := []struct {
+		ci           int
+		expected     string
+		unselectable bool
+	}{
+		{0, "...", true},
+		{1, "carol", false},
+		{2, "dave", false},
+		{3, "Loading...", true},
+	}
+	for _, test := range tests {
+		display, unselectable := e.completionLabel(1, 4, test.ci)
+		if string(display) != test.expected || unselectable != test.unselectable {
+			t.Errorf("row %d: expected %q (%v), got %q (%v)", test.ci, test.expected, test.unselectable, string(display), unselectable)
+		}
+	}
+}
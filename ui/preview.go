@@ -0,0 +1,107 @@
+package ui
+
+import (
+	"image"
+
+	"git.sr.ht/~rockorager/vaxis"
+)
+
+// previewHeight is the number of rows taken by an inline image preview.
+const previewHeight = 8
+
+// maxPreviews is the number of previews kept; the least recently shown ones
+// are dropped first.
+const maxPreviews = 64
+
+// preview is the inline preview of a link. Its image is nil while the link
+// is being fetched, or if it could not be displayed.
+type preview struct {
+	image vaxis.Image
+	used  uint64 // value of UI.previewClock when last shown or requested
+}
+
+// previewsEnabled reports whether inline previews can be shown at all.
+func (ui *UI) previewsEnabled() bool {
+	return ui.config.Preview != nil && ui.vx != nil && ui.vx.CanDisplayGraphics()
+}
+
+// linePreview returns the preview image to show below line, if any.
+func (ui *UI) linePreview(line *Line) vaxis.Image {
+	if ui.previews == nil {
+		return nil
+	}
+	for _, link := range line.Body.URLs() {
+		if p, ok := ui.previews[link]; ok && p.image != nil {
+			ui.previewClock++
+			p.used = ui.previewClock
+			return p.image
+		}
+	}
+	return nil
+}
+
+// requestPreviews starts fetching the previews of the links of line that
+// were not requested yet.
+func (ui *UI) requestPreviews(line *Line) {
+	if !ui.previewsEnabled() {
+		return
+	}
+	for _, link := range line.Body.URLs() {
+		ui.previewClock++
+		if p, ok := ui.previews[link]; ok {
+			p.used = ui.previewClock
+			continue
+		}
+		if ui.previews == nil {
+			ui.previews = make(map[string]*preview)
+		}
+		ui.previews[link] = &preview{
+			used: ui.previewClock,
+		}
+		ui.evictPreviews()
+		ui.config.Preview(link)
+	}
+}
+
+// evictPreviews drops the least recently used previews, until at most
+// maxPreviews are left.
+func (ui *UI) evictPreviews() {
+	for len(ui.previews) > maxPreviews {
+		var oldest string
+		var oldestUsed uint64
+		for link, p := range ui.previews {
+			if oldest == "" || p.used < oldestUsed {
+				oldest = link
+				oldestUsed = p.used
+			}
+		}
+		if p := ui.previews[oldest]; p.image != nil {
+			p.image.Destroy()
+		}
+		delete(ui.previews, oldest)
+	}
+}
+
+// SetPreview sets the image previewing link, as requested with
+// Config.Preview. img is nil if link is not a previewable image.
+func (ui *UI) SetPreview(link string, img image.Image) {
+	p, ok := ui.previews[link]
+	if !ok || img == nil {
+		return
+	}
+	vi, err := ui.vx.NewImage(img)
+	if err != nil {
+		return
+	}
+	vi.Resize(ui.bs.textWidth, previewHeight)
+	ui.bs.keepScrollPreview(link)
+	p.image = vi
+}
+
+func (ui *UI) resizePreviews() {
+	for _, p := range ui.previews {
+		if p.image != nil {
+			p.image.Resize(ui.bs.textWidth, previewHeight)
+		}
+	}
+}
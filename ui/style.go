@@ -87,8 +87,81 @@ func (s StyledString) String() string {
 	return s.string
 }
 
+// MapStyles returns s with each of its styles replaced by fn(style).
+func (s StyledString) MapStyles(fn func(vaxis.Style) vaxis.Style) StyledString {
+	styles := make([]rangedStyle, len(s.styles))
+	for i, rs := range s.styles {
+		styles[i] = rangedStyle{Start: rs.Start, Style: fn(rs.Style)}
+	}
+	return StyledString{
+		string: s.string,
+		styles: styles,
+	}
+}
+
+// isBidiControl reports whether r is a bidirectional embedding, override or
+// isolate, which can reorder the text around it. The implicit marks (ALM, LRM
+// and RLM), common in Arabic and Hebrew text, cannot and are not included.
+func isBidiControl(r rune) bool {
+	switch {
+	case 0x202A <= r && r <= 0x202E: // LRE, RLE, PDF, LRO, RLO
+		return true
+	case 0x2066 <= r && r <= 0x2069: // LRI, RLI, FSI, PDI
+		return true
+	}
+	return false
+}
+
+// EscapeBidi returns s with its bidirectional formatting characters replaced
+// by a visible marker, so that they cannot make text appear in a misleading
+// order.
+func (s StyledString) EscapeBidi() StyledString {
+	if strings.IndexFunc(s.string, isBidiControl) < 0 {
+		return s
+	}
+	var sb strings.Builder
+	sb.Grow(len(s.string))
+	styles := make([]rangedStyle, len(s.styles))
+	si := 0
+	for i, r := range s.string {
+		for ; si < len(s.styles) && s.styles[si].Start <= i; si++ {
+			styles[si] = rangedStyle{Start: sb.Len(), Style: s.styles[si].Style}
+		}
+		if isBidiControl(r) {
+			r = '␦'
+		}
+		sb.WriteRune(r)
+	}
+	for ; si < len(s.styles); si++ {
+		styles[si] = rangedStyle{Start: sb.Len(), Style: s.styles[si].Style}
+	}
+	return StyledString{
+		string: sb.String(),
+		styles: styles,
+	}
+}
+
 var urlRegex, _ = xurls.StrictMatchingScheme(xurls.AnyScheme)
 
+// URLs returns the links of s, as tagged by ParseURLs, in order.
+func (s StyledString) URLs() []string {
+	var urls []string
+	var lastParams string
+	for _, st := range s.styles {
+		if st.Style.Hyperlink == "" {
+			lastParams = ""
+			continue
+		}
+		if st.Style.HyperlinkParams == lastParams {
+			// same link, split across several styles
+			continue
+		}
+		lastParams = st.Style.HyperlinkParams
+		urls = append(urls, st.Style.Hyperlink)
+	}
+	return urls
+}
+
 func (s StyledString) ParseURLs() StyledString {
 	if !strings.ContainsRune(s.string, '.') {
 		// fast path: no dot means no URL
@@ -242,53 +315,86 @@ func parseHexColor(raw string) (fg, bg vaxis.Color, n int) {
 	return fg, bg, n
 }
 
+// ircFormat applies the IRC formatting code at the start of raw to st.
+// It returns the resulting style and the length in bytes of the formatting
+// code, including its parameters, or 0 if raw does not start with a
+// formatting code.
+func ircFormat(st vaxis.Style, raw string) (vaxis.Style, int) {
+	if len(raw) == 0 {
+		return st, 0
+	}
+	switch raw[0] {
+	case 0x0F:
+		st = vaxis.Style{}
+	case 0x02:
+		st.Attribute ^= vaxis.AttrBold
+	case 0x03, 0x04:
+		var fg vaxis.Color
+		var bg vaxis.Color
+		var n int
+		if raw[0] == 0x03 {
+			fg, bg, n = parseColor(raw[1:])
+		} else {
+			fg, bg, n = parseHexColor(raw[1:])
+		}
+		if n == 0 {
+			// Both `fg` and `bg` are equal to
+			// tcell.ColorDefault.
+			st.Foreground = vaxis.Color(0)
+			st.Background = vaxis.Color(0)
+		} else if bg == vaxis.Color(0) {
+			st.Foreground = fg
+		} else {
+			st.Foreground = fg
+			st.Background = bg
+		}
+		return st, 1 + n
+	case 0x16:
+		st.Attribute ^= vaxis.AttrReverse
+	case 0x1D:
+		st.Attribute ^= vaxis.AttrItalic
+	case 0x1E:
+		st.Attribute ^= vaxis.AttrStrikethrough
+	case 0x1F:
+		if st.UnderlineStyle == vaxis.UnderlineOff {
+			st.UnderlineStyle = vaxis.UnderlineSingle
+		} else {
+			st.UnderlineStyle = vaxis.UnderlineOff
+		}
+	default:
+		return st, 0
+	}
+	return st, 1
+}
+
+// controlPicture returns a visible replacement for control characters, which
+// would otherwise break the layout of the terminal, or r itself. Line feeds,
+// which only come from multiline messages, are kept and wrap the line.
+func controlPicture(r rune) rune {
+	switch {
+	case r == '\t' || r == '\n':
+		return r
+	case r < 0x20:
+		return 0x2400 + r // ␀ to ␟
+	case r == 0x7F:
+		return '␡'
+	case 0x80 <= r && r <= 0x9F:
+		return utf8.RuneError
+	}
+	return r
+}
+
 func IRCString(raw string) StyledString {
 	var formatted strings.Builder
 	var styles []rangedStyle
 	var last vaxis.Style
 
 	for len(raw) != 0 {
-		r, runeSize := utf8.DecodeRuneInString(raw)
-		current := last
-		if r == 0x0F {
-			current = vaxis.Style{}
-		} else if r == 0x02 {
-			current.Attribute ^= vaxis.AttrBold
-		} else if r == 0x03 || r == 0x04 {
-			var fg vaxis.Color
-			var bg vaxis.Color
-			var n int
-			if r == 0x03 {
-				fg, bg, n = parseColor(raw[1:])
-			} else {
-				fg, bg, n = parseHexColor(raw[1:])
-			}
-			raw = raw[n:]
-			if n == 0 {
-				// Both `fg` and `bg` are equal to
-				// tcell.ColorDefault.
-				current.Foreground = vaxis.Color(0)
-				current.Background = vaxis.Color(0)
-			} else if bg == vaxis.Color(0) {
-				current.Foreground = fg
-			} else {
-				current.Foreground = fg
-				current.Background = bg
-			}
-		} else if r == 0x16 {
-			current.Attribute ^= vaxis.AttrReverse
-		} else if r == 0x1D {
-			current.Attribute ^= vaxis.AttrItalic
-		} else if r == 0x1E {
-			current.Attribute ^= vaxis.AttrStrikethrough
-		} else if r == 0x1F {
-			if last.UnderlineStyle == vaxis.UnderlineOff {
-				current.UnderlineStyle = vaxis.UnderlineSingle
-			} else {
-				current.UnderlineStyle = vaxis.UnderlineOff
-			}
-		} else {
-			formatted.WriteRune(r)
+		current, n := ircFormat(last, raw)
+		if n == 0 {
+			r, runeSize := utf8.DecodeRuneInString(raw)
+			formatted.WriteRune(controlPicture(r))
+			n = runeSize
 		}
 		if last != current {
 			if len(styles) != 0 && styles[len(styles)-1].Start == formatted.Len() {
@@ -304,7 +410,7 @@ func IRCString(raw string) StyledString {
 			}
 		}
 		last = current
-		raw = raw[runeSize:]
+		raw = raw[n:]
 	}
 
 	return StyledString{
@@ -94,3 +94,57 @@ func TestIRCString(t *testing.T) {
 		},
 	})
 }
+
+func TestIRCStringControl(t *testing.T) {
+	assertIRCString(t, "a\x00b\x07c\x7fd", StyledString{
+		string: "a␀b␇c␡d",
+		styles: nil,
+	})
+	assertIRCString(t, "a\nb\rc", StyledString{
+		string: "a\nb␍c",
+		styles: nil,
+	})
+	assertIRCString(t, "\x02a\tb\x1b[2J", StyledString{
+		string: "a\tb␛[2J",
+		styles: []rangedStyle{
+			{Start: 0, Style: vaxis.Style{Attribute: vaxis.AttrBold}},
+		},
+	})
+}
+
+func TestEscapeBidi(t *testing.T) {
+	s := IRCString("see \u202eexe.txt\x02 bold").EscapeBidi()
+	expected := StyledString{
+		string: "see ␦exe.txt bold",
+		styles: []rangedStyle{
+			{Start: len("see ␦exe.txt"), Style: vaxis.Style{Attribute: vaxis.AttrBold}},
+		},
+	}
+	if s.string != expected.string {
+		t.Errorf("expected string %q, got %q", expected.string, s.string)
+	}
+	if len(s.styles) != 1 || s.styles[0] != expected.styles[0] {
+		t.Errorf("expected styles %+v, got %+v", expected.styles, s.styles)
+	}
+}
+
+func TestEscapeBidiMarks(t *testing.T) {
+	text := "שלום\u200f (senpai)\u200e مرحبا\u061c"
+	if s := IRCString(text).EscapeBidi(); s.string != text {
+		t.Errorf("expected implicit marks to be kept, got %q", s.string)
+	}
+}
+
+func TestURLs(t *testing.T) {
+	s := IRCString("see \x02https://example.com/a\x02 and https://example.org, or nothing").ParseURLs()
+	actual := s.URLs()
+	expected := []string{"https://example.com/a", "https://example.org"}
+	if len(actual) != len(expected) {
+		t.Fatalf("expected URLs %q, got %q", expected, actual)
+	}
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Errorf("URL #%d expected to be %q, got %q", i, expected[i], actual[i])
+		}
+	}
+}
@@ -23,15 +23,30 @@ type Config struct {
 	AutoComplete      func(cursorIdx int, text []rune) []Completion
 	Mouse             bool
 	MergeLine         func(former *Line, addition Line)
+	MergeWindow       time.Duration // if non-zero, only merge lines this close in time
 	Colors            ConfigColors
 	LocalIntegrations bool
+	Dictionary        map[string]struct{}   // lowercase words; if nil, spelling is not checked
+	MessageText       func(text []rune) int // index of the message text of the input, whose spelling is checked, or -1 if it has none
+	Preview           func(link string)     // fetches an image preview; if nil, previews are disabled
+	CycleStatus       bool                  // whether buffers with only status activity are unread when cycling
+	HideServerBuffers bool                  // whether server buffers without activity are left out of buffer lists
+	CompletionPopup   bool                  // whether the candidates of auto-completion are listed above the input
+	CJKLineBreak      bool                  // whether lines can be wrapped between CJK characters
+	EscapeBidi        bool                  // whether bidirectional formatting characters are shown as markers
+	GroupAuthors      time.Duration         // if non-zero, omit the author of messages this close to the previous one from the same author
+	UnreadRuler       rune                  // character of the ruler before unread lines, or 0 to hide it
 }
 
 type ConfigColors struct {
-	Status vaxis.Color
-	Prompt vaxis.Color
-	Unread vaxis.Color
-	Nicks  ColorScheme
+	Status       vaxis.Color
+	Prompt       vaxis.Color
+	Unread       vaxis.Color
+	UnreadStatus vaxis.Color // buffers with only unread status events
+	Highlights   vaxis.Color // highlight counts of buffers
+	Action       vaxis.Color // text of actions (/me)
+	Ruler        vaxis.Color // unread ruler
+	Nicks        ColorScheme
 }
 
 type Vaxis struct {
@@ -73,7 +88,14 @@ type UI struct {
 
 	image vaxis.Image
 
+	previews     map[string]*preview
+	previewClock uint64 // incremented each time a preview is used
+
 	mouseLinks bool
+
+	// composeRows is the height of the compose area the timeline was last
+	// resized for.
+	composeRows int
 }
 
 func New(config Config) (ui *UI, err error) {
@@ -177,6 +199,11 @@ func (ui *UI) PreviousUnreadBuffer() {
 	ui.memberOffset = 0
 }
 
+// BufferCount returns the number of buffers shown in the buffer list.
+func (ui *UI) BufferCount() int {
+	return ui.bs.visibleCount()
+}
+
 func (ui *UI) ClickedBuffer() int {
 	return ui.bs.clicked
 }
@@ -196,11 +223,7 @@ func (ui *UI) ChannelColClicked() bool {
 }
 
 func (ui *UI) ResizeChannelCol(x int) {
-	if x < 6 {
-		x = 6
-	} else if x > 24 {
-		x = 24
-	}
+	x = clampColWidth(x)
 	if ui.channelWidth == x {
 		return
 	}
@@ -217,11 +240,7 @@ func (ui *UI) MemberColClicked() bool {
 }
 
 func (ui *UI) ResizeMemberCol(x int) {
-	if x < 6 {
-		x = 6
-	} else if x > 24 {
-		x = 24
-	}
+	x = clampColWidth(x)
 	if ui.memberWidth == x {
 		return
 	}
@@ -233,6 +252,18 @@ func (ui *UI) GoToBufferNo(i int) {
 	if ui.bs.To(i) {
 		ui.memberOffset = 0
 	}
+	ui.ScrollToBuffer()
+}
+
+// GoToBufferPosition focuses the buffer at position i (from 0) among the
+// buffers shown in the buffer list, or the last one if there are fewer.
+func (ui *UI) GoToBufferPosition(i int) {
+	if n := ui.bs.visibleCount(); i >= n {
+		i = n - 1
+	}
+	if j := ui.bs.position(i); j >= 0 {
+		ui.GoToBufferNo(j)
+	}
 }
 
 func (ui *UI) FilterBuffers(enable bool, query string) {
@@ -241,7 +272,7 @@ func (ui *UI) FilterBuffers(enable bool, query string) {
 
 func (ui *UI) GoToNextUnread() bool {
 	for i, buffer := range ui.bs.list {
-		if buffer.unread {
+		if ui.bs.isUnread(&buffer) {
 			ui.GoToBufferNo(i)
 			return true
 		}
@@ -277,6 +308,73 @@ func (ui *UI) HasEvent(x, y int) bool {
 	return false
 }
 
+// MoveBuffer moves the current buffer to position to (from 0) among the
+// buffers shown in the buffer list.
+func (ui *UI) MoveBuffer(to int) {
+	if n := ui.bs.visibleCount(); to >= n {
+		to = n - 1
+	}
+	if to < 0 {
+		to = 0
+	}
+	if i := ui.bs.position(to); i >= 0 {
+		ui.bs.Move(i)
+	}
+}
+
+// CurrentBufferPosition returns the position (from 0) of the current buffer
+// among the buffers shown in the buffer list.
+func (ui *UI) CurrentBufferPosition() int {
+	return ui.bs.positionOf(ui.bs.current)
+}
+
+func (ui *UI) BufferOrder() []BufferKey {
+	return ui.bs.Order()
+}
+
+func (ui *UI) SetBufferOrder(order []BufferKey) {
+	ui.bs.SetOrder(order)
+}
+
+func (ui *UI) ScrollAnchors() map[BufferKey]time.Time {
+	return ui.bs.ScrollAnchors()
+}
+
+func (ui *UI) SetScrollAnchors(anchors map[BufferKey]time.Time) {
+	ui.bs.SetScrollAnchors(anchors)
+}
+
+// SetAway marks the start of an away period: buffers receiving unread lines
+// during it get an "away since" divider at their read position.
+func (ui *UI) SetAway(since time.Time) {
+	ui.bs.SetAway(since)
+}
+
+// SetBack marks the end of the current away period.
+func (ui *UI) SetBack(until time.Time) {
+	ui.bs.SetBack(until)
+}
+
+func (ui *UI) SelectLine() bool {
+	return ui.bs.SelectLine()
+}
+
+func (ui *UI) SelectUp() {
+	ui.bs.SelectUp()
+}
+
+func (ui *UI) SelectDown() {
+	ui.bs.SelectDown()
+}
+
+func (ui *UI) ClearSelection() bool {
+	return ui.bs.ClearSelection()
+}
+
+func (ui *UI) Selection() (Line, bool) {
+	return ui.bs.Selection()
+}
+
 func (ui *UI) ScrollUp() {
 	ui.bs.ScrollUp(ui.bs.tlHeight / 2)
 }
@@ -335,6 +433,41 @@ func (ui *UI) MemberWidth() int {
 	return ui.memberWidth
 }
 
+// Layout returns whether the buffer and member lists are shown.
+func (ui *UI) Layout() (channelShown, memberShown bool) {
+	return ui.channelWidth != 0, ui.memberWidth != 0
+}
+
+// SetLayout shows or hides the buffer and member lists, as returned by
+// Layout, with their configured widths. It does nothing if the terminal is
+// too narrow to show the timeline next to the lists.
+func (ui *UI) SetLayout(channelShown, memberShown bool) {
+	var channelWidth, memberWidth int
+	if channelShown {
+		channelWidth = ui.config.ChanColWidth
+	}
+	if memberShown {
+		memberWidth = ui.config.MemberColWidth
+	}
+	w, _ := ui.vx.window.Size()
+	if w-9-channelWidth-memberWidth <= 0 {
+		return
+	}
+	ui.channelWidth = channelWidth
+	ui.memberWidth = memberWidth
+	ui.Resize()
+}
+
+// clampColWidth returns the closest valid width of a resized list column.
+func clampColWidth(x int) int {
+	if x < 6 {
+		return 6
+	} else if x > 24 {
+		return 24
+	}
+	return x
+}
+
 func (ui *UI) ToggleChannelList() {
 	if ui.channelWidth == 0 {
 		ui.channelWidth = ui.config.ChanColWidth
@@ -389,6 +522,11 @@ func (ui *UI) AddBuffer(netID, netName, title string) (i int, added bool) {
 	return
 }
 
+func (ui *UI) SetNetworkName(netID, netName string) {
+	ui.bs.SetNetworkName(netID, netName)
+	ui.ScrollToBuffer()
+}
+
 func (ui *UI) RemoveBuffer(netID, title string) {
 	_ = ui.bs.Remove(netID, title)
 	ui.memberOffset = 0
@@ -399,26 +537,45 @@ func (ui *UI) RemoveNetworkBuffers(netID string) {
 	ui.memberOffset = 0
 }
 
+func (ui *UI) SetLoadingHistory(netID, buffer string, loading bool) {
+	ui.bs.SetLoadingHistory(netID, buffer, loading)
+}
+
+func (ui *UI) NetworkName(netID string) string {
+	return ui.bs.NetworkName(netID)
+}
+
+// HasBuffer reports whether the given buffer is open.
+func (ui *UI) HasBuffer(netID, buffer string) bool {
+	_, b := ui.bs.at(netID, buffer)
+	return b != nil
+}
+
 func (ui *UI) AddLine(netID, buffer string, line Line) {
 	ui.bs.AddLine(netID, buffer, line)
+}
 
+// NotifyHighlight sends a desktop notification for a highlight from head in
+// the given buffer, unless the buffer is currently shown.
+func (ui *UI) NotifyHighlight(netID, buffer, head, body string) {
 	curNetID, curBuffer := ui.bs.Current()
 	_, b := ui.bs.at(netID, buffer)
 	focused := ui.bs.focused && curNetID == netID && curBuffer == buffer
-	if b != nil && line.Notify == NotifyHighlight && !focused {
-		var header string
-		if buffer != line.Head {
-			header = fmt.Sprintf("%s — %s", buffer, line.Head)
-		} else {
-			header = line.Head
-		}
-		id := ui.notify(NotifyEvent{
-			NetID:  netID,
-			Buffer: buffer,
-		}, header, line.Body.String())
-		if id >= 0 {
-			b.notifications = append(b.notifications, id)
-		}
+	if b == nil || focused {
+		return
+	}
+	var header string
+	if buffer != head {
+		header = fmt.Sprintf("%s — %s", buffer, head)
+	} else {
+		header = head
+	}
+	id := ui.notify(NotifyEvent{
+		NetID:  netID,
+		Buffer: buffer,
+	}, header, body)
+	if id >= 0 {
+		b.notifications = append(b.notifications, id)
 	}
 }
 
@@ -426,6 +583,39 @@ func (ui *UI) AddLines(netID, buffer string, before, after []Line) {
 	ui.bs.AddLines(netID, buffer, before, after)
 }
 
+func (ui *UI) ClearBuffer(netID, buffer string) {
+	ui.bs.Clear(netID, buffer)
+}
+
+func (ui *UI) CurrentBufferCleared() bool {
+	return ui.bs.Cleared()
+}
+
+func (ui *UI) LineByID(netID, buffer, id string) (Line, bool) {
+	return ui.bs.LineByID(netID, buffer, id)
+}
+
+func (ui *UI) ReplaceLine(netID, buffer, id string, line Line) bool {
+	return ui.bs.ReplaceLine(netID, buffer, id, line)
+}
+
+// CurrentLines returns the lines of the current buffer.
+// The result must not be modified.
+func (ui *UI) CurrentLines() []Line {
+	return ui.bs.CurrentLines()
+}
+
+// VisibleLines returns the lines shown in the timeline of the current buffer.
+// The result must not be modified.
+func (ui *UI) VisibleLines() []Line {
+	return ui.bs.VisibleLines()
+}
+
+// CopyToClipboard sets the system clipboard to text, through the terminal.
+func (ui *UI) CopyToClipboard(text string) {
+	ui.vx.ClipboardPush(text)
+}
+
 func (ui *UI) JumpBuffer(sub string) bool {
 	subLower := strings.ToLower(sub)
 	for i, b := range ui.bs.list {
@@ -456,6 +646,15 @@ func (ui *UI) JumpBufferIndex(i int) bool {
 	return false
 }
 
+// JumpBufferPosition focuses the buffer at position i (from 0) among the
+// buffers shown in the buffer list, and returns false if there is none.
+func (ui *UI) JumpBufferPosition(i int) bool {
+	if i < 0 {
+		return false
+	}
+	return ui.JumpBufferIndex(ui.bs.position(i))
+}
+
 func (ui *UI) JumpBufferNetwork(netID, buffer string) bool {
 	for i, b := range ui.bs.list {
 		if b.netID == netID && strings.ToLower(b.title) == strings.ToLower(buffer) {
@@ -468,6 +667,16 @@ func (ui *UI) JumpBufferNetwork(netID, buffer string) bool {
 	return false
 }
 
+// JumpToLine switches to a buffer and selects its line with the given message
+// ID, or else its last line at or before the given time. It returns false if
+// the buffer does not exist or does not have lines that old.
+func (ui *UI) JumpToLine(netID, buffer, id string, at time.Time) bool {
+	ok := ui.bs.JumpToLine(netID, buffer, id, at)
+	ui.memberOffset = 0
+	ui.ScrollToBuffer()
+	return ok
+}
+
 func (ui *UI) Focused() bool {
 	return ui.bs.Focused()
 }
@@ -594,22 +803,28 @@ func (ui *UI) Resize() {
 		innerWidth = 1 // will break display somewhat, but this is an edge case
 	}
 	ui.e.Resize(innerWidth)
-	textWidth := innerWidth
-	if ui.config.TextMaxWidth > 0 && ui.config.TextMaxWidth < textWidth {
-		textWidth = ui.config.TextMaxWidth
-	}
-	if ui.channelWidth == 0 {
-		ui.bs.ResizeTimeline(innerWidth, h-3, textWidth)
-	} else {
-		ui.bs.ResizeTimeline(innerWidth, h-2, textWidth)
-	}
+	textWidth := timelineTextWidth(innerWidth, ui.config.TextMaxWidth)
+	height, compose := ui.timelineHeight(h)
+	ui.composeRows = compose
+	ui.bs.ResizeTimeline(innerWidth, height, textWidth)
 	ui.ScrollToBuffer()
 	if ui.image != nil {
 		ui.image.Resize(w, h)
 	}
+	ui.resizePreviews()
 	ui.vx.Refresh()
 }
 
+// timelineTextWidth returns the width at which the text of the timeline is
+// wrapped, given the width of the timeline and the configured maximum text
+// width (0 meaning no maximum).
+func timelineTextWidth(innerWidth, maxWidth int) int {
+	if maxWidth > 0 && maxWidth < innerWidth {
+		return maxWidth
+	}
+	return innerWidth
+}
+
 func (ui *UI) Size() (int, int) {
 	return ui.vx.window.Size()
 }
@@ -626,6 +841,10 @@ func (ui *UI) Highlights() int {
 	return ui.bs.Highlights()
 }
 
+func (ui *UI) Activity() []BufferActivity {
+	return ui.bs.Activity()
+}
+
 func (ui *UI) ImageReady() bool {
 	if ui.image == nil {
 		return false
@@ -659,10 +878,52 @@ func (ui *UI) AsyncCompletions(id int, cs []Completion) {
 	ui.e.AsyncCompletions(id, cs)
 }
 
+// Below this size of the timeline, the layout cannot be drawn.
+const (
+	minTimelineWidth  = 10
+	minTimelineHeight = 1
+)
+
+// tooSmall reports whether the terminal, of size w×h, is too small to draw the
+// layout.
+func (ui *UI) tooSmall(w, h int) bool {
+	height := h - 2 // status bar and editor
+	if ui.channelWidth == 0 {
+		height-- // horizontal buffer list
+	}
+	return w-9-ui.channelWidth-ui.memberWidth < minTimelineWidth || height < minTimelineHeight
+}
+
+// drawTooSmall replaces the layout by a message, until the terminal is
+// resized.
+func (ui *UI) drawTooSmall(w, h int) {
+	clearArea(ui.vx, 0, 0, w, h)
+	ui.vx.HideCursor()
+	text := "terminal too small"
+	if ui.channelWidth != 0 || ui.memberWidth != 0 {
+		text += " (F7/F8 hide the lists)"
+	}
+	text = truncate(ui.vx, text, w, "\u2026")
+	x := (w - stringWidth(ui.vx, text)) / 2
+	printString(ui.vx, &x, h/2, Styled(text, vaxis.Style{
+		Foreground: ColorGray,
+	}))
+	ui.vx.Render()
+}
+
 func (ui *UI) Draw(members []irc.Member) {
 	ui.clickEvents = ui.clickEvents[:0]
 
 	w, h := ui.vx.window.Size()
+	if ui.tooSmall(w, h) {
+		ui.drawTooSmall(w, h)
+		return
+	}
+	if _, compose := ui.timelineHeight(h); compose != ui.composeRows {
+		// The compose area grew or shrank: give its rows to or take them
+		// from the timeline.
+		ui.Resize()
+	}
 
 	ui.bs.DrawTimeline(ui, ui.channelWidth, 0)
 	if ui.channelWidth == 0 {
@@ -688,7 +949,11 @@ func (ui *UI) Draw(members []irc.Member) {
 		editorY -= 1
 		statusBarY -= 1
 	}
-	printString(ui.vx, &promptX, editorY, Styled("       > ", vaxis.Style{Foreground: vaxis.IndexColor(9)}))
+	if ui.composeRows > 0 {
+		ui.drawCompose(promptX, statusBarY-ui.composeRows, w-ui.channelWidth-ui.memberWidth, ui.composeRows)
+	}
+	clearArea(ui.vx, promptX, editorY, 9, 1)
+	printIdent(ui.vx, promptX+1, editorY, 7, ui.prompt)
 	var hint string
 	if ui.bs.HasOverlay() {
 		hint = ui.overlayHint
@@ -712,7 +977,7 @@ func (ui *UI) ScrollToBuffer() {
 	w, h := ui.vx.window.Size()
 	var first int
 	if ui.channelWidth > 0 {
-		first = ui.bs.current - h + 1
+		first = ui.bs.GetTopMost(h)
 	} else {
 		first = ui.bs.GetLeftMost(w - ui.memberWidth)
 	}
@@ -742,7 +1007,8 @@ func (ui *UI) drawStatusBar(x0, y, width int) {
 	s.SetStyle(vaxis.Style{
 		Foreground: ColorGray,
 	})
-	s.WriteString(ui.status)
+	// Stop at the edge of the timeline, before the member list.
+	s.WriteString(truncate(ui.vx, ui.status, x0+width-x, "…"))
 
 	printString(ui.vx, &x, y, s.StyledString())
 }
@@ -850,7 +1116,7 @@ func (ui *UI) drawVerticalMemberList(vx *Vaxis, x0, y0, width, height int, membe
 				Attribute:  attr,
 			})
 		} else {
-			color := IdentColor(ui.config.Colors.Nicks, m.Name.Name, m.Self)
+			color := NickColor(ui.config.Colors.Nicks, m.Name.Name, m.Account, m.Self)
 			name = Styled(nameText, vaxis.Style{
 				Foreground: color,
 				Attribute:  attr,
@@ -0,0 +1,33 @@
+package ui
+
+import (
+	"fmt"
+	"testing"
+
+	"git.sr.ht/~rockorager/vaxis"
+)
+
+func TestGoToBufferScrolls(t *testing.T) {
+	ui := &UI{
+		vx:           &Vaxis{window: vaxis.Window{Width: 80, Height: 5}},
+		channelWidth: 16,
+	}
+	ui.bs = NewBufferList(ui)
+	ui.bs.Add("", "(home)", "")
+	for i := 0; i < 9; i++ {
+		ui.bs.Add("", "", fmt.Sprintf("#chan%d", i))
+	}
+
+	ui.GoToBufferNo(7)
+	if ui.channelOffset != 3 {
+		t.Errorf("expected the list to scroll down to the buffer, got offset %d", ui.channelOffset)
+	}
+	ui.GoToBufferPosition(1)
+	if ui.channelOffset != 1 {
+		t.Errorf("expected the list to scroll up to the buffer, got offset %d", ui.channelOffset)
+	}
+	ui.GoToBufferPosition(100)
+	if ui.channelOffset != 5 {
+		t.Errorf("expected the list to scroll down to the last buffer, got offset %d", ui.channelOffset)
+	}
+}
@@ -2,17 +2,27 @@ package senpai
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"git.sr.ht/~delthas/senpai/irc"
 	"git.sr.ht/~delthas/senpai/ui"
 )
 
 const welcomeMessage = "Welcome to senpai! To get started, use the Help buttons, or enter /help for a list of commands."
 
+// defaultHomeName is the name of the home buffer when it is not configured
+// and the server did not advertise a network name.
+const defaultHomeName = "(home)"
+
 func (app *App) initWindow() {
-	app.win.AddBuffer("", "(home)", "")
+	homeName := app.cfg.HomeName
+	if homeName == "" {
+		homeName = defaultHomeName
+	}
+	app.win.AddBuffer("", homeName, "")
 	app.win.AddLine("", "", ui.Line{
 		Head: "--",
 		Body: ui.PlainString(welcomeMessage),
@@ -38,6 +48,21 @@ func (app *App) queueStatusLine(netID string, line ui.Line) {
 	}
 }
 
+// queueNetworkStatusLine is like queueStatusLine, but keeps the line in
+// order with the events of the network.
+func (app *App) queueNetworkStatusLine(netID string, line ui.Line) {
+	if line.At.IsZero() {
+		line.At = time.Now()
+	}
+	app.netEvents.push(netID, event{
+		src: "*",
+		content: statusLine{
+			netID: netID,
+			line:  line,
+		},
+	})
+}
+
 func (app *App) addStatusLine(netID string, line ui.Line) {
 	currentNetID, buffer := app.win.CurrentBuffer()
 	if currentNetID == netID && buffer != "" {
@@ -61,11 +86,31 @@ func (app *App) setStatus() {
 	}
 
 	netID, buffer := app.win.CurrentBuffer()
-	s := app.sessions[netID]
-	if s == nil {
-		return
+	app.win.SetStatus(statusText(app.sessions[netID], buffer, app.offlineNetworks(netID)))
+}
+
+// statusText returns the status of a buffer of the session s, which is nil
+// when disconnected, given the names of the other networks which are offline.
+func statusText(s *irc.Session, buffer string, offline []string) string {
+	var parts []string
+	if s != nil {
+		if typing := typingStatus(s.Typings(buffer)); typing != "" {
+			parts = append(parts, typing)
+		}
+	}
+	parts = append(parts, connectionStatus(s))
+	if len(offline) > 0 {
+		parts = append(parts, "offline: "+strings.Join(offline, ", "))
 	}
-	ts := s.Typings(buffer)
+	if s != nil && buffer != "" && s.IsChannel(buffer) {
+		if summary := channelSummary(s, buffer); summary != "" {
+			parts = append(parts, summary)
+		}
+	}
+	return strings.Join(parts, " | ")
+}
+
+func typingStatus(ts []string) string {
 	status := ""
 	if 3 < len(ts) {
 		status = "several people are typing..."
@@ -79,7 +124,56 @@ func (app *App) setStatus() {
 			status += ts[len(ts)-1] + verb
 		}
 	}
-	app.win.SetStatus(status)
+	return status
+}
+
+// connectionStatus describes the state of the connection of a session, with
+// its lag if known.
+func connectionStatus(s *irc.Session) string {
+	if s == nil {
+		return "offline"
+	}
+	if !s.Registered() {
+		return "connecting"
+	}
+	if lag := s.Lag(); lag > 0 {
+		return fmt.Sprintf("connected, lag %dms", lag.Milliseconds())
+	}
+	return "connected"
+}
+
+// offlineNetworks returns the names of the networks, other than the current
+// one, that are not connected.
+func (app *App) offlineNetworks(current string) []string {
+	app.networkLock.RLock()
+	defer app.networkLock.RUnlock()
+	var offline []string
+	for netID := range app.networks {
+		if netID == current {
+			continue
+		}
+		if s := app.sessions[netID]; s != nil && s.Registered() {
+			continue
+		}
+		name := app.win.NetworkName(netID)
+		if name == "" {
+			continue
+		}
+		offline = append(offline, name)
+	}
+	sort.Strings(offline)
+	return offline
+}
+
+// channelSummary returns the modes of a channel and the start of its topic.
+func channelSummary(s *irc.Session, channel string) string {
+	const maxTopic = 40
+	topic, _, _ := s.Topic(channel)
+	t := []rune(ui.IRCString(topic).String())
+	if len(t) > maxTopic {
+		t = append(t[:maxTopic-1], '…')
+	}
+	return strings.TrimSpace(s.ChannelModes(channel) + " " + string(t))
 }
 
 func (app *App) setBufferNumbers() {